@@ -0,0 +1,107 @@
+package main
+
+import (
+	"log"
+	"path"
+	"strings"
+
+	corev2 "github.com/sensu/core/v2"
+	"github.com/sensu/sensu-plugin-sdk/sensu"
+)
+
+// protectedOptions can never be overridden through annotations, since they
+// control which options can be
+var protectedOptions = []string{"annotation-allow", "annotation-deny"}
+
+// defaultAnnotationDeny lists the security sensitive options that a
+// compromised agent could use to redirect the handler or leak its credentials
+var defaultAnnotationDeny = []string{
+	"endpoint", "cert", "key", "ca-cert", "puppet-ca-url", "puppet-ca-fingerprint",
+	"insecure-skip-tls-verify", "strict-tls", "tls-renegotiation",
+	"sensu-api-url", "sensu-api-key", "sensu-ca-cert", "sensu-use-puppet-cert",
+	"sensu-namespace-api-keys", "sensu-namespace-api-keys-file", "sensu-namespace-api-urls",
+	"sensu-access-token", "sensu-refresh-token", "sensu-token-file",
+	"puppet-oauth-token-url", "puppet-oauth-client-id", "puppet-oauth-client-secret",
+	"puppet-spnego", "sensu-spnego", "krb5-config", "krb5-keytab", "krb5-principal",
+	"puppet-proxy-url", "sensu-proxy-url", "consul-addr", "consul-token",
+	"state-dir", "config-dir", "env-prefix", "protected-nodes-file",
+	"redirect-forward-auth", "opa-url", "opa-token",
+	"nats-url", "kafka-brokers", "pagerduty-routing-key", "agent-events-url",
+	"servicenow-url", "servicenow-username", "servicenow-password",
+	"rest-url", "rest-username", "rest-password", "rest-token",
+	"exec-command", "exec-args", "pre-delete-hook", "post-delete-hook",
+	"decision-hook", "approval-queue", "entity-name", "entity-namespace",
+	"dns-servers", "har-file",
+}
+
+// annotationGuard wraps a configuration option to ignore annotation
+// overrides when they are not allowed for the option
+type annotationGuard struct {
+	sensu.ConfigOption
+	path string
+}
+
+// SetAnnotationValue sets the option value from the event annotations if the
+// option can be overridden through annotations
+func (g *annotationGuard) SetAnnotationValue(keySpace string, event *corev2.Event) (sensu.SetAnnotationResult, error) {
+	if !annotationAllowed(g.path) {
+		key := path.Join(keySpace, g.path)
+		if hasAnnotation(event, key) {
+			log.Printf("ignoring annotation %q, the %s option cannot be overridden through annotations", key, g.path)
+		}
+		return sensu.SetAnnotationResult{}, nil
+	}
+	return g.ConfigOption.SetAnnotationValue(keySpace, event)
+}
+
+// guardAnnotations wraps every option whose value can be set through
+// annotations with an annotation guard
+func guardAnnotations(opts []sensu.ConfigOption) []sensu.ConfigOption {
+	guarded := make([]sensu.ConfigOption, 0, len(opts))
+	for _, opt := range opts {
+		if info, ok := describeOption(opt); ok && info.path != "" {
+			opt = &annotationGuard{ConfigOption: opt, path: info.path}
+		}
+		guarded = append(guarded, opt)
+	}
+	return guarded
+}
+
+// annotationAllowed returns whether the option can be overridden through
+// annotations. When an allow list is configured, only the options it lists
+// can be, otherwise any option not in the deny list can be.
+func annotationAllowed(name string) bool {
+	for _, protected := range protectedOptions {
+		if name == protected {
+			return false
+		}
+	}
+	if len(handler.annotationAllow) > 0 {
+		for _, allowed := range handler.annotationAllow {
+			if name == allowed {
+				return true
+			}
+		}
+		return false
+	}
+	for _, denied := range handler.annotationDeny {
+		if name == denied {
+			return false
+		}
+	}
+	return true
+}
+
+// hasAnnotation returns whether the check or entity of the event carries the
+// annotation, looked up the same way the SDK does
+func hasAnnotation(event *corev2.Event, key string) bool {
+	for _, k := range []string{strings.ToLower(key), key} {
+		if event.Check != nil && event.Check.Annotations[k] != "" {
+			return true
+		}
+		if event.Entity != nil && event.Entity.Annotations[k] != "" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"testing"
+
+	corev2 "github.com/sensu/core/v2"
+	"github.com/sensu/sensu-plugin-sdk/sensu"
+)
+
+func Test_annotationGuard(t *testing.T) {
+	saveHandler(t)
+	tests := []struct {
+		name   string
+		allow  []string
+		deny   []string
+		option string
+		want   string
+	}{
+		{
+			name:   "allowed by default",
+			option: "action",
+			want:   "annotation",
+		},
+		{
+			name:   "denied",
+			deny:   []string{"endpoint"},
+			option: "endpoint",
+			want:   "flag",
+		},
+		{
+			name:   "not denied",
+			deny:   []string{"endpoint"},
+			option: "action",
+			want:   "annotation",
+		},
+		{
+			name:   "allow list takes precedence over the deny list",
+			allow:  []string{"endpoint"},
+			deny:   []string{"endpoint"},
+			option: "endpoint",
+			want:   "annotation",
+		},
+		{
+			name:   "not in the allow list",
+			allow:  []string{"node-name"},
+			option: "action",
+			want:   "flag",
+		},
+		{
+			name:   "protected option",
+			allow:  []string{"annotation-deny"},
+			option: "annotation-deny",
+			want:   "flag",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler.annotationAllow = tt.allow
+			handler.annotationDeny = tt.deny
+			value := "flag"
+			opts := guardAnnotations([]sensu.ConfigOption{
+				&sensu.PluginConfigOption[string]{Path: tt.option, Argument: tt.option, Value: &value},
+			})
+
+			event := corev2.FixtureEvent("foo", "keepalive")
+			event.Entity.Annotations = map[string]string{
+				"sensu.io/plugins/sensu-puppet-handler/config/" + tt.option: "annotation",
+			}
+			if _, err := opts[0].SetAnnotationValue("sensu.io/plugins/sensu-puppet-handler/config", event); err != nil {
+				t.Fatal(err)
+			}
+			if value != tt.want {
+				t.Errorf("SetAnnotationValue() value = %q, want %q", value, tt.want)
+			}
+		})
+	}
+}
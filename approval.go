@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	corev2 "github.com/sensu/core/v2"
+	"github.com/sensu/sensu-plugin-sdk/sensu"
+)
+
+// pendingDeregistration is an entry of the approval queue, one JSON object per
+// line. Entries are approved by setting their approved field to true.
+type pendingDeregistration struct {
+	deregistrationRecord
+	Approved bool `json:"approved"`
+}
+
+// queueEntry is a line of the approval queue file and its decoded entry
+type queueEntry struct {
+	line    []byte
+	pending pendingDeregistration
+}
+
+// readApprovalQueue reads the entries of the approval queue file. A missing
+// queue file is an empty queue.
+func readApprovalQueue(file string) ([]queueEntry, error) {
+	b, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []queueEntry
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for line := 1; scanner.Scan(); line++ {
+		text := bytes.TrimSpace(scanner.Bytes())
+		if len(text) == 0 {
+			continue
+		}
+		entry := queueEntry{line: append([]byte(nil), text...)}
+		if err := json.Unmarshal(text, &entry.pending); err != nil {
+			return nil, fmt.Errorf("invalid entry on line %d: %s", line, err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
+
+// queueDeregistration appends the deregistration of the event's entity to the
+// approval queue instead of taking it, unless the entity is already pending
+// approval, so that the deregistrations are only taken once approved in
+// change-controlled environments
+func queueDeregistration(event *corev2.Event, lookup nodeLookup, action string) error {
+	entries, err := readApprovalQueue(handler.approvalQueue)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.pending.Entity == event.Entity.Name && entry.pending.Namespace == event.Entity.Namespace {
+			log.Printf("entity (%s/%s) is already pending approval", event.Entity.Namespace, event.Entity.Name)
+			return nil
+		}
+	}
+
+	b, err := json.Marshal(pendingDeregistration{deregistrationRecord: newDeregistrationRecord(event, lookup, action)})
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(handler.approvalQueue, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		_ = f.Close()
+		return err
+	}
+	log.Printf("queued the deregistration of entity (%s/%s) for approval", event.Entity.Namespace, event.Entity.Name)
+	return f.Close()
+}
+
+// applyApproved takes the approved deregistrations of the approval queue and
+// removes them from the queue, leaving the entries pending approval and the
+// deregistrations which failed for a later run. Every entry is verified again
+// first, since the node may have come back while it waited for approval, and
+// the stale entries are dropped from the queue.
+func applyApproved(_ *corev2.Event) (int, error) {
+	setupRequestID()
+	entries, err := readApprovalQueue(handler.approvalQueue)
+	if err != nil {
+		return sensu.CheckStateUnknown, fmt.Errorf("could not read the approval queue: %s", err)
+	}
+	puppetClient, err := puppetHTTPClient()
+	if err != nil {
+		return sensu.CheckStateUnknown, err
+	}
+
+	done := make(map[string]bool)
+	var applied, dropped, failed, pending int
+	for _, entry := range entries {
+		queued := entry.pending
+		event, lookup, reason, err := recheckQueued(puppetClient, queued)
+		if err != nil {
+			log.Printf("could not verify the deregistration of entity (%s/%s) again: %s", queued.Namespace, queued.Entity, err)
+			if queued.Approved {
+				failed++
+			} else {
+				pending++
+			}
+			continue
+		}
+		if reason != "" {
+			log.Printf("dropping the deregistration of entity (%s/%s) from the approval queue, %s", queued.Namespace, queued.Entity, reason)
+			done[string(entry.line)] = true
+			dropped++
+			continue
+		}
+		if !queued.Approved {
+			pending++
+			continue
+		}
+
+		if queued.Action == actionTombstone {
+			err = tombstoneEntity(event, lookup)
+		} else {
+			err = deregisterEntity(event)
+		}
+		if err != nil {
+			log.Printf("could not deregister entity (%s/%s): %s", queued.Namespace, queued.Entity, err)
+			failed++
+			continue
+		}
+		summary.recordDeregistration(queued.Action)
+		done[string(entry.line)] = true
+		applied++
+		if err := publishRecord(event, lookup, queued.Action); err != nil {
+			log.Printf("could not publish the deregistration of entity (%s/%s): %s", queued.Namespace, queued.Entity, err)
+		}
+	}
+
+	if len(done) > 0 {
+		if err := removeFromQueue(done); err != nil {
+			return sensu.CheckStateUnknown, fmt.Errorf("could not update the approval queue: %s", err)
+		}
+	}
+	fmt.Printf("%d approved deregistrations applied, %d failed, %d dropped, %d pending approval\n", applied, failed, dropped, pending)
+	if failed > 0 {
+		return sensu.CheckStateCritical, nil
+	}
+	return sensu.CheckStateOK, nil
+}
+
+// recheckQueued looks up the entity of a queue entry again, and returns the
+// event to deregister it with, or why the entry is stale: the entity no longer
+// exists, its agent came back since the entry was queued, or its node is found
+// again.
+func recheckQueued(puppetClient *http.Client, queued pendingDeregistration) (*corev2.Event, nodeLookup, string, error) {
+	check := corev2.NewCheck(&corev2.CheckConfig{ObjectMeta: corev2.ObjectMeta{Name: corev2.KeepaliveCheckName, Namespace: queued.Namespace}})
+	event := &corev2.Event{
+		ObjectMeta: corev2.ObjectMeta{Namespace: queued.Namespace},
+		Entity:     corev2.NewEntity(corev2.NewObjectMeta(queued.Entity, queued.Namespace)),
+		Check:      check,
+		Timestamp:  queued.Timestamp,
+	}
+	// The agent is compared to its state when the entry was queued
+	event.Entity.LastSeen = queued.Timestamp
+	reason, err := entityRecovered(event)
+	if err != nil || reason != "" {
+		return nil, nodeLookup{}, reason, err
+	}
+
+	entity, err := fetchEntity(queued.Namespace, queued.Entity)
+	if err != nil {
+		return nil, nodeLookup{}, "", err
+	}
+	if entity == nil {
+		return nil, nodeLookup{}, "the entity no longer exists", nil
+	}
+	event.Entity = entity
+	lookup, deregister, err := shouldDeregister(puppetClient, event)
+	if err != nil {
+		return nil, nodeLookup{}, "", err
+	}
+	if !deregister {
+		return nil, nodeLookup{}, fmt.Sprintf("puppet node %q is %s", lookup.name, lookup.status), nil
+	}
+	return event, lookup, "", nil
+}
+
+// removeFromQueue rewrites the approval queue without the applied lines. The
+// queue is read again first to keep the entries queued meanwhile, and replaced
+// atomically.
+func removeFromQueue(applied map[string]bool) error {
+	entries, err := readApprovalQueue(handler.approvalQueue)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	for _, entry := range entries {
+		if applied[string(entry.line)] {
+			continue
+		}
+		buf.Write(entry.line)
+		buf.WriteByte('\n')
+	}
+
+	dir, name := filepath.Split(handler.approvalQueue)
+	if dir == "" {
+		dir = "."
+	}
+	tmp, err := os.CreateTemp(dir, name+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(buf.Bytes()); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), handler.approvalQueue)
+}
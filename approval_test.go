@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	corev2 "github.com/sensu/core/v2"
+	"github.com/sensu/sensu-plugin-sdk/sensu"
+	"github.com/sensu/sensu-puppet-handler/puppet"
+)
+
+func Test_queueDeregistration(t *testing.T) {
+	setHandler(t, Handler{approvalQueue: filepath.Join(t.TempDir(), "queue.jsonl")})
+
+	lookup := nodeLookup{name: "foo", status: nodeNotFound}
+	for _, name := range []string{"foo", "bar", "foo"} {
+		if err := queueDeregistration(corev2.FixtureEvent(name, "keepalive"), lookup, actionDelete); err != nil {
+			t.Fatalf("queueDeregistration() error = %v", err)
+		}
+	}
+
+	entries, err := readApprovalQueue(handler.approvalQueue)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("queue entries = %d, want 2", len(entries))
+	}
+	pending := entries[0].pending
+	if pending.Entity != "foo" || pending.Namespace != "default" || pending.Action != actionDelete || pending.Approved {
+		t.Errorf("queue entry = %+v", pending)
+	}
+}
+
+func Test_applyApproved(t *testing.T) {
+	savedSummary := summary
+	defer func() { summary = savedSummary }()
+
+	// Only the node of entity back exists in PuppetDB again
+	puppetdb := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case puppet.VersionPath:
+			_, _ = w.Write([]byte(`{"version":"7.0.0"}`))
+		case "/pdb/query/v4/nodes":
+			var query []string
+			_ = json.Unmarshal([]byte(r.URL.Query().Get("query")), &query)
+			nodes := []map[string]interface{}{}
+			if len(query) == 3 && query[2] == "back" {
+				nodes = append(nodes, map[string]interface{}{"certname": "back"})
+			}
+			_ = json.NewEncoder(w).Encode(nodes)
+		default:
+			t.Errorf("applyApproved() unexpected PuppetDB request %s", r.URL.Path)
+			http.NotFound(w, r)
+		}
+	}))
+	defer puppetdb.Close()
+
+	// Entity gone was deleted meanwhile and the agent of entity seen came back
+	var deleted []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := path.Base(r.URL.Path)
+		switch {
+		case r.Method == http.MethodDelete:
+			deleted = append(deleted, name)
+			if name == "broken" {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		case strings.HasPrefix(r.URL.Path, "/api/core/v2/namespaces/default/entities/") && name != "gone":
+			entity := corev2.FixtureEntity(name)
+			entity.LastSeen = 500
+			if name == "seen" {
+				entity.LastSeen = 2000
+			}
+			_ = json.NewEncoder(w).Encode(entity)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+
+	queue := filepath.Join(t.TempDir(), "queue.jsonl")
+	var lines []byte
+	for _, pending := range []pendingDeregistration{
+		{deregistrationRecord: deregistrationRecord{Entity: "foo", Namespace: "default", Action: actionDelete, Timestamp: 1000}, Approved: true},
+		{deregistrationRecord: deregistrationRecord{Entity: "bar", Namespace: "default", Action: actionDelete, Timestamp: 1000}},
+		{deregistrationRecord: deregistrationRecord{Entity: "broken", Namespace: "default", Action: actionDelete, Timestamp: 1000}, Approved: true},
+		{deregistrationRecord: deregistrationRecord{Entity: "back", Namespace: "default", Action: actionDelete, Timestamp: 1000}, Approved: true},
+		{deregistrationRecord: deregistrationRecord{Entity: "gone", Namespace: "default", Action: actionDelete, Timestamp: 1000}, Approved: true},
+		{deregistrationRecord: deregistrationRecord{Entity: "seen", Namespace: "default", Action: actionDelete, Timestamp: 1000}},
+	} {
+		b, err := json.Marshal(pending)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines = append(append(lines, b...), '\n')
+	}
+	if err := os.WriteFile(queue, lines, 0600); err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile := writeKeyPair(t)
+	setHandler(t, Handler{
+		endpoint:                 puppetdb.URL + "/pdb/query/v4/nodes",
+		puppetCert:               certFile,
+		puppetKey:                keyFile,
+		puppetCACert:             certFile,
+		puppetInsecureSkipVerify: true,
+		sensuAPIURL:              ts.URL,
+		approvalQueue:            queue,
+	})
+	summary = runSummary{}
+
+	state, err := applyApproved(nil)
+	if err != nil {
+		t.Fatalf("applyApproved() error = %v", err)
+	}
+	if state != sensu.CheckStateCritical {
+		t.Errorf("applyApproved() state = %d, want %d", state, sensu.CheckStateCritical)
+	}
+	if len(deleted) != 2 || deleted[0] != "foo" || deleted[1] != "broken" {
+		t.Errorf("applyApproved() deleted = %v, want [foo broken]", deleted)
+	}
+	if summary.deleted != 1 {
+		t.Errorf("applyApproved() summary deleted = %d, want 1", summary.deleted)
+	}
+
+	// The stale entries are dropped along with the applied one
+	entries, err := readApprovalQueue(queue)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var left []string
+	for _, entry := range entries {
+		left = append(left, entry.pending.Entity)
+	}
+	if len(left) != 2 || left[0] != "bar" || left[1] != "broken" {
+		t.Errorf("queue entries left = %v, want [bar broken]", left)
+	}
+}
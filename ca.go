@@ -0,0 +1,169 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// caStateFile caches the CA certificate fetched from the Puppet CA API
+	caStateFile = "puppet-ca.pem"
+
+	defaultCAAPIPath = "puppet-ca/v1/certificate/ca"
+)
+
+// puppetCACertificate returns the PEM encoded Puppet CA certificate, read from
+// the configured file or, without one, fetched from the Puppet CA API on first
+// use and cached in the state directory
+func puppetCACertificate() ([]byte, error) {
+	if handler.puppetCACert != "" || handler.puppetCAURL == "" {
+		caCert, err := ioutil.ReadFile(handler.puppetCACert)
+		if err != nil {
+			return nil, fmt.Errorf("could not read the CA certificate: %s", err)
+		}
+		return caCert, nil
+	}
+
+	cached := filepath.Join(handler.stateDir, caStateFile)
+	caCert, err := os.ReadFile(cached)
+	if err == nil {
+		if caCert, err = verifyCAFingerprint(caCert); err != nil {
+			return nil, fmt.Errorf("invalid cached CA certificate %s: %s", cached, err)
+		}
+		return caCert, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("could not read the cached CA certificate: %s", err)
+	}
+
+	if caCert, err = fetchPuppetCA(); err != nil {
+		return nil, fmt.Errorf("could not fetch the CA certificate: %s", err)
+	}
+	if caCert, err = verifyCAFingerprint(caCert); err != nil {
+		return nil, fmt.Errorf("invalid CA certificate fetched from %s: %s", handler.puppetCAURL, err)
+	}
+	if err := writeStateFile(caStateFile, caCert); err != nil {
+		log.Printf("could not cache the CA certificate: %s", err)
+	}
+	return caCert, nil
+}
+
+// caURL returns the URL of the CA certificate, defaulting to the path of the
+// Puppet CA API when the URL has none
+func caURL(rawURL string) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return "", errors.New("the scheme must be http or https")
+	}
+	if u.Host == "" {
+		return "", errors.New("missing host")
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = path.Join("/", defaultCAAPIPath)
+	}
+	return u.String(), nil
+}
+
+// fetchPuppetCA downloads the CA certificate from the Puppet CA API. The CA
+// server certificate cannot be verified before the CA is known, so the
+// download is only authenticated when the CA fingerprint is pinned.
+func fetchPuppetCA() ([]byte, error) {
+	endpoint, err := caURL(handler.puppetCAURL)
+	if err != nil {
+		return nil, err
+	}
+	if handler.puppetCAFingerprint == "" {
+		log.Printf("trusting the CA certificate fetched from %s on first use, set --puppet-ca-fingerprint to pin it", endpoint)
+	}
+
+	transport := &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	if err := setProxy(transport, handler.puppetProxyURL); err != nil {
+		return nil, err
+	}
+	client := &http.Client{Transport: limitedTransport(withRequestID(withConnectionTrace(transport))), Timeout: requestTimeout()}
+	req, err := http.NewRequestWithContext(executionCtx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected HTTP status %s", http.StatusText(resp.StatusCode))
+	}
+	caCert, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("fetched the CA certificate from %s", endpoint)
+	return caCert, nil
+}
+
+// verifyCAFingerprint makes sure the PEM bundle holds certificates and
+// returns the certificates to trust: the whole bundle when the CA fingerprint
+// is not pinned, and only the certificate matching it when it is, so that a
+// CA appended next to the pinned one is not trusted along with it
+func verifyCAFingerprint(bundle []byte) ([]byte, error) {
+	var (
+		found  bool
+		pinned []byte
+	)
+	fingerprint := normalizeFingerprint(handler.puppetCAFingerprint)
+	for block, rest := pem.Decode(bundle); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		found = true
+		sum := sha256.Sum256(cert.Raw)
+		if hex.EncodeToString(sum[:]) == fingerprint {
+			pinned = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+		}
+	}
+	if !found {
+		return nil, errors.New("no PEM encoded certificate found")
+	}
+	if handler.puppetCAFingerprint == "" {
+		return bundle, nil
+	}
+	if pinned == nil {
+		return nil, errors.New("the certificate does not match the pinned fingerprint")
+	}
+	return pinned, nil
+}
+
+// normalizeFingerprint lowercases a hex encoded fingerprint and strips the
+// colons separating its bytes
+func normalizeFingerprint(fingerprint string) string {
+	return strings.ToLower(strings.ReplaceAll(fingerprint, ":", ""))
+}
+
+// validFingerprint returns whether the fingerprint is a hex encoded SHA-256
+// hash
+func validFingerprint(fingerprint string) bool {
+	b, err := hex.DecodeString(normalizeFingerprint(fingerprint))
+	return err == nil && len(b) == sha256.Size
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func Test_puppetCACertificate(t *testing.T) {
+	var caCert, served []byte
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/"+defaultCAAPIPath {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_, _ = w.Write(served)
+	}))
+	defer ts.Close()
+	caCert = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw})
+	sum := sha256.Sum256(ts.Certificate().Raw)
+
+	certFile, _ := writeKeyPair(t)
+	other, err := os.ReadFile(certFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		bundle      []byte
+		fingerprint string
+		wantErr     bool
+	}{
+		{
+			name: "trusted on first use",
+		},
+		{
+			name:        "pinned fingerprint",
+			fingerprint: hex.EncodeToString(sum[:]),
+		},
+		{
+			name:        "only the pinned certificate of the bundle is trusted",
+			bundle:      append(append([]byte{}, other...), caCert...),
+			fingerprint: hex.EncodeToString(sum[:]),
+		},
+		{
+			name:        "fingerprint mismatch",
+			fingerprint: hex.EncodeToString(make([]byte, sha256.Size)),
+			wantErr:     true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			saveHandler(t)
+			served = caCert
+			if tt.bundle != nil {
+				served = tt.bundle
+			}
+			handler.puppetCAURL = ts.URL
+			handler.puppetCAFingerprint = tt.fingerprint
+			handler.stateDir = t.TempDir()
+
+			got, err := puppetCACertificate()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("puppetCACertificate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			cached, cacheErr := os.ReadFile(filepath.Join(handler.stateDir, caStateFile))
+			if tt.wantErr {
+				if cacheErr == nil {
+					t.Error("puppetCACertificate() cached a mismatching certificate")
+				}
+				return
+			}
+			if !bytes.Equal(got, caCert) || !bytes.Equal(cached, caCert) {
+				t.Errorf("puppetCACertificate() did not return and cache the CA certificate")
+			}
+
+			// The cached certificate is used from then on
+			handler.puppetCAURL = "https://127.0.0.1:0"
+			if _, err := puppetCACertificate(); err != nil {
+				t.Errorf("puppetCACertificate() did not use the cache: %v", err)
+			}
+		})
+	}
+}
+
+func Test_validFingerprint(t *testing.T) {
+	sum := sha256.Sum256([]byte("ca"))
+	colons := ""
+	for i, b := range sum {
+		if i > 0 {
+			colons += ":"
+		}
+		colons += hex.EncodeToString([]byte{b})
+	}
+	for fingerprint, want := range map[string]bool{
+		hex.EncodeToString(sum[:]): true,
+		colons:                     true,
+		"abcd":                     false,
+		"not a fingerprint":        false,
+	} {
+		if got := validFingerprint(fingerprint); got != want {
+			t.Errorf("validFingerprint(%q) = %v, want %v", fingerprint, got, want)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	corev2 "github.com/sensu/core/v2"
+)
+
+const deregisteredStateFile = "deregistered.json"
+
+// deregisteredCache maps the namespaced names of recently deregistered
+// entities to the Unix time their cache entry expires
+type deregisteredCache map[string]int64
+
+func cacheKey(event *corev2.Event) string {
+	return fmt.Sprintf("%s/%s", event.Entity.Namespace, event.Entity.Name)
+}
+
+// recentlyDeregistered returns whether the event's entity was deregistered
+// less than the negative cache TTL ago, in which case repeated events can be
+// ignored without querying PuppetDB or the Sensu API again
+func recentlyDeregistered(event *corev2.Event) bool {
+	if handler.negativeCacheTTL <= 0 {
+		return false
+	}
+	cache := make(deregisteredCache)
+	if err := readState(deregisteredStateFile, &cache); err != nil {
+		log.Printf("could not read the deregistered entities cache: %s", err)
+		return false
+	}
+	return cache[cacheKey(event)] > time.Now().Unix()
+}
+
+// cacheDeregistered records the deregistration of the event's entity, pruning
+// the expired entries
+func cacheDeregistered(event *corev2.Event) {
+	if handler.negativeCacheTTL <= 0 {
+		return
+	}
+	cache := make(deregisteredCache)
+	if err := readState(deregisteredStateFile, &cache); err != nil {
+		log.Printf("could not read the deregistered entities cache: %s", err)
+	}
+	now := time.Now().Unix()
+	for key, expires := range cache {
+		if expires <= now {
+			delete(cache, key)
+		}
+	}
+	cache[cacheKey(event)] = now + int64(handler.negativeCacheTTL)
+	if err := writeState(deregisteredStateFile, cache); err != nil {
+		log.Printf("could not write the deregistered entities cache: %s", err)
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	corev2 "github.com/sensu/core/v2"
+)
+
+func Test_recentlyDeregistered(t *testing.T) {
+	saveHandler(t)
+	handler.stateDir = t.TempDir()
+	handler.negativeCacheTTL = 60
+	defer func() { handler.negativeCacheTTL = 0 }()
+
+	event := corev2.FixtureEvent("foo", "keepalive")
+	other := corev2.FixtureEvent("bar", "keepalive")
+	if recentlyDeregistered(event) {
+		t.Fatal("recentlyDeregistered() = true before any deregistration")
+	}
+
+	cacheDeregistered(event)
+	if !recentlyDeregistered(event) {
+		t.Error("recentlyDeregistered() = false after deregistration")
+	}
+	if recentlyDeregistered(other) {
+		t.Error("recentlyDeregistered() = true for another entity")
+	}
+
+	// Expired entries are ignored and pruned
+	if err := writeState(deregisteredStateFile, deregisteredCache{cacheKey(event): time.Now().Unix() - 1}); err != nil {
+		t.Fatal(err)
+	}
+	if recentlyDeregistered(event) {
+		t.Error("recentlyDeregistered() = true after expiry")
+	}
+	cacheDeregistered(other)
+	cache := make(deregisteredCache)
+	if err := readState(deregisteredStateFile, &cache); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := cache[cacheKey(event)]; ok {
+		t.Error("cacheDeregistered() did not prune the expired entry")
+	}
+
+	handler.negativeCacheTTL = 0
+	if recentlyDeregistered(other) {
+		t.Error("recentlyDeregistered() = true with the cache disabled")
+	}
+}
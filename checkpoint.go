@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+)
+
+// checkpointEntry is a line of the checkpoint file, an item processed by a
+// bulk subcommand and whether it was found, an orphan entity for the check
+// subcommand
+type checkpointEntry struct {
+	Command string `json:"command"`
+	Item    string `json:"item"`
+	Found   bool   `json:"found,omitempty"`
+}
+
+// checkpoint records the items processed by a bulk subcommand in the
+// --checkpoint-file, one JSON line each as they complete, so that an
+// interrupted run resumes where it left off instead of looking everything up
+// again. A nil checkpoint records nothing.
+type checkpoint struct {
+	command string
+	done    map[string]bool
+
+	mu   sync.Mutex
+	file *os.File
+}
+
+// openCheckpoint reads the items recorded by an interrupted run of the
+// subcommand and opens the checkpoint file to record the next ones, or returns
+// nil when --checkpoint-file is not set
+func openCheckpoint(command string) (*checkpoint, error) {
+	if handler.checkpointFile == "" {
+		return nil, nil
+	}
+	c := &checkpoint{command: command, done: make(map[string]bool)}
+	data, err := os.ReadFile(handler.checkpointFile)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		var entry checkpointEntry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			// The line being written when the run was killed
+			log.Printf("ignoring invalid checkpoint line: %s", err)
+			continue
+		}
+		if entry.Command != command {
+			return nil, fmt.Errorf("the checkpoint file was written by the %s subcommand", entry.Command)
+		}
+		c.done[entry.Item] = entry.Found
+	}
+	if len(c.done) > 0 {
+		log.Printf("resuming from the checkpoint file, %d items were processed by the interrupted run", len(c.done))
+	}
+
+	if c.file, err = os.OpenFile(handler.checkpointFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600); err != nil {
+		return nil, err
+	}
+	// Terminate the line cut off by the interruption, if any
+	if len(data) > 0 && data[len(data)-1] != '\n' {
+		if _, err := c.file.Write([]byte("\n")); err != nil {
+			_ = c.file.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// processed returns whether the item was processed by the interrupted run, and
+// whether it was found
+func (c *checkpoint) processed(item string) (found, ok bool) {
+	if c == nil {
+		return false, false
+	}
+	found, ok = c.done[item]
+	return found, ok
+}
+
+// record appends the processed item to the checkpoint file
+func (c *checkpoint) record(item string, found bool) error {
+	if c == nil {
+		return nil
+	}
+	b, err := json.Marshal(checkpointEntry{Command: c.command, Item: item, Found: found})
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, err := c.file.Write(append(b, '\n')); err != nil {
+		return fmt.Errorf("could not write the checkpoint file: %s", err)
+	}
+	return nil
+}
+
+// close closes the checkpoint file, and removes it once the run completed so
+// that the next run starts over
+func (c *checkpoint) close(completed bool) {
+	if c == nil {
+		return
+	}
+	if err := c.file.Close(); err != nil {
+		log.Printf("could not close the checkpoint file: %s", err)
+	}
+	if !completed {
+		return
+	}
+	if err := os.Remove(handler.checkpointFile); err != nil {
+		log.Printf("could not remove the checkpoint file: %s", err)
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func Test_checkpoint(t *testing.T) {
+	saveHandler(t)
+	handler.checkpointFile = filepath.Join(t.TempDir(), "checkpoint")
+
+	cp, err := openCheckpoint("check")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for item, found := range map[string]bool{"default/web01": false, "default/web02": true} {
+		if err := cp.record(item, found); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cp.close(false)
+
+	// The line being written when the run was killed is ignored
+	f, err := os.OpenFile(handler.checkpointFile, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = f.WriteString(`{"command":"check","item":"default/we`)
+	f.Close()
+
+	cp, err = openCheckpoint("check")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found, ok := cp.processed("default/web02"); !ok || !found {
+		t.Errorf("processed(default/web02) = %t, %t, want true, true", found, ok)
+	}
+	if found, ok := cp.processed("default/web01"); !ok || found {
+		t.Errorf("processed(default/web01) = %t, %t, want false, true", found, ok)
+	}
+	if _, ok := cp.processed("default/web03"); ok {
+		t.Error("processed(default/web03) = true, want false")
+	}
+	if err := cp.record("default/web03", false); err != nil {
+		t.Fatal(err)
+	}
+	cp.close(false)
+
+	if _, err := openCheckpoint("cleanup"); err == nil {
+		t.Error("openCheckpoint() of another subcommand expected an error")
+	}
+	cp, err = openCheckpoint("check")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := cp.processed("default/web03"); !ok {
+		t.Error("processed(default/web03) = false after the cut off line, want true")
+	}
+
+	// A completed run removes the checkpoint
+	cp.close(true)
+	if _, err := os.Stat(handler.checkpointFile); !os.IsNotExist(err) {
+		t.Errorf("checkpoint file still exists after a completed run: %v", err)
+	}
+}
+
+func Test_openCheckpoint_disabled(t *testing.T) {
+	saveHandler(t)
+	handler.checkpointFile = ""
+	cp, err := openCheckpoint("check")
+	if err != nil || cp != nil {
+		t.Fatalf("openCheckpoint() = %v, %v, want nil without --checkpoint-file", cp, err)
+	}
+	if _, ok := cp.processed("default/web01"); ok {
+		t.Error("processed() = true on a nil checkpoint")
+	}
+	if err := cp.record("default/web01", true); err != nil {
+		t.Errorf("record() error = %v", err)
+	}
+	cp.close(true)
+}
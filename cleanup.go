@@ -0,0 +1,256 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	corev2 "github.com/sensu/core/v2"
+	"github.com/sensu/sensu-plugin-sdk/sensu"
+	"github.com/sensu/sensu-puppet-handler/puppet"
+)
+
+// puppetNodesStateFile caches the PuppetDB node listing of the cleanup
+// subcommand with its validators
+const puppetNodesStateFile = "puppetdb-nodes.json"
+
+// cleanupNodes deactivates the PuppetDB nodes which have not reported for
+// --cleanup-unreported-after seconds and have no entity in the namespaces
+// listed with --check-namespaces, the reverse of the deregistration, so that
+// both systems are kept tidy from one tool
+func cleanupNodes(_ *corev2.Event) (int, error) {
+	setupRequestID()
+	puppetClient, err := puppetHTTPClient()
+	if err != nil {
+		return sensu.CheckStateUnknown, err
+	}
+	config := puppetConfig(puppetClient)
+
+	// Collect the node names of all the entities, whatever their class, so
+	// that the nodes monitored through proxy entities or left out by the
+	// entity selectors are kept too
+	known := make(map[string]bool)
+	for _, namespace := range handler.checkNamespaces {
+		entities := 0
+		err := forEachEntity(namespace, false, func(entity *corev2.Entity) error {
+			entities++
+			event := &corev2.Event{ObjectMeta: corev2.ObjectMeta{Namespace: namespace}, Entity: entity}
+			names, err := config.NodeNameCandidates(event)
+			if err != nil {
+				return fmt.Errorf("could not derive the node names of entity %q: %s", entity.Name, err)
+			}
+			for _, name := range append(names, entity.Name) {
+				known[strings.ToLower(name)] = true
+			}
+			return nil
+		})
+		if err != nil {
+			return sensu.CheckStateUnknown, fmt.Errorf("could not list the entities of namespace %q: %s", namespace, err)
+		}
+		// An empty namespace is more likely a wrong namespace or API key than
+		// a fleet without entities, and would leave no node to keep
+		if entities == 0 {
+			return sensu.CheckStateUnknown, fmt.Errorf("namespace %q lists no entities, refusing to deactivate the Puppet nodes", namespace)
+		}
+	}
+
+	if handler.minPuppetNodes > 0 {
+		count, err := puppet.ActiveNodeCount(executionCtx, config)
+		if err != nil {
+			return sensu.CheckStateUnknown, fmt.Errorf("could not count the active Puppet nodes: %s", err)
+		}
+		if count < handler.minPuppetNodes {
+			return sensu.CheckStateUnknown, fmt.Errorf("PuppetDB has %d active nodes, fewer than the minimum of %d, refusing to deactivate the Puppet nodes", count, handler.minPuppetNodes)
+		}
+	}
+
+	var patterns []string
+	if handler.protectedNodesFile != "" {
+		if patterns, err = readProtectedNodes(handler.protectedNodesFile); err != nil {
+			return sensu.CheckStateUnknown, fmt.Errorf("could not read the protected nodes file: %s", err)
+		}
+	}
+
+	now := time.Now()
+	threshold := time.Duration(handler.cleanupUnreportedAfter) * time.Second
+	// The listing of the whole fleet takes much longer than the lookup of a
+	// node, it is bounded by its own timeout rather than the request one
+	listClient := *config.Client
+	listClient.Timeout = time.Duration(handler.nodeListTimeout) * time.Second
+	listConfig := config
+	listConfig.Client = &listClient
+	reported, err := reportedNodes(listConfig)
+	if err != nil {
+		return sensu.CheckStateUnknown, fmt.Errorf("could not list the unreported Puppet nodes: %s", err)
+	}
+	var nodes []puppet.UnreportedNode
+	for _, node := range reported {
+		if node.ReportTimestamp.Before(now.Add(-threshold)) {
+			nodes = append(nodes, node)
+		}
+	}
+	var (
+		mu          sync.Mutex
+		deactivated []string
+	)
+	// A dry run changes nothing, it neither resumes nor leaves a checkpoint
+	var cp *checkpoint
+	if !handler.dryRun {
+		if cp, err = openCheckpoint("cleanup"); err != nil {
+			return sensu.CheckStateUnknown, fmt.Errorf("could not open the checkpoint file: %s", err)
+		}
+	}
+	completed := false
+	defer func() { cp.close(completed) }()
+
+	var candidates []puppet.UnreportedNode
+	for _, node := range nodes {
+		if known[strings.ToLower(node.Certname)] || nodeProtected(patterns, node.Certname) {
+			continue
+		}
+		// PuppetDB processes the commands asynchronously, the nodes
+		// deactivated by the interrupted run may still be listed
+		if _, ok := cp.processed(node.Certname); ok {
+			deactivated = append(deactivated, node.Certname)
+			continue
+		}
+		candidates = append(candidates, node)
+	}
+
+	if handler.dryRun {
+		fmt.Print(dryRunSummary(candidates, len(nodes)))
+		return sensu.CheckStateOK, nil
+	}
+
+	confirmed, err := confirmDeactivation(candidates)
+	if err != nil {
+		return sensu.CheckStateUnknown, fmt.Errorf("could not read the confirmation: %s", err)
+	}
+	if !confirmed {
+		return sensu.CheckStateUnknown, errors.New("the deactivation of the nodes was not confirmed, --yes is required without a terminal")
+	}
+
+	progress := startProgress("nodes deactivated", "", len(candidates))
+	defer progress.finish()
+	pool := newWorkerPool(handler.concurrency)
+	for _, node := range candidates {
+		node := node
+		err := pool.submit(func() error {
+			if err := puppet.DeactivateNode(executionCtx, config, node.Certname, now); err != nil {
+				return fmt.Errorf("could not deactivate puppet node %q: %s", node.Certname, err)
+			}
+			if err := cp.record(node.Certname, false); err != nil {
+				return err
+			}
+			log.Printf("deactivated puppet node %q, without a Sensu entity and unreported since %s", node.Certname, node.ReportTimestamp.Format(time.RFC3339))
+			progress.add(false)
+			mu.Lock()
+			deactivated = append(deactivated, node.Certname)
+			mu.Unlock()
+			return nil
+		})
+		if err != nil {
+			break
+		}
+	}
+	if err := pool.wait(); err != nil {
+		return sensu.CheckStateUnknown, err
+	}
+	completed = true
+	sort.Strings(deactivated)
+
+	fmt.Println(cleanupSummary(deactivated, len(nodes)))
+	return sensu.CheckStateOK, nil
+}
+
+// reportedNodes lists the reported PuppetDB nodes, revalidating the listing
+// cached in the state directory by the previous run so that an unchanged
+// inventory is not downloaded again on each scheduled run
+func reportedNodes(config puppet.Config) ([]puppet.UnreportedNode, error) {
+	cache := make(map[string]puppet.NodeList)
+	if err := readState(puppetNodesStateFile, &cache); err != nil {
+		log.Printf("could not read the PuppetDB node list cache: %s", err)
+	}
+	var cached *puppet.NodeList
+	if list, ok := cache[config.Endpoint]; ok {
+		cached = &list
+	}
+	list, err := puppet.ReportedNodes(executionCtx, config, cached)
+	if err != nil {
+		return nil, err
+	}
+	if list.NotModified {
+		log.Printf("the PuppetDB node list is unchanged since the last run")
+		return list.Nodes, nil
+	}
+
+	// Without validators the listing cannot be revalidated, caching it would
+	// only cost disk space
+	if list.ETag == "" && list.LastModified == "" {
+		if cached == nil {
+			return list.Nodes, nil
+		}
+		delete(cache, config.Endpoint)
+	} else {
+		cache[config.Endpoint] = list
+	}
+	if err := writeState(puppetNodesStateFile, cache); err != nil {
+		log.Printf("could not write the PuppetDB node list cache: %s", err)
+	}
+	return list.Nodes, nil
+}
+
+// nodeProtected returns whether the certname matches one of the protected
+// nodes patterns
+func nodeProtected(patterns []string, certname string) bool {
+	for _, pattern := range patterns {
+		name := certname
+		if handler.caseInsensitive {
+			pattern, name = strings.ToLower(pattern), strings.ToLower(name)
+		}
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// dryRunSummary returns the output of a dry run, listing every node the run
+// would deactivate
+func dryRunSummary(candidates []puppet.UnreportedNode, total int) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "would deactivate %d Puppet nodes without a Sensu entity out of %d unreported nodes\n", len(candidates), total)
+	names := make([]string, 0, len(candidates))
+	reported := make(map[string]time.Time, len(candidates))
+	for _, node := range candidates {
+		names = append(names, node.Certname)
+		reported[node.Certname] = node.ReportTimestamp
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(&b, "  %s\tunreported since %s\n", name, reported[name].Format(time.RFC3339))
+	}
+	return b.String()
+}
+
+// cleanupSummary returns the check output, naming the first deactivated nodes
+func cleanupSummary(deactivated []string, total int) string {
+	summary := fmt.Sprintf("deactivated %d Puppet nodes without a Sensu entity out of %d unreported nodes", len(deactivated), total)
+	if len(deactivated) == 0 {
+		return summary
+	}
+	named := deactivated
+	if len(named) > maxReportedOrphans {
+		named = named[:maxReportedOrphans]
+	}
+	summary += ": " + strings.Join(named, ", ")
+	if more := len(deactivated) - len(named); more > 0 {
+		summary += fmt.Sprintf(" and %d more", more)
+	}
+	return summary
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	corev2 "github.com/sensu/core/v2"
+	"github.com/sensu/sensu-plugin-sdk/sensu"
+	"github.com/sensu/sensu-puppet-handler/puppet"
+)
+
+func Test_cleanupNodes(t *testing.T) {
+	var deactivated []string
+	puppetdb := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case puppet.CommandPath:
+			if got := r.URL.Query().Get("command"); got != "deactivate_node" {
+				t.Errorf("cleanupNodes() command = %q", got)
+			}
+			deactivated = append(deactivated, r.URL.Query().Get("certname"))
+			_, _ = w.Write([]byte(`{"uuid":"a3a81ca9-0a4e-4d4d-8b6f-4a2b0e5e7c1d"}`))
+		case "/pdb/query/v4/nodes":
+			if strings.HasPrefix(r.URL.Query().Get("query"), `["extract"`) {
+				_, _ = w.Write([]byte(`[{"count":4}]`))
+				return
+			}
+			_ = json.NewEncoder(w).Encode([]map[string]interface{}{
+				{"certname": "web01", "report_timestamp": "2024-01-01T00:00:00Z"},
+				{"certname": "switch01", "report_timestamp": "2024-01-01T00:00:00Z"},
+				{"certname": "ops01", "report_timestamp": "2024-01-01T00:00:00Z"},
+				{"certname": "db01", "report_timestamp": "2024-01-01T00:00:00Z"},
+			})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer puppetdb.Close()
+
+	// Proxy entities and the entities left out by the selectors keep their
+	// nodes too
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got := r.URL.Query().Get("labelSelector"); got != "" {
+			t.Errorf("cleanupNodes() labelSelector = %q, want none", got)
+		}
+		proxy := corev2.FixtureEntity("switch01")
+		proxy.EntityClass = corev2.EntityProxyClass
+		_ = json.NewEncoder(w).Encode([]*corev2.Entity{corev2.FixtureEntity("web01"), proxy})
+	}))
+	defer api.Close()
+
+	protected := filepath.Join(t.TempDir(), "protected")
+	if err := os.WriteFile(protected, []byte("ops*\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile := writeKeyPair(t)
+	setHandler(t, Handler{
+		endpoint:                 puppetdb.URL + "/pdb/query/v4/nodes",
+		puppetCert:               certFile,
+		puppetKey:                keyFile,
+		puppetCACert:             certFile,
+		puppetInsecureSkipVerify: true,
+		sensuAPIURL:              api.URL,
+		sensuAPIKey:              "xxxxxxxxxx",
+		checkNamespaces:          []string{"default"},
+		entityLabelSelector:      "region == us-west-1",
+		protectedNodesFile:       protected,
+		stateDir:                 t.TempDir(),
+		cleanupUnreportedAfter:   86400,
+		yes:                      true,
+		minPuppetNodes:           4,
+	})
+
+	got, err := cleanupNodes(nil)
+	if err != nil {
+		t.Fatalf("cleanupNodes() error = %v", err)
+	}
+	if got != sensu.CheckStateOK {
+		t.Errorf("cleanupNodes() = %d, want %d", got, sensu.CheckStateOK)
+	}
+	if want := []string{"db01"}; !reflect.DeepEqual(deactivated, want) {
+		t.Errorf("cleanupNodes() deactivated %v, want %v", deactivated, want)
+	}
+}
+
+func Test_cleanupNodes_resume(t *testing.T) {
+	var deactivated []string
+	puppetdb := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case puppet.CommandPath:
+			deactivated = append(deactivated, r.URL.Query().Get("certname"))
+			_, _ = w.Write([]byte(`{"uuid":"a3a81ca9-0a4e-4d4d-8b6f-4a2b0e5e7c1d"}`))
+		case "/pdb/query/v4/nodes":
+			_ = json.NewEncoder(w).Encode([]map[string]interface{}{
+				{"certname": "db01", "report_timestamp": "2024-01-01T00:00:00Z"},
+				{"certname": "db02", "report_timestamp": "2024-01-01T00:00:00Z"},
+			})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer puppetdb.Close()
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode([]*corev2.Entity{corev2.FixtureEntity("web01")})
+	}))
+	defer api.Close()
+
+	// The interrupted run deactivated db01
+	checkpointFile := filepath.Join(t.TempDir(), "checkpoint")
+	if err := os.WriteFile(checkpointFile, []byte(`{"command":"cleanup","item":"db01"}`+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile := writeKeyPair(t)
+	setHandler(t, Handler{
+		endpoint:                 puppetdb.URL + "/pdb/query/v4/nodes",
+		puppetCert:               certFile,
+		puppetKey:                keyFile,
+		puppetCACert:             certFile,
+		puppetInsecureSkipVerify: true,
+		sensuAPIURL:              api.URL,
+		sensuAPIKey:              "xxxxxxxxxx",
+		checkNamespaces:          []string{"default"},
+		stateDir:                 t.TempDir(),
+		cleanupUnreportedAfter:   86400,
+		yes:                      true,
+		checkpointFile:           checkpointFile,
+	})
+
+	if _, err := cleanupNodes(nil); err != nil {
+		t.Fatalf("cleanupNodes() error = %v", err)
+	}
+	if want := []string{"db02"}; !reflect.DeepEqual(deactivated, want) {
+		t.Errorf("cleanupNodes() deactivated %v, want %v", deactivated, want)
+	}
+	if _, err := os.Stat(checkpointFile); !os.IsNotExist(err) {
+		t.Errorf("cleanupNodes() left the checkpoint file of the completed run: %v", err)
+	}
+}
+
+func Test_cleanupNodes_dryRun(t *testing.T) {
+	puppetdb := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case puppet.CommandPath:
+			t.Errorf("cleanupNodes() deactivated %q in a dry run", r.URL.Query().Get("certname"))
+		case "/pdb/query/v4/nodes":
+			// The listing of a large fleet outlasts the request timeout
+			time.Sleep(1100 * time.Millisecond)
+			_ = json.NewEncoder(w).Encode([]map[string]interface{}{
+				{"certname": "db01", "report_timestamp": "2024-01-01T00:00:00Z"},
+			})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer puppetdb.Close()
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode([]*corev2.Entity{corev2.FixtureEntity("web01")})
+	}))
+	defer api.Close()
+
+	checkpointFile := filepath.Join(t.TempDir(), "checkpoint")
+	certFile, keyFile := writeKeyPair(t)
+	setHandler(t, Handler{
+		endpoint:                 puppetdb.URL + "/pdb/query/v4/nodes",
+		puppetCert:               certFile,
+		puppetKey:                keyFile,
+		puppetCACert:             certFile,
+		puppetInsecureSkipVerify: true,
+		sensuAPIURL:              api.URL,
+		sensuAPIKey:              "xxxxxxxxxx",
+		checkNamespaces:          []string{"default"},
+		stateDir:                 t.TempDir(),
+		cleanupUnreportedAfter:   86400,
+		requestTimeout:           1,
+		nodeListTimeout:          defaultNodeListTimeout,
+		checkpointFile:           checkpointFile,
+		dryRun:                   true,
+	})
+
+	got, err := cleanupNodes(nil)
+	if err != nil {
+		t.Fatalf("cleanupNodes() error = %v", err)
+	}
+	if got != sensu.CheckStateOK {
+		t.Errorf("cleanupNodes() = %d, want %d", got, sensu.CheckStateOK)
+	}
+	if _, err := os.Stat(checkpointFile); !os.IsNotExist(err) {
+		t.Errorf("cleanupNodes() wrote a checkpoint in a dry run: %v", err)
+	}
+}
+
+func Test_dryRunSummary(t *testing.T) {
+	candidates := []puppet.UnreportedNode{
+		{Certname: "web02", ReportTimestamp: time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)},
+		{Certname: "db01", ReportTimestamp: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)},
+	}
+	want := "would deactivate 2 Puppet nodes without a Sensu entity out of 5 unreported nodes\n" +
+		"  db01\tunreported since 2024-01-01T00:00:00Z\n" +
+		"  web02\tunreported since 2024-02-01T00:00:00Z\n"
+	if got := dryRunSummary(candidates, 5); got != want {
+		t.Errorf("dryRunSummary() = %q, want %q", got, want)
+	}
+}
+
+func Test_cleanupNodes_guards(t *testing.T) {
+	puppetdb := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case puppet.CommandPath:
+			t.Errorf("cleanupNodes() deactivated %q", r.URL.Query().Get("certname"))
+		case "/pdb/query/v4/nodes":
+			if strings.HasPrefix(r.URL.Query().Get("query"), `["extract"`) {
+				// A freshly restored PuppetDB
+				_, _ = w.Write([]byte(`[{"count":2}]`))
+				return
+			}
+			_ = json.NewEncoder(w).Encode([]map[string]interface{}{
+				{"certname": "web01", "report_timestamp": "2024-01-01T00:00:00Z"},
+				{"certname": "db01", "report_timestamp": "2024-01-01T00:00:00Z"},
+			})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer puppetdb.Close()
+
+	tests := []struct {
+		name           string
+		entities       []*corev2.Entity
+		minPuppetNodes int
+		wantErr        string
+	}{
+		{
+			name:     "no entities",
+			entities: []*corev2.Entity{},
+			wantErr:  `namespace "default" lists no entities`,
+		},
+		{
+			name:           "too few nodes",
+			entities:       []*corev2.Entity{corev2.FixtureEntity("web01")},
+			minPuppetNodes: 100,
+			wantErr:        "PuppetDB has 2 active nodes, fewer than the minimum of 100",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				_ = json.NewEncoder(w).Encode(tt.entities)
+			}))
+			defer api.Close()
+
+			certFile, keyFile := writeKeyPair(t)
+			setHandler(t, Handler{
+				endpoint:                 puppetdb.URL + "/pdb/query/v4/nodes",
+				puppetCert:               certFile,
+				puppetKey:                keyFile,
+				puppetCACert:             certFile,
+				puppetInsecureSkipVerify: true,
+				sensuAPIURL:              api.URL,
+				sensuAPIKey:              "xxxxxxxxxx",
+				checkNamespaces:          []string{"default"},
+				stateDir:                 t.TempDir(),
+				cleanupUnreportedAfter:   86400,
+				yes:                      true,
+				minPuppetNodes:           tt.minPuppetNodes,
+			})
+
+			got, err := cleanupNodes(nil)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("cleanupNodes() error = %v, want %q", err, tt.wantErr)
+			}
+			if got != sensu.CheckStateUnknown {
+				t.Errorf("cleanupNodes() = %d, want %d", got, sensu.CheckStateUnknown)
+			}
+		})
+	}
+}
+
+func Test_reportedNodes(t *testing.T) {
+	var full, revalidated int
+	puppetdb := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") == `"nodes-1"` {
+			revalidated++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		full++
+		w.Header().Set("ETag", `"nodes-1"`)
+		_, _ = w.Write([]byte(`[{"certname":"web01","report_timestamp":"2024-01-01T00:00:00Z"}]`))
+	}))
+	defer puppetdb.Close()
+
+	saveHandler(t)
+	handler.stateDir = t.TempDir()
+	config := puppet.Config{Endpoint: puppetdb.URL + "/pdb/query/v4/nodes"}
+
+	// The second run revalidates the listing cached by the first one
+	for run := 1; run <= 2; run++ {
+		nodes, err := reportedNodes(config)
+		if err != nil {
+			t.Fatalf("reportedNodes() run %d error = %v", run, err)
+		}
+		if len(nodes) != 1 || nodes[0].Certname != "web01" {
+			t.Errorf("reportedNodes() run %d = %+v", run, nodes)
+		}
+	}
+	if full != 1 || revalidated != 1 {
+		t.Errorf("reportedNodes() made %d full and %d conditional requests, want 1 and 1", full, revalidated)
+	}
+}
+
+func Test_cleanupSummary(t *testing.T) {
+	var nodes []string
+	for i := 0; i < 11; i++ {
+		nodes = append(nodes, fmt.Sprintf("web%02d", i))
+	}
+	want := "deactivated 11 Puppet nodes without a Sensu entity out of 15 unreported nodes: " +
+		"web00, web01, web02, web03, web04, web05, web06, web07, web08, web09 and 1 more"
+	if got := cleanupSummary(nodes, 15); got != want {
+		t.Errorf("cleanupSummary() = %q, want %q", got, want)
+	}
+}
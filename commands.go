@@ -0,0 +1,171 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"strings"
+
+	corev2 "github.com/sensu/core/v2"
+	"github.com/sensu/sensu-plugin-sdk/sensu"
+)
+
+// subcommand is a command of the handler binary other than the handler itself.
+// The plugin SDK does not expose its command tree, so subcommands are
+// dispatched from the command line arguments before the SDK parses them.
+type subcommand struct {
+	path  []string
+	short string
+	run   func()
+	// hidden subcommands are left out of the shell completions
+	hidden bool
+}
+
+var subcommands = []subcommand{
+	{
+		path:  []string{"version"},
+		short: "Print the version, commit, build date and Go version of the handler",
+		run: func() {
+			printVersion(os.Stdout)
+		},
+	},
+	{
+		path:  []string{"config", "print"},
+		short: "Print the effective configuration, with secrets masked",
+		run: func() {
+			config := subcommandConfig("config print", "Print the effective configuration, with secrets masked")
+			check := sensu.NewGoCheck(&config, options, noValidation, printConfig, stdinIsPipe())
+			check.Execute()
+		},
+	},
+	{
+		path:  []string{"check"},
+		short: "Report the entities without a Puppet node, without deregistering them",
+		run: func() {
+			config := subcommandConfig("check", "Report the entities without a Puppet node, without deregistering them")
+			validateCheck := func(_ *corev2.Event) (int, error) {
+				// There is no event, validate the options against a placeholder
+				event := corev2.FixtureEvent("check", "keepalive")
+				if err := validate(event); err != nil {
+					return sensu.CheckStateUnknown, redactError(err)
+				}
+				return sensu.CheckStateOK, nil
+			}
+			check := sensu.NewGoCheck(&config, options, validateCheck, checkOrphans, false)
+			check.Execute()
+		},
+	},
+	{
+		path:  []string{"apply"},
+		short: "Take the approved deregistrations of the approval queue",
+		run: func() {
+			config := subcommandConfig("apply", "Take the approved deregistrations of the approval queue")
+			validateApply := func(_ *corev2.Event) (int, error) {
+				if handler.approvalQueue == "" {
+					return sensu.CheckStateUnknown, errors.New("the approval queue is required")
+				}
+				// There is no event, validate the options against a placeholder
+				event := corev2.FixtureEvent("apply", "keepalive")
+				if err := validate(event); err != nil {
+					return sensu.CheckStateUnknown, redactError(err)
+				}
+				return sensu.CheckStateOK, nil
+			}
+			check := sensu.NewGoCheck(&config, options, validateApply, applyApproved, false)
+			check.Execute()
+		},
+	},
+	{
+		path:  []string{"cleanup"},
+		short: "Deactivate the unreported PuppetDB nodes without a Sensu entity",
+		run: func() {
+			config := subcommandConfig("cleanup", "Deactivate the unreported PuppetDB nodes without a Sensu entity")
+			validateCleanup := func(_ *corev2.Event) (int, error) {
+				if handler.cleanupUnreportedAfter <= 0 {
+					return sensu.CheckStateUnknown, errors.New("the unreported nodes threshold is required")
+				}
+				// There is no event, validate the options against a placeholder
+				event := corev2.FixtureEvent("cleanup", "keepalive")
+				if err := validatePuppetDB(event); err != nil {
+					return sensu.CheckStateUnknown, redactError(err)
+				}
+				if err := validateSensu(event); err != nil {
+					return sensu.CheckStateUnknown, redactError(err)
+				}
+				return sensu.CheckStateOK, nil
+			}
+			check := sensu.NewGoCheck(&config, options, validateCleanup, cleanupNodes, false)
+			check.Execute()
+		},
+	},
+	{
+		path:  []string{"mutate", "facts"},
+		short: "Merge PuppetDB facts into the event's entity labels",
+		run: func() {
+			config := subcommandConfig("mutate facts", "Merge PuppetDB facts into the event's entity labels")
+			validateMutator := func(event *corev2.Event) error {
+				if err := validatePuppetDB(event); err != nil {
+					return redactError(err)
+				}
+				if len(handler.facts) == 0 {
+					return errors.New("at least one fact is required")
+				}
+				return nil
+			}
+			mutator := sensu.NewMutator(&config, options, validateMutator, mutateFacts)
+			mutator.Execute()
+		},
+	},
+	{
+		path:  []string{"mutate"},
+		short: "Annotate events with their Puppet node instead of deregistering entities",
+		run: func() {
+			config := subcommandConfig("mutate", "Annotate events with their Puppet node instead of deregistering entities")
+			validateMutator := func(event *corev2.Event) error {
+				return redactError(validatePuppetDB(event))
+			}
+			mutator := sensu.NewMutator(&config, options, validateMutator, mutateEvent)
+			mutator.Execute()
+		},
+	},
+}
+
+// runSubcommand runs the subcommand named by the command line arguments, if
+// any, and returns whether one was run
+func runSubcommand() bool {
+	for _, cmd := range subcommands {
+		if len(os.Args) <= len(cmd.path) || !equalArgs(os.Args[1:len(cmd.path)+1], cmd.path) {
+			continue
+		}
+		// Drop the subcommand path so the SDK only parses the flags
+		os.Args = append(os.Args[:1], os.Args[len(cmd.path)+1:]...)
+		cmd.run()
+		return true
+	}
+	return false
+}
+
+// subcommandConfig returns the plugin configuration of a subcommand, sharing
+// the handler's annotations keyspace
+func subcommandConfig(name, short string) sensu.PluginConfig {
+	return sensu.PluginConfig{
+		Name:     strings.Join([]string{handler.Name, name}, " "),
+		Short:    short,
+		Keyspace: handler.Keyspace,
+	}
+}
+
+func equalArgs(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func noValidation(_ *corev2.Event) (int, error) {
+	return sensu.CheckStateOK, nil
+}
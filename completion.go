@@ -0,0 +1,109 @@
+package main
+
+import (
+	"os"
+
+	"github.com/sensu/sensu-plugin-sdk/sensu"
+	"github.com/spf13/cobra"
+)
+
+// The completion subcommands are registered at init time, as they build their
+// command tree from the other subcommands
+func init() {
+	subcommands = append(subcommands,
+		subcommand{
+			path:  []string{"completion"},
+			short: "Generate the completion script for bash, zsh or fish",
+			run:   runCompletion("completion"),
+		},
+		subcommand{
+			path:   []string{cobra.ShellCompRequestCmd},
+			run:    runCompletion(cobra.ShellCompRequestCmd),
+			hidden: true,
+		},
+		subcommand{
+			path:   []string{cobra.ShellCompNoDescRequestCmd},
+			run:    runCompletion(cobra.ShellCompNoDescRequestCmd),
+			hidden: true,
+		},
+	)
+}
+
+// completionCommand returns a command tree mirroring the handler's flags and
+// subcommands. The SDK generates completions from its own command tree, which
+// does not know about the subcommands dispatched by runSubcommand.
+func completionCommand() *cobra.Command {
+	root := &cobra.Command{
+		Use:   handler.Name,
+		Short: handler.Short,
+		Run:   func(*cobra.Command, []string) {},
+	}
+
+	// The flags are shared by every subcommand, define them once on a
+	// scratch command and make them persistent
+	flags := &cobra.Command{}
+	for _, opt := range options {
+		_ = opt.SetupFlag(flags)
+	}
+	root.PersistentFlags().AddFlagSet(flags.Flags())
+	for _, opt := range options {
+		if guard, ok := opt.(*annotationGuard); ok {
+			opt = guard.ConfigOption
+		}
+		var argument string
+		var allowed []string
+		switch o := opt.(type) {
+		case *sensu.PluginConfigOption[string]:
+			argument, allowed = o.Argument, o.Allow
+		case *sensu.SlicePluginConfigOption[string]:
+			argument, allowed = o.Argument, o.Allow
+		}
+		if argument == "" || len(allowed) == 0 {
+			continue
+		}
+		_ = root.RegisterFlagCompletionFunc(argument, func(*cobra.Command, []string, string) ([]string, cobra.ShellCompDirective) {
+			return allowed, cobra.ShellCompDirectiveNoFileComp
+		})
+	}
+
+	for _, sub := range subcommands {
+		if sub.hidden || sub.path[0] == "completion" {
+			continue
+		}
+		parent := root
+		for i, name := range sub.path {
+			child := findCommand(parent, name)
+			if child == nil {
+				child = &cobra.Command{Use: name, Run: func(*cobra.Command, []string) {}}
+				parent.AddCommand(child)
+			}
+			if i == len(sub.path)-1 {
+				child.Short = sub.short
+			}
+			parent = child
+		}
+	}
+	return root
+}
+
+func findCommand(parent *cobra.Command, name string) *cobra.Command {
+	for _, cmd := range parent.Commands() {
+		if cmd.Name() == name {
+			return cmd
+		}
+	}
+	return nil
+}
+
+// runCompletion returns a subcommand run function executing the named
+// command of the completion tree, either the completion script generator or
+// the hidden commands the generated scripts call back into
+func runCompletion(name string) func() {
+	return func() {
+		root := completionCommand()
+		root.SetArgs(append([]string{name}, os.Args[1:]...))
+		if err := root.Execute(); err != nil {
+			exit(1)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/spf13/cobra"
+)
+
+func Test_completionCommand(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		want []string
+	}{
+		{
+			name: "subcommands",
+			args: []string{""},
+			want: []string{"check", "completion", "config", "mutate", "version"},
+		},
+		{
+			name: "nested subcommands",
+			args: []string{"mutate", ""},
+			want: []string{"facts"},
+		},
+		{
+			name: "allowed values",
+			args: []string{"check", "--action", ""},
+			want: []string{"delete", "tombstone"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			root := completionCommand()
+			root.SetOut(&buf)
+			root.SetArgs(append([]string{cobra.ShellCompNoDescRequestCmd}, tt.args...))
+			if err := root.Execute(); err != nil {
+				t.Fatal(err)
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(buf.String(), want+"\n") {
+					t.Errorf("completions = %q, missing %q", buf.String(), want)
+				}
+			}
+			if strings.Contains(buf.String(), cobra.ShellCompRequestCmd+"\n") {
+				t.Errorf("completions = %q, hidden command listed", buf.String())
+			}
+		})
+	}
+}
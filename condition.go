@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/google/cel-go/cel"
+	corev2 "github.com/sensu/core/v2"
+)
+
+// compileCondition compiles the CEL deregistration condition. The expression
+// has access to the event, the PuppetDB node record (null when the node does
+// not exist) and the lookup status, and must evaluate to a boolean.
+func compileCondition(expr string) (cel.Program, error) {
+	env, err := cel.NewEnv(
+		cel.Variable("event", cel.DynType),
+		cel.Variable("node", cel.DynType),
+		cel.Variable("status", cel.StringType),
+		cel.CrossTypeNumericComparisons(true),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	ast, issues := env.Compile(expr)
+	if issues != nil && issues.Err() != nil {
+		return nil, issues.Err()
+	}
+	if ast.OutputType() != cel.BoolType && ast.OutputType() != cel.DynType {
+		return nil, fmt.Errorf("condition must evaluate to a boolean, got %s", ast.OutputType())
+	}
+
+	return env.Program(ast)
+}
+
+// evaluateCondition returns whether the entity should be deregistered
+// according to the CEL condition
+func evaluateCondition(event *corev2.Event, lookup nodeLookup) (bool, error) {
+	program, err := compileCondition(handler.condition)
+	if err != nil {
+		return false, fmt.Errorf("invalid condition: %s", err)
+	}
+
+	// Expose the event as generic JSON values so that fields are named the way
+	// they appear in Sensu resources
+	b, err := json.Marshal(event)
+	if err != nil {
+		return false, err
+	}
+	var eventValue map[string]interface{}
+	if err := json.Unmarshal(b, &eventValue); err != nil {
+		return false, err
+	}
+
+	var node interface{}
+	if lookup.record != nil {
+		node = lookup.record
+	}
+
+	out, _, err := program.Eval(map[string]interface{}{
+		"event":  eventValue,
+		"node":   node,
+		"status": lookup.status,
+	})
+	if err != nil {
+		return false, fmt.Errorf("could not evaluate condition: %s", err)
+	}
+	result, ok := out.Value().(bool)
+	if !ok {
+		return false, errors.New("condition did not evaluate to a boolean")
+	}
+
+	return result, nil
+}
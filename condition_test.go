@@ -0,0 +1,83 @@
+package main
+
+import (
+	"testing"
+
+	corev2 "github.com/sensu/core/v2"
+)
+
+func Test_evaluateCondition(t *testing.T) {
+	saveHandler(t)
+	event := corev2.FixtureEvent("foo", "keepalive")
+	event.Check.Occurrences = 5
+
+	expired := nodeLookup{
+		name:   "foo",
+		status: nodeActive,
+		record: map[string]interface{}{"certname": "foo", "expired": "2023-02-09T12:00:00.000Z"},
+	}
+	active := nodeLookup{
+		name:   "foo",
+		status: nodeActive,
+		record: map[string]interface{}{"certname": "foo", "expired": nil},
+	}
+	notFound := nodeLookup{name: "foo", status: nodeNotFound}
+
+	tests := []struct {
+		name      string
+		condition string
+		lookup    nodeLookup
+		want      bool
+		wantErr   bool
+	}{
+		{
+			name:      "expired node with enough occurrences",
+			condition: `node.expired != null && event.check.occurrences > 3`,
+			lookup:    expired,
+			want:      true,
+		},
+		{
+			name:      "active node",
+			condition: `node.expired != null && event.check.occurrences > 3`,
+			lookup:    active,
+			want:      false,
+		},
+		{
+			name:      "missing node",
+			condition: `node == null && status == "not-found"`,
+			lookup:    notFound,
+			want:      true,
+		},
+		{
+			name:      "entity fields",
+			condition: `event.entity.metadata.namespace == "default"`,
+			lookup:    notFound,
+			want:      true,
+		},
+		{
+			name:      "non boolean result",
+			condition: `event.check.occurrences`,
+			lookup:    notFound,
+			wantErr:   true,
+		},
+		{
+			name:      "syntax error",
+			condition: `node.expired !=`,
+			lookup:    notFound,
+			wantErr:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler.condition = tt.condition
+			got, err := evaluateCondition(event, tt.lookup)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("evaluateCondition() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if got != tt.want {
+				t.Errorf("evaluateCondition() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	corev2 "github.com/sensu/core/v2"
+	"github.com/sensu/sensu-plugin-sdk/sensu"
+	"github.com/spf13/viper"
+)
+
+const secretMask = "********"
+
+// optionValue is the effective value of an option along with its origin
+type optionValue struct {
+	name   string
+	value  string
+	origin string
+}
+
+// optionInfo describes a configuration option and its current value
+type optionInfo struct {
+	name, short, env, path, value string
+	secret                        bool
+}
+
+// describeOption returns the description of an option, and false if the
+// option type is not supported
+func describeOption(opt sensu.ConfigOption) (optionInfo, bool) {
+	if guard, ok := opt.(*annotationGuard); ok {
+		opt = guard.ConfigOption
+	}
+	switch o := opt.(type) {
+	case *sensu.PluginConfigOption[string]:
+		return optionInfo{o.Argument, o.Shorthand, o.Env, o.Path, *o.Value, o.Secret}, true
+	case *sensu.PluginConfigOption[bool]:
+		return optionInfo{o.Argument, o.Shorthand, o.Env, o.Path, fmt.Sprint(*o.Value), o.Secret}, true
+	case *sensu.PluginConfigOption[int]:
+		return optionInfo{o.Argument, o.Shorthand, o.Env, o.Path, fmt.Sprint(*o.Value), o.Secret}, true
+	case *sensu.SlicePluginConfigOption[string]:
+		return optionInfo{o.Argument, o.Shorthand, o.Env, o.Path, strings.Join(*o.Value, ","), o.Secret}, true
+	case *sensu.MapPluginConfigOption[int]:
+		return optionInfo{o.Argument, o.Shorthand, o.Env, o.Path, formatMap(*o.Value), o.Secret}, true
+	case *sensu.MapPluginConfigOption[string]:
+		return optionInfo{o.Argument, o.Shorthand, o.Env, o.Path, formatMap(*o.Value), o.Secret}, true
+	}
+	return optionInfo{}, false
+}
+
+// effectiveConfig returns the effective value of every option, sorted by
+// name, with the values of secret options masked
+func effectiveConfig(event *corev2.Event) []optionValue {
+	var values []optionValue
+	for _, opt := range options {
+		info, ok := describeOption(opt)
+		if !ok {
+			continue
+		}
+		value := info.value
+		if info.secret && value != "" {
+			value = secretMask
+		}
+		if !annotationAllowed(info.path) {
+			info.path = ""
+		}
+		values = append(values, optionValue{
+			name:   info.name,
+			value:  value,
+			origin: optionOrigin(event, info.name, info.short, info.env, info.path),
+		})
+	}
+
+	sort.Slice(values, func(i, j int) bool {
+		return values[i].name < values[j].name
+	})
+	return values
+}
+
+// optionOrigin returns where the value of an option comes from, following the
+// precedence of the plugin SDK: annotations, flags, environment and defaults
+func optionOrigin(event *corev2.Event, name, short, env, annotationPath string) string {
+	if event != nil && annotationPath != "" {
+		key := path.Join(handler.Keyspace, annotationPath)
+		if event.Check != nil {
+			if _, ok := event.Check.Annotations[key]; ok {
+				return "check annotation"
+			}
+		}
+		if event.Entity != nil {
+			if _, ok := event.Entity.Annotations[key]; ok {
+				return "entity annotation"
+			}
+		}
+	}
+	for _, arg := range os.Args[1:] {
+		if arg == "--"+name || strings.HasPrefix(arg, "--"+name+"=") {
+			return "flag"
+		}
+		if short != "" && (arg == "-"+short || strings.HasPrefix(arg, "-"+short+"=")) {
+			return "flag"
+		}
+	}
+	if _, ok := os.LookupEnv(env); ok && env != "" {
+		return "env"
+	}
+	if viper.InConfig(name) {
+		return "config file"
+	}
+	return "default"
+}
+
+func formatMap[T int | string](m map[string]T) string {
+	pairs := make([]string, 0, len(m))
+	for k, v := range m {
+		pairs = append(pairs, fmt.Sprintf("%s=%v", k, v))
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+// printConfig prints the effective configuration. When an event is passed on
+// stdin, its annotations overrides are taken into account.
+func printConfig(event *corev2.Event) (int, error) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "OPTION\tVALUE\tORIGIN")
+	for _, v := range effectiveConfig(event) {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", v.name, v.value, v.origin)
+	}
+	if err := w.Flush(); err != nil {
+		return sensu.CheckStateUnknown, err
+	}
+	return sensu.CheckStateOK, nil
+}
+
+// stdinIsPipe returns whether stdin is redirected rather than a terminal
+func stdinIsPipe() bool {
+	info, err := os.Stdin.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice == 0
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"testing"
+
+	corev2 "github.com/sensu/core/v2"
+)
+
+func Test_effectiveConfig(t *testing.T) {
+	saveHandler(t)
+	t.Setenv("SENSU_API_KEY", "xxxxxxxxxx")
+	handler.Keyspace = "sensu.io/plugins/sensu-puppet-handler/config"
+	handler.annotationAllow, handler.annotationDeny = nil, nil
+	handler.sensuAPIKey = "xxxxxxxxxx"
+	handler.action = actionTombstone
+	handler.puppetNodeName = ""
+
+	event := corev2.FixtureEvent("foo", "keepalive")
+	event.Check.Annotations = map[string]string{
+		"sensu.io/plugins/sensu-puppet-handler/config/action": actionTombstone,
+	}
+
+	values := make(map[string]optionValue)
+	for _, v := range effectiveConfig(event) {
+		values[v.name] = v
+	}
+
+	if got := values["sensu-api-key"]; got.value != secretMask || got.origin != "env" {
+		t.Errorf("effectiveConfig() sensu-api-key = %q (%s), want %q (env)", got.value, got.origin, secretMask)
+	}
+	if got := values["action"]; got.value != actionTombstone || got.origin != "check annotation" {
+		t.Errorf("effectiveConfig() action = %q (%s), want %q (check annotation)", got.value, got.origin, actionTombstone)
+	}
+	if got := values["node-name"]; got.value != "" || got.origin != "default" {
+		t.Errorf("effectiveConfig() node-name = %q (%s), want empty (default)", got.value, got.origin)
+	}
+}
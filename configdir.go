@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// configDirOption is the option naming the configuration directory, which is
+// read before the SDK parses the flags
+const configDirOption = "config-dir"
+
+// loadConfigDir merges the YAML fragments of the configuration directory, in
+// lexical order, into the configuration the SDK reads the option defaults
+// from. Later fragments override earlier ones, so that base, per-environment
+// and per-site fragments can be layered, and the environment and flags
+// override them all.
+func loadConfigDir() error {
+	dir := earlyOptionValue(configDirOption)
+	if dir == "" {
+		return nil
+	}
+	files, err := configFragments(dir)
+	if err != nil {
+		return err
+	}
+
+	known := make(map[string]bool)
+	for _, opt := range options {
+		if info, ok := describeOption(opt); ok && info.name != configDirOption {
+			known[info.name] = true
+		}
+	}
+	for _, file := range files {
+		fragment := viper.New()
+		fragment.SetConfigFile(file)
+		fragment.SetConfigType("yaml")
+		if err := fragment.ReadInConfig(); err != nil {
+			return fmt.Errorf("could not read %s: %s", file, err)
+		}
+		settings := fragment.AllSettings()
+		for name := range settings {
+			if !known[name] {
+				return fmt.Errorf("unknown option %q in %s", name, file)
+			}
+		}
+		if err := viper.MergeConfigMap(settings); err != nil {
+			return fmt.Errorf("could not merge %s: %s", file, err)
+		}
+	}
+	return nil
+}
+
+// configFragments returns the YAML files of the directory in lexical order
+func configFragments(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, entry := range entries {
+		ext := filepath.Ext(entry.Name())
+		if entry.IsDir() || (ext != ".yaml" && ext != ".yml") {
+			continue
+		}
+		files = append(files, filepath.Join(dir, entry.Name()))
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// earlyOptionValue returns the value of the named option set on the command
+// line or in the environment, for the options needed before the SDK parses
+// them
+func earlyOptionValue(name string) string {
+	args := os.Args[1:]
+	for i := len(args) - 1; i >= 0; i-- {
+		if value := strings.TrimPrefix(args[i], "--"+name+"="); value != args[i] {
+			return value
+		}
+		if args[i] == "--"+name && i+1 < len(args) {
+			return args[i+1]
+		}
+	}
+	for _, opt := range options {
+		if info, ok := describeOption(opt); ok && info.name == name && info.env != "" {
+			return os.Getenv(info.env)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func Test_loadConfigDir(t *testing.T) {
+	dir := t.TempDir()
+	fragments := map[string]string{
+		"00-base.yaml":       "action: tombstone\ntrigger-checks: [keepalive]\n",
+		"10-production.yaml": "trigger-checks: [keepalive, puppet]\n",
+		"20-site.yml":        "action: delete\n",
+		"README":             "not a fragment",
+	}
+	for name, content := range fragments {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	savedArgs := os.Args
+	defer func() {
+		os.Args = savedArgs
+		viper.Reset()
+	}()
+	os.Args = []string{"sensu-puppet-handler", "--config-dir", dir}
+	if err := loadConfigDir(); err != nil {
+		t.Fatal(err)
+	}
+	if got := viper.GetString("action"); got != "delete" {
+		t.Errorf("action = %q, want %q", got, "delete")
+	}
+	if got := strings.Join(viper.GetStringSlice("trigger-checks"), ","); got != "keepalive,puppet" {
+		t.Errorf("trigger-checks = %q, want %q", got, "keepalive,puppet")
+	}
+	if got := optionOrigin(nil, "action", "", "PUPPET_ACTION", ""); got != "config file" {
+		t.Errorf("optionOrigin() = %q, want %q", got, "config file")
+	}
+
+	// Unknown options are rejected rather than silently ignored
+	if err := os.WriteFile(filepath.Join(dir, "30-typo.yaml"), []byte("acton: delete\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	os.Args = []string{"sensu-puppet-handler", "--config-dir=" + dir}
+	if err := loadConfigDir(); err == nil || !strings.Contains(err.Error(), `unknown option "acton"`) {
+		t.Errorf("loadConfigDir() error = %v, want unknown option", err)
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/sensu/sensu-puppet-handler/puppet"
+)
+
+var (
+	// stdinIsTerminal returns whether an operator runs the subcommand from a
+	// terminal, replaced in tests
+	stdinIsTerminal = func() bool {
+		info, err := os.Stdin.Stat()
+		return err == nil && info.Mode()&os.ModeCharDevice != 0
+	}
+
+	// confirmInput and confirmOutput are the streams of the confirmation
+	// prompt, which stays out of the check output on the standard output
+	confirmInput  io.Reader = os.Stdin
+	confirmOutput io.Writer = os.Stderr
+)
+
+// confirmDeactivation lists the nodes the cleanup subcommand is about to
+// deactivate and asks the operator to type yes when run from a terminal
+// without --yes, so that a mistyped threshold does not deactivate the fleet.
+// Without a terminal nothing can confirm, the runs from cron or a Sensu check
+// are refused unless --yes is set.
+func confirmDeactivation(nodes []puppet.UnreportedNode) (bool, error) {
+	if handler.yes || len(nodes) == 0 {
+		return true, nil
+	}
+	if !stdinIsTerminal() {
+		return false, nil
+	}
+	var b strings.Builder
+	for _, node := range nodes {
+		fmt.Fprintf(&b, "  %s\tunreported since %s\n", node.Certname, node.ReportTimestamp.Format(time.RFC3339))
+	}
+	fmt.Fprintf(&b, "Deactivate these %d Puppet nodes? Type yes to confirm: ", len(nodes))
+	if _, err := io.WriteString(confirmOutput, b.String()); err != nil {
+		return false, err
+	}
+	answer, err := bufio.NewReader(confirmInput).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return false, err
+	}
+	return strings.TrimSpace(answer) == "yes", nil
+}
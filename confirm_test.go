@@ -0,0 +1,63 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sensu/sensu-puppet-handler/puppet"
+)
+
+func Test_confirmDeactivation(t *testing.T) {
+	savedTerminal, savedInput, savedOutput := stdinIsTerminal, confirmInput, confirmOutput
+	defer func() { stdinIsTerminal, confirmInput, confirmOutput = savedTerminal, savedInput, savedOutput }()
+
+	nodes := []puppet.UnreportedNode{
+		{Certname: "web01", ReportTimestamp: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{Certname: "db01", ReportTimestamp: time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)},
+	}
+	tests := []struct {
+		name       string
+		yes        bool
+		terminal   bool
+		nodes      []puppet.UnreportedNode
+		answer     string
+		want       bool
+		wantPrompt bool
+	}{
+		{name: "confirmed", terminal: true, nodes: nodes, answer: "yes\n", want: true, wantPrompt: true},
+		{name: "declined", terminal: true, nodes: nodes, answer: "y\n", wantPrompt: true},
+		{name: "no answer", terminal: true, nodes: nodes, wantPrompt: true},
+		{name: "yes option", yes: true, terminal: true, nodes: nodes, want: true},
+		{name: "no terminal", nodes: nodes},
+		{name: "no nodes", terminal: true, want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			saveHandler(t)
+			handler.yes = tt.yes
+			stdinIsTerminal = func() bool { return tt.terminal }
+			confirmInput = strings.NewReader(tt.answer)
+			var prompt strings.Builder
+			confirmOutput = &prompt
+
+			got, err := confirmDeactivation(tt.nodes)
+			if err != nil {
+				t.Fatalf("confirmDeactivation() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("confirmDeactivation() = %t, want %t", got, tt.want)
+			}
+			if tt.wantPrompt {
+				want := "  web01\tunreported since 2024-01-01T00:00:00Z\n" +
+					"  db01\tunreported since 2024-02-01T00:00:00Z\n" +
+					"Deactivate these 2 Puppet nodes? Type yes to confirm: "
+				if prompt.String() != want {
+					t.Errorf("confirmDeactivation() prompt = %q, want %q", prompt.String(), want)
+				}
+			} else if prompt.Len() > 0 {
+				t.Errorf("confirmDeactivation() prompted %q, want no prompt", prompt.String())
+			}
+		})
+	}
+}
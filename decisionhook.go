@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os/exec"
+	"strings"
+
+	corev2 "github.com/sensu/core/v2"
+)
+
+// Decisions of the decision hook
+const (
+	decisionKeep       = "keep"
+	decisionDeregister = "deregister"
+	decisionSilence    = "silence"
+)
+
+// decisionHookInput is written to the stdin of the decision hook
+type decisionHookInput struct {
+	Event      *corev2.Event          `json:"event"`
+	Node       map[string]interface{} `json:"node"`
+	NodeName   string                 `json:"node_name"`
+	Status     string                 `json:"status"`
+	Deregister bool                   `json:"deregister"`
+}
+
+// decisionHookOutput is the JSON form of the decision hook output
+type decisionHookOutput struct {
+	Decision string `json:"decision"`
+	Reason   string `json:"reason"`
+}
+
+// hookDecision runs the decision hook with the event and the inventory lookup,
+// and returns whether the entity is kept, deregistered or silenced. The hook
+// decides by printing the decision, either alone or as the decision field of
+// a JSON object, or when it prints nothing by its exit status: 0 to
+// deregister, 1 to keep and 2 to silence the entity.
+func hookDecision(event *corev2.Event, lookup nodeLookup, deregister bool) (string, error) {
+	stdout, err := runCommand(handler.decisionHook, nil, decisionHookInput{
+		Event:      event,
+		Node:       lookup.record,
+		NodeName:   lookup.name,
+		Status:     lookup.status,
+		Deregister: deregister,
+	})
+	exitCode := 0
+	if err != nil {
+		var exitErr *exec.ExitError
+		if !errors.As(err, &exitErr) {
+			return "", err
+		}
+		exitCode = exitErr.ExitCode()
+	}
+
+	output := strings.TrimSpace(string(stdout))
+	if output == "" || exitCode != 0 {
+		switch exitCode {
+		case 0:
+			return decisionDeregister, nil
+		case 1:
+			return decisionKeep, nil
+		case 2:
+			return decisionSilence, nil
+		}
+		return "", err
+	}
+
+	var decision decisionHookOutput
+	if strings.HasPrefix(output, "{") {
+		if err := json.Unmarshal([]byte(output), &decision); err != nil {
+			return "", fmt.Errorf("the decision hook returned an invalid decision: %s", err)
+		}
+	} else {
+		decision.Decision = output
+	}
+	switch decision.Decision {
+	case decisionKeep, decisionDeregister, decisionSilence:
+	default:
+		return "", fmt.Errorf("the decision hook returned an unknown decision %q", decision.Decision)
+	}
+	if decision.Reason != "" {
+		log.Printf("decision hook: %s", decision.Reason)
+	}
+	return decision.Decision, nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	corev2 "github.com/sensu/core/v2"
+)
+
+func Test_hookDecision(t *testing.T) {
+	tests := []struct {
+		name    string
+		script  string
+		want    string
+		wantErr bool
+	}{
+		{
+			name:   "printed decision",
+			script: "echo keep",
+			want:   decisionKeep,
+		},
+		{
+			name:   "JSON decision",
+			script: `echo '{"decision": "silence", "reason": "host in maintenance"}'`,
+			want:   decisionSilence,
+		},
+		{
+			name:   "decision from the input",
+			script: `grep -q '"deregister":true' && echo deregister || echo keep`,
+			want:   decisionDeregister,
+		},
+		{
+			name:   "exit status 0",
+			script: "exit 0",
+			want:   decisionDeregister,
+		},
+		{
+			name:   "exit status 1",
+			script: "exit 1",
+			want:   decisionKeep,
+		},
+		{
+			name:   "exit status 2",
+			script: "exit 2",
+			want:   decisionSilence,
+		},
+		{
+			name:    "other exit status",
+			script:  "echo boom >&2; exit 3",
+			wantErr: true,
+		},
+		{
+			name:    "unknown decision",
+			script:  "echo delete",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hook := filepath.Join(t.TempDir(), "decide")
+			if err := os.WriteFile(hook, []byte("#!/bin/sh\n"+tt.script+"\n"), 0700); err != nil {
+				t.Fatal(err)
+			}
+			setHandler(t, Handler{decisionHook: hook})
+
+			lookup := nodeLookup{name: "web01", status: nodeNotFound}
+			got, err := hookDecision(corev2.FixtureEvent("web01", "keepalive"), lookup, true)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("hookDecision() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("hookDecision() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const (
+	schemeSRV    = "srv"
+	schemeConsul = "consul"
+
+	defaultConsulAddr = "http://127.0.0.1:8500"
+)
+
+// lookupSRV resolves DNS SRV records with the DNS resolver, replaced in tests
+var lookupSRV = func(ctx context.Context, name string) ([]*net.SRV, error) {
+	ctx, cancel := dnsLookupContext(ctx)
+	defer cancel()
+	_, addrs, err := dnsResolver().LookupSRV(ctx, "", "", name)
+	return addrs, err
+}
+
+// resolveEndpoint resolves the service discovery URLs to the URL of a live
+// instance, so that the configuration does not need updating when the
+// services move:
+//
+//   - srv://_puppetdb._tcp.example.com picks the target of the DNS SRV
+//     records with the best priority
+//   - consul://puppetdb picks an instance of the Consul service whose health
+//     checks are passing
+//
+// The instances are reached with https, or http with the srv+http and
+// consul+http schemes, and the path of the discovery URL is kept. Other URLs
+// are returned unchanged.
+func resolveEndpoint(endpoint string) (string, error) {
+	scheme, rest, ok := strings.Cut(endpoint, "://")
+	if !ok {
+		return endpoint, nil
+	}
+	discovery, instanceScheme, _ := strings.Cut(scheme, "+")
+	if discovery != schemeSRV && discovery != schemeConsul {
+		return endpoint, nil
+	}
+	if instanceScheme == "" {
+		instanceScheme = "https"
+	}
+	if instanceScheme != "http" && instanceScheme != "https" {
+		return "", fmt.Errorf("unsupported scheme %q", scheme)
+	}
+	name, path := rest, ""
+	if i := strings.Index(rest, "/"); i >= 0 {
+		name, path = rest[:i], rest[i:]
+	}
+	if name == "" {
+		return "", errors.New("missing service name")
+	}
+
+	var (
+		host string
+		err  error
+	)
+	if discovery == schemeSRV {
+		host, err = resolveSRV(name)
+	} else {
+		host, err = resolveConsul(name)
+	}
+	if err != nil {
+		return "", err
+	}
+	resolved := fmt.Sprintf("%s://%s%s", instanceScheme, host, path)
+	log.Printf("resolved %s to %s", endpoint, resolved)
+	return resolved, nil
+}
+
+// resolveSRV returns the host and port of the first target of the SRV
+// records, which are ordered by priority and randomized by weight
+func resolveSRV(name string) (string, error) {
+	addrs, err := lookupSRV(executionCtx, name)
+	if err != nil {
+		return "", fmt.Errorf("could not resolve the SRV records of %s: %s", name, err)
+	}
+	for _, addr := range addrs {
+		// A "." target means the service is decidedly not available
+		if target := strings.TrimSuffix(addr.Target, "."); target != "" {
+			return net.JoinHostPort(target, strconv.Itoa(int(addr.Port))), nil
+		}
+	}
+	return "", fmt.Errorf("no SRV records for %s", name)
+}
+
+// consulServiceEntry is an entry of the Consul health API response
+type consulServiceEntry struct {
+	Node struct {
+		Address string `json:"Address"`
+	} `json:"Node"`
+	Service struct {
+		Address string `json:"Address"`
+		Port    int    `json:"Port"`
+	} `json:"Service"`
+}
+
+// resolveConsul returns the host and port of the first passing instance of
+// the Consul service
+func resolveConsul(service string) (string, error) {
+	endpoint := fmt.Sprintf("%s/v1/health/service/%s?passing=true", strings.TrimRight(handler.consulAddr, "/"), url.PathEscape(service))
+	req, err := http.NewRequestWithContext(executionCtx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return "", err
+	}
+	if handler.consulToken != "" {
+		req.Header.Set("X-Consul-Token", handler.consulToken)
+	}
+
+	client := &http.Client{Transport: limitedTransport(withConnectionTrace(nil)), Timeout: requestTimeout()}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("could not query Consul: %s", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected HTTP status %s while querying Consul", http.StatusText(resp.StatusCode))
+	}
+	var entries []consulServiceEntry
+	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		return "", fmt.Errorf("Consul returned an invalid response: %s", err)
+	}
+	for _, entry := range entries {
+		// The service address defaults to the node address when not set
+		address := entry.Service.Address
+		if address == "" {
+			address = entry.Node.Address
+		}
+		if address != "" && entry.Service.Port > 0 {
+			return net.JoinHostPort(address, strconv.Itoa(entry.Service.Port)), nil
+		}
+	}
+	return "", fmt.Errorf("no passing instance of the Consul service %s", service)
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func Test_resolveEndpoint(t *testing.T) {
+	consul := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/health/service/puppetdb" || r.URL.Query().Get("passing") != "true" {
+			t.Errorf("unexpected Consul query %s", r.URL)
+		}
+		if r.Header.Get("X-Consul-Token") != "token" {
+			t.Errorf("missing Consul token")
+		}
+		_, _ = w.Write([]byte(`[{"Node":{"Address":"10.0.0.2"},"Service":{"Address":"","Port":8081}}]`))
+	}))
+	defer consul.Close()
+
+	saveHandler(t)
+	savedLookup := lookupSRV
+	defer func() { lookupSRV = savedLookup }()
+	lookupSRV = func(_ context.Context, name string) ([]*net.SRV, error) {
+		if name != "_puppetdb._tcp.example.com" {
+			return nil, errors.New("no such host")
+		}
+		return []*net.SRV{{Target: "puppetdb2.example.com.", Port: 8081, Priority: 10}}, nil
+	}
+	handler.consulAddr = consul.URL
+	handler.consulToken = "token"
+
+	tests := []struct {
+		endpoint string
+		want     string
+		wantErr  bool
+	}{
+		{endpoint: "https://puppetdb:8081", want: "https://puppetdb:8081"},
+		{endpoint: "puppetdb:8081", want: "puppetdb:8081"},
+		{endpoint: "srv://_puppetdb._tcp.example.com", want: "https://puppetdb2.example.com:8081"},
+		{endpoint: "srv+http://_puppetdb._tcp.example.com/pdb/query/v4/nodes", want: "http://puppetdb2.example.com:8081/pdb/query/v4/nodes"},
+		{endpoint: "srv://_missing._tcp.example.com", wantErr: true},
+		{endpoint: "consul://puppetdb", want: "https://10.0.0.2:8081"},
+		{endpoint: "srv+ftp://_puppetdb._tcp.example.com", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.endpoint, func(t *testing.T) {
+			got, err := resolveEndpoint(tt.endpoint)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("resolveEndpoint() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("resolveEndpoint() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
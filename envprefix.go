@@ -0,0 +1,54 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/sensu/sensu-plugin-sdk/sensu"
+)
+
+// envPrefixOption is the option replacing the environment variable names of
+// the other options, which is read before the SDK parses them
+const envPrefixOption = "env-prefix"
+
+// applyEnvPrefix renames the environment variables of the options after the
+// configured prefix and their argument, e.g. SPH_SENSU_API_URL for the
+// sensu-api-url option with the SPH_ prefix, so that the handler does not
+// read the generic variables other plugins of the agent environment use
+func applyEnvPrefix() {
+	prefix := earlyOptionValue(envPrefixOption)
+	if prefix == "" {
+		return
+	}
+	for _, opt := range options {
+		if guard, ok := opt.(*annotationGuard); ok {
+			opt = guard.ConfigOption
+		}
+		info, ok := describeOption(opt)
+		if !ok || info.name == "" || info.name == envPrefixOption {
+			continue
+		}
+		setOptionEnv(opt, prefixedEnv(prefix, info.name))
+	}
+}
+
+func prefixedEnv(prefix, argument string) string {
+	return prefix + strings.ToUpper(strings.ReplaceAll(argument, "-", "_"))
+}
+
+// setOptionEnv sets the environment variable of an option
+func setOptionEnv(opt sensu.ConfigOption, env string) {
+	switch o := opt.(type) {
+	case *sensu.PluginConfigOption[string]:
+		o.Env = env
+	case *sensu.PluginConfigOption[bool]:
+		o.Env = env
+	case *sensu.PluginConfigOption[int]:
+		o.Env = env
+	case *sensu.SlicePluginConfigOption[string]:
+		o.Env = env
+	case *sensu.MapPluginConfigOption[int]:
+		o.Env = env
+	case *sensu.MapPluginConfigOption[string]:
+		o.Env = env
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+func Test_applyEnvPrefix(t *testing.T) {
+	saved := make(map[string]string)
+	for _, opt := range options {
+		if info, ok := describeOption(opt); ok {
+			saved[info.name] = info.env
+		}
+	}
+	savedArgs := os.Args
+	defer func() {
+		os.Args = savedArgs
+		for _, opt := range options {
+			if guard, ok := opt.(*annotationGuard); ok {
+				opt = guard.ConfigOption
+			}
+			if info, ok := describeOption(opt); ok {
+				setOptionEnv(opt, saved[info.name])
+			}
+		}
+	}()
+
+	os.Args = []string{"sensu-puppet-handler", "--env-prefix=SPH_"}
+	applyEnvPrefix()
+	want := map[string]string{
+		"endpoint":      "SPH_ENDPOINT",
+		"ca-cert":       "SPH_CA_CERT",
+		"sensu-ca-cert": "SPH_SENSU_CA_CERT",
+		"sensu-api-url": "SPH_SENSU_API_URL",
+		"env-prefix":    "PUPPET_ENV_PREFIX",
+	}
+	for _, opt := range options {
+		info, ok := describeOption(opt)
+		if !ok {
+			continue
+		}
+		if env, ok := want[info.name]; ok && info.env != env {
+			t.Errorf("%s environment variable = %q, want %q", info.name, info.env, env)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+
+	corev2 "github.com/sensu/core/v2"
+)
+
+const sourceExec = "exec"
+
+// execRequest is written to the stdin of the inventory command
+type execRequest struct {
+	Name  string        `json:"name"`
+	Event *corev2.Event `json:"event"`
+}
+
+// execResponse is read from the stdout of the inventory command
+type execResponse struct {
+	Exists bool                   `json:"exists"`
+	Status string                 `json:"status,omitempty"`
+	Record map[string]interface{} `json:"record,omitempty"`
+}
+
+// lookupExec returns the lookup function running the inventory command for
+// each node name. The command is given the node name and the event as JSON on
+// stdin, and answers with whether the node exists on stdout, so that custom
+// sources of truth are consulted without forking the handler.
+func lookupExec(event *corev2.Event) func(name string) (nodeLookup, error) {
+	return func(name string) (nodeLookup, error) {
+		lookup := nodeLookup{name: name}
+
+		stdout, err := runCommand(handler.execCommand, handler.execArgs, execRequest{Name: name, Event: event})
+		if err != nil {
+			return lookup, fmt.Errorf("inventory command failed: %s", err)
+		}
+
+		var response execResponse
+		if err := json.Unmarshal(stdout, &response); err != nil {
+			return lookup, fmt.Errorf("inventory command returned invalid response: %s", err)
+		}
+		switch {
+		case response.Exists:
+			lookup.status = nodeActive
+		case response.Status != "" && response.Status != nodeActive:
+			lookup.status = response.Status
+		default:
+			lookup.status = nodeNotFound
+		}
+		lookup.record = response.Record
+		log.Printf("node %q is %s according to the inventory command", name, lookup.status)
+		return lookup, nil
+	}
+}
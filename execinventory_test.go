@@ -0,0 +1,59 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	corev2 "github.com/sensu/core/v2"
+)
+
+func Test_lookupExec(t *testing.T) {
+	// The script answers according to the node name it reads on stdin
+	script := filepath.Join(t.TempDir(), "inventory")
+	content := `#!/bin/sh
+request=$(cat)
+case "$request" in
+*'"name":"web01"'*'"namespace":"default"'*) echo '{"exists": true, "record": {"owner": "web"}}' ;;
+*'"name":"old01"'*) echo '{"exists": false, "status": "decommissioned"}' ;;
+*'"name":"gone01"'*) echo '{"exists": false}' ;;
+*'"name":"bad01"'*) echo 'not json' ;;
+*) echo "unexpected request $request" >&2; exit 2 ;;
+esac
+`
+	if err := os.WriteFile(script, []byte(content), 0700); err != nil {
+		t.Fatal(err)
+	}
+	setHandler(t, Handler{execCommand: script})
+
+	tests := []struct {
+		name       string
+		wantStatus string
+		wantErr    string
+	}{
+		{name: "web01", wantStatus: nodeActive},
+		{name: "old01", wantStatus: "decommissioned"},
+		{name: "gone01", wantStatus: nodeNotFound},
+		{name: "bad01", wantErr: "invalid response"},
+		{name: "other", wantErr: "exit status 2: unexpected request"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			event := corev2.FixtureEvent(tt.name, "keepalive")
+			lookup, err := lookupExec(event)(tt.name)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("lookupExec() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("lookupExec() error = %v", err)
+			}
+			if lookup.status != tt.wantStatus {
+				t.Errorf("lookupExec() status = %v, want %v", lookup.status, tt.wantStatus)
+			}
+		})
+	}
+}
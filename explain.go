@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+
+	corev2 "github.com/sensu/core/v2"
+)
+
+// explainStep is a rule evaluated while processing the event
+type explainStep struct {
+	rule   string
+	result string
+}
+
+// explanation records the rules evaluated while processing the event, in
+// order, and which one determined the outcome. The bulk subcommands record
+// the rules from several workers, hence the lock.
+var explanation struct {
+	mu    sync.Mutex
+	steps []explainStep
+	// decidedBy is the number of the step which determined the outcome, or
+	// zero if none did, like when the processing failed
+	decidedBy int
+}
+
+// explainRule records a rule which was evaluated without determining the
+// outcome
+func explainRule(rule, format string, args ...interface{}) {
+	explanation.mu.Lock()
+	defer explanation.mu.Unlock()
+	explanation.steps = append(explanation.steps, explainStep{rule: rule, result: fmt.Sprintf(format, args...)})
+}
+
+// explainDecision records the rule which determined the outcome, replacing
+// any rule recorded as such before since later rules override earlier ones
+func explainDecision(rule, format string, args ...interface{}) {
+	step := explainStep{rule: rule, result: fmt.Sprintf(format, args...)}
+	explanation.mu.Lock()
+	defer explanation.mu.Unlock()
+	explanation.steps = append(explanation.steps, step)
+	explanation.decidedBy = len(explanation.steps)
+}
+
+// logExplanation logs the rules evaluated for the event when --explain is set
+func logExplanation(event *corev2.Event) {
+	if !handler.explain {
+		return
+	}
+	log.Printf("explain: rules evaluated for entity (%s/%s):", event.Entity.Namespace, event.Entity.Name)
+	for i, step := range explanation.steps {
+		mark := ""
+		if i+1 == explanation.decidedBy {
+			mark = " <- determined the outcome"
+		}
+		log.Printf("explain: %d. %s: %s%s", i+1, step.rule, step.result, mark)
+	}
+	if explanation.decidedBy == 0 {
+		log.Print("explain: no rule determined the outcome")
+	}
+}
+
+// deregisterVerb describes whether the entity is deregistered
+func deregisterVerb(deregister bool) string {
+	if deregister {
+		return "deregister the entity"
+	}
+	return "keep the entity"
+}
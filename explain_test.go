@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	corev2 "github.com/sensu/core/v2"
+)
+
+func Test_explanation(t *testing.T) {
+	savedOutput := log.Writer()
+	defer func() {
+		explanation.steps, explanation.decidedBy = nil, 0
+		log.SetOutput(savedOutput)
+	}()
+	protected := filepath.Join(t.TempDir(), "protected")
+	if err := os.WriteFile(protected, []byte("foo\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	setHandler(t, Handler{triggerChecks: []string{"keepalive"}, protectedNodesFile: protected, explain: true})
+
+	tests := []struct {
+		name  string
+		check string
+		want  []string
+	}{
+		{
+			name:  "not a trigger check",
+			check: "check-cpu",
+			want: []string{
+				`explain: 1. trigger check: "check-cpu" is not a trigger check, ignoring the event <- determined the outcome`,
+			},
+		},
+		{
+			name:  "protected node",
+			check: "keepalive",
+			want: []string{
+				`explain: 1. trigger check: "keepalive" is a trigger check`,
+				`explain: 2. protected nodes: the node is protected by "foo", ignoring the event <- determined the outcome`,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			explanation.steps, explanation.decidedBy = nil, 0
+			event := corev2.FixtureEvent("foo", tt.check)
+			if err := processEvent(event); err != nil {
+				t.Fatalf("processEvent() error = %v", err)
+			}
+
+			var out bytes.Buffer
+			log.SetOutput(&out)
+			logExplanation(event)
+			log.SetOutput(savedOutput)
+			for _, want := range tt.want {
+				if !strings.Contains(out.String(), want) {
+					t.Errorf("explanation %q does not contain %q", out.String(), want)
+				}
+			}
+		})
+	}
+
+	explanation.steps, explanation.decidedBy = nil, 0
+	var out bytes.Buffer
+	log.SetOutput(&out)
+	logExplanation(corev2.FixtureEvent("foo", "keepalive"))
+	if !strings.Contains(out.String(), "no rule determined the outcome") {
+		t.Errorf("explanation without decision = %q", out.String())
+	}
+}
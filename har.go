@@ -0,0 +1,335 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+)
+
+// harHeaders are the headers whose values are masked in the HAR file
+var harHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie", "X-Consul-Token"}
+
+// harFields are the fields of the JSON and form bodies whose values are masked
+// in the HAR file, such as the tokens returned by the authentication APIs
+var harFields = []string{"access_token", "refresh_token", "id_token", "client_secret", "password", "token"}
+
+// harRecorder accumulates the HTTP exchanges of the execution
+type harRecorder struct {
+	mu      sync.Mutex
+	entries []*harEntry
+}
+
+// har records the HTTP exchanges of the execution when --har-file is set
+var har harRecorder
+
+// HAR 1.2 format, see http://www.softwareishard.com/blog/har-12-spec/
+type (
+	harFile struct {
+		Log harLog `json:"log"`
+	}
+	harLog struct {
+		Version string      `json:"version"`
+		Creator harCreator  `json:"creator"`
+		Entries []*harEntry `json:"entries"`
+	}
+	harCreator struct {
+		Name    string `json:"name"`
+		Version string `json:"version"`
+	}
+	harEntry struct {
+		StartedDateTime string      `json:"startedDateTime"`
+		Time            float64     `json:"time"`
+		Request         harRequest  `json:"request"`
+		Response        harResponse `json:"response"`
+		Cache           struct{}    `json:"cache"`
+		Timings         harTimings  `json:"timings"`
+		Error           string      `json:"_error,omitempty"`
+
+		started time.Time
+	}
+	harRequest struct {
+		Method      string         `json:"method"`
+		URL         string         `json:"url"`
+		HTTPVersion string         `json:"httpVersion"`
+		Cookies     []harNameValue `json:"cookies"`
+		Headers     []harNameValue `json:"headers"`
+		QueryString []harNameValue `json:"queryString"`
+		PostData    *harPostData   `json:"postData,omitempty"`
+		HeadersSize int            `json:"headersSize"`
+		BodySize    int            `json:"bodySize"`
+	}
+	harResponse struct {
+		Status      int            `json:"status"`
+		StatusText  string         `json:"statusText"`
+		HTTPVersion string         `json:"httpVersion"`
+		Cookies     []harNameValue `json:"cookies"`
+		Headers     []harNameValue `json:"headers"`
+		Content     harContent     `json:"content"`
+		RedirectURL string         `json:"redirectURL"`
+		HeadersSize int            `json:"headersSize"`
+		BodySize    int            `json:"bodySize"`
+	}
+	harNameValue struct {
+		Name  string `json:"name"`
+		Value string `json:"value"`
+	}
+	harPostData struct {
+		MimeType string `json:"mimeType"`
+		Text     string `json:"text"`
+	}
+	harContent struct {
+		Size     int    `json:"size"`
+		MimeType string `json:"mimeType"`
+		Text     string `json:"text,omitempty"`
+	}
+	harTimings struct {
+		Send    float64 `json:"send"`
+		Wait    float64 `json:"wait"`
+		Receive float64 `json:"receive"`
+	}
+)
+
+// harTransport records the exchanges sent through it
+type harTransport struct {
+	base http.RoundTripper
+}
+
+// withHARCapture wraps the transport to record its exchanges in the HAR file
+// when --har-file is set
+func withHARCapture(base http.RoundTripper) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	if handler.harFile == "" {
+		return base
+	}
+	return harTransport{base: base}
+}
+
+func (t harTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	entry := &harEntry{started: time.Now()}
+	entry.StartedDateTime = entry.started.Format(time.RFC3339Nano)
+	entry.Request = harRequest{
+		Method:      req.Method,
+		URL:         redactURL(req.URL),
+		HTTPVersion: req.Proto,
+		Cookies:     []harNameValue{},
+		Headers:     harHeaderValues(req.Header),
+		QueryString: []harNameValue{},
+		HeadersSize: -1,
+		BodySize:    -1,
+	}
+	if entry.Request.HTTPVersion == "" {
+		entry.Request.HTTPVersion = "HTTP/1.1"
+	}
+	for name, values := range req.URL.Query() {
+		for _, value := range values {
+			entry.Request.QueryString = append(entry.Request.QueryString, harNameValue{Name: name, Value: redact(value)})
+		}
+	}
+	if req.Body != nil && req.GetBody != nil {
+		if body, err := req.GetBody(); err == nil {
+			data, _ := io.ReadAll(body)
+			body.Close()
+			mimeType := req.Header.Get("Content-Type")
+			entry.Request.PostData = &harPostData{MimeType: mimeType, Text: redactBody(mimeType, data)}
+			entry.Request.BodySize = len(data)
+		}
+	}
+
+	resp, err := t.base.RoundTrip(req)
+	entry.Timings.Wait = milliseconds(time.Since(entry.started))
+	if err != nil {
+		entry.Error = redact(err.Error())
+		entry.Response = harResponse{Cookies: []harNameValue{}, Headers: []harNameValue{}, HeadersSize: -1, BodySize: -1}
+		entry.Time = entry.Timings.Wait
+		har.add(entry)
+		return resp, err
+	}
+	entry.Response = harResponse{
+		Status:      resp.StatusCode,
+		StatusText:  http.StatusText(resp.StatusCode),
+		HTTPVersion: resp.Proto,
+		Cookies:     []harNameValue{},
+		Headers:     harHeaderValues(resp.Header),
+		Content:     harContent{MimeType: resp.Header.Get("Content-Type")},
+		RedirectURL: resp.Header.Get("Location"),
+		HeadersSize: -1,
+		BodySize:    -1,
+	}
+	resp.Body = &harBody{ReadCloser: resp.Body, entry: entry}
+	return resp, nil
+}
+
+// harBody records the response body as it is read, and the entry once closed
+type harBody struct {
+	io.ReadCloser
+	entry  *harEntry
+	buf    bytes.Buffer
+	closed bool
+}
+
+func (b *harBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.buf.Write(p[:n])
+	return n, err
+}
+
+func (b *harBody) Close() error {
+	err := b.ReadCloser.Close()
+	if b.closed {
+		return err
+	}
+	b.closed = true
+	e := b.entry
+	e.Response.Content.Size = b.buf.Len()
+	e.Response.BodySize = b.buf.Len()
+	e.Response.Content.Text = redactBody(e.Response.Content.MimeType, b.buf.Bytes())
+	e.Time = milliseconds(time.Since(e.started))
+	e.Timings.Receive = e.Time - e.Timings.Wait
+	har.add(e)
+	return err
+}
+
+func (r *harRecorder) add(entry *harEntry) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.entries = append(r.entries, entry)
+}
+
+// saveHAR writes the exchanges recorded so far to the HAR file, when set
+func saveHAR() {
+	if handler.harFile == "" {
+		return
+	}
+	har.mu.Lock()
+	file := harFile{Log: harLog{
+		Version: "1.2",
+		Creator: harCreator{Name: handler.Name, Version: buildVersion()},
+		Entries: append([]*harEntry{}, har.entries...),
+	}}
+	har.mu.Unlock()
+
+	data, err := json.MarshalIndent(file, "", "  ")
+	if err == nil {
+		err = writeHARFile(data)
+	}
+	if err != nil {
+		log.Printf("could not write the HAR file: %s", err)
+	}
+}
+
+// writeHARFile atomically replaces the HAR file with b, through a temporary
+// file readable by its owner only since the exchanges describe the
+// infrastructure
+func writeHARFile(b []byte) error {
+	dir, name := filepath.Split(handler.harFile)
+	if dir == "" {
+		dir = "."
+	}
+	tmp, err := os.CreateTemp(dir, name+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), handler.harFile)
+}
+
+// buildVersion returns the version of the handler module, if known
+func buildVersion() string {
+	if info, ok := debug.ReadBuildInfo(); ok {
+		return info.Main.Version
+	}
+	return ""
+}
+
+// harHeaderValues returns the headers with the credentials masked
+func harHeaderValues(header http.Header) []harNameValue {
+	values := []harNameValue{}
+	for name, list := range header {
+		for _, value := range list {
+			if containsFold(harHeaders, name) {
+				value = secretMask
+			}
+			values = append(values, harNameValue{Name: name, Value: redact(value)})
+		}
+	}
+	return values
+}
+
+// redactURL returns the URL with its password and secret values masked
+func redactURL(u *url.URL) string {
+	return redact(u.Redacted())
+}
+
+// redactBody returns the body with the values of the credential fields of JSON
+// and form bodies masked, as well as the secret values
+func redactBody(mimeType string, data []byte) string {
+	var value interface{}
+	if err := json.Unmarshal(data, &value); err == nil {
+		if b, err := json.Marshal(maskFields(value)); err == nil {
+			data = b
+		}
+	} else if strings.HasPrefix(mimeType, "application/x-www-form-urlencoded") {
+		if form, err := url.ParseQuery(string(data)); err == nil {
+			for name := range form {
+				if containsFold(harFields, name) {
+					form.Set(name, secretMask)
+				}
+			}
+			data = []byte(form.Encode())
+		}
+	}
+	return redact(string(data))
+}
+
+// maskFields masks the credential fields of a decoded JSON value
+func maskFields(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for name, field := range v {
+			if containsFold(harFields, name) {
+				v[name] = secretMask
+			} else {
+				v[name] = maskFields(field)
+			}
+		}
+	case []interface{}:
+		for i, item := range v {
+			v[i] = maskFields(item)
+		}
+	}
+	return value
+}
+
+// containsFold returns whether the list contains the string, regardless of
+// case
+func containsFold(list []string, s string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// milliseconds returns the duration in milliseconds
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func Test_withHARCapture(t *testing.T) {
+	saveHandler(t)
+	savedHAR := har.entries
+	defer func() { har.entries = savedHAR }()
+	handler.harFile = filepath.Join(t.TempDir(), "handler.har")
+	har.entries = nil
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Set-Cookie", "session=s3cr3t")
+		_, _ = w.Write([]byte(`{"access_token":"t0k3n","expires_in":300}`))
+	}))
+	defer ts.Close()
+
+	client := &http.Client{Transport: withHARCapture(nil)}
+	req, _ := http.NewRequest(http.MethodPost, ts.URL+"/token?grant=1", strings.NewReader("grant_type=client_credentials&client_secret=hunter22"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Authorization", "Basic dXNlcjpwYXNz")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	saveHAR()
+
+	data, err := os.ReadFile(handler.harFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, secret := range []string{"s3cr3t", "t0k3n", "hunter22", "dXNlcjpwYXNz"} {
+		if strings.Contains(string(data), secret) {
+			t.Errorf("HAR file leaks %q", secret)
+		}
+	}
+	var file harFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		t.Fatal(err)
+	}
+	if len(file.Log.Entries) != 1 {
+		t.Fatalf("HAR file has %d entries, want 1", len(file.Log.Entries))
+	}
+	entry := file.Log.Entries[0]
+	if entry.Request.Method != http.MethodPost || entry.Response.Status != http.StatusOK {
+		t.Errorf("HAR entry = %s %d, want POST 200", entry.Request.Method, entry.Response.Status)
+	}
+	if want := `{"access_token":"********","expires_in":300}`; entry.Response.Content.Text != want {
+		t.Errorf("HAR response content = %s, want %s", entry.Response.Content.Text, want)
+	}
+	if entry.Request.PostData == nil || !strings.Contains(entry.Request.PostData.Text, "grant_type=client_credentials") {
+		t.Errorf("HAR request post data = %+v, want the form", entry.Request.PostData)
+	}
+}
+
+func Test_redactBody(t *testing.T) {
+	tests := []struct {
+		name     string
+		mimeType string
+		body     string
+		want     string
+	}{
+		{name: "JSON", mimeType: "application/json", body: `{"nodes":[{"token":"abcd"}],"name":"web01"}`, want: `{"name":"web01","nodes":[{"token":"********"}]}`},
+		{name: "form", mimeType: "application/x-www-form-urlencoded", body: "client_id=handler&client_secret=abcd", want: "client_id=handler&client_secret=%2A%2A%2A%2A%2A%2A%2A%2A"},
+		{name: "text", mimeType: "text/plain", body: "client_secret=abcd", want: "client_secret=abcd"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := redactBody(tt.mimeType, []byte(tt.body)); got != tt.want {
+				t.Errorf("redactBody() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
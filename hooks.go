@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os/exec"
+	"strings"
+
+	corev2 "github.com/sensu/core/v2"
+)
+
+// hookInput is written to the stdin of the deregistration hooks
+type hookInput struct {
+	Event    *corev2.Event        `json:"event"`
+	Decision deregistrationRecord `json:"decision"`
+}
+
+// runCommand runs the command with the input encoded as JSON on stdin, bounded
+// by the request timeout, and returns its stdout, also when the command
+// fails, in which case the error includes its stderr.
+func runCommand(name string, args []string, input interface{}) ([]byte, error) {
+	stdin, err := json.Marshal(input)
+	if err != nil {
+		return nil, err
+	}
+	ctx := executionCtx
+	if timeout := requestTimeout(); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Stdin = bytes.NewReader(stdin)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return stdout.Bytes(), commandError{err: err, stderr: strings.TrimSpace(stderr.String())}
+	}
+	return stdout.Bytes(), nil
+}
+
+// commandError is the error of a failed command, along with its stderr
+type commandError struct {
+	err    error
+	stderr string
+}
+
+func (e commandError) Error() string {
+	if e.stderr != "" {
+		return fmt.Sprintf("%s: %s", e.err, e.stderr)
+	}
+	return e.err.Error()
+}
+
+func (e commandError) Unwrap() error {
+	return e.err
+}
+
+// runHook runs the deregistration hook with the event and the decision taken
+// on its entity
+func runHook(hook string, event *corev2.Event, lookup nodeLookup, action string) error {
+	_, err := runCommand(hook, nil, hookInput{Event: event, Decision: newDeregistrationRecord(event, lookup, action)})
+	return err
+}
+
+// preDeleteHook runs the pre-delete hook, if any, and returns why the
+// deregistration is aborted when the hook fails, empty otherwise
+func preDeleteHook(event *corev2.Event, lookup nodeLookup, action string) string {
+	if handler.preDeleteHook == "" {
+		return ""
+	}
+	if err := runHook(handler.preDeleteHook, event, lookup, action); err != nil {
+		return fmt.Sprintf("the pre-delete hook failed: %s", err)
+	}
+	log.Print("the pre-delete hook allowed the deregistration")
+	return ""
+}
+
+// postDeleteHook runs the post-delete hook, if any
+func postDeleteHook(event *corev2.Event, lookup nodeLookup, action string) error {
+	if handler.postDeleteHook == "" {
+		return nil
+	}
+	if err := runHook(handler.postDeleteHook, event, lookup, action); err != nil {
+		return fmt.Errorf("the post-delete hook failed: %s", err)
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	corev2 "github.com/sensu/core/v2"
+)
+
+func Test_preDeleteHook(t *testing.T) {
+	dir := t.TempDir()
+	hook := filepath.Join(dir, "guard")
+	content := `#!/bin/sh
+if grep -q '"entity":"db01"'; then
+	echo "db01 still resolves in DNS" >&2
+	exit 1
+fi
+`
+	if err := os.WriteFile(hook, []byte(content), 0700); err != nil {
+		t.Fatal(err)
+	}
+	setHandler(t, Handler{preDeleteHook: hook})
+
+	lookup := nodeLookup{name: "web01", status: nodeNotFound}
+	if reason := preDeleteHook(corev2.FixtureEvent("web01", "keepalive"), lookup, actionDelete); reason != "" {
+		t.Errorf("preDeleteHook() = %q, want the deregistration allowed", reason)
+	}
+	lookup.name = "db01"
+	reason := preDeleteHook(corev2.FixtureEvent("db01", "keepalive"), lookup, actionDelete)
+	if !strings.Contains(reason, "db01 still resolves in DNS") {
+		t.Errorf("preDeleteHook() = %q, want the deregistration aborted", reason)
+	}
+}
+
+func Test_postDeleteHook(t *testing.T) {
+	dir := t.TempDir()
+	output := filepath.Join(dir, "input.json")
+	hook := filepath.Join(dir, "ticket")
+	if err := os.WriteFile(hook, []byte("#!/bin/sh\ncat > "+output+"\n"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	setHandler(t, Handler{postDeleteHook: hook})
+
+	event := corev2.FixtureEvent("web01", "keepalive")
+	if err := postDeleteHook(event, nodeLookup{name: "web01.example.com", status: nodeNotFound}, actionTombstone); err != nil {
+		t.Fatalf("postDeleteHook() error = %v", err)
+	}
+	b, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var input hookInput
+	if err := json.Unmarshal(b, &input); err != nil {
+		t.Fatal(err)
+	}
+	if input.Event.Entity.Name != "web01" || input.Decision.PuppetNode != "web01.example.com" || input.Decision.Action != actionTombstone {
+		t.Errorf("postDeleteHook() input = %s", b)
+	}
+
+	handler.postDeleteHook = filepath.Join(dir, "missing")
+	if err := postDeleteHook(event, nodeLookup{}, actionDelete); err == nil {
+		t.Error("postDeleteHook() expected an error with a missing command")
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+
+	"golang.org/x/net/http2"
+)
+
+const (
+	// httpVersionAuto negotiates HTTP/2 over TLS when the server supports it
+	httpVersionAuto = "auto"
+	// httpVersionHTTP1 forces HTTP/1.1
+	httpVersionHTTP1 = "http1"
+	// httpVersionHTTP2 forces HTTP/2, with prior knowledge (h2c) for http
+	// URLs
+	httpVersionHTTP2 = "http2"
+)
+
+// httpVersions are the allowed values of the HTTP version options
+var httpVersions = []string{httpVersionAuto, httpVersionHTTP1, httpVersionHTTP2}
+
+// withHTTPVersion returns a round tripper using the transport's settings with
+// the given HTTP version. Forcing HTTP/2 replaces the transport, which does not
+// support proxies.
+func withHTTPVersion(transport *http.Transport, version string) http.RoundTripper {
+	switch version {
+	case httpVersionHTTP1:
+		// A non-nil empty map disables the HTTP/2 upgrade
+		transport.ForceAttemptHTTP2 = false
+		transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+		if transport.TLSClientConfig != nil {
+			config := transport.TLSClientConfig.Clone()
+			config.NextProtos = nil
+			for _, proto := range transport.TLSClientConfig.NextProtos {
+				if proto != http2.NextProtoTLS {
+					config.NextProtos = append(config.NextProtos, proto)
+				}
+			}
+			transport.TLSClientConfig = config
+		}
+	case httpVersionHTTP2:
+		// The HTTP/2 transports dial with the transport's dialer if set
+		dial := transport.DialContext
+		if dial == nil {
+			var dialer net.Dialer
+			dial = dialer.DialContext
+		}
+		h2 := &h2Transport{
+			tls: &http2.Transport{TLSClientConfig: transport.TLSClientConfig},
+			h2c: &http2.Transport{
+				AllowHTTP: true,
+				DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+					return dial(ctx, network, addr)
+				},
+			},
+		}
+		if transport.DialContext != nil {
+			h2.tls.DialTLSContext = func(ctx context.Context, network, addr string, config *tls.Config) (net.Conn, error) {
+				conn, err := dial(ctx, network, addr)
+				if err != nil {
+					return nil, err
+				}
+				tlsConn := tls.Client(conn, config)
+				if err := tlsConn.HandshakeContext(ctx); err != nil {
+					conn.Close()
+					return nil, err
+				}
+				return tlsConn, nil
+			}
+		}
+		return h2
+	}
+	return transport
+}
+
+// h2Transport sends requests over HTTP/2, in cleartext for http URLs
+type h2Transport struct {
+	tls *http2.Transport
+	h2c *http2.Transport
+}
+
+func (t *h2Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Scheme == "http" {
+		return t.h2c.RoundTrip(req)
+	}
+	return t.tls.RoundTrip(req)
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+func Test_withHTTPVersion(t *testing.T) {
+	proto := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(r.Proto))
+	})
+	tlsServer := httptest.NewUnstartedServer(proto)
+	tlsServer.EnableHTTP2 = true
+	tlsServer.StartTLS()
+	defer tlsServer.Close()
+	h2cServer := httptest.NewServer(h2c.NewHandler(proto, &http2.Server{}))
+	defer h2cServer.Close()
+
+	tests := []struct {
+		name    string
+		url     string
+		version string
+		want    string
+	}{
+		{
+			name:    "negotiated over TLS",
+			url:     tlsServer.URL,
+			version: httpVersionAuto,
+			want:    "HTTP/2.0",
+		},
+		{
+			name:    "HTTP/1.1 forced over TLS",
+			url:     tlsServer.URL,
+			version: httpVersionHTTP1,
+			want:    "HTTP/1.1",
+		},
+		{
+			name:    "cleartext without prior knowledge",
+			url:     h2cServer.URL,
+			version: httpVersionAuto,
+			want:    "HTTP/1.1",
+		},
+		{
+			name:    "cleartext with prior knowledge",
+			url:     h2cServer.URL,
+			version: httpVersionHTTP2,
+			want:    "HTTP/2.0",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			transport := tlsServer.Client().Transport.(*http.Transport).Clone()
+			client := &http.Client{Transport: withHTTPVersion(transport, tt.version)}
+			resp, err := client.Get(tt.url)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if resp.Proto != tt.want {
+				t.Errorf("withHTTPVersion() proto = %s, want %s", resp.Proto, tt.want)
+			}
+		})
+	}
+}
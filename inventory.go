@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+
+	corev2 "github.com/sensu/core/v2"
+)
+
+const (
+	sourcePuppetDB   = "puppetdb"
+	sourceServiceNow = "servicenow"
+
+	policyAllAbsent = "all-absent"
+	policyAnyAbsent = "any-absent"
+	policyWeighted  = "weighted"
+)
+
+// sourceResult is the outcome of looking up a node in one inventory source
+type sourceResult struct {
+	source string
+	lookup nodeLookup
+}
+
+// inventorySources returns the inventory sources to consult, in order. When
+// none are configured, PuppetDB is used, followed by the ServiceNow CMDB if
+// its URL is set.
+func inventorySources() []string {
+	if len(handler.sources) > 0 {
+		return handler.sources
+	}
+	sources := []string{sourcePuppetDB}
+	if handler.serviceNowURL != "" {
+		sources = append(sources, sourceServiceNow)
+	}
+	return sources
+}
+
+// sourceWeight returns the weight of the source in the weighted policy
+func sourceWeight(source string) int {
+	if weight, ok := handler.sourceWeights[source]; ok {
+		return weight
+	}
+	return 1
+}
+
+// puppetLookup returns the PuppetDB lookup among the source results, whatever
+// the order of the sources, or the first result if PuppetDB was not consulted
+func puppetLookup(results []sourceResult) nodeLookup {
+	for _, result := range results {
+		if result.source == sourcePuppetDB {
+			return result.lookup
+		}
+	}
+	return results[0].lookup
+}
+
+// lookupInventory looks up the event's node in the configured inventory
+// sources and returns their results along with whether the entity should be
+// deregistered according to the source policy. Sources are consulted in order
+// and the lookup stops as soon as the outcome is known.
+func lookupInventory(puppetClient *http.Client, event *corev2.Event) ([]sourceResult, bool, error) {
+	var (
+		results      []sourceResult
+		absentWeight int
+	)
+
+	for _, source := range inventorySources() {
+		var (
+			lookup nodeLookup
+			err    error
+		)
+		switch source {
+		case sourcePuppetDB:
+			lookup, err = lookupPuppetNode(puppetClient, event)
+		case sourceServiceNow:
+			lookup, err = lookupCandidates(event, lookupCMDB)
+		case sourceGenericREST:
+			lookup, err = lookupCandidates(event, lookupREST)
+		case sourceExec:
+			lookup, err = lookupCandidates(event, lookupExec(event))
+		default:
+			err = fmt.Errorf("unknown inventory source %q", source)
+		}
+		if err != nil {
+			return results, false, err
+		}
+		results = append(results, sourceResult{source: source, lookup: lookup})
+		explainRule("inventory "+source, "node %q is %s", lookup.name, lookup.status)
+
+		absent := !lookup.exists()
+		if absent {
+			absentWeight += sourceWeight(source)
+		}
+		switch handler.sourcePolicy {
+		case policyAnyAbsent:
+			if absent {
+				return results, true, nil
+			}
+		case policyWeighted:
+			if absentWeight >= handler.absentWeightThreshold {
+				return results, true, nil
+			}
+		default:
+			if !absent {
+				log.Printf("node %q exists in %s, keeping entity", lookup.name, source)
+				return results, false, nil
+			}
+		}
+	}
+
+	// Every source was consulted without reaching a decision, which means all
+	// sources agreed the node is absent with the all-absent policy, and that
+	// the threshold was not reached or no source reported the node as absent
+	// otherwise
+	return results, handler.sourcePolicy == policyAllAbsent || handler.sourcePolicy == "", nil
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	corev2 "github.com/sensu/core/v2"
+)
+
+func Test_lookupInventory(t *testing.T) {
+	tests := []struct {
+		name           string
+		policy         string
+		weights        map[string]int
+		threshold      int
+		puppetStatus   int
+		cmdbStatus     string
+		wantDeregister bool
+		wantLookups    int
+	}{
+		{
+			name:           "all-absent with node in PuppetDB",
+			policy:         policyAllAbsent,
+			puppetStatus:   http.StatusOK,
+			wantDeregister: false,
+			wantLookups:    1,
+		},
+		{
+			name:           "all-absent with CI still active",
+			policy:         policyAllAbsent,
+			puppetStatus:   http.StatusNotFound,
+			cmdbStatus:     "1",
+			wantDeregister: false,
+			wantLookups:    2,
+		},
+		{
+			name:           "all-absent with node absent everywhere",
+			policy:         policyAllAbsent,
+			puppetStatus:   http.StatusNotFound,
+			cmdbStatus:     "7",
+			wantDeregister: true,
+			wantLookups:    2,
+		},
+		{
+			name:           "any-absent with node absent from PuppetDB",
+			policy:         policyAnyAbsent,
+			puppetStatus:   http.StatusNotFound,
+			wantDeregister: true,
+			wantLookups:    1,
+		},
+		{
+			name:           "any-absent with CI retired",
+			policy:         policyAnyAbsent,
+			puppetStatus:   http.StatusOK,
+			cmdbStatus:     "7",
+			wantDeregister: true,
+			wantLookups:    2,
+		},
+		{
+			name:           "weighted under the threshold",
+			policy:         policyWeighted,
+			weights:        map[string]int{sourcePuppetDB: 2},
+			threshold:      3,
+			puppetStatus:   http.StatusNotFound,
+			cmdbStatus:     "1",
+			wantDeregister: false,
+			wantLookups:    2,
+		},
+		{
+			name:           "weighted reaching the threshold",
+			policy:         policyWeighted,
+			weights:        map[string]int{sourcePuppetDB: 2},
+			threshold:      2,
+			puppetStatus:   http.StatusNotFound,
+			wantDeregister: true,
+			wantLookups:    1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			puppetDB := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				nodes := []map[string]interface{}{}
+				if tt.puppetStatus == http.StatusOK {
+					nodes = append(nodes, map[string]interface{}{"certname": "foo"})
+				}
+				_ = json.NewEncoder(w).Encode(nodes)
+			}))
+			defer puppetDB.Close()
+			cmdb := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				_ = json.NewEncoder(w).Encode(serviceNowResponse{
+					Result: []map[string]string{{"name": "foo", "install_status": tt.cmdbStatus}},
+				})
+			}))
+			defer cmdb.Close()
+			setHandler(t, Handler{
+				endpoint:                  puppetDB.URL,
+				serviceNowURL:             cmdb.URL,
+				serviceNowTable:           "cmdb_ci_server",
+				serviceNowNameField:       "name",
+				serviceNowRetiredStatuses: []string{"7"},
+				sourcePolicy:              tt.policy,
+				sourceWeights:             tt.weights,
+				absentWeightThreshold:     tt.threshold,
+			})
+
+			event := corev2.FixtureEvent("foo", "keepalive")
+			results, deregister, err := lookupInventory(puppetDB.Client(), event)
+			if err != nil {
+				t.Fatalf("lookupInventory() error = %v", err)
+			}
+			if deregister != tt.wantDeregister {
+				t.Errorf("lookupInventory() deregister = %v, want %v", deregister, tt.wantDeregister)
+			}
+			if len(results) != tt.wantLookups {
+				t.Errorf("lookupInventory() lookups = %d, want %d", len(results), tt.wantLookups)
+			}
+		})
+	}
+}
+
+func Test_puppetLookup(t *testing.T) {
+	cmdb := sourceResult{source: sourceServiceNow, lookup: nodeLookup{name: "foo", status: nodeNotFound}}
+	puppetDB := sourceResult{source: sourcePuppetDB, lookup: nodeLookup{name: "foo.example.com", status: nodeNotFound}}
+
+	if got := puppetLookup([]sourceResult{cmdb, puppetDB}); got.name != "foo.example.com" {
+		t.Errorf("puppetLookup() = %q, want the PuppetDB lookup", got.name)
+	}
+	if got := puppetLookup([]sourceResult{cmdb}); got.name != "foo" {
+		t.Errorf("puppetLookup() = %q, want the first lookup", got.name)
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+
+	corev2 "github.com/sensu/core/v2"
+)
+
+// Labels of the Sensu license file reporting the licensed entities
+const (
+	licenseEntityCountLabel = "sensu.io/entity-count"
+	licenseEntityLimitLabel = "sensu.io/entity-limit"
+)
+
+// licenseUsage is the entity usage of the Sensu license
+type licenseUsage struct {
+	count int
+	limit int
+}
+
+// fetchLicenseUsage fetches the entity count and limit of the license of the
+// backend serving the namespace
+func fetchLicenseUsage(namespace string) (licenseUsage, error) {
+	var usage licenseUsage
+	client, err := sensuClient(namespace)
+	if err != nil {
+		return usage, err
+	}
+
+	req, err := http.NewRequestWithContext(executionCtx, http.MethodGet, client.Config.URL+"/api/enterprise/licensing/v2/license", nil)
+	if err != nil {
+		return usage, err
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("Key %s", client.Config.APIKey))
+
+	resp, err := client.HTTPClient.Do(req)
+	if err != nil {
+		return usage, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return usage, errors.New("the backend has no license")
+	}
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+		return usage, errors.New("the Sensu API denied access to the license, make sure the API key or access token is allowed to get licenses")
+	}
+	if resp.StatusCode >= 400 {
+		return usage, fmt.Errorf("unexpected HTTP status %s while fetching the license", http.StatusText(resp.StatusCode))
+	}
+
+	var license struct {
+		Metadata corev2.ObjectMeta `json:"metadata"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&license); err != nil {
+		return usage, fmt.Errorf("invalid license response: %s", err)
+	}
+	if usage.count, err = strconv.Atoi(license.Metadata.Labels[licenseEntityCountLabel]); err != nil {
+		return usage, fmt.Errorf("invalid %s license label: %s", licenseEntityCountLabel, err)
+	}
+	// Unlimited licenses have no entity limit
+	if limit, ok := license.Metadata.Labels[licenseEntityLimitLabel]; ok {
+		if usage.limit, err = strconv.Atoi(limit); err != nil {
+			return usage, fmt.Errorf("invalid %s license label: %s", licenseEntityLimitLabel, err)
+		}
+	}
+	return usage, nil
+}
+
+// logLicenseUsage logs the licensed entities reclaimed by the deletion of the
+// event's entity and the remaining headroom of the license. The license usage
+// only informs, failing to fetch it is logged and does not fail the handler.
+func logLicenseUsage(event *corev2.Event) {
+	usage, err := fetchLicenseUsage(event.Entity.Namespace)
+	if err != nil {
+		log.Printf("could not report the license usage: %s", err)
+		return
+	}
+	if usage.limit == 0 {
+		log.Printf("license: 1 entity reclaimed, %d entities in use", usage.count)
+		return
+	}
+	log.Printf("license: 1 entity reclaimed, %d of %d licensed entities in use, %d remaining", usage.count, usage.limit, usage.limit-usage.count)
+}
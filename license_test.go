@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	corev2 "github.com/sensu/core/v2"
+)
+
+func Test_logLicenseUsage(t *testing.T) {
+	saveHandler(t)
+	savedOutput := log.Writer()
+	defer log.SetOutput(savedOutput)
+
+	tests := []struct {
+		name   string
+		status int
+		body   string
+		want   string
+	}{
+		{
+			name:   "limited license",
+			status: http.StatusOK,
+			body:   `{"type":"LicenseFile","metadata":{"labels":{"sensu.io/entity-count":"90","sensu.io/entity-limit":"100"}}}`,
+			want:   "license: 1 entity reclaimed, 90 of 100 licensed entities in use, 10 remaining",
+		},
+		{
+			name:   "unlimited license",
+			status: http.StatusOK,
+			body:   `{"type":"LicenseFile","metadata":{"labels":{"sensu.io/entity-count":"90"}}}`,
+			want:   "license: 1 entity reclaimed, 90 entities in use",
+		},
+		{
+			name:   "no license",
+			status: http.StatusNotFound,
+			want:   "could not report the license usage: the backend has no license",
+		},
+		{
+			name:   "access denied",
+			status: http.StatusForbidden,
+			want:   "could not report the license usage: the Sensu API denied access to the license",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != "/api/enterprise/licensing/v2/license" {
+					t.Errorf("logLicenseUsage() path = %v", r.URL.Path)
+				}
+				w.WriteHeader(tt.status)
+				_, _ = w.Write([]byte(tt.body))
+			}))
+			defer ts.Close()
+			setHandler(t, Handler{sensuAPIURL: ts.URL, sensuAPIKey: "xxxxxxxxxx"})
+
+			var out bytes.Buffer
+			log.SetOutput(&out)
+			logLicenseUsage(corev2.FixtureEvent("foo", "keepalive"))
+			log.SetOutput(savedOutput)
+			if !strings.Contains(out.String(), tt.want) {
+				t.Errorf("logLicenseUsage() logged %q, want %q", out.String(), tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+)
+
+// errResponseTooLarge is returned when reading a response body larger than
+// the configured maximum response size
+var errResponseTooLarge = errors.New("response body exceeds the maximum response size")
+
+// limitTransport caps the size of the response bodies read through it
+type limitTransport struct {
+	base  http.RoundTripper
+	limit int64
+}
+
+// limitedTransport wraps the transport so that response bodies larger than the
+// maximum response size fail to be read, instead of being buffered in memory
+func limitedTransport(base http.RoundTripper) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	if handler.maxResponseSize <= 0 {
+		return base
+	}
+	return limitTransport{base: base, limit: int64(handler.maxResponseSize)}
+}
+
+func (t limitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		return resp, err
+	}
+	resp.Body = &limitedBody{ReadCloser: resp.Body, remaining: t.limit}
+	return resp, nil
+}
+
+// limitedBody is a response body returning errResponseTooLarge once more than
+// the remaining bytes are read
+type limitedBody struct {
+	io.ReadCloser
+	remaining int64
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.remaining <= 0 {
+		// Only fail if the body actually holds more data
+		var one [1]byte
+		n, err := b.ReadCloser.Read(one[:])
+		if n > 0 {
+			return 0, errResponseTooLarge
+		}
+		return 0, err
+	}
+	if int64(len(p)) > b.remaining {
+		p = p[:b.remaining]
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.remaining -= int64(n)
+	return n, err
+}
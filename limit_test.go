@@ -0,0 +1,44 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func Test_limitedTransport(t *testing.T) {
+	saveHandler(t)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, strings.Repeat("x", 100))
+	}))
+	defer ts.Close()
+
+	tests := []struct {
+		name    string
+		limit   int
+		wantErr error
+	}{
+		{name: "body under the limit", limit: 200},
+		{name: "body at the limit", limit: 100},
+		{name: "body over the limit", limit: 50, wantErr: errResponseTooLarge},
+		{name: "limit disabled", limit: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler.maxResponseSize = tt.limit
+			client := &http.Client{Transport: limitedTransport(nil)}
+			resp, err := client.Get(ts.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			_, err = io.ReadAll(resp.Body)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("reading body error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"log"
+)
+
+const logSamplingStateFile = "log-sampling.json"
+
+// logSamplingState counts the executions which kept their entity, across
+// executions
+type logSamplingState struct {
+	Kept int64 `json:"kept"`
+}
+
+// startLogSampling buffers the log lines of the execution when log sampling
+// is enabled, and returns the function deciding whether they are written once
+// the outcome of the execution is known. Executions deregistering an entity or
+// failing are always logged, the ones keeping their entity only one out of
+// --log-sample-rate times.
+func startLogSampling() func(err error) {
+	if handler.logSampleRate <= 1 {
+		return func(error) {}
+	}
+	out := log.Writer()
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+
+	return func(err error) {
+		log.SetOutput(out)
+		if err != nil || summary.kept == 0 || summary.deleted+summary.tombstoned+summary.queued > 0 {
+			_, _ = io.Copy(out, &buf)
+			return
+		}
+		n, serr := countKept()
+		if serr != nil {
+			_, _ = io.Copy(out, &buf)
+			log.Printf("could not update the log sampling state: %s", serr)
+			return
+		}
+		if (n-1)%int64(handler.logSampleRate) == 0 {
+			_, _ = io.Copy(out, &buf)
+			log.Printf("logged 1 out of %d executions keeping their entity, %d so far", handler.logSampleRate, n)
+		}
+	}
+}
+
+// countKept records an execution keeping its entity and returns the number
+// recorded so far. Concurrent executions may miss each other's updates, which
+// only makes the sampling approximate.
+func countKept() (int64, error) {
+	var state logSamplingState
+	if err := readState(logSamplingStateFile, &state); err != nil {
+		return 0, err
+	}
+	state.Kept++
+	if err := writeState(logSamplingStateFile, state); err != nil {
+		return 0, err
+	}
+	return state.Kept, nil
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func Test_startLogSampling(t *testing.T) {
+	savedSummary, savedOutput := summary, log.Writer()
+	defer func() {
+		summary = savedSummary
+		log.SetOutput(savedOutput)
+	}()
+	setHandler(t, Handler{stateDir: t.TempDir(), logSampleRate: 3})
+
+	var out bytes.Buffer
+	log.SetOutput(&out)
+	run := func(s runSummary, err error) bool {
+		out.Reset()
+		summary = s
+		finish := startLogSampling()
+		log.Print("puppet node exists")
+		finish(err)
+		return strings.Contains(out.String(), "puppet node exists")
+	}
+
+	var logged []bool
+	for i := 0; i < 4; i++ {
+		logged = append(logged, run(runSummary{checked: 1, kept: 1}, nil))
+	}
+	if want := []bool{true, false, false, true}; !reflect.DeepEqual(logged, want) {
+		t.Errorf("kept executions logged = %v, want %v", logged, want)
+	}
+	if !run(runSummary{checked: 1, deleted: 1}, nil) {
+		t.Error("deregistration not logged")
+	}
+	if !run(runSummary{checked: 1, kept: 1}, errors.New("failed")) {
+		t.Error("error not logged")
+	}
+	if !run(runSummary{}, nil) {
+		t.Error("ignored event not logged")
+	}
+}
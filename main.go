@@ -2,43 +2,201 @@ package main
 
 import (
 	"context"
-	"crypto/tls"
-	"crypto/x509"
-	"encoding/json"
-	"encoding/pem"
 	"errors"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"net/http"
 	"net/url"
-	"path"
-	"strings"
+	"os"
+	"path/filepath"
+	"text/template"
+	"time"
 
 	corev2 "github.com/sensu/core/v2"
-	"github.com/sensu/sensu-plugin-sdk/httpclient"
 	"github.com/sensu/sensu-plugin-sdk/sensu"
+	"github.com/sensu/sensu-puppet-handler/puppet"
 )
 
 // Handler represents the sensu-puppet-handler plugin
 type Handler struct {
 	sensu.PluginConfig
-	endpoint                 string
-	puppetCert               string
-	puppetKey                string
-	puppetCACert             string
-	puppetInsecureSkipVerify bool
-	puppetNodeName           string
-	sensuAPIURL              string
-	sensuAPIKey              string
-	sensuCACert              string
+	endpoint                  string
+	puppetCert                string
+	puppetKey                 string
+	puppetCACert              string
+	puppetInsecureSkipVerify  bool
+	puppetNodeName            string
+	sensuAPIURL               string
+	sensuAPIKey               string
+	sensuCACert               string
+	action                    string
+	natsURL                   string
+	natsSubject               string
+	kafkaBrokers              []string
+	kafkaTopic                string
+	publishKept               bool
+	messageFormat             string
+	cloudEventsSource         string
+	cloudEventsType           string
+	stateDir                  string
+	pagerDutyRoutingKey       string
+	pagerDutyThreshold        int
+	serviceNowURL             string
+	serviceNowUsername        string
+	serviceNowPassword        string
+	serviceNowTable           string
+	serviceNowNameField       string
+	serviceNowRetiredStatuses []string
+	sources                   []string
+	sourcePolicy              string
+	sourceWeights             map[string]int
+	absentWeightThreshold     int
+	triggerChecks             []string
+	sensuUsePuppetCert        bool
+	sensuAccessToken          string
+	sensuRefreshToken         string
+	sensuTokenFile            string
+	maxResponseSize           int
+	puppetProxyURL            string
+	sensuProxyURL             string
+	caseInsensitive           bool
+	nodeNameRewrites          []string
+	nodeNameSource            string
+	nodeNameAnnotation        string
+	fallbackNames             []string
+	negativeCacheTTL          int
+	annotationAllow           []string
+	annotationDeny            []string
+	includeDeactivated        bool
+	includeExpired            bool
+	requestID                 string
+	tlsRenegotiation          string
+	skipSilenced              bool
+	agentEventsURL            string
+	agentEventCheck           string
+	agentEventHandlers        []string
+	labelSelector             string
+	condition                 string
+	logTemplate               string
+	messageTemplate           string
+	requestTimeout            int
+	deadline                  int
+	puppetCAURL               string
+	puppetCAFingerprint       string
+	strictTLS                 bool
+	puppetHTTPVersion         string
+	sensuHTTPVersion          string
+	facts                     []string
+	factLabelPrefix           string
+	checkNamespaces           []string
+	orphanWarning             int
+	orphanCritical            int
+	protectedNodesFile        string
+	requireSubscriptions      []string
+	excludeSubscriptions      []string
+	entityLabelSelector       string
+	entityFieldSelector       string
+	maxRedirects              int
+	redirectForwardAuth       bool
+	configDir                 string
+	envPrefix                 string
+	reverify                  bool
+	recheckAfter              int
+	output                    string
+	metricsFormat             string
+	namespaceEnvironments     map[string]string
+	opaURL                    string
+	opaToken                  string
+	puppetOAuthTokenURL       string
+	puppetOAuthClientID       string
+	puppetOAuthClientSecret   string
+	puppetOAuthScopes         []string
+	consulAddr                string
+	consulToken               string
+	strictEvents              bool
+	checkPermissions          bool
+	logSampleRate             int
+	namespaceAPIKeys          map[string]string
+	namespaceAPIKeysFile      string
+	restURL                   string
+	restUsername              string
+	restPassword              string
+	restToken                 string
+	restExistsField           string
+	restDeactivatedField      string
+	restLastSeenField         string
+	restMaxAge                int
+	execCommand               string
+	execArgs                  []string
+	preDeleteHook             string
+	postDeleteHook            string
+	decisionHook              string
+	silenceExpire             int
+	traceConnections          bool
+	explain                   bool
+	namespaceAPIURLs          map[string]string
+	minLastSeen               int
+	passingCheckWindow        int
+	approvalQueue             string
+	reportLicenseUsage        bool
+	entityName                string
+	entityNamespace           string
+	canonicalizeDNS           bool
+	preflight                 bool
+	inventoryFallback         bool
+	dnsServers                []string
+	dnsTimeout                int
+	harFile                   string
+	tee                       bool
+	cleanupUnreportedAfter    int
+	stampLastVerified         bool
+	puppetSPNEGO              bool
+	sensuSPNEGO               bool
+	krb5Config                string
+	krb5Keytab                string
+	krb5Principal             string
+	concurrency               int
+	progressInterval          int
+	diffReport                string
+	yes                       bool
+	minPuppetNodes            int
+	checkpointFile            string
+	nodeListTimeout           int
+	dryRun                    bool
 }
 
 const (
 	defaultAPIPath = "pdb/query/v4/nodes"
+
+	// annotationPrefix is prepended to the annotations written by the handler
+	annotationPrefix = "sensu.io/plugins/sensu-puppet-handler/"
+
+	actionDelete    = "delete"
+	actionTombstone = "tombstone"
+
+	// actionSilence is recorded when the decision hook silences the entity
+	actionSilence = "silence"
+
+	// defaultNodeListTimeout is the timeout in seconds of the node listing
+	// of the cleanup subcommand, which returns the whole fleet
+	defaultNodeListTimeout = 300
+
+	// defaultSilenceExpire is the duration in seconds of the silencing
+	// entries created by the handler
+	defaultSilenceExpire = 86400
+
+	// defaultMaxResponseSize matches the limit of the Sensu SDK HTTP client
+	defaultMaxResponseSize = 1 << 24
+
+	// defaultRequestTimeout bounds in seconds the requests made to PuppetDB,
+	// the Sensu API and third-party services
+	defaultRequestTimeout = 10
 )
 
 var (
+	// exit terminates the handler, replaced in tests
+	exit = os.Exit
+
 	handler = Handler{
 		PluginConfig: sensu.PluginConfig{
 			Name:     "sensu-puppet-handler",
@@ -53,7 +211,7 @@ var (
 			Env:       "PUPPET_ENDPOINT",
 			Argument:  "endpoint",
 			Shorthand: "e",
-			Usage:     "the PuppetDB API endpoint (URL). If an API path is not specified, /pdb/query/v4/nodes/ will be used",
+			Usage:     "the PuppetDB API endpoint (URL). If a scheme is not specified, https will be used, and if an API path is not specified, /pdb/query/v4/nodes/ will be used",
 			Value:     &handler.endpoint,
 		},
 		&sensu.PluginConfigOption[string]{
@@ -77,6 +235,78 @@ var (
 			Usage:    "path to the site's Puppet CA certificate PEM file",
 			Value:    &handler.puppetCACert,
 		},
+		&sensu.PluginConfigOption[string]{
+			Path:     "puppet-ca-url",
+			Env:      "PUPPET_CA_URL",
+			Argument: "puppet-ca-url",
+			Usage:    "URL of the Puppet CA server the CA certificate is fetched from and cached when --ca-cert is not set, e.g. https://puppet:8140",
+			Value:    &handler.puppetCAURL,
+		},
+		&sensu.PluginConfigOption[string]{
+			Path:     "puppet-ca-fingerprint",
+			Env:      "PUPPET_CA_FINGERPRINT",
+			Argument: "puppet-ca-fingerprint",
+			Usage:    "SHA-256 fingerprint the CA certificate fetched from the Puppet CA server must match",
+			Value:    &handler.puppetCAFingerprint,
+		},
+		&sensu.PluginConfigOption[string]{
+			Path:     "puppet-oauth-token-url",
+			Env:      "PUPPET_OAUTH_TOKEN_URL",
+			Argument: "puppet-oauth-token-url",
+			Usage:    "OAuth2 token URL of the identity provider minting the bearer tokens of PuppetDB published through an API gateway, with the client credentials flow",
+			Value:    &handler.puppetOAuthTokenURL,
+		},
+		&sensu.PluginConfigOption[string]{
+			Path:     "puppet-oauth-client-id",
+			Env:      "PUPPET_OAUTH_CLIENT_ID",
+			Argument: "puppet-oauth-client-id",
+			Usage:    "OAuth2 client ID of the handler",
+			Value:    &handler.puppetOAuthClientID,
+		},
+		&sensu.PluginConfigOption[string]{
+			Path:     "puppet-oauth-client-secret",
+			Env:      "PUPPET_OAUTH_CLIENT_SECRET",
+			Argument: "puppet-oauth-client-secret",
+			Secret:   true,
+			Usage:    "OAuth2 client secret of the handler",
+			Value:    &handler.puppetOAuthClientSecret,
+		},
+		&sensu.SlicePluginConfigOption[string]{
+			Path:     "puppet-oauth-scopes",
+			Env:      "PUPPET_OAUTH_SCOPES",
+			Argument: "puppet-oauth-scopes",
+			Usage:    "OAuth2 scopes requested for the PuppetDB bearer tokens",
+			Value:    &handler.puppetOAuthScopes,
+		},
+		&sensu.PluginConfigOption[bool]{
+			Path:     "puppet-spnego",
+			Env:      "PUPPET_SPNEGO",
+			Argument: "puppet-spnego",
+			Usage:    "authenticate to PuppetDB published through a reverse proxy with Kerberos SPNEGO",
+			Value:    &handler.puppetSPNEGO,
+		},
+		&sensu.PluginConfigOption[string]{
+			Path:     "krb5-config",
+			Env:      "PUPPET_KRB5_CONFIG",
+			Argument: "krb5-config",
+			Default:  defaultKrb5Config,
+			Usage:    "path to the Kerberos configuration used by the SPNEGO authentication",
+			Value:    &handler.krb5Config,
+		},
+		&sensu.PluginConfigOption[string]{
+			Path:     "krb5-keytab",
+			Env:      "PUPPET_KRB5_KEYTAB",
+			Argument: "krb5-keytab",
+			Usage:    "path to the keytab of --krb5-principal used by the SPNEGO authentication, the credential cache being used when not set",
+			Value:    &handler.krb5Keytab,
+		},
+		&sensu.PluginConfigOption[string]{
+			Path:     "krb5-principal",
+			Env:      "PUPPET_KRB5_PRINCIPAL",
+			Argument: "krb5-principal",
+			Usage:    "Kerberos principal (user or user@REALM) of the keytab",
+			Value:    &handler.krb5Principal,
+		},
 		&sensu.PluginConfigOption[bool]{
 			Path:     "insecure-skip-tls-verify",
 			Env:      "PUPPET_INSECURE_SKIP_TLS_VERIFY",
@@ -84,6 +314,22 @@ var (
 			Usage:    "skip TLS verification for Puppet and sensu-backend",
 			Value:    &handler.puppetInsecureSkipVerify,
 		},
+		&sensu.PluginConfigOption[bool]{
+			Path:     "strict-tls",
+			Env:      "PUPPET_STRICT_TLS",
+			Argument: "strict-tls",
+			Usage:    "reject contradictory TLS settings, such as a CA certificate with --insecure-skip-tls-verify",
+			Value:    &handler.strictTLS,
+		},
+		&sensu.PluginConfigOption[string]{
+			Path:     "tls-renegotiation",
+			Env:      "PUPPET_TLS_RENEGOTIATION",
+			Argument: "tls-renegotiation",
+			Default:  renegotiateNever,
+			Allow:    []string{renegotiateNever, renegotiateOnce, renegotiateFreely},
+			Usage:    "TLS renegotiation accepted from PuppetDB (never, once or freely)",
+			Value:    &handler.tlsRenegotiation,
+		},
 		&sensu.PluginConfigOption[string]{
 			Path:     "node-name",
 			Env:      "PUPPET_NODE_NAME",
@@ -91,6 +337,78 @@ var (
 			Usage:    "node name to use for the entity when querying PuppetDB",
 			Value:    &handler.puppetNodeName,
 		},
+		&sensu.MapPluginConfigOption[string]{
+			Path:     "namespace-environments",
+			Env:      "PUPPET_NAMESPACE_ENVIRONMENTS",
+			Argument: "namespace-environments",
+			Usage:    "Puppet environment of the nodes matched by the entities of each Sensu namespace (e.g. staging=staging,default=production)",
+			Value:    &handler.namespaceEnvironments,
+		},
+		&sensu.PluginConfigOption[bool]{
+			Path:     "case-insensitive",
+			Env:      "PUPPET_CASE_INSENSITIVE",
+			Argument: "case-insensitive",
+			Usage:    "lowercase the node name and match it against PuppetDB certnames regardless of case",
+			Value:    &handler.caseInsensitive,
+		},
+		&sensu.PluginConfigOption[bool]{
+			Path:     "include-deactivated",
+			Env:      "PUPPET_INCLUDE_DEACTIVATED",
+			Argument: "include-deactivated",
+			Usage:    "consider deactivated Puppet nodes as existing",
+			Value:    &handler.includeDeactivated,
+		},
+		&sensu.PluginConfigOption[bool]{
+			Path:     "include-expired",
+			Env:      "PUPPET_INCLUDE_EXPIRED",
+			Argument: "include-expired",
+			Usage:    "consider expired Puppet nodes as existing",
+			Value:    &handler.includeExpired,
+		},
+		&sensu.PluginConfigOption[bool]{
+			Path:     "inventory-fallback",
+			Env:      "PUPPET_INVENTORY_FALLBACK",
+			Argument: "inventory-fallback",
+			Usage:    "look the Puppet nodes not found up in the PuppetDB inventory by certname or fqdn fact before deregistering their entities",
+			Value:    &handler.inventoryFallback,
+		},
+		&sensu.PluginConfigOption[string]{
+			Path:     "node-name-source",
+			Env:      "PUPPET_NODE_NAME_SOURCE",
+			Argument: "node-name-source",
+			Default:  puppet.NameSourceEntityName,
+			Allow:    puppet.NameSources,
+			Usage:    "entity attribute used as node name: entity-name, hostname, fqdn or annotation (the node-name annotation)",
+			Value:    &handler.nodeNameSource,
+		},
+		&sensu.PluginConfigOption[string]{
+			Path:     "node-name-annotation",
+			Env:      "PUPPET_NODE_NAME_ANNOTATION",
+			Argument: "node-name-annotation",
+			Usage:    "entity annotation holding the node name, overriding the node-name option when present",
+			Value:    &handler.nodeNameAnnotation,
+		},
+		&sensu.SlicePluginConfigOption[string]{
+			Path:     "fallback-names",
+			Env:      "PUPPET_FALLBACK_NAMES",
+			Argument: "fallback-names",
+			Usage:    "node name sources (entity-name, hostname, fqdn or annotation) tried in order when the node is absent",
+			Value:    &handler.fallbackNames,
+		},
+		&sensu.PluginConfigOption[bool]{
+			Path:     "canonicalize-dns",
+			Env:      "PUPPET_CANONICALIZE_DNS",
+			Argument: "canonicalize-dns",
+			Usage:    "use the name the reverse DNS lookup of the entity's address resolves to as node name",
+			Value:    &handler.canonicalizeDNS,
+		},
+		&sensu.SlicePluginConfigOption[string]{
+			Path:     "node-name-rewrite",
+			Env:      "PUPPET_NODE_NAME_REWRITE",
+			Argument: "node-name-rewrite",
+			Usage:    "rewrite rules (s/pattern/replacement/flags) applied in order to the entity name to derive the node name",
+			Value:    &handler.nodeNameRewrites,
+		},
 		&sensu.PluginConfigOption[string]{
 			Path:      "sensu-api-url",
 			Env:       "SENSU_API_URL",
@@ -100,14 +418,37 @@ var (
 			Usage:     "The Sensu API URL",
 			Value:     &handler.sensuAPIURL,
 		},
+		&sensu.MapPluginConfigOption[string]{
+			Path:     "sensu-namespace-api-urls",
+			Env:      "SENSU_NAMESPACE_API_URLS",
+			Argument: "sensu-namespace-api-urls",
+			Usage:    "Sensu API URLs of the backends serving each namespace instead of the Sensu API URL (e.g. staging=https://staging:8080)",
+			Value:    &handler.namespaceAPIURLs,
+		},
 		&sensu.PluginConfigOption[string]{
 			Path:      "sensu-api-key",
 			Env:       "SENSU_API_KEY",
 			Argument:  "sensu-api-key",
 			Shorthand: "a",
+			Secret:    true,
 			Usage:     "The Sensu API key",
 			Value:     &handler.sensuAPIKey,
 		},
+		&sensu.MapPluginConfigOption[string]{
+			Path:     "sensu-namespace-api-keys",
+			Env:      "SENSU_NAMESPACE_API_KEYS",
+			Argument: "sensu-namespace-api-keys",
+			Secret:   true,
+			Usage:    "Sensu API keys used for the entities of each namespace instead of the Sensu API key (e.g. staging=<key>,production=<key>)",
+			Value:    &handler.namespaceAPIKeys,
+		},
+		&sensu.PluginConfigOption[string]{
+			Path:     "sensu-namespace-api-keys-file",
+			Env:      "SENSU_NAMESPACE_API_KEYS_FILE",
+			Argument: "sensu-namespace-api-keys-file",
+			Usage:    "file of the Sensu API keys used for the entities of each namespace, one namespace=key pair per line",
+			Value:    &handler.namespaceAPIKeysFile,
+		},
 		&sensu.PluginConfigOption[string]{
 			Path:      "sensu-ca-cert",
 			Env:       "SENSU_CA_CERT",
@@ -116,15 +457,849 @@ var (
 			Usage:     "The Sensu Go CA Certificate",
 			Value:     &handler.sensuCACert,
 		},
+		&sensu.PluginConfigOption[bool]{
+			Path:     "sensu-use-puppet-cert",
+			Env:      "SENSU_USE_PUPPET_CERT",
+			Argument: "sensu-use-puppet-cert",
+			Usage:    "present the Puppet certificate and private key as client certificate to the Sensu API",
+			Value:    &handler.sensuUsePuppetCert,
+		},
+		&sensu.PluginConfigOption[string]{
+			Path:     "sensu-access-token",
+			Env:      "SENSU_ACCESS_TOKEN",
+			Argument: "sensu-access-token",
+			Secret:   true,
+			Usage:    "Sensu API access token, used instead of the API key",
+			Value:    &handler.sensuAccessToken,
+		},
+		&sensu.PluginConfigOption[string]{
+			Path:     "sensu-refresh-token",
+			Env:      "SENSU_REFRESH_TOKEN",
+			Argument: "sensu-refresh-token",
+			Secret:   true,
+			Usage:    "Sensu API refresh token, used to renew the access token when it expires",
+			Value:    &handler.sensuRefreshToken,
+		},
+		&sensu.PluginConfigOption[string]{
+			Path:     "sensu-token-file",
+			Env:      "SENSU_TOKEN_FILE",
+			Argument: "sensu-token-file",
+			Usage:    "path to a JSON file holding the Sensu API access_token and refresh_token, updated when refreshed",
+			Value:    &handler.sensuTokenFile,
+		},
+		&sensu.PluginConfigOption[bool]{
+			Path:     "sensu-spnego",
+			Env:      "SENSU_SPNEGO",
+			Argument: "sensu-spnego",
+			Usage:    "authenticate to the Sensu API published through a reverse proxy with Kerberos SPNEGO rather than an API key or token",
+			Value:    &handler.sensuSPNEGO,
+		},
+		&sensu.PluginConfigOption[int]{
+			Path:     "max-response-size",
+			Env:      "PUPPET_MAX_RESPONSE_SIZE",
+			Argument: "max-response-size",
+			Default:  defaultMaxResponseSize,
+			Usage:    "maximum size in bytes of the responses read from PuppetDB, the Sensu API and other services, 0 to disable",
+			Value:    &handler.maxResponseSize,
+		},
+		&sensu.PluginConfigOption[int]{
+			Path:     "request-timeout",
+			Env:      "PUPPET_REQUEST_TIMEOUT",
+			Argument: "request-timeout",
+			Default:  defaultRequestTimeout,
+			Usage:    "timeout in seconds of each HTTP request, timed out PuppetDB queries are retried within the deadline (0 to disable)",
+			Value:    &handler.requestTimeout,
+		},
+		&sensu.PluginConfigOption[int]{
+			Path:     "deadline",
+			Env:      "PUPPET_DEADLINE",
+			Argument: "deadline",
+			Usage:    "timeout in seconds of the whole handler execution (0 to disable)",
+			Value:    &handler.deadline,
+		},
+		&sensu.PluginConfigOption[int]{
+			Path:     "recheck-after",
+			Env:      "PUPPET_RECHECK_AFTER",
+			Argument: "recheck-after",
+			Usage:    "seconds to wait before querying PuppetDB again when the node is not found, before deciding (0 to disable)",
+			Value:    &handler.recheckAfter,
+		},
+		&sensu.PluginConfigOption[string]{
+			Path:     "puppet-proxy-url",
+			Env:      "PUPPET_PROXY_URL",
+			Argument: "puppet-proxy-url",
+			Usage:    "proxy URL (http, https, socks5 or socks5h) used to reach PuppetDB",
+			Value:    &handler.puppetProxyURL,
+		},
+		&sensu.PluginConfigOption[string]{
+			Path:     "consul-addr",
+			Env:      "PUPPET_CONSUL_ADDR",
+			Argument: "consul-addr",
+			Default:  defaultConsulAddr,
+			Usage:    "Consul HTTP API address resolving the consul:// endpoint and Sensu API URLs",
+			Value:    &handler.consulAddr,
+		},
+		&sensu.PluginConfigOption[string]{
+			Path:     "consul-token",
+			Env:      "PUPPET_CONSUL_TOKEN",
+			Argument: "consul-token",
+			Secret:   true,
+			Usage:    "Consul ACL token",
+			Value:    &handler.consulToken,
+		},
+		&sensu.PluginConfigOption[string]{
+			Path:     "sensu-proxy-url",
+			Env:      "SENSU_PROXY_URL",
+			Argument: "sensu-proxy-url",
+			Usage:    "proxy URL (http, https, socks5 or socks5h) used to reach the Sensu API",
+			Value:    &handler.sensuProxyURL,
+		},
+		&sensu.SlicePluginConfigOption[string]{
+			Path:     "dns-servers",
+			Env:      "PUPPET_DNS_SERVERS",
+			Argument: "dns-servers",
+			Usage:    "DNS servers (IP address with an optional port) resolving the names of PuppetDB, the Sensu API and the SRV records instead of the host's resolver",
+			Value:    &handler.dnsServers,
+		},
+		&sensu.PluginConfigOption[int]{
+			Path:     "dns-timeout",
+			Env:      "PUPPET_DNS_TIMEOUT",
+			Argument: "dns-timeout",
+			Usage:    "timeout in seconds of each DNS lookup of PuppetDB, the Sensu API and the SRV records (0 to disable)",
+			Value:    &handler.dnsTimeout,
+		},
+		&sensu.PluginConfigOption[string]{
+			Path:     "puppet-http-version",
+			Env:      "PUPPET_HTTP_VERSION",
+			Argument: "puppet-http-version",
+			Default:  httpVersionAuto,
+			Allow:    httpVersions,
+			Usage:    "HTTP version used to reach PuppetDB (auto, http1, or http2 with prior knowledge for http URLs)",
+			Value:    &handler.puppetHTTPVersion,
+		},
+		&sensu.PluginConfigOption[string]{
+			Path:     "sensu-http-version",
+			Env:      "SENSU_HTTP_VERSION",
+			Argument: "sensu-http-version",
+			Default:  httpVersionAuto,
+			Allow:    httpVersions,
+			Usage:    "HTTP version used to reach the Sensu API (auto, http1, or http2 with prior knowledge for http URLs)",
+			Value:    &handler.sensuHTTPVersion,
+		},
+		&sensu.PluginConfigOption[int]{
+			Path:     "max-redirects",
+			Env:      "PUPPET_MAX_REDIRECTS",
+			Argument: "max-redirects",
+			Default:  defaultMaxRedirects,
+			Usage:    "maximum number of HTTP redirects followed by the PuppetDB and Sensu API clients (0 to disable)",
+			Value:    &handler.maxRedirects,
+		},
+		&sensu.PluginConfigOption[bool]{
+			Path:     "redirect-forward-auth",
+			Env:      "PUPPET_REDIRECT_FORWARD_AUTH",
+			Argument: "redirect-forward-auth",
+			Usage:    "forward the authorization headers on redirects to another host",
+			Value:    &handler.redirectForwardAuth,
+		},
+		&sensu.PluginConfigOption[string]{
+			Path:     "request-id",
+			Env:      "PUPPET_REQUEST_ID",
+			Argument: "request-id",
+			Usage:    "correlation ID sent to PuppetDB and Sensu and included in the logs, generated if not set",
+			Value:    &handler.requestID,
+		},
+		&sensu.PluginConfigOption[bool]{
+			Path:     "trace-connections",
+			Env:      "PUPPET_TRACE_CONNECTIONS",
+			Argument: "trace-connections",
+			Usage:    "log the DNS, connect, TLS handshake and first byte timings of each HTTP request",
+			Value:    &handler.traceConnections,
+		},
+		&sensu.PluginConfigOption[bool]{
+			Path:     "explain",
+			Env:      "PUPPET_EXPLAIN",
+			Argument: "explain",
+			Usage:    "log the rules evaluated for the event, in order, and which one determined the outcome",
+			Value:    &handler.explain,
+		},
+		&sensu.PluginConfigOption[bool]{
+			Path:     "preflight",
+			Env:      "PUPPET_PREFLIGHT",
+			Argument: "preflight",
+			Usage:    "check that PuppetDB and the Sensu API are reachable before processing the event, reporting the TCP, TLS and HTTP result of each",
+			Value:    &handler.preflight,
+		},
+		&sensu.PluginConfigOption[string]{
+			Path:     "har-file",
+			Env:      "PUPPET_HAR_FILE",
+			Argument: "har-file",
+			Usage:    "file recording the HTTP exchanges of the execution in HAR format, with the secrets redacted, to attach to support tickets",
+			Value:    &handler.harFile,
+		},
+		&sensu.PluginConfigOption[string]{
+			Path:     "action",
+			Env:      "PUPPET_ACTION",
+			Argument: "action",
+			Default:  actionDelete,
+			Allow:    []string{actionDelete, actionTombstone},
+			Usage:    "action to take on entities without a Puppet node (delete or tombstone)",
+			Value:    &handler.action,
+		},
+		&sensu.PluginConfigOption[string]{
+			Path:     "nats-url",
+			Env:      "PUPPET_NATS_URL",
+			Argument: "nats-url",
+			Usage:    "NATS server URL to publish deregistration records to",
+			Value:    &handler.natsURL,
+		},
+		&sensu.PluginConfigOption[string]{
+			Path:     "nats-subject",
+			Env:      "PUPPET_NATS_SUBJECT",
+			Argument: "nats-subject",
+			Default:  "sensu.puppet.deregistrations",
+			Usage:    "NATS subject to publish deregistration records to",
+			Value:    &handler.natsSubject,
+		},
+		&sensu.SlicePluginConfigOption[string]{
+			Path:     "kafka-brokers",
+			Env:      "PUPPET_KAFKA_BROKERS",
+			Argument: "kafka-brokers",
+			Usage:    "Kafka broker addresses (host:port) to publish deregistration records to",
+			Value:    &handler.kafkaBrokers,
+		},
+		&sensu.PluginConfigOption[string]{
+			Path:     "kafka-topic",
+			Env:      "PUPPET_KAFKA_TOPIC",
+			Argument: "kafka-topic",
+			Default:  "sensu-puppet-deregistrations",
+			Usage:    "Kafka topic to publish deregistration records to",
+			Value:    &handler.kafkaTopic,
+		},
+		&sensu.PluginConfigOption[string]{
+			Path:     "agent-events-url",
+			Env:      "PUPPET_AGENT_EVENTS_URL",
+			Argument: "agent-events-url",
+			Usage:    "local sensu-agent events API URL (e.g. http://127.0.0.1:3031/events) to publish deregistration records to",
+			Value:    &handler.agentEventsURL,
+		},
+		&sensu.PluginConfigOption[string]{
+			Path:     "agent-event-check",
+			Env:      "PUPPET_AGENT_EVENT_CHECK",
+			Argument: "agent-event-check",
+			Default:  "puppet-deregistration",
+			Usage:    "check name of the events published to the agent events API",
+			Value:    &handler.agentEventCheck,
+		},
+		&sensu.SlicePluginConfigOption[string]{
+			Path:     "agent-event-handlers",
+			Env:      "PUPPET_AGENT_EVENT_HANDLERS",
+			Argument: "agent-event-handlers",
+			Usage:    "handlers of the events published to the agent events API",
+			Value:    &handler.agentEventHandlers,
+		},
+		&sensu.PluginConfigOption[bool]{
+			Path:     "publish-kept",
+			Env:      "PUPPET_PUBLISH_KEPT",
+			Argument: "publish-kept",
+			Usage:    "also publish a record for entities kept because their Puppet node exists",
+			Value:    &handler.publishKept,
+		},
+		&sensu.PluginConfigOption[bool]{
+			Path:     "stamp-last-verified",
+			Env:      "PUPPET_STAMP_LAST_VERIFIED",
+			Argument: "stamp-last-verified",
+			Usage:    "annotate the entities kept because their Puppet node exists with the time the node was last found",
+			Value:    &handler.stampLastVerified,
+		},
+		&sensu.PluginConfigOption[string]{
+			Path:     "message-format",
+			Env:      "PUPPET_MESSAGE_FORMAT",
+			Argument: "message-format",
+			Default:  formatJSON,
+			Allow:    []string{formatJSON, formatCloudEvents},
+			Usage:    "format of the published records (json or cloudevents)",
+			Value:    &handler.messageFormat,
+		},
+		&sensu.PluginConfigOption[string]{
+			Path:     "cloudevents-source",
+			Env:      "PUPPET_CLOUDEVENTS_SOURCE",
+			Argument: "cloudevents-source",
+			Default:  "/sensu-puppet-handler",
+			Usage:    "source attribute of the published CloudEvents",
+			Value:    &handler.cloudEventsSource,
+		},
+		&sensu.PluginConfigOption[string]{
+			Path:     "cloudevents-type",
+			Env:      "PUPPET_CLOUDEVENTS_TYPE",
+			Argument: "cloudevents-type",
+			Default:  "io.sensu.puppet.deregistration",
+			Usage:    "type attribute of the published CloudEvents",
+			Value:    &handler.cloudEventsType,
+		},
+		&sensu.PluginConfigOption[string]{
+			Path:     "state-dir",
+			Env:      "PUPPET_STATE_DIR",
+			Argument: "state-dir",
+			Default:  filepath.Join(os.TempDir(), "sensu-puppet-handler"),
+			Usage:    "directory where state is kept between handler executions",
+			Value:    &handler.stateDir,
+		},
+		&sensu.PluginConfigOption[string]{
+			Path:     "config-dir",
+			Env:      "PUPPET_CONFIG_DIR",
+			Argument: "config-dir",
+			Usage:    "directory of YAML configuration fragments merged in lexical order, overridden by the environment and flags",
+			Value:    &handler.configDir,
+		},
+		&sensu.PluginConfigOption[string]{
+			Path:     "env-prefix",
+			Env:      "PUPPET_ENV_PREFIX",
+			Argument: "env-prefix",
+			Usage:    "prefix replacing the environment variables of the other options, named after the prefix and the option, e.g. SPH_ for SPH_SENSU_API_URL",
+			Value:    &handler.envPrefix,
+		},
+		&sensu.PluginConfigOption[int]{
+			Path:     "negative-cache-ttl",
+			Env:      "PUPPET_NEGATIVE_CACHE_TTL",
+			Argument: "negative-cache-ttl",
+			Usage:    "seconds during which repeated events for a just deregistered entity are ignored (0 to disable)",
+			Value:    &handler.negativeCacheTTL,
+		},
+		&sensu.SlicePluginConfigOption[string]{
+			Path:     "annotation-allow",
+			Env:      "PUPPET_ANNOTATION_ALLOW",
+			Argument: "annotation-allow",
+			Usage:    "options that can be overridden through annotations, all but the denied ones if empty",
+			Value:    &handler.annotationAllow,
+		},
+		&sensu.SlicePluginConfigOption[string]{
+			Path:     "annotation-deny",
+			Env:      "PUPPET_ANNOTATION_DENY",
+			Argument: "annotation-deny",
+			Default:  defaultAnnotationDeny,
+			Usage:    "options that cannot be overridden through annotations",
+			Value:    &handler.annotationDeny,
+		},
+		&sensu.PluginConfigOption[string]{
+			Path:     "pagerduty-routing-key",
+			Env:      "PUPPET_PAGERDUTY_ROUTING_KEY",
+			Argument: "pagerduty-routing-key",
+			Secret:   true,
+			Usage:    "PagerDuty Events API routing key used to alert on repeated handler failures",
+			Value:    &handler.pagerDutyRoutingKey,
+		},
+		&sensu.PluginConfigOption[int]{
+			Path:     "pagerduty-failure-threshold",
+			Env:      "PUPPET_PAGERDUTY_FAILURE_THRESHOLD",
+			Argument: "pagerduty-failure-threshold",
+			Default:  3,
+			Usage:    "number of consecutive handler failures before alerting PagerDuty",
+			Value:    &handler.pagerDutyThreshold,
+		},
+		&sensu.PluginConfigOption[string]{
+			Path:     "servicenow-url",
+			Env:      "PUPPET_SERVICENOW_URL",
+			Argument: "servicenow-url",
+			Usage:    "ServiceNow instance URL, when set entities are only deregistered if also absent or retired in the CMDB",
+			Value:    &handler.serviceNowURL,
+		},
+		&sensu.PluginConfigOption[string]{
+			Path:     "servicenow-username",
+			Env:      "PUPPET_SERVICENOW_USERNAME",
+			Argument: "servicenow-username",
+			Usage:    "ServiceNow username",
+			Value:    &handler.serviceNowUsername,
+		},
+		&sensu.PluginConfigOption[string]{
+			Path:     "servicenow-password",
+			Env:      "PUPPET_SERVICENOW_PASSWORD",
+			Argument: "servicenow-password",
+			Secret:   true,
+			Usage:    "ServiceNow password",
+			Value:    &handler.serviceNowPassword,
+		},
+		&sensu.PluginConfigOption[string]{
+			Path:     "servicenow-table",
+			Env:      "PUPPET_SERVICENOW_TABLE",
+			Argument: "servicenow-table",
+			Default:  "cmdb_ci_server",
+			Usage:    "ServiceNow CMDB table holding the configuration items",
+			Value:    &handler.serviceNowTable,
+		},
+		&sensu.PluginConfigOption[string]{
+			Path:     "servicenow-name-field",
+			Env:      "PUPPET_SERVICENOW_NAME_FIELD",
+			Argument: "servicenow-name-field",
+			Default:  "name",
+			Usage:    "ServiceNow CMDB field matched against the Puppet node name",
+			Value:    &handler.serviceNowNameField,
+		},
+		&sensu.SlicePluginConfigOption[string]{
+			Path:     "servicenow-retired-statuses",
+			Env:      "PUPPET_SERVICENOW_RETIRED_STATUSES",
+			Argument: "servicenow-retired-statuses",
+			Default:  []string{"7", "100"},
+			Usage:    "ServiceNow CI install statuses considered retired",
+			Value:    &handler.serviceNowRetiredStatuses,
+		},
+		&sensu.PluginConfigOption[string]{
+			Path:     "rest-url",
+			Env:      "PUPPET_REST_URL",
+			Argument: "rest-url",
+			Usage:    "Go template of the URL of the node in the generic REST inventory, with the node name as {{ .Name }} (e.g. https://cmdb.example.com/api/hosts/{{ .Name }})",
+			Value:    &handler.restURL,
+		},
+		&sensu.PluginConfigOption[string]{
+			Path:     "rest-username",
+			Env:      "PUPPET_REST_USERNAME",
+			Argument: "rest-username",
+			Usage:    "generic REST inventory username",
+			Value:    &handler.restUsername,
+		},
+		&sensu.PluginConfigOption[string]{
+			Path:     "rest-password",
+			Env:      "PUPPET_REST_PASSWORD",
+			Argument: "rest-password",
+			Secret:   true,
+			Usage:    "generic REST inventory password",
+			Value:    &handler.restPassword,
+		},
+		&sensu.PluginConfigOption[string]{
+			Path:     "rest-token",
+			Env:      "PUPPET_REST_TOKEN",
+			Argument: "rest-token",
+			Secret:   true,
+			Usage:    "bearer token authenticating against the generic REST inventory, instead of the username and password",
+			Value:    &handler.restToken,
+		},
+		&sensu.PluginConfigOption[string]{
+			Path:     "rest-exists-field",
+			Env:      "PUPPET_REST_EXISTS_FIELD",
+			Argument: "rest-exists-field",
+			Usage:    "dot-separated path of the field of the generic REST inventory response which is false when the node does not exist",
+			Value:    &handler.restExistsField,
+		},
+		&sensu.PluginConfigOption[string]{
+			Path:     "rest-deactivated-field",
+			Env:      "PUPPET_REST_DEACTIVATED_FIELD",
+			Argument: "rest-deactivated-field",
+			Usage:    "dot-separated path of the field of the generic REST inventory response which is true when the node is deactivated",
+			Value:    &handler.restDeactivatedField,
+		},
+		&sensu.PluginConfigOption[string]{
+			Path:     "rest-last-seen-field",
+			Env:      "PUPPET_REST_LAST_SEEN_FIELD",
+			Argument: "rest-last-seen-field",
+			Usage:    "dot-separated path of the field of the generic REST inventory response holding when the node was last seen, as a RFC 3339 time or Unix timestamp",
+			Value:    &handler.restLastSeenField,
+		},
+		&sensu.PluginConfigOption[int]{
+			Path:     "rest-max-age",
+			Env:      "PUPPET_REST_MAX_AGE",
+			Argument: "rest-max-age",
+			Usage:    "age in seconds of the last seen time after which the node is considered absent from the generic REST inventory",
+			Value:    &handler.restMaxAge,
+		},
+		&sensu.PluginConfigOption[string]{
+			Path:     "exec-command",
+			Env:      "PUPPET_EXEC_COMMAND",
+			Argument: "exec-command",
+			Usage:    "inventory command of the exec source, given the node name and the event as JSON on stdin and answering with whether the node exists as JSON on stdout",
+			Value:    &handler.execCommand,
+		},
+		&sensu.SlicePluginConfigOption[string]{
+			Path:     "exec-args",
+			Env:      "PUPPET_EXEC_ARGS",
+			Argument: "exec-args",
+			Usage:    "arguments of the inventory command of the exec source",
+			Value:    &handler.execArgs,
+		},
+		&sensu.SlicePluginConfigOption[string]{
+			Path:     "sources",
+			Env:      "PUPPET_SOURCES",
+			Argument: "sources",
+			Usage:    "inventory sources to consult in order (puppetdb, servicenow, generic-rest, exec), defaults to PuppetDB and the ServiceNow CMDB if configured",
+			Value:    &handler.sources,
+		},
+		&sensu.PluginConfigOption[string]{
+			Path:     "source-policy",
+			Env:      "PUPPET_SOURCE_POLICY",
+			Argument: "source-policy",
+			Default:  policyAllAbsent,
+			Allow:    []string{policyAllAbsent, policyAnyAbsent, policyWeighted},
+			Usage:    "policy combining the inventory sources results (all-absent, any-absent or weighted)",
+			Value:    &handler.sourcePolicy,
+		},
+		&sensu.MapPluginConfigOption[int]{
+			Path:     "source-weights",
+			Env:      "PUPPET_SOURCE_WEIGHTS",
+			Argument: "source-weights",
+			Usage:    "weight of each inventory source with the weighted policy (e.g. puppetdb=2,servicenow=1), defaults to 1",
+			Value:    &handler.sourceWeights,
+		},
+		&sensu.PluginConfigOption[int]{
+			Path:     "absent-weight-threshold",
+			Env:      "PUPPET_ABSENT_WEIGHT_THRESHOLD",
+			Argument: "absent-weight-threshold",
+			Default:  1,
+			Usage:    "total weight of the sources reporting the node as absent required to deregister with the weighted policy",
+			Value:    &handler.absentWeightThreshold,
+		},
+		&sensu.PluginConfigOption[bool]{
+			Path:     "strict-events",
+			Env:      "PUPPET_STRICT_EVENTS",
+			Argument: "strict-events",
+			Usage:    "reject the events with fields unknown to the Sensu event schema or missing required fields, instead of ignoring the unknown fields",
+			Value:    &handler.strictEvents,
+		},
+		&sensu.SlicePluginConfigOption[string]{
+			Path:     "trigger-checks",
+			Env:      "PUPPET_TRIGGER_CHECKS",
+			Argument: "trigger-checks",
+			Default:  []string{"keepalive"},
+			Usage:    "names of the checks whose events trigger the Puppet node lookup",
+			Value:    &handler.triggerChecks,
+		},
+		&sensu.PluginConfigOption[string]{
+			Path:     "entity-name",
+			Env:      "PUPPET_ENTITY_NAME",
+			Argument: "entity-name",
+			Usage:    "entity to check and deregister instead of the event entity, for ad hoc runs without an event",
+			Value:    &handler.entityName,
+		},
+		&sensu.PluginConfigOption[string]{
+			Path:     "entity-namespace",
+			Env:      "PUPPET_ENTITY_NAMESPACE",
+			Argument: "entity-namespace",
+			Usage:    "namespace of the entity given by --entity-name, the event namespace if not set",
+			Value:    &handler.entityNamespace,
+		},
+		&sensu.PluginConfigOption[string]{
+			Path:     "label-selector",
+			Env:      "PUPPET_LABEL_SELECTOR",
+			Argument: "label-selector",
+			Usage:    "label selector (e.g. \"tier != critical\") restricting the entities eligible for deregistration",
+			Value:    &handler.labelSelector,
+		},
+		&sensu.SlicePluginConfigOption[string]{
+			Path:     "require-subscription",
+			Env:      "PUPPET_REQUIRE_SUBSCRIPTION",
+			Argument: "require-subscription",
+			Usage:    "subscriptions of which entities must have at least one to be eligible for deregistration",
+			Value:    &handler.requireSubscriptions,
+		},
+		&sensu.SlicePluginConfigOption[string]{
+			Path:     "exclude-subscription",
+			Env:      "PUPPET_EXCLUDE_SUBSCRIPTION",
+			Argument: "exclude-subscription",
+			Usage:    "subscriptions excluding the entities having any of them from deregistration",
+			Value:    &handler.excludeSubscriptions,
+		},
+		&sensu.PluginConfigOption[string]{
+			Path:     "protected-nodes-file",
+			Env:      "PUPPET_PROTECTED_NODES_FILE",
+			Argument: "protected-nodes-file",
+			Usage:    "file listing the entity or node names and glob patterns that are never deregistered, one per line",
+			Value:    &handler.protectedNodesFile,
+		},
+		&sensu.PluginConfigOption[bool]{
+			Path:     "skip-silenced",
+			Env:      "PUPPET_SKIP_SILENCED",
+			Argument: "skip-silenced",
+			Usage:    "keep entities targeted by an active silencing entry",
+			Value:    &handler.skipSilenced,
+		},
+		&sensu.PluginConfigOption[bool]{
+			Path:     "reverify",
+			Env:      "PUPPET_REVERIFY",
+			Argument: "reverify",
+			Usage:    "fetch the entity and its keepalive event again right before deregistering it, and keep it if its agent came back",
+			Value:    &handler.reverify,
+		},
+		&sensu.PluginConfigOption[int]{
+			Path:     "min-last-seen",
+			Env:      "PUPPET_MIN_LAST_SEEN",
+			Argument: "min-last-seen",
+			Usage:    "fetch the entity right before deregistering it, and keep it if its agent was seen less than this many seconds ago (0 to disable)",
+			Value:    &handler.minLastSeen,
+		},
+		&sensu.PluginConfigOption[int]{
+			Path:     "passing-check-window",
+			Env:      "PUPPET_PASSING_CHECK_WINDOW",
+			Argument: "passing-check-window",
+			Usage:    "fetch the events of the entity right before deregistering it, and keep it if one of its checks other than keepalive passed in the last this many seconds (0 to disable)",
+			Value:    &handler.passingCheckWindow,
+		},
+		&sensu.PluginConfigOption[string]{
+			Path:     "approval-queue",
+			Env:      "PUPPET_APPROVAL_QUEUE",
+			Argument: "approval-queue",
+			Usage:    "file to queue the deregistrations to for approval instead of taking them, the approved ones being taken by the apply subcommand",
+			Value:    &handler.approvalQueue,
+		},
+		&sensu.PluginConfigOption[bool]{
+			Path:     "report-license-usage",
+			Env:      "PUPPET_REPORT_LICENSE_USAGE",
+			Argument: "report-license-usage",
+			Usage:    "log the licensed entities reclaimed and the remaining headroom of the Sensu license after deleting an entity",
+			Value:    &handler.reportLicenseUsage,
+		},
+		&sensu.PluginConfigOption[bool]{
+			Path:     "check-permissions",
+			Env:      "PUPPET_CHECK_PERMISSIONS",
+			Argument: "check-permissions",
+			Usage:    "verify that the Sensu API credentials are allowed to deregister entities in the namespace of the event before querying PuppetDB",
+			Value:    &handler.checkPermissions,
+		},
+		&sensu.PluginConfigOption[string]{
+			Path:     "pre-delete-hook",
+			Env:      "PUPPET_PRE_DELETE_HOOK",
+			Argument: "pre-delete-hook",
+			Usage:    "command run with the event and the decision as JSON on stdin before deregistering the entity, which is kept if the command fails",
+			Value:    &handler.preDeleteHook,
+		},
+		&sensu.PluginConfigOption[string]{
+			Path:     "post-delete-hook",
+			Env:      "PUPPET_POST_DELETE_HOOK",
+			Argument: "post-delete-hook",
+			Usage:    "command run with the event and the decision as JSON on stdin after deregistering the entity",
+			Value:    &handler.postDeleteHook,
+		},
+		&sensu.PluginConfigOption[string]{
+			Path:     "decision-hook",
+			Env:      "PUPPET_DECISION_HOOK",
+			Argument: "decision-hook",
+			Usage:    "command run with the event and the inventory lookup as JSON on stdin, deciding whether the entity is kept, deregistered or silenced, replacing the inventory sources policy",
+			Value:    &handler.decisionHook,
+		},
+		&sensu.PluginConfigOption[int]{
+			Path:     "silence-expire",
+			Env:      "PUPPET_SILENCE_EXPIRE",
+			Argument: "silence-expire",
+			Default:  defaultSilenceExpire,
+			Usage:    "duration in seconds of the silencing entries created for the entities silenced by the decision hook (0 for no expiration)",
+			Value:    &handler.silenceExpire,
+		},
+		&sensu.PluginConfigOption[string]{
+			Path:     "condition",
+			Env:      "PUPPET_CONDITION",
+			Argument: "condition",
+			Usage:    "CEL expression over event, node and status deciding whether the entity is deregistered, replacing the inventory sources policy",
+			Value:    &handler.condition,
+		},
+		&sensu.PluginConfigOption[string]{
+			Path:     "opa-url",
+			Env:      "PUPPET_OPA_URL",
+			Argument: "opa-url",
+			Usage:    "Open Policy Agent data API URL of the deregistration policy (e.g. http://localhost:8181/v1/data/sensu/deregistration), consulted before deregistering entities",
+			Value:    &handler.opaURL,
+		},
+		&sensu.PluginConfigOption[string]{
+			Path:     "opa-token",
+			Env:      "PUPPET_OPA_TOKEN",
+			Argument: "opa-token",
+			Secret:   true,
+			Usage:    "bearer token authenticating the handler to Open Policy Agent",
+			Value:    &handler.opaToken,
+		},
+		&sensu.PluginConfigOption[string]{
+			Path:     "log-template",
+			Env:      "PUPPET_LOG_TEMPLATE",
+			Argument: "log-template",
+			Usage:    "Go template of the audit line logged for each deregistered entity",
+			Value:    &handler.logTemplate,
+		},
+		&sensu.PluginConfigOption[int]{
+			Path:     "log-sample-rate",
+			Env:      "PUPPET_LOG_SAMPLE_RATE",
+			Argument: "log-sample-rate",
+			Default:  1,
+			Usage:    "log only one out of this many executions keeping their entity, deregistrations and errors are always logged",
+			Value:    &handler.logSampleRate,
+		},
+		&sensu.PluginConfigOption[string]{
+			Path:     "output",
+			Env:      "PUPPET_OUTPUT",
+			Argument: "output",
+			Default:  outputText,
+			Allow:    []string{outputText, outputMetrics},
+			Usage:    "output of the handler on stdout: text (log lines only) or metrics summarizing the execution",
+			Value:    &handler.output,
+		},
+		&sensu.PluginConfigOption[string]{
+			Path:     "metrics-format",
+			Env:      "PUPPET_METRICS_FORMAT",
+			Argument: "metrics-format",
+			Default:  metricsGraphite,
+			Allow:    []string{metricsGraphite, metricsInflux},
+			Usage:    "format of the metrics output (graphite_plaintext or influxdb_line)",
+			Value:    &handler.metricsFormat,
+		},
+		&sensu.PluginConfigOption[bool]{
+			Path:     "tee",
+			Env:      "PUPPET_TEE",
+			Argument: "tee",
+			Usage:    "write the event JSON to stdout after processing it, for chains of piped handlers",
+			Value:    &handler.tee,
+		},
+		&sensu.PluginConfigOption[string]{
+			Path:     "message-template",
+			Env:      "PUPPET_MESSAGE_TEMPLATE",
+			Argument: "message-template",
+			Usage:    "Go template of the published messages, replacing the JSON record",
+			Value:    &handler.messageTemplate,
+		},
+		&sensu.SlicePluginConfigOption[string]{
+			Path:     "facts",
+			Env:      "PUPPET_FACTS",
+			Argument: "facts",
+			Usage:    "PuppetDB facts merged into the entity labels by the mutate facts subcommand, dots select structured fact values",
+			Value:    &handler.facts,
+		},
+		&sensu.PluginConfigOption[string]{
+			Path:     "fact-label-prefix",
+			Env:      "PUPPET_FACT_LABEL_PREFIX",
+			Argument: "fact-label-prefix",
+			Default:  "puppet_",
+			Usage:    "prefix of the entity labels holding the facts",
+			Value:    &handler.factLabelPrefix,
+		},
+		&sensu.SlicePluginConfigOption[string]{
+			Path:     "check-namespaces",
+			Env:      "PUPPET_CHECK_NAMESPACES",
+			Argument: "check-namespaces",
+			Default:  []string{"default"},
+			Usage:    "namespaces whose entities are compared to PuppetDB by the check and cleanup subcommands",
+			Value:    &handler.checkNamespaces,
+		},
+		&sensu.PluginConfigOption[int]{
+			Path:     "cleanup-unreported-after",
+			Env:      "PUPPET_CLEANUP_UNREPORTED_AFTER",
+			Argument: "cleanup-unreported-after",
+			Usage:    "seconds since their last report after which the cleanup subcommand deactivates the PuppetDB nodes without a Sensu entity",
+			Value:    &handler.cleanupUnreportedAfter,
+		},
+		&sensu.PluginConfigOption[int]{
+			Path:     "concurrency",
+			Env:      "PUPPET_CONCURRENCY",
+			Argument: "concurrency",
+			Default:  1,
+			Usage:    "number of entities looked up, or nodes deactivated, at once by the check and cleanup subcommands",
+			Value:    &handler.concurrency,
+		},
+		&sensu.PluginConfigOption[int]{
+			Path:     "progress-interval",
+			Env:      "PUPPET_PROGRESS_INTERVAL",
+			Argument: "progress-interval",
+			Usage:    "seconds between the progress lines logged by the check and cleanup subcommands (0 to disable)",
+			Value:    &handler.progressInterval,
+		},
+		&sensu.PluginConfigOption[string]{
+			Path:     "diff-report",
+			Env:      "PUPPET_DIFF_REPORT",
+			Argument: "diff-report",
+			Usage:    "file the check subcommand writes the entities it would remove, keep or skip to, grouped by namespace (- for the standard output)",
+			Value:    &handler.diffReport,
+		},
+		&sensu.PluginConfigOption[bool]{
+			Path:     "yes",
+			Env:      "PUPPET_YES",
+			Argument: "yes",
+			Usage:    "deactivate the nodes without asking for a confirmation, required when the cleanup subcommand runs without a terminal",
+			Value:    &handler.yes,
+		},
+		&sensu.PluginConfigOption[int]{
+			Path:     "min-puppet-nodes",
+			Env:      "PUPPET_MIN_PUPPET_NODES",
+			Argument: "min-puppet-nodes",
+			Usage:    "minimum number of active PuppetDB nodes below which the cleanup subcommand deactivates nothing (0 to disable)",
+			Value:    &handler.minPuppetNodes,
+		},
+		&sensu.PluginConfigOption[string]{
+			Path:     "checkpoint-file",
+			Env:      "PUPPET_CHECKPOINT_FILE",
+			Argument: "checkpoint-file",
+			Usage:    "file recording the entities checked, or nodes deactivated, by the check and cleanup subcommands, so that an interrupted run resumes from it",
+			Value:    &handler.checkpointFile,
+		},
+		&sensu.PluginConfigOption[int]{
+			Path:     "node-list-timeout",
+			Env:      "PUPPET_NODE_LIST_TIMEOUT",
+			Argument: "node-list-timeout",
+			Default:  defaultNodeListTimeout,
+			Usage:    "timeout in seconds of the PuppetDB node listing of the cleanup subcommand (0 to only bound it by the deadline)",
+			Value:    &handler.nodeListTimeout,
+		},
+		&sensu.PluginConfigOption[bool]{
+			Path:     "dry-run",
+			Env:      "PUPPET_DRY_RUN",
+			Argument: "dry-run",
+			Usage:    "list the nodes the cleanup subcommand would deactivate without deactivating them",
+			Value:    &handler.dryRun,
+		},
+		&sensu.PluginConfigOption[string]{
+			Path:     "entity-label-selector",
+			Env:      "PUPPET_ENTITY_LABEL_SELECTOR",
+			Argument: "entity-label-selector",
+			Usage:    "label selector evaluated by the Sensu API when the check subcommand lists entities",
+			Value:    &handler.entityLabelSelector,
+		},
+		&sensu.PluginConfigOption[string]{
+			Path:     "entity-field-selector",
+			Env:      "PUPPET_ENTITY_FIELD_SELECTOR",
+			Argument: "entity-field-selector",
+			Usage:    "field selector (e.g. \"entity.entity_class == agent\") evaluated by the Sensu API when the check subcommand lists entities",
+			Value:    &handler.entityFieldSelector,
+		},
+		&sensu.PluginConfigOption[int]{
+			Path:     "orphan-warning",
+			Env:      "PUPPET_ORPHAN_WARNING",
+			Argument: "orphan-warning",
+			Default:  1,
+			Usage:    "number of orphan entities from which the check subcommand reports a warning (0 to disable)",
+			Value:    &handler.orphanWarning,
+		},
+		&sensu.PluginConfigOption[int]{
+			Path:     "orphan-critical",
+			Env:      "PUPPET_ORPHAN_CRITICAL",
+			Argument: "orphan-critical",
+			Default:  10,
+			Usage:    "number of orphan entities from which the check subcommand reports a critical (0 to disable)",
+			Value:    &handler.orphanCritical,
+		},
 	}
 )
 
 func main() {
-	handler := sensu.NewGoHandler(&handler.PluginConfig, options, validate, executeHandler)
+	log.SetOutput(redactWriter{w: os.Stderr})
+	options = guardAnnotations(options)
+	stop := handleSignals()
+	defer stop()
+	applyEnvPrefix()
+	if err := loadConfigDir(); err != nil {
+		log.Printf("could not load the configuration directory: %s", err)
+		exit(1)
+		return
+	}
+	if runSubcommand() {
+		return
+	}
+	supplyOverrideEvent()
+	captureEvent()
+	validateHandler := func(event *corev2.Event) error {
+		err := validate(event)
+		if err != nil {
+			saveHAR()
+		}
+		return redactError(err)
+	}
+	handler := sensu.NewGoHandler(&handler.PluginConfig, options, validateHandler, executeHandler)
 	handler.Execute()
 }
 
-func validate(event *corev2.Event) error {
+// validatePuppetDB validates the options needed to query PuppetDB, shared by
+// the handler and the mutator
+func validatePuppetDB(event *corev2.Event) error {
 	// Make sure we have a valid event
 	if event.Check == nil || event.Entity == nil {
 		return errors.New("invalid event")
@@ -134,187 +1309,629 @@ func validate(event *corev2.Event) error {
 	if len(handler.endpoint) == 0 {
 		return errors.New("the PuppetDB API endpoint is required")
 	}
-	if len(handler.puppetCert) == 0 {
-		return errors.New("the path to the SSL certificate is required")
-	}
-	if len(handler.puppetKey) == 0 {
-		return errors.New("the path to the private key is required")
-	}
-	if len(handler.sensuAPIURL) == 0 {
-		return errors.New("the Sensu API URL is required")
+	if puppetOAuth() && handler.puppetSPNEGO {
+		return errors.New("the OAuth2 and SPNEGO authentications cannot be combined")
 	}
-	if len(handler.sensuAPIKey) == 0 {
-		return errors.New("the Sensu API key is required")
+	if puppetOAuth() {
+		if _, err := url.ParseRequestURI(handler.puppetOAuthTokenURL); err != nil {
+			return fmt.Errorf("invalid OAuth2 token URL: %s", err)
+		}
+		if handler.puppetOAuthClientID == "" || handler.puppetOAuthClientSecret == "" {
+			return errors.New("the OAuth2 client ID and secret are required")
+		}
+		if (handler.puppetCert == "") != (handler.puppetKey == "") {
+			return errors.New("the SSL certificate and private key must be set together")
+		}
+	} else if handler.puppetSPNEGO {
+		if err := validateKerberos(); err != nil {
+			return err
+		}
+		if (handler.puppetCert == "") != (handler.puppetKey == "") {
+			return errors.New("the SSL certificate and private key must be set together")
+		}
+	} else {
+		if len(handler.puppetCert) == 0 {
+			return errors.New("the path to the SSL certificate is required")
+		}
+		if len(handler.puppetKey) == 0 {
+			return errors.New("the path to the private key is required")
+		}
 	}
 
-	// Make sure the PuppetDB endpoint URL is valid
-	u, err := url.Parse(handler.endpoint)
+	// Make sure the PuppetDB endpoint URL is valid, resolving it first if it
+	// names a discovered service
+	endpoint, err := resolveEndpoint(handler.endpoint)
 	if err != nil {
+		return fmt.Errorf("could not resolve the PuppetDB API endpoint: %s", err)
+	}
+	if endpoint, err = normalizeEndpoint(endpoint); err != nil {
 		return fmt.Errorf("invalid PuppetDB API endpoint URL: %s", err)
 	}
-	if u.Scheme == "" {
-		u.Host = "https://"
+	handler.endpoint = endpoint
+
+	// Make sure the Puppet CA settings are valid
+	if handler.puppetCAURL != "" {
+		if _, err := caURL(handler.puppetCAURL); err != nil {
+			return fmt.Errorf("invalid Puppet CA URL: %s", err)
+		}
 	}
-	if u.Host == "" {
-		return errors.New("invalid PuppetDB API endpoint URL")
+	if handler.puppetCAFingerprint != "" && !validFingerprint(handler.puppetCAFingerprint) {
+		return errors.New("the Puppet CA fingerprint must be a hex encoded SHA-256 hash")
 	}
-	if u.Path == "" || u.Path == "/" {
-		u.Path = path.Join(u.Path, defaultAPIPath)
+
+	// Make sure HTTP/2 is not forced through a proxy
+	if handler.puppetHTTPVersion == httpVersionHTTP2 && handler.puppetProxyURL != "" {
+		return errors.New("HTTP/2 cannot be forced for PuppetDB through a proxy")
 	}
-	handler.endpoint = u.String()
 
-	// Make sure the Sensu API URL is valid
-	u, err = url.Parse(handler.sensuAPIURL)
-	if err != nil {
-		return fmt.Errorf("invalid Sensu API URL: %s", err)
+	// Make sure the TLS settings are consistent
+	if err := checkTLSSettings(); err != nil {
+		return err
 	}
-	if u.Scheme == "" {
-		return errors.New("invalid Sensu API URL, missing scheme")
+
+	// Make sure the node name settings are valid
+	if err := puppetConfig(nil).Validate(); err != nil {
+		return err
 	}
-	if u.Host == "" {
-		return errors.New("invalid Sensu API URL, missing host")
+
+	// Make sure the PuppetDB proxy URL is valid
+	if handler.puppetProxyURL != "" {
+		if _, err := parseProxyURL(handler.puppetProxyURL); err != nil {
+			return fmt.Errorf("invalid proxy URL: %s", err)
+		}
 	}
 
 	return nil
 }
 
-func executeHandler(event *corev2.Event) error {
-	if event.Check.Name != "keepalive" {
-		log.Print("received non-keepalive event, not checking for puppet node")
-		return nil
+func validate(event *corev2.Event) error {
+	if handler.strictEvents {
+		data, err := capturedEvent()
+		if err != nil {
+			return fmt.Errorf("could not read the event: %s", err)
+		}
+		if err := validateStrictEvent(data); err != nil {
+			return err
+		}
 	}
 
-	puppetClient, err := puppetHTTPClient()
-	if err != nil {
+	if err := validatePuppetDB(event); err != nil {
+		return err
+	}
+
+	if err := validateSensu(event); err != nil {
 		return err
 	}
 
-	exists, err := puppetNodeExists(puppetClient, event)
+	// Make sure stdout is not shared by the event and the metrics
+	if handler.tee && handler.output == outputMetrics {
+		return errors.New("the event cannot be written to stdout along with the metrics output")
+	}
+
+	// Make sure the DNS servers are IP addresses
+	for _, server := range handler.dnsServers {
+		if _, err := dnsServerAddr(server); err != nil {
+			return fmt.Errorf("invalid DNS server: %s", err)
+		}
+	}
+
+	// Make sure the label selector is valid
+	if _, err := parseLabelSelector(handler.labelSelector); err != nil {
+		return fmt.Errorf("invalid label selector: %s", err)
+	}
+
+	// Make sure the message bus destinations are provided
+	if handler.natsURL != "" && handler.natsSubject == "" {
+		return errors.New("the NATS subject is required")
+	}
+	if len(handler.kafkaBrokers) > 0 && handler.kafkaTopic == "" {
+		return errors.New("the Kafka topic is required")
+	}
+	if handler.agentEventsURL != "" && handler.agentEventCheck == "" {
+		return errors.New("the agent event check name is required")
+	}
+	if handler.messageFormat == formatCloudEvents && (handler.cloudEventsSource == "" || handler.cloudEventsType == "") {
+		return errors.New("the CloudEvents source and type are required")
+	}
+
+	if handler.pagerDutyRoutingKey != "" && handler.pagerDutyThreshold < 1 {
+		return errors.New("the PagerDuty failure threshold must be at least 1")
+	}
+
+	for _, source := range inventorySources() {
+		switch source {
+		case sourcePuppetDB:
+		case sourceServiceNow:
+			if handler.serviceNowURL == "" {
+				return errors.New("the ServiceNow URL is required to use the servicenow source")
+			}
+		case sourceGenericREST:
+			if handler.restURL == "" {
+				return errors.New("the REST inventory URL is required to use the generic-rest source")
+			}
+			endpoint, err := restURL("node")
+			if err != nil {
+				return err
+			}
+			if _, err := url.ParseRequestURI(endpoint); err != nil {
+				return fmt.Errorf("invalid REST inventory URL: %s", err)
+			}
+			if handler.restLastSeenField != "" && handler.restMaxAge <= 0 {
+				return errors.New("the REST inventory maximum age is required with the last seen field")
+			}
+		case sourceExec:
+			if handler.execCommand == "" {
+				return errors.New("the inventory command is required to use the exec source")
+			}
+		default:
+			return fmt.Errorf("unknown inventory source %q", source)
+		}
+	}
+	if handler.sourcePolicy == policyWeighted && handler.absentWeightThreshold < 1 {
+		return errors.New("the absent weight threshold must be at least 1")
+	}
+
+	for _, tmpl := range []string{handler.logTemplate, handler.messageTemplate} {
+		if _, err := template.New("template").Parse(tmpl); err != nil {
+			return fmt.Errorf("invalid template: %s", err)
+		}
+	}
+	if handler.messageTemplate != "" && handler.messageFormat == formatCloudEvents {
+		return errors.New("the message template cannot be used with the cloudevents message format")
+	}
+
+	if handler.condition != "" {
+		if _, err := compileCondition(handler.condition); err != nil {
+			return fmt.Errorf("invalid condition: %s", err)
+		}
+	}
+
+	if handler.opaURL != "" {
+		if _, err := url.ParseRequestURI(handler.opaURL); err != nil {
+			return fmt.Errorf("invalid OPA URL: %s", err)
+		}
+	}
+
+	if handler.minLastSeen < 0 {
+		return errors.New("the minimum last seen age cannot be negative")
+	}
+	if handler.passingCheckWindow < 0 {
+		return errors.New("the passing check window cannot be negative")
+	}
+
+	if handler.deadline > 0 && handler.recheckAfter >= handler.deadline {
+		return errors.New("the re-check delay must be shorter than the deadline")
+	}
+
+	if handler.serviceNowURL != "" {
+		if _, err := url.ParseRequestURI(handler.serviceNowURL); err != nil {
+			return fmt.Errorf("invalid ServiceNow URL: %s", err)
+		}
+		if handler.serviceNowUsername == "" || handler.serviceNowPassword == "" {
+			return errors.New("the ServiceNow username and password are required")
+		}
+	}
+
+	return nil
+}
+
+// validateSensu validates the options needed to use the Sensu API, shared by
+// the handler and the apply subcommand
+func validateSensu(event *corev2.Event) error {
+	// Make sure the Sensu API options are provided
+	if len(sensuAPIURLFor(event.Entity.Namespace)) == 0 {
+		return errors.New("the Sensu API URL is required")
+	}
+	apiKey, err := sensuAPIKeyFor(event.Entity.Namespace)
 	if err != nil {
 		return err
 	}
-	if exists {
-		return nil
+	if handler.sensuSPNEGO && sensuTokenAuth() {
+		return errors.New("the Sensu API tokens and SPNEGO authentication cannot be combined")
+	}
+	if handler.sensuSPNEGO {
+		if err := validateKerberos(); err != nil {
+			return err
+		}
+	} else if len(apiKey) == 0 && !sensuTokenAuth() {
+		return errors.New("the Sensu API key or access token is required")
+	}
+
+	// Make sure the Sensu API URLs are valid, resolving them first if they
+	// name a discovered service
+	for namespace, apiURL := range handler.namespaceAPIURLs {
+		resolved, err := validateSensuAPIURL(apiURL)
+		if err != nil {
+			return fmt.Errorf("%s (namespace %q)", err, namespace)
+		}
+		handler.namespaceAPIURLs[namespace] = resolved
+	}
+	if handler.sensuAPIURL != "" {
+		if handler.sensuAPIURL, err = validateSensuAPIURL(handler.sensuAPIURL); err != nil {
+			return err
+		}
+	}
+
+	// Make sure HTTP/2 is not forced through a proxy
+	if handler.sensuHTTPVersion == httpVersionHTTP2 && handler.sensuProxyURL != "" {
+		return errors.New("HTTP/2 cannot be forced for the Sensu API through a proxy")
 	}
 
-	return deregisterEntity(event)
+	// Make sure the Sensu proxy URL is valid
+	if handler.sensuProxyURL != "" {
+		if _, err := parseProxyURL(handler.sensuProxyURL); err != nil {
+			return fmt.Errorf("invalid proxy URL: %s", err)
+		}
+	}
+
+	return nil
 }
 
-// puppetHTTPClient configures an HTTP client for PuppetDB
-func puppetHTTPClient() (*http.Client, error) {
-	// Load the public/private key pair
-	cert, err := tls.LoadX509KeyPair(handler.puppetCert, handler.puppetKey)
+// validateSensuAPIURL resolves the Sensu API URL if it names a discovered
+// service and makes sure it is valid
+func validateSensuAPIURL(apiURL string) (string, error) {
+	resolved, err := resolveEndpoint(apiURL)
 	if err != nil {
-		return nil, fmt.Errorf("could not read the certificate/key: %s", err)
+		return "", fmt.Errorf("could not resolve the Sensu API URL: %s", err)
+	}
+	u, err := url.Parse(resolved)
+	if err != nil {
+		return "", fmt.Errorf("invalid Sensu API URL: %s", err)
+	}
+	if u.Scheme == "" {
+		return "", errors.New("invalid Sensu API URL, missing scheme")
+	}
+	if u.Host == "" {
+		return "", errors.New("invalid Sensu API URL, missing host")
 	}
+	return resolved, nil
+}
 
-	// Load the CA certificate
-	caCert, err := ioutil.ReadFile(handler.puppetCACert)
+func executeHandler(event *corev2.Event) error {
+	setupRequestID()
+	if handler.deadline > 0 {
+		ctx, cancel := context.WithTimeout(executionCtx, time.Duration(handler.deadline)*time.Second)
+		defer cancel()
+		executionCtx = ctx
+	}
+	start := time.Now()
+	finishLogSampling := startLogSampling()
+	processErr := processEvent(event)
+	err := redactError(processErr)
+	summary.duration = time.Since(start)
 	if err != nil {
-		return nil, fmt.Errorf("could not read the CA certificate: %s", err)
+		summary.failed++
+	}
+	finishLogSampling(err)
+	log.Print(summary.line(event))
+	logExplanation(event)
+	if handler.tee {
+		if terr := teeEvent(os.Stdout); terr != nil {
+			log.Printf("could not write the event to stdout: %s", terr)
+		}
+	}
+	if handler.output == outputMetrics {
+		if werr := writeMetrics(os.Stdout, event, summary, time.Now()); werr != nil {
+			log.Printf("could not write the metrics: %s", werr)
+		}
 	}
-	caCertPool := x509.NewCertPool()
-	caCertPool.AppendCertsFromPEM(caCert)
+	if handler.pagerDutyRoutingKey != "" {
+		if perr := trackFailures(err); perr != nil {
+			log.Printf("could not track handler failures: %s", perr)
+		}
+	}
+	saveHAR()
 
-	// Setup the HTTPS client
-	tlsConfig := &tls.Config{
-		Certificates:       []tls.Certificate{cert},
-		RootCAs:            caCertPool,
-		InsecureSkipVerify: handler.puppetInsecureSkipVerify,
+	// Access failures get their own exit status so that they can be told
+	// apart from transient failures
+	var accessErr sensuAccessError
+	if errors.As(processErr, &accessErr) {
+		log.Printf("error executing handler: %s", err)
+		exit(exitSensuAccessDenied)
 	}
-	client := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+	return err
+}
 
-	return client, nil
+// requestTimeout returns the timeout of each HTTP request, 0 if disabled
+func requestTimeout() time.Duration {
+	if handler.requestTimeout <= 0 {
+		return 0
+	}
+	return time.Duration(handler.requestTimeout) * time.Second
 }
 
-// puppetNodeExists returns whether a given node exists in Puppet and any error
-// encountered. The Puppet node name defaults to the entity name but can be
-// overriden through the entity label "puppet_node_name"
-func puppetNodeExists(client *http.Client, event *corev2.Event) (bool, error) {
-	// Determine the Puppet node name via the annotations and fallback to the
-	// entity name
-	name := handler.puppetNodeName
-	if handler.puppetNodeName == "" {
-		name = event.Entity.Name
-	}
-
-	// Get the puppet node
-	endpoint := strings.TrimRight(handler.endpoint, "/")
-	endpoint = fmt.Sprintf("%s/%s", endpoint, name)
-	resp, err := client.Get(endpoint)
+// shouldDeregister looks up the event's entity in the inventory sources and
+// returns the PuppetDB lookup and whether the entity should be deregistered,
+// as decided by the inventory policy or the custom condition. The lookup of
+// the first source stands in for the PuppetDB one when PuppetDB was not
+// consulted.
+func shouldDeregister(puppetClient *http.Client, event *corev2.Event) (nodeLookup, bool, error) {
+	results, deregister, err := lookupInventory(puppetClient, event)
 	if err != nil {
-		log.Printf("error getting puppet node: %s", err)
-		return false, err
+		return nodeLookup{}, false, err
+	}
+	lookup := puppetLookup(results)
+	policy := handler.sourcePolicy
+	if policy == "" {
+		policy = policyAllAbsent
+	}
+	explainDecision("inventory", "the %s source policy decided to %s", policy, deregisterVerb(deregister))
+	if handler.condition != "" {
+		deregister, err = evaluateCondition(event, lookup)
+		if err != nil {
+			return lookup, false, err
+		}
+		log.Printf("condition evaluated to %t for puppet node %q", deregister, lookup.name)
+		explainDecision("condition", "%q evaluated to %t", handler.condition, deregister)
+	}
+	return lookup, deregister, nil
+}
+
+// processEvent deregisters the event's entity if it has no associated Puppet
+// node
+func processEvent(event *corev2.Event) error {
+	if handler.preflight {
+		if err := preflight(event); err != nil {
+			return err
+		}
 	}
-	defer resp.Body.Close()
 
-	// Determine if the node exists
-	if resp.StatusCode == http.StatusOK {
-		var info map[string]interface{}
-		if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
-			log.Printf("puppet node returned invalid response: %s", err)
-			return false, err
+	switch {
+	case handler.entityName != "":
+		// The overridden entity is checked whatever the event
+		if err := overrideEntity(event); err != nil {
+			return err
 		}
-		nodeInfo := make(map[string]interface{})
-		timeDeactivated := nodeInfo["deactivated"]
+		explainRule("entity override", "checking entity %q instead of the event entity", handler.entityName)
+	case !isTriggerCheck(event.Check.Name):
+		log.Printf("received event for check %q, not checking for puppet node", event.Check.Name)
+		explainDecision("trigger check", "%q is not a trigger check, ignoring the event", event.Check.Name)
+		return nil
+	default:
+		explainRule("trigger check", "%q is a trigger check", event.Check.Name)
+	}
 
-		log.Printf("puppet node %q exists, checking if deactivated", name)
-		if timeDeactivated != nil {
-			return false, nil
+	// Checks run on behalf of a proxy entity target it rather than the agent
+	// running them, the proxy entity is looked up and deregistered instead
+	if name := event.Check.ProxyEntityName; name != "" && name != event.Entity.Name && handler.entityName == "" {
+		entity, err := fetchEntity(event.Entity.Namespace, name)
+		if err != nil {
+			return fmt.Errorf("could not fetch proxy entity %q: %s", name, err)
 		}
-		return true, nil
-	} else if resp.StatusCode == http.StatusNotFound {
-		log.Printf("puppet node %q does not exist", name)
-		return false, nil
+		if entity == nil {
+			log.Printf("proxy entity %q does not exist, ignoring event", name)
+			explainDecision("proxy entity", "%q does not exist, ignoring the event", name)
+			return nil
+		}
+		log.Printf("event of check %q targets proxy entity %q", event.Check.Name, name)
+		explainRule("proxy entity", "the event targets proxy entity %q", name)
+		event.Entity = entity
 	}
 
-	return false, fmt.Errorf("unexpected HTTP status %s while querying PuppetDB", http.StatusText(resp.StatusCode))
-}
+	selected, err := entitySelected(event)
+	if err != nil {
+		return err
+	}
+	if !selected {
+		log.Printf("entity %q does not match the label selector, ignoring event", event.Entity.Name)
+		explainDecision("label selector", "%q does not match, ignoring the event", handler.labelSelector)
+		return nil
+	}
+	if handler.labelSelector != "" {
+		explainRule("label selector", "%q matches", handler.labelSelector)
+	}
+	if !entitySubscribed(event) {
+		log.Printf("entity %q subscriptions do not make it eligible, ignoring event", event.Entity.Name)
+		explainDecision("subscriptions", "the entity subscriptions do not make it eligible, ignoring the event")
+		return nil
+	}
+	if len(handler.excludeSubscriptions) > 0 || len(handler.requireSubscriptions) > 0 {
+		explainRule("subscriptions", "the entity subscriptions make it eligible")
+	}
+
+	pattern, err := entityProtected(event)
+	if err != nil {
+		return err
+	}
+	if pattern != "" {
+		log.Printf("entity %q is protected by %q, ignoring event", event.Entity.Name, pattern)
+		explainDecision("protected nodes", "the node is protected by %q, ignoring the event", pattern)
+		return nil
+	}
+	if handler.protectedNodesFile != "" {
+		explainRule("protected nodes", "the node is not protected")
+	}
 
-func deregisterEntity(event *corev2.Event) error {
-	// First authenticate against the Sensu API
-	config := httpclient.CoreClientConfig{
-		URL:    handler.sensuAPIURL,
-		APIKey: handler.sensuAPIKey,
+	if recentlyDeregistered(event) {
+		log.Printf("entity %q was recently deregistered, ignoring event", event.Entity.Name)
+		explainDecision("deregistered entities cache", "the entity was recently deregistered, ignoring the event")
+		return nil
 	}
-	if handler.sensuCACert != "" {
-		pemCert, err := ioutil.ReadFile(handler.sensuCACert)
+	if handler.negativeCacheTTL > 0 {
+		explainRule("deregistered entities cache", "the entity was not recently deregistered")
+	}
+
+	if handler.checkPermissions {
+		if err := checkPermissions(event.Entity.Namespace); err != nil {
+			return err
+		}
+		explainRule("permissions", "the handler is allowed to %s entities", handler.action)
+	}
+
+	puppetClient, err := puppetHTTPClient()
+	if err != nil {
+		return err
+	}
+
+	lookupStart := time.Now()
+	lookup, deregister, err := shouldDeregister(puppetClient, event)
+	summary.lookupDuration = time.Since(lookupStart)
+	if err != nil {
+		return err
+	}
+	summary.checked++
+	summary.node, summary.status = lookup.name, lookup.status
+	if handler.decisionHook != "" {
+		decision, err := hookDecision(event, lookup, deregister)
 		if err != nil {
-			return fmt.Errorf("unable to load sensu-ca-cert: %s", err)
+			return fmt.Errorf("could not run the decision hook: %s", err)
+		}
+		log.Printf("the decision hook decided to %s entity %q", decision, event.Entity.Name)
+		explainDecision("decision hook", "decided to %s the entity", decision)
+		if decision == decisionSilence {
+			if err := silenceEntity(event); err != nil {
+				return err
+			}
+			summary.skipped++
+			return publishRecord(event, lookup, actionSilence)
+		}
+		deregister = decision == decisionDeregister
+	}
+	if !deregister {
+		summary.kept++
+		if handler.stampLastVerified && lookup.status == nodeActive {
+			if err := stampLastVerified(event); err != nil {
+				return fmt.Errorf("could not stamp the entity as verified: %s", err)
+			}
+		}
+		if handler.publishKept {
+			return publishRecord(event, lookup, actionKeep)
 		}
+		return nil
+	}
 
-		block, _ := pem.Decode([]byte(pemCert))
-		if block == nil {
-			return errors.New("failed to decode sensu-ca-cert PEM")
+	action := handler.action
+	if handler.opaURL != "" {
+		if action, err = policyAction(event, lookup); err != nil {
+			return fmt.Errorf("could not evaluate the deregistration policy: %s", err)
+		}
+		explainDecision("deregistration policy", "decided to %s the entity", action)
+		if action == actionKeep {
+			summary.kept++
+			if handler.publishKept {
+				return publishRecord(event, lookup, actionKeep)
+			}
+			return nil
 		}
+	}
+
+	if at := tombstonedAt(event.Entity); action == actionTombstone && at != "" {
+		log.Printf("entity %q was already tombstoned at %s, skipping", event.Entity.Name, at)
+		explainDecision("tombstone", "the entity was already tombstoned at %s, leaving it untouched", at)
+		summary.skipped++
+		return nil
+	}
 
-		cert, err := x509.ParseCertificate(block.Bytes)
+	if handler.skipSilenced {
+		silenced, err := entitySilenced(event)
 		if err != nil {
-			return fmt.Errorf("invalid sensu-ca-cert: %s", err)
+			return fmt.Errorf("could not check silenced entries: %s", err)
+		}
+		if silenced {
+			log.Printf("entity %q is silenced, skipping deregistration", event.Entity.Name)
+			explainDecision("silenced entities", "the entity is silenced, skipping the deregistration")
+			summary.skipped++
+			return nil
 		}
-		config.CACert = cert
+		explainRule("silenced entities", "the entity is not silenced")
+	}
 
+	if handler.reverify {
+		reason, err := entityRecovered(event)
+		if err != nil {
+			return err
+		}
+		if reason != "" {
+			log.Printf("entity %q not deregistered, %s", event.Entity.Name, reason)
+			explainDecision("reverification", "%s, skipping the deregistration", reason)
+			summary.skipped++
+			return nil
+		}
+		explainRule("reverification", "the entity has not recovered")
 	}
-	if handler.puppetInsecureSkipVerify {
-		config.InsecureSkipVerify = true
+
+	if handler.minLastSeen > 0 {
+		reason, err := entitySeenRecently(event, time.Now())
+		if err != nil {
+			return err
+		}
+		if reason != "" {
+			log.Printf("entity %q not deregistered, %s", event.Entity.Name, reason)
+			explainDecision("last seen", "%s, skipping the deregistration", reason)
+			summary.skipped++
+			return nil
+		}
+		explainRule("last seen", "the agent was not seen in the last %ds", handler.minLastSeen)
+	}
+
+	if handler.passingCheckWindow > 0 {
+		reason, err := entityPassingCheck(event, time.Now())
+		if err != nil {
+			return err
+		}
+		if reason != "" {
+			log.Printf("entity %q not deregistered, %s", event.Entity.Name, reason)
+			explainDecision("passing checks", "%s, skipping the deregistration", reason)
+			summary.skipped++
+			return nil
+		}
+		explainRule("passing checks", "no check passed in the last %ds", handler.passingCheckWindow)
+	}
+
+	if reason := preDeleteHook(event, lookup, action); reason != "" {
+		log.Printf("entity %q not deregistered, %s", event.Entity.Name, reason)
+		explainDecision("pre-delete hook", "%s, skipping the deregistration", reason)
+		summary.skipped++
+		return nil
+	}
+	if handler.preDeleteHook != "" {
+		explainRule("pre-delete hook", "the hook allowed the deregistration")
+	}
+
+	if handler.approvalQueue != "" {
+		if err := queueDeregistration(event, lookup, action); err != nil {
+			return fmt.Errorf("could not queue the deregistration for approval: %s", err)
+		}
+		explainRule("approval queue", "the deregistration was queued for approval")
+		summary.queued++
+		return nil
+	}
+
+	if action == actionTombstone {
+		err = tombstoneEntity(event, lookup)
+	} else {
+		err = deregisterEntity(event)
 	}
-	client := httpclient.NewCoreClient(config)
-	request, err := httpclient.NewResourceRequest("core/v2", "Entity", event.Entity.Namespace, event.Entity.Name)
 	if err != nil {
 		return err
 	}
+	summary.recordDeregistration(action)
+	cacheDeregistered(event)
+	if handler.reportLicenseUsage && action == actionDelete {
+		logLicenseUsage(event)
+	}
 
-	// Delete the Sensu entity
-	log.Printf("deleting entity (%s/%s)\n", event.Entity.Namespace, event.Entity.Name)
-	if _, err := client.DeleteResource(context.Background(), request); err != nil {
-		if httperr, ok := err.(httpclient.HTTPError); ok {
-			if httperr.StatusCode < 500 {
-				log.Printf("entity already deleted (%s/%s)", event.Entity.Namespace, event.Entity.Name)
-				return nil
-			}
+	if handler.logTemplate != "" {
+		line, err := renderTemplate(handler.logTemplate, newTemplateData(event, lookup, action))
+		if err != nil {
+			return fmt.Errorf("could not render log template: %s", err)
 		}
+		log.Print(line)
+	}
+
+	if err := postDeleteHook(event, lookup, action); err != nil {
 		return err
 	}
+	return publishRecord(event, lookup, action)
+}
 
-	return nil
+// isTriggerCheck returns whether events of the named check trigger the Puppet
+// node lookup
+func isTriggerCheck(name string) bool {
+	for _, check := range handler.triggerChecks {
+		if check == name {
+			return true
+		}
+	}
+	return false
 }
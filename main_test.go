@@ -1,13 +1,23 @@
 package main
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/json"
+	"encoding/pem"
+	"math/big"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
 	corev2 "github.com/sensu/core/v2"
+	"github.com/sensu/sensu-puppet-handler/puppet"
 )
 
 func Test_validate(t *testing.T) {
@@ -34,6 +44,28 @@ func Test_validate(t *testing.T) {
 			event:   event,
 			wantErr: true,
 		},
+		{
+			name: "required keytab principal",
+			testHandler: Handler{
+				endpoint:     "http://127.0.0.1",
+				puppetSPNEGO: true,
+				krb5Keytab:   "sensu.keytab",
+			},
+			event:   event,
+			wantErr: true,
+		},
+		{
+			name: "OAuth2 combined with SPNEGO",
+			testHandler: Handler{
+				endpoint:                "http://127.0.0.1",
+				puppetOAuthTokenURL:     "https://idp.example.com/oauth2/token",
+				puppetOAuthClientID:     "handler",
+				puppetOAuthClientSecret: "secret",
+				puppetSPNEGO:            true,
+			},
+			event:   event,
+			wantErr: true,
+		},
 		{
 			name: "required private key",
 			testHandler: Handler{
@@ -89,17 +121,47 @@ func Test_validate(t *testing.T) {
 			event:   event,
 			wantErr: false,
 		},
+		{
+			name: "valid namespace Sensu API URL is required",
+			testHandler: Handler{
+				endpoint:         "http://127.0.0.1",
+				puppetCert:       "cert.pem",
+				puppetKey:        "key.pem",
+				puppetCACert:     "ca.pem",
+				sensuAPIURL:      "http://localhost:8080",
+				sensuAPIKey:      "xxxxxxxxxx",
+				namespaceAPIURLs: map[string]string{"staging": "staging:8080"},
+			},
+			event:   event,
+			wantErr: true,
+		},
 		{
 			name: "valid endpoint is required",
 			testHandler: Handler{
-				endpoint:     "foo",
+				endpoint:     "ftp://foo",
 				puppetCert:   "cert.pem",
 				puppetKey:    "key.pem",
 				puppetCACert: "ca.pem",
+				sensuAPIURL:  "http://localhost:8080",
+				sensuAPIKey:  "xxxxxxxxxx",
 			},
 			event:   event,
 			wantErr: true,
 		},
+		{
+			name: "scheme defaults to https",
+			testHandler: Handler{
+				endpoint:     "puppetdb:8081",
+				puppetCert:   "cert.pem",
+				puppetKey:    "key.pem",
+				puppetCACert: "ca.pem",
+				sensuAPIURL:  "http://localhost:8080",
+				sensuAPIKey:  "xxxxxxxxxx",
+			},
+			event:        event,
+			wantErr:      false,
+			wantEndpoint: "https://puppetdb:8081/pdb/query/v4/nodes",
+		},
 		{
 			name: "default API path is appended if missing",
 			testHandler: Handler{
@@ -114,6 +176,89 @@ func Test_validate(t *testing.T) {
 			wantErr:      false,
 			wantEndpoint: "http://127.0.0.1/pdb/query/v4/nodes",
 		},
+		{
+			name: "Kafka topic is required with brokers",
+			testHandler: Handler{
+				endpoint:     "http://127.0.0.1",
+				puppetCert:   "cert.pem",
+				puppetKey:    "key.pem",
+				puppetCACert: "ca.pem",
+				sensuAPIURL:  "http://localhost:8080",
+				sensuAPIKey:  "xxxxxxxxxx",
+				kafkaBrokers: []string{"localhost:9092"},
+			},
+			event:   event,
+			wantErr: true,
+		},
+		{
+			name: "CA certificate ignored with skip verify",
+			testHandler: Handler{
+				endpoint:                 "http://127.0.0.1",
+				puppetCert:               "cert.pem",
+				puppetKey:                "key.pem",
+				puppetCACert:             "ca.pem",
+				puppetInsecureSkipVerify: true,
+				sensuAPIURL:              "http://localhost:8080",
+				sensuAPIKey:              "xxxxxxxxxx",
+			},
+			event:   event,
+			wantErr: false,
+		},
+		{
+			name: "CA certificate rejected with skip verify in strict TLS mode",
+			testHandler: Handler{
+				endpoint:                 "http://127.0.0.1",
+				puppetCert:               "cert.pem",
+				puppetKey:                "key.pem",
+				puppetCACert:             "ca.pem",
+				puppetInsecureSkipVerify: true,
+				strictTLS:                true,
+				sensuAPIURL:              "http://localhost:8080",
+				sensuAPIKey:              "xxxxxxxxxx",
+			},
+			event:   event,
+			wantErr: true,
+		},
+		{
+			name: "client certificate optional with OAuth2",
+			testHandler: Handler{
+				endpoint:                "https://puppetdb.example.com",
+				puppetOAuthTokenURL:     "https://idp.example.com/oauth2/token",
+				puppetOAuthClientID:     "sensu",
+				puppetOAuthClientSecret: "xxxxxxxxxx",
+				sensuAPIURL:             "http://localhost:8080",
+				sensuAPIKey:             "xxxxxxxxxx",
+			},
+			event:   event,
+			wantErr: false,
+		},
+		{
+			name: "OAuth2 client secret is required",
+			testHandler: Handler{
+				endpoint:            "https://puppetdb.example.com",
+				puppetOAuthTokenURL: "https://idp.example.com/oauth2/token",
+				puppetOAuthClientID: "sensu",
+				sensuAPIURL:         "http://localhost:8080",
+				sensuAPIKey:         "xxxxxxxxxx",
+			},
+			event:   event,
+			wantErr: true,
+		},
+		{
+			name: "re-check delay must be shorter than the deadline",
+			testHandler: Handler{
+				endpoint:     "http://127.0.0.1",
+				puppetCert:   "cert.pem",
+				puppetKey:    "key.pem",
+				puppetCACert: "ca.pem",
+				sensuAPIURL:  "http://localhost:8080",
+				sensuAPIKey:  "xxxxxxxxxx",
+				deadline:     30,
+				recheckAfter: 30,
+			},
+			event:   event,
+			wantErr: true,
+		},
 		{
 			name:        "valid event is required",
 			testHandler: Handler{},
@@ -123,7 +268,7 @@ func Test_validate(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			handler = tt.testHandler
+			setHandler(t, tt.testHandler)
 			if err := validate(tt.event); (err != nil) != tt.wantErr {
 				t.Errorf("validate() error = %v, wantErr %v", err, tt.wantErr)
 			}
@@ -135,86 +280,160 @@ func Test_validate(t *testing.T) {
 	}
 }
 
-func Test_puppetNodeExists(t *testing.T) {
-	tests := []struct {
-		name       string
-		statusCode int
-		want       bool
-		wantErr    bool
-	}{
-		{
-			name:       "node exists",
-			statusCode: http.StatusOK,
-			want:       true,
-		},
-		{
-			name:       "node does not exist",
-			statusCode: http.StatusNotFound,
-			want:       false,
-		},
-		{
-			name:       "unexpected status code",
-			statusCode: http.StatusInternalServerError,
-			want:       false,
-			wantErr:    true,
-		},
+// saveHandler restores the handler configuration once the test and its
+// subtests complete, so that the settings of a test never leak into another
+func saveHandler(t *testing.T) {
+	t.Helper()
+	saved := handler
+	t.Cleanup(func() { handler = saved })
+}
+
+// setHandler replaces the handler configuration until the test completes
+func setHandler(t *testing.T, h Handler) {
+	t.Helper()
+	saveHandler(t)
+	handler = h
+}
+
+// writeKeyPair writes a self-signed certificate and its private key to PEM
+// files in a temporary directory and returns their paths
+func writeKeyPair(t *testing.T) (string, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
 	}
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-				w.WriteHeader(tt.statusCode)
-				if tt.statusCode == http.StatusOK {
-					_ = json.NewEncoder(w).Encode(map[string]interface{}{"deactivated": time.Now().Unix()})
-				}
-			}))
-			defer ts.Close()
-			handler.endpoint = ts.URL
-
-			event := corev2.FixtureEvent("foo", "check-cpu")
-			got, err := puppetNodeExists(ts.Client(), event)
-			if (err != nil) != tt.wantErr {
-				t.Errorf("puppetNodeExists() error = %v, wantErr %v", err, tt.wantErr)
-				return
-			}
-			if got != tt.want {
-				t.Errorf("puppetNodeExists() = %v, want %v", got, tt.want)
-			}
-		})
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "foo.example.com"},
+		DNSNames:              []string{"foo.example.com"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
 	}
+	return certFile, keyFile
 }
 
-func Test_deregisterEntity(t *testing.T) {
-	tests := []struct {
-		name       string
-		statusCode int
-		wantErr    bool
-	}{
-		{
-			name:       "entity deleted",
-			statusCode: http.StatusNoContent,
-		},
-		{
-			name:       "entity not deleted",
-			statusCode: http.StatusNotFound,
-		},
-		{
-			name:       "unexpected status code",
-			statusCode: http.StatusInternalServerError,
-			wantErr:    true,
-		},
+func Test_processEvent(t *testing.T) {
+	setHandler(t, Handler{triggerChecks: []string{"keepalive"}})
+
+	// Events from other checks are ignored before any request is made
+	event := corev2.FixtureEvent("foo", "check-cpu")
+	if err := processEvent(event); err != nil {
+		t.Errorf("processEvent() error = %v", err)
 	}
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-				w.WriteHeader(tt.statusCode)
-			}))
-			defer ts.Close()
-			handler.sensuAPIURL = ts.URL
-
-			event := corev2.FixtureEvent("foo", "check-cpu")
-			if err := deregisterEntity(event); (err != nil) != tt.wantErr {
-				t.Errorf("deregisterEntity() error = %v, wantErr %v", err, tt.wantErr)
-			}
-		})
+}
+
+func Test_processEvent_tombstoned(t *testing.T) {
+
+	puppetdb := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == puppet.VersionPath {
+			_, _ = w.Write([]byte(`{"version":"7.0.0"}`))
+			return
+		}
+		_, _ = w.Write([]byte(`[]`))
+	}))
+	defer puppetdb.Close()
+
+	var patches int
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPatch {
+			patches++
+		}
+	}))
+	defer api.Close()
+
+	certFile, keyFile := writeKeyPair(t)
+	setHandler(t, Handler{
+		triggerChecks:            []string{"keepalive"},
+		action:                   actionTombstone,
+		endpoint:                 puppetdb.URL,
+		puppetCert:               certFile,
+		puppetKey:                keyFile,
+		puppetCACert:             certFile,
+		puppetInsecureSkipVerify: true,
+		sensuAPIURL:              api.URL,
+		sensuAPIKey:              "xxxxxxxxxx",
+	})
+
+	event := corev2.FixtureEvent("foo", "keepalive")
+	if err := processEvent(event); err != nil {
+		t.Fatalf("processEvent() error = %v", err)
+	}
+	if patches != 1 {
+		t.Fatalf("processEvent() sent %d patches, want 1", patches)
+	}
+
+	// The next failing keepalive carries the tombstone, which is kept as is
+	event = corev2.FixtureEvent("foo", "keepalive")
+	event.Entity.Annotations = map[string]string{annotationPrefix + "deregistered-at": "2024-01-02T03:04:05Z"}
+	if err := processEvent(event); err != nil {
+		t.Fatalf("processEvent() error = %v", err)
+	}
+	if patches != 1 {
+		t.Errorf("processEvent() sent %d patches for the tombstoned entity, want none", patches-1)
+	}
+}
+
+func Test_processEvent_proxyEntity(t *testing.T) {
+
+	proxy := corev2.FixtureEntity("switch01")
+	proxy.EntityClass = corev2.EntityProxyClass
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/core/v2/namespaces/default/entities/switch01":
+			_ = json.NewEncoder(w).Encode(proxy)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+
+	// The proxy entity is protected so that the event is ignored before
+	// PuppetDB is queried, once the proxy entity replaced the agent entity
+	protected := filepath.Join(t.TempDir(), "protected")
+	if err := os.WriteFile(protected, []byte("switch01\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	setHandler(t, Handler{triggerChecks: []string{"check-snmp"}, sensuAPIURL: ts.URL, protectedNodesFile: protected})
+
+	event := corev2.FixtureEvent("agent01", "check-snmp")
+	event.Check.ProxyEntityName = "switch01"
+	if err := processEvent(event); err != nil {
+		t.Fatalf("processEvent() error = %v", err)
+	}
+	if event.Entity.Name != "switch01" {
+		t.Errorf("processEvent() entity = %q, want the proxy entity", event.Entity.Name)
+	}
+
+	// A missing proxy entity ignores the event
+	event = corev2.FixtureEvent("agent01", "check-snmp")
+	event.Check.ProxyEntityName = "switch02"
+	if err := processEvent(event); err != nil {
+		t.Fatalf("processEvent() error = %v", err)
+	}
+	if event.Entity.Name != "agent01" {
+		t.Errorf("processEvent() entity = %q, want the event entity", event.Entity.Name)
 	}
 }
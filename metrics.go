@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	corev2 "github.com/sensu/core/v2"
+)
+
+const (
+	outputText    = "text"
+	outputMetrics = "metrics"
+
+	metricsGraphite = "graphite_plaintext"
+	metricsInflux   = "influxdb_line"
+)
+
+// runSummary counts the outcomes of the handler execution
+type runSummary struct {
+	checked    int
+	kept       int
+	skipped    int
+	deleted    int
+	tombstoned int
+	queued     int
+	failed     int
+
+	lookupDuration time.Duration
+	duration       time.Duration
+
+	// node and status are the result of the lookup of the entity's node
+	node   string
+	status string
+
+	puppetDBRequests int
+	sensuRequests    int
+}
+
+// summary is the summary of the current execution
+var summary runSummary
+
+// recordDeregistration counts the deregistration of an entity with the given
+// action
+func (s *runSummary) recordDeregistration(action string) {
+	if action == actionTombstone {
+		s.tombstoned++
+	} else {
+		s.deleted++
+	}
+}
+
+// values returns the metrics of the summary by name
+func (s runSummary) values() map[string]float64 {
+	return map[string]float64{
+		"checked":                 float64(s.checked),
+		"kept":                    float64(s.kept),
+		"skipped":                 float64(s.skipped),
+		"deleted":                 float64(s.deleted),
+		"tombstoned":              float64(s.tombstoned),
+		"queued":                  float64(s.queued),
+		"failed":                  float64(s.failed),
+		"lookup_duration_seconds": s.lookupDuration.Seconds(),
+		"duration_seconds":        s.duration.Seconds(),
+	}
+}
+
+// writeMetrics writes the summary in the configured Sensu output metric
+// format, tagged with the entity of the event, so that the handler output can
+// be chained into a metrics pipeline
+func writeMetrics(w io.Writer, event *corev2.Event, s runSummary, now time.Time) error {
+	values := s.values()
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	measurement := strings.ReplaceAll(handler.Name, "-", "_")
+
+	switch handler.metricsFormat {
+	case metricsInflux:
+		fields := make([]string, 0, len(names))
+		for _, name := range names {
+			fields = append(fields, fmt.Sprintf("%s=%v", name, values[name]))
+		}
+		_, err := fmt.Fprintf(w, "%s,namespace=%s,entity=%s %s %d\n", measurement,
+			influxEscape(event.Entity.Namespace), influxEscape(event.Entity.Name), strings.Join(fields, ","), now.UnixNano())
+		return err
+	default:
+		prefix := strings.Join([]string{measurement, graphiteEscape(event.Entity.Namespace), graphiteEscape(event.Entity.Name)}, ".")
+		for _, name := range names {
+			if _, err := fmt.Fprintf(w, "%s.%s %v %d\n", prefix, name, values[name], now.Unix()); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+var (
+	influxEscaper   = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+	graphiteEscaper = strings.NewReplacer(".", "_", " ", "_")
+)
+
+func influxEscape(s string) string {
+	return influxEscaper.Replace(s)
+}
+
+func graphiteEscape(s string) string {
+	return graphiteEscaper.Replace(s)
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	corev2 "github.com/sensu/core/v2"
+)
+
+func Test_writeMetrics(t *testing.T) {
+	event := corev2.FixtureEvent("web 01", "keepalive")
+	s := runSummary{checked: 1, deleted: 1, lookupDuration: 250 * time.Millisecond, duration: time.Second}
+	now := time.Unix(1700000000, 0)
+
+	tests := []struct {
+		format string
+		want   string
+	}{
+		{
+			format: metricsGraphite,
+			want: `sensu_puppet_handler.default.web_01.checked 1 1700000000
+sensu_puppet_handler.default.web_01.deleted 1 1700000000
+sensu_puppet_handler.default.web_01.duration_seconds 1 1700000000
+sensu_puppet_handler.default.web_01.failed 0 1700000000
+sensu_puppet_handler.default.web_01.kept 0 1700000000
+sensu_puppet_handler.default.web_01.lookup_duration_seconds 0.25 1700000000
+sensu_puppet_handler.default.web_01.queued 0 1700000000
+sensu_puppet_handler.default.web_01.skipped 0 1700000000
+sensu_puppet_handler.default.web_01.tombstoned 0 1700000000
+`,
+		},
+		{
+			format: metricsInflux,
+			want: `sensu_puppet_handler,namespace=default,entity=web\ 01 checked=1,deleted=1,duration_seconds=1,failed=0,kept=0,lookup_duration_seconds=0.25,queued=0,skipped=0,tombstoned=0 1700000000000000000
+`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			saveHandler(t)
+			handler.Name = "sensu-puppet-handler"
+			handler.metricsFormat = tt.format
+
+			var buf bytes.Buffer
+			if err := writeMetrics(&buf, event, s, now); err != nil {
+				t.Fatal(err)
+			}
+			if buf.String() != tt.want {
+				t.Errorf("writeMetrics() = %q, want %q", buf.String(), tt.want)
+			}
+		})
+	}
+}
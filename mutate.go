@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	corev2 "github.com/sensu/core/v2"
+	"github.com/sensu/sensu-puppet-handler/puppet"
+)
+
+// Entity annotations set by the mutator
+const (
+	annotationNodeExists   = "puppet_node_exists"
+	annotationNodeName     = "puppet_node_name"
+	annotationEnvironment  = "puppet_environment"
+	annotationReportStatus = "puppet_latest_report_status"
+	annotationReportTime   = "puppet_report_timestamp"
+)
+
+// mutateEvent annotates the event's entity with what PuppetDB knows about its
+// node, so that filters and other handlers can act on it. The event is passed
+// along unchanged when PuppetDB cannot be queried.
+func mutateEvent(event *corev2.Event) (*corev2.Event, error) {
+	setupRequestID()
+	client, err := puppetHTTPClient()
+	if err != nil {
+		log.Printf("could not query PuppetDB, passing the event unchanged: %s", err)
+		return event, nil
+	}
+	lookup, err := lookupPuppetNode(client, event)
+	if err != nil {
+		log.Printf("could not query PuppetDB, passing the event unchanged: %s", err)
+		return event, nil
+	}
+
+	if event.Entity.Annotations == nil {
+		event.Entity.Annotations = make(map[string]string)
+	}
+	annotations := event.Entity.Annotations
+	annotations[annotationNodeExists] = strconv.FormatBool(lookup.exists())
+	annotations[annotationNodeName] = lookup.name
+	for key, fields := range map[string][]string{
+		annotationEnvironment:  {"catalog_environment", "facts_environment", "report_environment"},
+		annotationReportStatus: {"latest_report_status"},
+		annotationReportTime:   {"report_timestamp"},
+	} {
+		if value := nodeField(lookup.record, fields...); value != "" {
+			annotations[key] = value
+		}
+	}
+	return event, nil
+}
+
+// nodeField returns the first non-empty string field of the PuppetDB node
+func nodeField(node map[string]interface{}, fields ...string) string {
+	for _, field := range fields {
+		if value, ok := node[field].(string); ok && value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// mutateFacts merges the configured facts of the entity's Puppet node into the
+// entity labels, so that downstream handlers can include them in their
+// notifications. The event is passed along unchanged when the node does not
+// exist or PuppetDB cannot be queried.
+func mutateFacts(event *corev2.Event) (*corev2.Event, error) {
+	setupRequestID()
+	client, err := puppetHTTPClient()
+	if err != nil {
+		log.Printf("could not query PuppetDB, passing the event unchanged: %s", err)
+		return event, nil
+	}
+	lookup, err := lookupPuppetNode(client, event)
+	if err != nil {
+		log.Printf("could not query PuppetDB, passing the event unchanged: %s", err)
+		return event, nil
+	}
+	if !lookup.exists() {
+		return event, nil
+	}
+	facts, err := puppet.Facts(executionCtx, puppetConfig(client), lookup.name, handler.facts)
+	if err != nil {
+		log.Printf("could not query the facts of puppet node %q, passing the event unchanged: %s", lookup.name, err)
+		return event, nil
+	}
+
+	if event.Entity.Labels == nil {
+		event.Entity.Labels = make(map[string]string)
+	}
+	for name, value := range facts {
+		event.Entity.Labels[factLabel(name)] = factString(value)
+	}
+	log.Printf("merged %d facts of puppet node %q into the entity labels", len(facts), lookup.name)
+	return event, nil
+}
+
+// factLabel returns the entity label holding the named fact
+func factLabel(name string) string {
+	return handler.factLabelPrefix + strings.ReplaceAll(name, ".", "_")
+}
+
+// factString formats a fact value as a label value, structured values being
+// JSON encoded
+func factString(value interface{}) string {
+	if s, ok := value.(string); ok {
+		return s
+	}
+	b, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprint(value)
+	}
+	return string(b)
+}
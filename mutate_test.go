@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	corev2 "github.com/sensu/core/v2"
+)
+
+func Test_mutateEvent(t *testing.T) {
+	tests := []struct {
+		name  string
+		nodes []map[string]interface{}
+		want  map[string]string
+	}{
+		{
+			name: "node exists",
+			nodes: []map[string]interface{}{{
+				"certname":             "foo",
+				"catalog_environment":  "production",
+				"latest_report_status": "changed",
+			}},
+			want: map[string]string{
+				annotationNodeExists:   "true",
+				annotationNodeName:     "foo",
+				annotationEnvironment:  "production",
+				annotationReportStatus: "changed",
+			},
+		},
+		{
+			name:  "node does not exist",
+			nodes: []map[string]interface{}{},
+			want: map[string]string{
+				annotationNodeExists: "false",
+				annotationNodeName:   "foo",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				_ = json.NewEncoder(w).Encode(tt.nodes)
+			}))
+			defer ts.Close()
+			certFile, keyFile := writeKeyPair(t)
+			setHandler(t, Handler{
+				endpoint:                 ts.URL,
+				puppetCert:               certFile,
+				puppetKey:                keyFile,
+				puppetCACert:             certFile,
+				puppetInsecureSkipVerify: true,
+			})
+
+			event := corev2.FixtureEvent("foo", "check-cpu")
+			got, err := mutateEvent(event)
+			if err != nil {
+				t.Fatalf("mutateEvent() error = %v", err)
+			}
+			for key, want := range tt.want {
+				if got.Entity.Annotations[key] != want {
+					t.Errorf("mutateEvent() annotation %s = %q, want %q", key, got.Entity.Annotations[key], want)
+				}
+			}
+			if _, ok := got.Entity.Annotations[annotationReportTime]; ok {
+				t.Errorf("mutateEvent() set the missing %s annotation", annotationReportTime)
+			}
+		})
+	}
+}
+
+func Test_mutateFacts(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/facts") {
+			_ = json.NewEncoder(w).Encode([]map[string]interface{}{
+				{"name": "role", "value": "webserver"},
+				{"name": "os", "value": map[string]interface{}{"release": map[string]interface{}{"major": "9"}}},
+			})
+			return
+		}
+		_ = json.NewEncoder(w).Encode([]map[string]interface{}{{"certname": "foo"}})
+	}))
+	defer ts.Close()
+	certFile, keyFile := writeKeyPair(t)
+	setHandler(t, Handler{
+		endpoint:                 ts.URL,
+		puppetCert:               certFile,
+		puppetKey:                keyFile,
+		puppetCACert:             certFile,
+		puppetInsecureSkipVerify: true,
+		facts:                    []string{"role", "os.release", "owner"},
+		factLabelPrefix:          "puppet_",
+	})
+
+	event := corev2.FixtureEvent("foo", "check-cpu")
+	got, err := mutateFacts(event)
+	if err != nil {
+		t.Fatalf("mutateFacts() error = %v", err)
+	}
+	want := map[string]string{
+		"puppet_role":       "webserver",
+		"puppet_os_release": `{"major":"9"}`,
+	}
+	for key, value := range want {
+		if got.Entity.Labels[key] != value {
+			t.Errorf("mutateFacts() label %s = %q, want %q", key, got.Entity.Labels[key], value)
+		}
+	}
+	if _, ok := got.Entity.Labels["puppet_owner"]; ok {
+		t.Error("mutateFacts() set a label for a missing fact")
+	}
+}
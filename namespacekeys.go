@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// fileAPIKeys memoizes the Sensu API keys read from the namespace API keys
+// file during this execution
+var fileAPIKeys map[string]string
+
+// readNamespaceAPIKeys reads the Sensu API keys of the namespace API keys
+// file, one namespace=key pair per line. Blank lines and lines starting with #
+// are ignored.
+func readNamespaceAPIKeys(file string) (map[string]string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	keys := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		namespace, key, ok := strings.Cut(text, "=")
+		namespace, key = strings.TrimSpace(namespace), strings.TrimSpace(key)
+		if !ok || namespace == "" || key == "" {
+			return nil, fmt.Errorf("invalid namespace=key pair on line %d", line)
+		}
+		keys[namespace] = key
+	}
+	return keys, scanner.Err()
+}
+
+// sensuAPIKeyFor returns the Sensu API key used for the namespace: the key
+// mapped to the namespace by the flags or the namespace API keys file, in
+// this order, and the default API key otherwise. Mapping the namespaces to
+// keys scoped to them keeps the handler from needing a cluster-wide key.
+func sensuAPIKeyFor(namespace string) (string, error) {
+	if key, ok := handler.namespaceAPIKeys[namespace]; ok {
+		return key, nil
+	}
+	if handler.namespaceAPIKeysFile != "" {
+		if fileAPIKeys == nil {
+			keys, err := readNamespaceAPIKeys(handler.namespaceAPIKeysFile)
+			if err != nil {
+				return "", fmt.Errorf("could not read the namespace API keys file: %s", err)
+			}
+			fileAPIKeys = keys
+		}
+		if key, ok := fileAPIKeys[namespace]; ok {
+			return key, nil
+		}
+	}
+	return handler.sensuAPIKey, nil
+}
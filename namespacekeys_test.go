@@ -0,0 +1,48 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func Test_sensuAPIKeyFor(t *testing.T) {
+	savedKeys := fileAPIKeys
+	defer func() { fileAPIKeys = savedKeys }()
+
+	file := filepath.Join(t.TempDir(), "keys")
+	content := "# scoped keys\nstaging = staging-key\n\nproduction=file-key\n"
+	if err := os.WriteFile(file, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	setHandler(t, Handler{
+		sensuAPIKey:          "default-key",
+		namespaceAPIKeys:     map[string]string{"production": "flag-key"},
+		namespaceAPIKeysFile: file,
+	})
+	fileAPIKeys = nil
+
+	for namespace, want := range map[string]string{
+		"production": "flag-key",
+		"staging":    "staging-key",
+		"default":    "default-key",
+	} {
+		got, err := sensuAPIKeyFor(namespace)
+		if err != nil {
+			t.Fatalf("sensuAPIKeyFor(%q) error = %v", namespace, err)
+		}
+		if got != want {
+			t.Errorf("sensuAPIKeyFor(%q) = %q, want %q", namespace, got, want)
+		}
+	}
+}
+
+func Test_readNamespaceAPIKeys(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "keys")
+	if err := os.WriteFile(file, []byte("staging=key\nproduction\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readNamespaceAPIKeys(file); err == nil || err.Error() != "invalid namespace=key pair on line 2" {
+		t.Errorf("readNamespaceAPIKeys() error = %v, want an invalid pair error", err)
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"log"
+
+	corev2 "github.com/sensu/core/v2"
+)
+
+// puppetNodeName returns the Puppet node name of the event's entity
+func puppetNodeName(event *corev2.Event) (string, error) {
+	return puppetConfig(nil).ResolveNodeName(event)
+}
+
+// lookupCandidates looks up each candidate node name in turn and returns the
+// first one found to exist, or the lookup of the primary name if none do
+func lookupCandidates(event *corev2.Event, lookup func(name string) (nodeLookup, error)) (nodeLookup, error) {
+	names, err := puppetConfig(nil).NodeNameCandidates(event)
+	if err != nil {
+		return nodeLookup{}, err
+	}
+	var primary nodeLookup
+	for i, name := range names {
+		result, err := lookup(name)
+		if err != nil {
+			return result, err
+		}
+		if result.exists() {
+			return result, nil
+		}
+		if i == 0 {
+			primary = result
+		} else {
+			log.Printf("fallback node name %q does not exist either", name)
+		}
+	}
+	return primary, nil
+}
+
+// contains returns whether the value is in the list
+func contains(list []string, value string) bool {
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// oauthExpiryMargin is how long before its expiry an OAuth2 access token is
+// renewed, so that it does not expire in flight
+const oauthExpiryMargin = 30 * time.Second
+
+// oauthTransport authenticates requests to PuppetDB with a bearer token
+// minted by an identity provider through the OAuth2 client credentials flow,
+// for PuppetDB instances published through API gateways
+type oauthTransport struct {
+	base http.RoundTripper
+	// client requests the tokens from the identity provider
+	client *http.Client
+	// host is the host of the PuppetDB endpoint the tokens are sent to
+	host string
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+// newOAuthTransport returns an OAuth2 transport requesting the tokens through
+// the PuppetDB proxy, if any
+func newOAuthTransport(base http.RoundTripper) (*oauthTransport, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if err := setProxy(transport, handler.puppetProxyURL); err != nil {
+		return nil, err
+	}
+	return &oauthTransport{
+		base:   base,
+		client: &http.Client{Transport: limitedTransport(withConnectionTrace(transport)), Timeout: requestTimeout()},
+		host:   urlHost(handler.endpoint),
+	}, nil
+}
+
+func (t *oauthTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// Keep the token from the hosts the requests are redirected to
+	if !sendCredentials(req, t.host) {
+		return t.base.RoundTrip(req)
+	}
+	token, err := t.accessToken(req, false)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := t.base.RoundTrip(authorize(req, token))
+	if err != nil || resp.StatusCode != http.StatusUnauthorized || req.Body != nil {
+		return resp, err
+	}
+
+	// The token was revoked, request a new one and retry the request once
+	resp.Body.Close()
+	if token, err = t.accessToken(req, true); err != nil {
+		return nil, err
+	}
+	return t.base.RoundTrip(authorize(req, token))
+}
+
+// accessToken returns the current access token, requesting a new one when
+// there is none, when it is about to expire, or when renewal is forced
+func (t *oauthTransport) accessToken(orig *http.Request, renew bool) (string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !renew && t.token != "" && (t.expires.IsZero() || time.Now().Before(t.expires)) {
+		return t.token, nil
+	}
+
+	form := url.Values{"grant_type": {"client_credentials"}}
+	if len(handler.puppetOAuthScopes) > 0 {
+		form.Set("scope", strings.Join(handler.puppetOAuthScopes, " "))
+	}
+	req, err := http.NewRequestWithContext(orig.Context(), http.MethodPost, handler.puppetOAuthTokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.SetBasicAuth(url.QueryEscape(handler.puppetOAuthClientID), url.QueryEscape(handler.puppetOAuthClientSecret))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("could not request an OAuth2 access token: %s", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		_, _ = io.Copy(io.Discard, resp.Body)
+		return "", fmt.Errorf("unexpected HTTP status %s while requesting an OAuth2 access token", http.StatusText(resp.StatusCode))
+	}
+	var result struct {
+		AccessToken string `json:"access_token"`
+		TokenType   string `json:"token_type"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", fmt.Errorf("invalid OAuth2 token response: %s", err)
+	}
+	if result.AccessToken == "" {
+		return "", fmt.Errorf("the OAuth2 token response has no access token")
+	}
+	if result.TokenType != "" && !strings.EqualFold(result.TokenType, "bearer") {
+		return "", fmt.Errorf("unsupported OAuth2 token type %q", result.TokenType)
+	}
+
+	t.token = result.AccessToken
+	t.expires = time.Time{}
+	if result.ExpiresIn > 0 {
+		t.expires = time.Now().Add(time.Duration(result.ExpiresIn)*time.Second - oauthExpiryMargin)
+	}
+	log.Print("requested an OAuth2 access token for PuppetDB")
+	return t.token, nil
+}
+
+// puppetOAuth returns whether PuppetDB is authenticated with OAuth2 tokens
+func puppetOAuth() bool {
+	return handler.puppetOAuthTokenURL != ""
+}
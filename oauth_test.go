@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func Test_oauthTransport(t *testing.T) {
+	var tokens int32
+	idp := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			t.Error(err)
+		}
+		id, secret, _ := r.BasicAuth()
+		if r.Form.Get("grant_type") != "client_credentials" || r.Form.Get("scope") != "puppetdb:read" || id != "sensu" || secret != "s3cret" {
+			t.Errorf("unexpected token request %v (%s:%s)", r.Form, id, secret)
+		}
+		n := atomic.AddInt32(&tokens, 1)
+		fmt.Fprintf(w, `{"access_token":"token%d","token_type":"Bearer","expires_in":3600}`, n)
+	}))
+	defer idp.Close()
+
+	// The first token is revoked after one request
+	var requests int32
+	puppetdb := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		if atomic.AddInt32(&requests, 1) > 1 && auth == "Bearer token1" || auth == "" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		_, _ = w.Write([]byte(auth))
+	}))
+	defer puppetdb.Close()
+
+	saveHandler(t)
+	handler.endpoint = puppetdb.URL
+	handler.puppetOAuthTokenURL = idp.URL
+	handler.puppetOAuthClientID = "sensu"
+	handler.puppetOAuthClientSecret = "s3cret"
+	handler.puppetOAuthScopes = []string{"puppetdb:read"}
+
+	transport, err := newOAuthTransport(http.DefaultTransport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{Transport: transport}
+	for _, want := range []int{http.StatusOK, http.StatusOK} {
+		resp, err := client.Get(puppetdb.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Errorf("status = %d, want %d", resp.StatusCode, want)
+		}
+	}
+	if n := atomic.LoadInt32(&tokens); n != 2 {
+		t.Errorf("%d tokens requested, want 2", n)
+	}
+}
+
+func Test_oauthTransport_redirect(t *testing.T) {
+	idp := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"access_token":"token1","token_type":"Bearer"}`))
+	}))
+	defer idp.Close()
+	var gotAuth string
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotAuth = r.Header.Get("Authorization")
+	}))
+	defer target.Close()
+	targetURL := strings.Replace(target.URL, "127.0.0.1", "localhost", 1)
+	puppetdb := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, targetURL, http.StatusFound)
+	}))
+	defer puppetdb.Close()
+
+	saveHandler(t)
+	handler.endpoint = puppetdb.URL + "/pdb/query/v4/nodes"
+	handler.puppetOAuthTokenURL = idp.URL
+	handler.maxRedirects = 1
+
+	transport, err := newOAuthTransport(http.DefaultTransport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{Transport: transport, CheckRedirect: checkRedirect}
+	resp, err := client.Get(puppetdb.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if gotAuth != "" {
+		t.Errorf("redirect target received Authorization %q, want none", gotAuth)
+	}
+}
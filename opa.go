@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+
+	corev2 "github.com/sensu/core/v2"
+)
+
+// opaInput is the input document of the deregistration policy
+type opaInput struct {
+	Event    json.RawMessage        `json:"event"`
+	Node     map[string]interface{} `json:"node"`
+	NodeName string                 `json:"node_name"`
+	Status   string                 `json:"status"`
+	Action   string                 `json:"action"`
+}
+
+// opaDecision is the object form of the policy decision
+type opaDecision struct {
+	Allow  *bool  `json:"allow"`
+	Action string `json:"action"`
+	Reason string `json:"reason"`
+}
+
+// policyAction asks the Open Policy Agent deregistration policy what to do
+// with the entity of a node found absent, and returns the configured action
+// when the policy allows the deregistration, actionKeep when it denies it, or
+// the alternative action it returns. The policy decision is either a boolean
+// or an object with the allow, action and reason fields.
+func policyAction(event *corev2.Event, lookup nodeLookup) (string, error) {
+	eventJSON, err := json.Marshal(event)
+	if err != nil {
+		return "", err
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"input": opaInput{
+			Event:    eventJSON,
+			Node:     lookup.record,
+			NodeName: lookup.name,
+			Status:   lookup.status,
+			Action:   handler.action,
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequestWithContext(executionCtx, http.MethodPost, handler.opaURL, bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if handler.opaToken != "" {
+		req.Header.Set("Authorization", "Bearer "+handler.opaToken)
+	}
+
+	client := &http.Client{Transport: limitedTransport(withConnectionTrace(nil)), Timeout: requestTimeout()}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected HTTP status %s while querying the policy", http.StatusText(resp.StatusCode))
+	}
+
+	var result struct {
+		Result json.RawMessage `json:"result"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", fmt.Errorf("the policy returned an invalid response: %s", err)
+	}
+	if len(result.Result) == 0 {
+		// OPA leaves the result out when the policy is not defined
+		return "", errors.New("the policy is undefined, check the OPA URL")
+	}
+	return parseDecision(result.Result)
+}
+
+// parseDecision returns the action of the policy decision
+func parseDecision(raw json.RawMessage) (string, error) {
+	var allow bool
+	if err := json.Unmarshal(raw, &allow); err == nil {
+		if !allow {
+			log.Print("the policy denied the deregistration")
+			return actionKeep, nil
+		}
+		return handler.action, nil
+	}
+
+	var decision opaDecision
+	if err := json.Unmarshal(raw, &decision); err != nil {
+		return "", errors.New("the policy decision must be a boolean or an object")
+	}
+	if decision.Reason != "" {
+		log.Printf("policy decision: %s", decision.Reason)
+	}
+	if decision.Allow != nil && !*decision.Allow {
+		log.Print("the policy denied the deregistration")
+		return actionKeep, nil
+	}
+	switch decision.Action {
+	case "":
+		if decision.Allow == nil {
+			return "", errors.New("the policy decision has neither allow nor action")
+		}
+		return handler.action, nil
+	case actionKeep, actionDelete, actionTombstone:
+		if decision.Action != handler.action {
+			log.Printf("the policy replaced the %s action with %s", handler.action, decision.Action)
+		}
+		return decision.Action, nil
+	}
+	return "", fmt.Errorf("the policy returned the unknown action %q", decision.Action)
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	corev2 "github.com/sensu/core/v2"
+)
+
+func Test_policyAction(t *testing.T) {
+	tests := []struct {
+		name    string
+		result  string
+		want    string
+		wantErr bool
+	}{
+		{name: "allowed", result: `{"result":true}`, want: actionDelete},
+		{name: "denied", result: `{"result":false}`, want: actionKeep},
+		{name: "denied object", result: `{"result":{"allow":false,"reason":"production"}}`, want: actionKeep},
+		{name: "alternative action", result: `{"result":{"allow":true,"action":"tombstone"}}`, want: actionTombstone},
+		{name: "undefined policy", result: `{}`, wantErr: true},
+		{name: "unknown action", result: `{"result":{"action":"archive"}}`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				var body struct {
+					Input opaInput `json:"input"`
+				}
+				if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+					t.Error(err)
+				}
+				if body.Input.NodeName != "foo" || body.Input.Status != nodeNotFound || body.Input.Action != actionDelete {
+					t.Errorf("unexpected policy input %+v", body.Input)
+				}
+				if got := r.Header.Get("Authorization"); got != "Bearer secret" {
+					t.Errorf("Authorization = %q", got)
+				}
+				_, _ = w.Write([]byte(tt.result))
+			}))
+			defer ts.Close()
+			setHandler(t, Handler{opaURL: ts.URL, opaToken: "secret", action: actionDelete})
+
+			event := corev2.FixtureEvent("foo", "keepalive")
+			got, err := policyAction(event, nodeLookup{name: "foo", status: nodeNotFound})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("policyAction() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("policyAction() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
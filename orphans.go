@@ -0,0 +1,213 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+
+	corev2 "github.com/sensu/core/v2"
+	"github.com/sensu/sensu-plugin-sdk/sensu"
+)
+
+const (
+	// entitiesPageSize is the number of entities listed per Sensu API request
+	entitiesPageSize = 100
+
+	// maxReportedOrphans caps the orphan entities named in the check output
+	maxReportedOrphans = 10
+)
+
+// forEachEntity calls fn with each entity of the namespace, following the
+// Sensu API pagination. Only one page of entities is held in memory at a time,
+// so that namespaces with many entities are checked in constant memory. With
+// selectors, the entity selectors are passed to the Sensu API so that the
+// backend filters the entities instead of the handler.
+func forEachEntity(namespace string, selectors bool, fn func(*corev2.Entity) error) error {
+	client, err := sensuClient(namespace)
+	if err != nil {
+		return err
+	}
+
+	continueToken := ""
+	for {
+		query := url.Values{"limit": {fmt.Sprint(entitiesPageSize)}}
+		if selectors && handler.entityLabelSelector != "" {
+			query.Set("labelSelector", handler.entityLabelSelector)
+		}
+		if selectors && handler.entityFieldSelector != "" {
+			query.Set("fieldSelector", handler.entityFieldSelector)
+		}
+		if continueToken != "" {
+			query.Set("continue", continueToken)
+		}
+		endpoint := fmt.Sprintf("%s/api/core/v2/namespaces/%s/entities?%s",
+			client.Config.URL, url.PathEscape(namespace), query.Encode())
+		req, err := http.NewRequestWithContext(executionCtx, http.MethodGet, endpoint, nil)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", fmt.Sprintf("Key %s", client.Config.APIKey))
+
+		resp, err := client.HTTPClient.Do(req)
+		if err != nil {
+			return err
+		}
+		var page []corev2.Entity
+		if resp.StatusCode >= 400 {
+			err = fmt.Errorf("unexpected HTTP status %s while listing entities", http.StatusText(resp.StatusCode))
+		} else {
+			err = json.NewDecoder(resp.Body).Decode(&page)
+		}
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+		for i := range page {
+			if err := fn(&page[i]); err != nil {
+				return err
+			}
+		}
+
+		if continueToken = resp.Header.Get("Sensu-Continue"); continueToken == "" {
+			return nil
+		}
+	}
+}
+
+// checkOrphans reports the agent entities that the handler would deregister,
+// without deregistering them, so that drift between Sensu and PuppetDB can be
+// monitored
+func checkOrphans(_ *corev2.Event) (int, error) {
+	setupRequestID()
+	puppetClient, err := puppetHTTPClient()
+	if err != nil {
+		return sensu.CheckStateUnknown, err
+	}
+
+	var (
+		mu      sync.Mutex
+		orphans []string
+	)
+	total := 0
+	progress := startProgress("entities checked", "orphans found", 0)
+	defer progress.finish()
+	report := newDiffReport()
+	cp, err := openCheckpoint("check")
+	if err != nil {
+		return sensu.CheckStateUnknown, fmt.Errorf("could not open the checkpoint file: %s", err)
+	}
+	completed := false
+	defer func() { cp.close(completed) }()
+
+	// checked counts the checked entity, in this run or the interrupted one
+	checked := func(namespace, name string, orphan bool, format string, args ...interface{}) {
+		progress.add(orphan)
+		mark := diffKept
+		if orphan {
+			mark = diffRemoved
+			mu.Lock()
+			orphans = append(orphans, fmt.Sprintf("%s/%s", namespace, name))
+			mu.Unlock()
+		}
+		report.add(namespace, mark, name, format, args...)
+	}
+	for _, namespace := range handler.checkNamespaces {
+		// The entities are listed and filtered in order, only the lookups
+		// run on the workers
+		pool := newWorkerPool(handler.concurrency)
+		err := forEachEntity(namespace, true, func(entity *corev2.Entity) error {
+			// Proxy entities have no keepalive to trigger the handler
+			if entity.EntityClass == corev2.EntityProxyClass {
+				report.add(namespace, diffSkipped, entity.Name, "proxy entity, not checked")
+				return nil
+			}
+			event := &corev2.Event{
+				ObjectMeta: corev2.ObjectMeta{Namespace: namespace},
+				Entity:     entity,
+				Check:      corev2.NewCheck(&corev2.CheckConfig{ObjectMeta: corev2.ObjectMeta{Name: "keepalive", Namespace: namespace}}),
+			}
+			selected, err := entitySelected(event)
+			if err != nil {
+				return err
+			}
+			if !selected {
+				report.add(namespace, diffSkipped, entity.Name, "does not match the label selector %q", handler.labelSelector)
+				return nil
+			}
+			if !entitySubscribed(event) {
+				report.add(namespace, diffSkipped, entity.Name, "subscriptions do not make it eligible")
+				return nil
+			}
+			pattern, err := entityProtected(event)
+			if err != nil {
+				return err
+			}
+			if pattern != "" {
+				report.add(namespace, diffSkipped, entity.Name, "protected by %q", pattern)
+				return nil
+			}
+			total++
+			item := fmt.Sprintf("%s/%s", namespace, entity.Name)
+			if orphan, ok := cp.processed(item); ok {
+				checked(namespace, entity.Name, orphan, "checked by the interrupted run")
+				return nil
+			}
+			return pool.submit(func() error {
+				lookup, deregister, err := shouldDeregister(puppetClient, event)
+				if err != nil {
+					return fmt.Errorf("could not look up entity %q: %s", entity.Name, err)
+				}
+				if err := cp.record(item, deregister); err != nil {
+					return err
+				}
+				checked(namespace, entity.Name, deregister, "node %q is %s", lookup.name, lookup.status)
+				return nil
+			})
+		})
+		if werr := pool.wait(); err == nil {
+			err = werr
+		}
+		if err != nil {
+			return sensu.CheckStateUnknown, fmt.Errorf("could not check the entities of namespace %q: %s", namespace, err)
+		}
+	}
+	// Every entity was checked, the next run starts over
+	completed = true
+	sort.Strings(orphans)
+
+	state := sensu.CheckStateOK
+	switch {
+	case handler.orphanCritical > 0 && len(orphans) >= handler.orphanCritical:
+		state = sensu.CheckStateCritical
+	case handler.orphanWarning > 0 && len(orphans) >= handler.orphanWarning:
+		state = sensu.CheckStateWarning
+	}
+	fmt.Println(orphansSummary(orphans, total))
+	if err := report.save(handler.checkNamespaces); err != nil {
+		return sensu.CheckStateUnknown, fmt.Errorf("could not write the diff report: %s", err)
+	}
+	log.Printf("found %d orphan entities out of %d", len(orphans), total)
+	return state, nil
+}
+
+// orphansSummary returns the check output, naming the first orphan entities
+func orphansSummary(orphans []string, total int) string {
+	summary := fmt.Sprintf("%d orphan entities out of %d agent entities without a Puppet node", len(orphans), total)
+	if len(orphans) == 0 {
+		return summary
+	}
+	named := orphans
+	if len(named) > maxReportedOrphans {
+		named = named[:maxReportedOrphans]
+	}
+	summary += ": " + strings.Join(named, ", ")
+	if more := len(orphans) - len(named); more > 0 {
+		summary += fmt.Sprintf(" and %d more", more)
+	}
+	return summary
+}
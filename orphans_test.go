@@ -0,0 +1,199 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	corev2 "github.com/sensu/core/v2"
+	"github.com/sensu/sensu-plugin-sdk/sensu"
+	"github.com/sensu/sensu-puppet-handler/puppet"
+)
+
+func Test_checkOrphans(t *testing.T) {
+	puppetdb := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case puppet.VersionPath:
+			_, _ = w.Write([]byte(`{"version":"7.0.0"}`))
+		case "/pdb/query/v4/nodes":
+			var query []string
+			if err := json.Unmarshal([]byte(r.URL.Query().Get("query")), &query); err != nil || len(query) != 3 {
+				t.Errorf("checkOrphans() query = %q", r.URL.Query().Get("query"))
+				http.Error(w, "invalid query", http.StatusBadRequest)
+				return
+			}
+			nodes := []map[string]interface{}{}
+			if query[2] == "web01" {
+				nodes = append(nodes, map[string]interface{}{"certname": "web01"})
+			}
+			_ = json.NewEncoder(w).Encode(nodes)
+		default:
+			t.Errorf("checkOrphans() unexpected PuppetDB request %s", r.URL.Path)
+			http.NotFound(w, r)
+		}
+	}))
+	defer puppetdb.Close()
+
+	// Two pages of entities, including a proxy entity which is not checked
+	var pages int
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pages++
+		if got := r.URL.Query().Get("labelSelector"); got != "region == us-west-1" {
+			t.Errorf("forEachEntity() labelSelector = %q", got)
+		}
+		first := corev2.FixtureEntity("web01")
+		proxy := corev2.FixtureEntity("switch01")
+		proxy.EntityClass = corev2.EntityProxyClass
+		entities := []*corev2.Entity{first, proxy}
+		if r.URL.Query().Get("continue") == "" {
+			w.Header().Set("Sensu-Continue", "page2")
+		} else {
+			entities = []*corev2.Entity{corev2.FixtureEntity("web02"), corev2.FixtureEntity("web03")}
+		}
+		_ = json.NewEncoder(w).Encode(entities)
+	}))
+	defer api.Close()
+
+	tests := []struct {
+		name     string
+		warning  int
+		critical int
+		want     int
+	}{
+		{
+			name:     "below thresholds",
+			warning:  3,
+			critical: 5,
+			want:     sensu.CheckStateOK,
+		},
+		{
+			name:     "warning",
+			warning:  1,
+			critical: 5,
+			want:     sensu.CheckStateWarning,
+		},
+		{
+			name:     "critical",
+			warning:  1,
+			critical: 2,
+			want:     sensu.CheckStateCritical,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			certFile, keyFile := writeKeyPair(t)
+			setHandler(t, Handler{
+				endpoint:                 puppetdb.URL + "/pdb/query/v4/nodes",
+				puppetCert:               certFile,
+				puppetKey:                keyFile,
+				puppetCACert:             certFile,
+				puppetInsecureSkipVerify: true,
+				sensuAPIURL:              api.URL,
+				sensuAPIKey:              "xxxxxxxxxx",
+				checkNamespaces:          []string{"default"},
+				entityLabelSelector:      "region == us-west-1",
+				orphanWarning:            tt.warning,
+				orphanCritical:           tt.critical,
+				concurrency:              2,
+				diffReport:               filepath.Join(t.TempDir(), "report"),
+			})
+			pages = 0
+
+			got, err := checkOrphans(nil)
+			if err != nil {
+				t.Fatalf("checkOrphans() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("checkOrphans() = %d, want %d", got, tt.want)
+			}
+			if pages != 2 {
+				t.Errorf("checkOrphans() listed %d pages, want 2", pages)
+			}
+			report, err := os.ReadFile(handler.diffReport)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := `# namespace default: 2 removed, 1 kept, 1 skipped
+~ switch01: proxy entity, not checked
+  web01: node "web01" is active
+- web02: node "web02" is not-found
+- web03: node "web03" is not-found
+`
+			if string(report) != want {
+				t.Errorf("checkOrphans() diff report =\n%s\nwant\n%s", report, want)
+			}
+		})
+	}
+}
+
+func Test_checkOrphans_resume(t *testing.T) {
+	puppetdb := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case puppet.VersionPath:
+			_, _ = w.Write([]byte(`{"version":"7.0.0"}`))
+		case "/pdb/query/v4/nodes":
+			if query := r.URL.Query().Get("query"); strings.Contains(query, "web02") {
+				t.Errorf("checkOrphans() looked up the entity checked by the interrupted run: %s", query)
+			}
+			_ = json.NewEncoder(w).Encode([]map[string]interface{}{{"certname": "web01"}})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer puppetdb.Close()
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode([]*corev2.Entity{corev2.FixtureEntity("web01"), corev2.FixtureEntity("web02")})
+	}))
+	defer api.Close()
+
+	// The interrupted run found web02 to be an orphan
+	checkpointFile := filepath.Join(t.TempDir(), "checkpoint")
+	if err := os.WriteFile(checkpointFile, []byte(`{"command":"check","item":"default/web02","found":true}`+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile := writeKeyPair(t)
+	setHandler(t, Handler{
+		endpoint:                 puppetdb.URL + "/pdb/query/v4/nodes",
+		puppetCert:               certFile,
+		puppetKey:                keyFile,
+		puppetCACert:             certFile,
+		puppetInsecureSkipVerify: true,
+		sensuAPIURL:              api.URL,
+		sensuAPIKey:              "xxxxxxxxxx",
+		checkNamespaces:          []string{"default"},
+		orphanWarning:            1,
+		checkpointFile:           checkpointFile,
+	})
+
+	got, err := checkOrphans(nil)
+	if err != nil {
+		t.Fatalf("checkOrphans() error = %v", err)
+	}
+	if got != sensu.CheckStateWarning {
+		t.Errorf("checkOrphans() = %d, want %d", got, sensu.CheckStateWarning)
+	}
+	if _, err := os.Stat(checkpointFile); !os.IsNotExist(err) {
+		t.Errorf("checkOrphans() left the checkpoint file of the completed run: %v", err)
+	}
+}
+
+func Test_orphansSummary(t *testing.T) {
+	var orphans []string
+	for i := 0; i < 12; i++ {
+		orphans = append(orphans, fmt.Sprintf("default/web%02d", i))
+	}
+	want := "12 orphan entities out of 20 agent entities without a Puppet node: " +
+		"default/web00, default/web01, default/web02, default/web03, default/web04, " +
+		"default/web05, default/web06, default/web07, default/web08, default/web09 and 2 more"
+	if got := orphansSummary(orphans, 20); got != want {
+		t.Errorf("orphansSummary() = %q, want %q", got, want)
+	}
+	if got := orphansSummary(nil, 3); got != "0 orphan entities out of 3 agent entities without a Puppet node" {
+		t.Errorf("orphansSummary() = %q", got)
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+
+	corev2 "github.com/sensu/core/v2"
+)
+
+// supplyOverrideEvent feeds a placeholder event to the SDK when the entity is
+// overridden and no event is piped, so that operators can run the handler by
+// hand against a single entity
+func supplyOverrideEvent() {
+	name := earlyOptionValue("entity-name")
+	if name == "" || stdinIsPipe() {
+		return
+	}
+	event := corev2.FixtureEvent(name, corev2.KeepaliveCheckName)
+	if namespace := earlyOptionValue("entity-namespace"); namespace != "" {
+		event.Namespace, event.Entity.Namespace, event.Check.Namespace = namespace, namespace, namespace
+	}
+	b, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("could not supply the placeholder event: %s", err)
+		return
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		log.Printf("could not supply the placeholder event: %s", err)
+		return
+	}
+	os.Stdin = r
+	go func() {
+		_, _ = w.Write(b)
+		w.Close()
+	}()
+}
+
+// overrideEntity replaces the event's entity with the entity named by
+// --entity-name, fetched from the Sensu API, in the namespace given by
+// --entity-namespace or the event's
+func overrideEntity(event *corev2.Event) error {
+	namespace := handler.entityNamespace
+	if namespace == "" {
+		namespace = event.Entity.Namespace
+	}
+	entity, err := fetchEntity(namespace, handler.entityName)
+	if err != nil {
+		return fmt.Errorf("could not fetch entity %q: %s", handler.entityName, err)
+	}
+	if entity == nil {
+		return fmt.Errorf("entity %q does not exist in namespace %q", handler.entityName, namespace)
+	}
+	log.Printf("overriding the event entity with entity (%s/%s)", namespace, handler.entityName)
+	event.Entity = entity
+	return nil
+}
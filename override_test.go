@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	corev2 "github.com/sensu/core/v2"
+)
+
+func Test_overrideEntity(t *testing.T) {
+
+	entity := corev2.FixtureEntity("web01")
+	entity.Namespace = "production"
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/core/v2/namespaces/production/entities/web01" {
+			http.NotFound(w, r)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(entity)
+	}))
+	defer ts.Close()
+
+	// The entity is protected so that the event is ignored before PuppetDB is
+	// queried, once the overridden entity replaced the event entity
+	protected := filepath.Join(t.TempDir(), "protected")
+	if err := os.WriteFile(protected, []byte("web01\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	setHandler(t, Handler{
+		triggerChecks:      []string{"keepalive"},
+		sensuAPIURL:        ts.URL,
+		protectedNodesFile: protected,
+		entityName:         "web01",
+		entityNamespace:    "production",
+	})
+
+	// The trigger checks do not apply to the overridden entity
+	event := corev2.FixtureEvent("foo", "check-cpu")
+	if err := processEvent(event); err != nil {
+		t.Fatalf("processEvent() error = %v", err)
+	}
+	if event.Entity.Name != "web01" || event.Entity.Namespace != "production" {
+		t.Errorf("processEvent() entity = %s/%s, want production/web01", event.Entity.Namespace, event.Entity.Name)
+	}
+
+	handler.entityName = "web02"
+	if err := processEvent(corev2.FixtureEvent("foo", "keepalive")); err == nil {
+		t.Error("processEvent() expected an error with a missing entity")
+	}
+}
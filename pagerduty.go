@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+)
+
+const failuresStateFile = "failures.json"
+
+// pagerDutyEventsURL is the PagerDuty Events API v2 endpoint
+var pagerDutyEventsURL = "https://events.pagerduty.com/v2/enqueue"
+
+// failureState tracks the consecutive failures of the handler across
+// executions
+type failureState struct {
+	ConsecutiveFailures int    `json:"consecutive_failures"`
+	LastError           string `json:"last_error,omitempty"`
+}
+
+type pagerDutyEvent struct {
+	RoutingKey  string            `json:"routing_key"`
+	EventAction string            `json:"event_action"`
+	DedupKey    string            `json:"dedup_key"`
+	Payload     *pagerDutyPayload `json:"payload,omitempty"`
+}
+
+type pagerDutyPayload struct {
+	Summary       string                 `json:"summary"`
+	Source        string                 `json:"source"`
+	Severity      string                 `json:"severity"`
+	Component     string                 `json:"component"`
+	Timestamp     string                 `json:"timestamp"`
+	CustomDetails map[string]interface{} `json:"custom_details"`
+}
+
+// trackFailures records the outcome of the handler execution and alerts
+// PagerDuty once the number of consecutive failures reaches the configured
+// threshold. The alert is resolved on the next successful execution.
+func trackFailures(handlerErr error) error {
+	var state failureState
+	if err := readState(failuresStateFile, &state); err != nil {
+		return fmt.Errorf("could not read failure state: %s", err)
+	}
+	alerted := state.ConsecutiveFailures >= handler.pagerDutyThreshold
+
+	if handlerErr == nil {
+		if state.ConsecutiveFailures == 0 {
+			return nil
+		}
+		if err := writeState(failuresStateFile, failureState{}); err != nil {
+			return fmt.Errorf("could not write failure state: %s", err)
+		}
+		if alerted {
+			return sendPagerDutyEvent("resolve", nil)
+		}
+		return nil
+	}
+
+	state.ConsecutiveFailures++
+	state.LastError = handlerErr.Error()
+	if err := writeState(failuresStateFile, state); err != nil {
+		return fmt.Errorf("could not write failure state: %s", err)
+	}
+	if state.ConsecutiveFailures < handler.pagerDutyThreshold {
+		return nil
+	}
+
+	hostname, _ := os.Hostname()
+	return sendPagerDutyEvent("trigger", &pagerDutyPayload{
+		Summary:   fmt.Sprintf("%s failed %d consecutive times: %s", handler.Name, state.ConsecutiveFailures, handlerErr),
+		Source:    hostname,
+		Severity:  "error",
+		Component: handler.Name,
+		Timestamp: time.Now().UTC().Format(time.RFC3339),
+		CustomDetails: map[string]interface{}{
+			"consecutive_failures": state.ConsecutiveFailures,
+			"error":                handlerErr.Error(),
+		},
+	})
+}
+
+func sendPagerDutyEvent(action string, payload *pagerDutyPayload) error {
+	hostname, _ := os.Hostname()
+	body, err := json.Marshal(pagerDutyEvent{
+		RoutingKey:  handler.pagerDutyRoutingKey,
+		EventAction: action,
+		DedupKey:    fmt.Sprintf("%s/%s", handler.Name, hostname),
+		Payload:     payload,
+	})
+	if err != nil {
+		return err
+	}
+
+	client := &http.Client{Transport: limitedTransport(withConnectionTrace(nil)), Timeout: requestTimeout()}
+	resp, err := client.Post(pagerDutyEventsURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("could not send PagerDuty event: %s", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		return fmt.Errorf("unexpected HTTP status %s while sending PagerDuty event", http.StatusText(resp.StatusCode))
+	}
+
+	log.Printf("sent PagerDuty %s event", action)
+	return nil
+}
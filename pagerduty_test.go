@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func Test_trackFailures(t *testing.T) {
+	var actions []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event pagerDutyEvent
+		_ = json.NewDecoder(r.Body).Decode(&event)
+		if event.RoutingKey != "routing-key" {
+			t.Errorf("trackFailures() routing key = %q", event.RoutingKey)
+		}
+		actions = append(actions, event.EventAction)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer ts.Close()
+	pagerDutyEventsURL = ts.URL
+
+	setHandler(t, Handler{
+		stateDir:            t.TempDir(),
+		pagerDutyRoutingKey: "routing-key",
+		pagerDutyThreshold:  2,
+	})
+
+	steps := []struct {
+		err         error
+		wantActions []string
+	}{
+		{err: errors.New("connection refused"), wantActions: nil},
+		{err: errors.New("connection refused"), wantActions: []string{"trigger"}},
+		{err: errors.New("connection refused"), wantActions: []string{"trigger", "trigger"}},
+		{err: nil, wantActions: []string{"trigger", "trigger", "resolve"}},
+		{err: nil, wantActions: []string{"trigger", "trigger", "resolve"}},
+		{err: errors.New("connection refused"), wantActions: []string{"trigger", "trigger", "resolve"}},
+	}
+	for i, step := range steps {
+		if err := trackFailures(step.err); err != nil {
+			t.Fatalf("step %d: trackFailures() error = %v", i, err)
+		}
+		if len(actions) != len(step.wantActions) {
+			t.Fatalf("step %d: trackFailures() actions = %v, want %v", i, actions, step.wantActions)
+		}
+		for j := range actions {
+			if actions[j] != step.wantActions[j] {
+				t.Fatalf("step %d: trackFailures() actions = %v, want %v", i, actions, step.wantActions)
+			}
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	corev2 "github.com/sensu/core/v2"
+)
+
+// preflightTarget is a server reached by the handler
+type preflightTarget struct {
+	name     string
+	endpoint string
+	proxyURL string
+	client   *http.Client
+}
+
+// preflight checks that PuppetDB and the Sensu API are reachable before the
+// event is processed, logging the result of each step for each target: the
+// TCP connection, the TLS handshake and a HEAD request. It tells network
+// errors apart from configuration errors, which the validation reports.
+func preflight(event *corev2.Event) error {
+	puppetClient, err := puppetHTTPClient()
+	if err != nil {
+		return err
+	}
+	sensuAPI, err := sensuClient(event.Entity.Namespace)
+	if err != nil {
+		return err
+	}
+	targets := []preflightTarget{
+		{name: "PuppetDB", endpoint: handler.endpoint, proxyURL: handler.puppetProxyURL, client: puppetClient},
+		{name: "Sensu API", endpoint: strings.TrimRight(sensuAPI.Config.URL, "/") + "/health", proxyURL: handler.sensuProxyURL, client: &sensuAPI.HTTPClient},
+	}
+
+	var failed []string
+	for _, target := range targets {
+		if err := target.check(); err != nil {
+			log.Printf("preflight %s: %s", target.name, err)
+			failed = append(failed, target.name)
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("preflight failed, %s unreachable", strings.Join(failed, " and "))
+	}
+	return nil
+}
+
+// check connects to the target, through its proxy if any, and sends it a HEAD
+// request
+func (t preflightTarget) check() error {
+	u, err := url.Parse(t.endpoint)
+	if err != nil {
+		return err
+	}
+	address, via := hostPort(u), ""
+	if t.proxyURL != "" {
+		proxy, err := parseProxyURL(t.proxyURL)
+		if err != nil {
+			return err
+		}
+		address, via = hostPort(proxy), " through proxy "+proxy.Host
+	}
+
+	start := time.Now()
+	conn, err := net.DialTimeout("tcp", address, requestTimeout())
+	if err != nil {
+		return fmt.Errorf("TCP connection to %s failed: %s", address, err)
+	}
+	conn.Close()
+	log.Printf("preflight %s: TCP connection to %s ok (%s)", t.name, address, time.Since(start).Round(time.Millisecond))
+
+	var (
+		mu     sync.Mutex
+		tlsErr error
+		tlsOK  bool
+	)
+	trace := &httptrace.ClientTrace{
+		TLSHandshakeDone: func(_ tls.ConnectionState, err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			tlsErr, tlsOK = err, err == nil
+		},
+	}
+	req, err := http.NewRequestWithContext(httptrace.WithClientTrace(executionCtx, trace), http.MethodHead, t.endpoint, nil)
+	if err != nil {
+		return err
+	}
+	start = time.Now()
+	resp, err := t.client.Do(req)
+	mu.Lock()
+	defer mu.Unlock()
+	if err != nil {
+		if tlsErr != nil || isTLSError(err) {
+			return fmt.Errorf("TLS handshake with %s%s failed: %s", u.Host, via, err)
+		}
+		return fmt.Errorf("HEAD request failed: %s", err)
+	}
+	resp.Body.Close()
+	if tlsOK {
+		log.Printf("preflight %s: TLS handshake with %s ok", t.name, u.Host)
+	}
+	// Any response shows the server is reachable, the status is reported
+	log.Printf("preflight %s: HEAD %s answered %s (%s)", t.name, u.Redacted(), resp.Status, time.Since(start).Round(time.Millisecond))
+	return nil
+}
+
+// isTLSError returns whether the error comes from the TLS handshake or the
+// verification of the server certificate
+func isTLSError(err error) bool {
+	var recordErr tls.RecordHeaderError
+	return errors.As(err, &recordErr) || strings.Contains(err.Error(), "tls: ") || strings.Contains(err.Error(), "x509: ")
+}
+
+// hostPort returns the host and port of the URL, the default port of its
+// scheme if it has none
+func hostPort(u *url.URL) string {
+	if port := u.Port(); port != "" {
+		return u.Host
+	}
+	port := "443"
+	if u.Scheme == "http" {
+		port = "80"
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	corev2 "github.com/sensu/core/v2"
+)
+
+func Test_preflight(t *testing.T) {
+	saveHandler(t)
+	savedOutput := log.Writer()
+	defer log.SetOutput(savedOutput)
+	certFile, keyFile := writeKeyPair(t)
+
+	// The PuppetDB server certificate is not issued by the Puppet CA
+	puppetDB := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer puppetDB.Close()
+	sensuAPI := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodHead || r.URL.Path != "/health" {
+			t.Errorf("preflight() request = %s %s", r.Method, r.URL.Path)
+		}
+	}))
+	defer sensuAPI.Close()
+	closed := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	closed.Close()
+
+	tests := []struct {
+		name     string
+		endpoint string
+		want     []string
+		wantErr  string
+	}{
+		{
+			name:     "TLS failure",
+			endpoint: puppetDB.URL,
+			want: []string{
+				"preflight PuppetDB: TCP connection to " + strings.TrimPrefix(puppetDB.URL, "https://") + " ok",
+				"preflight PuppetDB: TLS handshake with " + strings.TrimPrefix(puppetDB.URL, "https://") + " failed",
+				"preflight Sensu API: HEAD " + sensuAPI.URL + "/health answered 200 OK",
+			},
+			wantErr: "preflight failed, PuppetDB unreachable",
+		},
+		{
+			name:     "TCP failure",
+			endpoint: closed.URL,
+			want:     []string{"preflight PuppetDB: TCP connection to " + strings.TrimPrefix(closed.URL, "http://") + " failed"},
+			wantErr:  "preflight failed, PuppetDB unreachable",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setHandler(t, Handler{
+				endpoint:     tt.endpoint,
+				puppetCert:   certFile,
+				puppetKey:    keyFile,
+				puppetCACert: certFile,
+				sensuAPIURL:  sensuAPI.URL,
+				sensuAPIKey:  "xxxxxxxxxx",
+			})
+			var out bytes.Buffer
+			log.SetOutput(&out)
+			err := preflight(corev2.FixtureEvent("foo", "keepalive"))
+			log.SetOutput(savedOutput)
+			if err == nil || err.Error() != tt.wantErr {
+				t.Errorf("preflight() error = %v, want %q", err, tt.wantErr)
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(out.String(), want) {
+					t.Errorf("preflight() logged %q, want %q", out.String(), want)
+				}
+			}
+		})
+	}
+}
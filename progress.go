@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// progressReporter counts the items processed by a bulk subcommand and logs
+// its progress every --progress-interval seconds, so that long runs are not
+// silent until their check output
+type progressReporter struct {
+	doneLabel  string
+	foundLabel string
+	total      int
+	start      time.Time
+
+	mu    sync.Mutex
+	done  int
+	found int
+
+	stop    chan struct{}
+	stopped chan struct{}
+}
+
+// startProgress starts reporting the progress of a run processing total items,
+// or an unknown number when zero. Without a found label only the processed
+// items are reported.
+func startProgress(doneLabel, foundLabel string, total int) *progressReporter {
+	p := &progressReporter{doneLabel: doneLabel, foundLabel: foundLabel, total: total, start: time.Now()}
+	if handler.progressInterval <= 0 {
+		return p
+	}
+	p.stop, p.stopped = make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(p.stopped)
+		ticker := time.NewTicker(time.Duration(handler.progressInterval) * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case now := <-ticker.C:
+				log.Print(p.line(now))
+			case <-p.stop:
+				return
+			}
+		}
+	}()
+	return p
+}
+
+// add counts a processed item, and whether it was found
+func (p *progressReporter) add(found bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.done++
+	if found {
+		p.found++
+	}
+}
+
+// finish stops the reporting
+func (p *progressReporter) finish() {
+	if p.stop == nil {
+		return
+	}
+	close(p.stop)
+	<-p.stopped
+}
+
+// line returns the progress at the given time, with the time left estimated
+// from the rate so far when the total is known
+func (p *progressReporter) line(now time.Time) string {
+	p.mu.Lock()
+	done, found := p.done, p.found
+	p.mu.Unlock()
+
+	elapsed := now.Sub(p.start)
+	line := fmt.Sprintf("progress: %d %s", done, p.doneLabel)
+	if p.total > 0 {
+		line = fmt.Sprintf("progress: %d of %d %s", done, p.total, p.doneLabel)
+	}
+	if p.foundLabel != "" {
+		line += fmt.Sprintf(", %d %s", found, p.foundLabel)
+	}
+	line += fmt.Sprintf(", %s elapsed", elapsed.Round(time.Second))
+	if p.total > 0 && done > 0 && done < p.total {
+		left := time.Duration(float64(elapsed) * float64(p.total-done) / float64(done))
+		line += fmt.Sprintf(", about %s left", left.Round(time.Second))
+	}
+	return line
+}
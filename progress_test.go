@@ -0,0 +1,69 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_progressReporter_line(t *testing.T) {
+	saveHandler(t)
+	handler.progressInterval = 0
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name       string
+		foundLabel string
+		total      int
+		done       []bool
+		want       string
+	}{
+		{
+			name:       "unknown total",
+			foundLabel: "orphans found",
+			done:       []bool{true, false, false, true},
+			want:       "progress: 4 entities checked, 2 orphans found, 1m0s elapsed",
+		},
+		{
+			name:  "known total",
+			total: 10,
+			done:  []bool{false, false},
+			want:  "progress: 2 of 10 entities checked, 1m0s elapsed, about 4m0s left",
+		},
+		{
+			name:  "nothing done",
+			total: 10,
+			want:  "progress: 0 of 10 entities checked, 1m0s elapsed",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := startProgress("entities checked", tt.foundLabel, tt.total)
+			defer p.finish()
+			p.start = start
+			for _, found := range tt.done {
+				p.add(found)
+			}
+			if got := p.line(start.Add(time.Minute)); got != tt.want {
+				t.Errorf("line() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_startProgress(t *testing.T) {
+	saveHandler(t)
+	handler.progressInterval = 1
+	p := startProgress("nodes deactivated", "", 3)
+	p.add(false)
+	// finish returns once the reporting goroutine is stopped
+	done := make(chan struct{})
+	go func() {
+		p.finish()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("finish() did not stop the reporting")
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	corev2 "github.com/sensu/core/v2"
+)
+
+// readProtectedNodes reads the names and glob patterns of the protected nodes
+// file, one per line. Blank lines and lines starting with # are ignored.
+func readProtectedNodes(file string) ([]string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var patterns []string
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		pattern := strings.TrimSpace(scanner.Text())
+		if pattern == "" || strings.HasPrefix(pattern, "#") {
+			continue
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern %q on line %d", pattern, line)
+		}
+		patterns = append(patterns, pattern)
+	}
+	return patterns, scanner.Err()
+}
+
+// entityProtected returns the protected nodes pattern matching the event's
+// entity name or Puppet node name, if any. The file is read on every
+// execution so that changes apply without redeploying the handler, and an
+// unreadable file is an error rather than an empty list.
+func entityProtected(event *corev2.Event) (string, error) {
+	if handler.protectedNodesFile == "" {
+		return "", nil
+	}
+	patterns, err := readProtectedNodes(handler.protectedNodesFile)
+	if err != nil {
+		return "", fmt.Errorf("could not read the protected nodes file: %s", err)
+	}
+	nodeName, err := puppetNodeName(event)
+	if err != nil {
+		return "", err
+	}
+
+	for _, pattern := range patterns {
+		for _, name := range []string{event.Entity.Name, nodeName} {
+			if handler.caseInsensitive {
+				pattern, name = strings.ToLower(pattern), strings.ToLower(name)
+			}
+			if matched, _ := path.Match(pattern, name); matched {
+				return pattern, nil
+			}
+		}
+	}
+	return "", nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	corev2 "github.com/sensu/core/v2"
+)
+
+func Test_entityProtected(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "protected")
+	content := "# infrastructure nodes\n\ndb*.example.com\n  bastion01  \n"
+	if err := os.WriteFile(file, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		entity   string
+		nodeName string
+		want     string
+	}{
+		{
+			name:   "exact name",
+			entity: "bastion01",
+			want:   "bastion01",
+		},
+		{
+			name:   "glob pattern",
+			entity: "db01.example.com",
+			want:   "db*.example.com",
+		},
+		{
+			name:     "puppet node name",
+			entity:   "db01",
+			nodeName: "db01.example.com",
+			want:     "db*.example.com",
+		},
+		{
+			name:   "not protected",
+			entity: "web01.example.com",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setHandler(t, Handler{protectedNodesFile: file, puppetNodeName: tt.nodeName})
+			event := corev2.FixtureEvent(tt.entity, "keepalive")
+			got, err := entityProtected(event)
+			if err != nil {
+				t.Fatalf("entityProtected() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("entityProtected() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	// A missing file must not be mistaken for an empty list
+	setHandler(t, Handler{protectedNodesFile: filepath.Join(t.TempDir(), "missing")})
+	if _, err := entityProtected(corev2.FixtureEvent("foo", "keepalive")); err == nil {
+		t.Error("entityProtected() expected an error for a missing file")
+	}
+}
+
+func Test_readProtectedNodes(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "protected")
+	if err := os.WriteFile(file, []byte("web[01\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readProtectedNodes(file); err == nil {
+		t.Error("readProtectedNodes() expected an error for an invalid pattern")
+	}
+}
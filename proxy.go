@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+// proxySchemes are the proxy URL schemes supported by the HTTP transports
+var proxySchemes = []string{"http", "https", "socks5", "socks5h"}
+
+// parseProxyURL parses and validates a proxy URL
+func parseProxyURL(proxyURL string) (*url.URL, error) {
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		return nil, err
+	}
+	for _, scheme := range proxySchemes {
+		if u.Scheme == scheme {
+			if u.Host == "" {
+				return nil, fmt.Errorf("missing proxy host in %q", proxyURL)
+			}
+			return u, nil
+		}
+	}
+	return nil, fmt.Errorf("unsupported proxy scheme %q, must be one of %v", u.Scheme, proxySchemes)
+}
+
+// setProxy routes the transport's requests through the proxy URL, if set
+func setProxy(transport *http.Transport, proxyURL string) error {
+	if proxyURL == "" {
+		return nil
+	}
+	u, err := parseProxyURL(proxyURL)
+	if err != nil {
+		return err
+	}
+	transport.Proxy = http.ProxyURL(u)
+	return nil
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func Test_setProxy(t *testing.T) {
+	tests := []struct {
+		name      string
+		proxyURL  string
+		wantProxy string
+		wantErr   bool
+	}{
+		{name: "no proxy"},
+		{name: "SOCKS5 proxy", proxyURL: "socks5://bastion.example.com:1080", wantProxy: "socks5://bastion.example.com:1080"},
+		{name: "HTTP proxy", proxyURL: "http://proxy.example.com:3128", wantProxy: "http://proxy.example.com:3128"},
+		{name: "unsupported scheme", proxyURL: "ftp://proxy.example.com", wantErr: true},
+		{name: "missing host", proxyURL: "socks5://", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			transport := new(http.Transport)
+			if err := setProxy(transport, tt.proxyURL); (err != nil) != tt.wantErr {
+				t.Fatalf("setProxy() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantProxy == "" {
+				return
+			}
+			req, _ := http.NewRequest(http.MethodGet, "https://puppetdb.example.com:8081", nil)
+			got, err := transport.Proxy(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.String() != tt.wantProxy {
+				t.Errorf("setProxy() proxy = %v, want %v", got, tt.wantProxy)
+			}
+		})
+	}
+}
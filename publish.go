@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nats-io/nats.go"
+	"github.com/segmentio/kafka-go"
+	corev2 "github.com/sensu/core/v2"
+)
+
+const (
+	// actionKeep is recorded when the Puppet node exists and the entity is
+	// left untouched
+	actionKeep = "keep"
+
+	formatJSON        = "json"
+	formatCloudEvents = "cloudevents"
+)
+
+// deregistrationRecord is the message published to the message bus for each
+// entity handled
+type deregistrationRecord struct {
+	Entity       string `json:"entity"`
+	Namespace    string `json:"namespace"`
+	PuppetNode   string `json:"puppet_node"`
+	PuppetStatus string `json:"puppet_status"`
+	Action       string `json:"action"`
+	Timestamp    int64  `json:"timestamp"`
+}
+
+func newDeregistrationRecord(event *corev2.Event, lookup nodeLookup, action string) deregistrationRecord {
+	return deregistrationRecord{
+		Entity:       event.Entity.Name,
+		Namespace:    event.Entity.Namespace,
+		PuppetNode:   lookup.name,
+		PuppetStatus: lookup.status,
+		Action:       action,
+		Timestamp:    time.Now().Unix(),
+	}
+}
+
+// cloudEvent is a CloudEvents 1.0 envelope in structured content mode
+type cloudEvent struct {
+	SpecVersion     string               `json:"specversion"`
+	ID              string               `json:"id"`
+	Source          string               `json:"source"`
+	Type            string               `json:"type"`
+	Subject         string               `json:"subject"`
+	Time            string               `json:"time"`
+	DataContentType string               `json:"datacontenttype"`
+	Data            deregistrationRecord `json:"data"`
+}
+
+// encodeRecord serializes the record according to the configured message
+// format
+func encodeRecord(record deregistrationRecord) ([]byte, error) {
+	if handler.messageFormat != formatCloudEvents {
+		return json.Marshal(record)
+	}
+
+	return json.Marshal(cloudEvent{
+		SpecVersion:     "1.0",
+		ID:              uuid.New().String(),
+		Source:          handler.cloudEventsSource,
+		Type:            handler.cloudEventsType,
+		Subject:         fmt.Sprintf("%s/%s", record.Namespace, record.Entity),
+		Time:            time.Unix(record.Timestamp, 0).UTC().Format(time.RFC3339),
+		DataContentType: "application/json",
+		Data:            record,
+	})
+}
+
+// contentType returns the content type of the encoded records
+func contentType() string {
+	if handler.messageFormat == formatCloudEvents {
+		return "application/cloudevents+json"
+	}
+	return "application/json"
+}
+
+// publishEnabled returns whether any message bus publisher is configured
+func publishEnabled() bool {
+	return handler.natsURL != "" || len(handler.kafkaBrokers) > 0 || handler.agentEventsURL != ""
+}
+
+// publishRecord sends the record of the action taken on the event's entity to
+// every configured message bus
+func publishRecord(event *corev2.Event, lookup nodeLookup, action string) error {
+	if !publishEnabled() {
+		return nil
+	}
+
+	record := newDeregistrationRecord(event, lookup, action)
+	var payload []byte
+	if handler.messageTemplate != "" {
+		message, err := renderTemplate(handler.messageTemplate, newTemplateData(event, lookup, action))
+		if err != nil {
+			return fmt.Errorf("could not render message template: %s", err)
+		}
+		payload = []byte(message)
+	} else {
+		var err error
+		if payload, err = encodeRecord(record); err != nil {
+			return err
+		}
+	}
+
+	if handler.natsURL != "" {
+		if err := publishNATS(payload); err != nil {
+			return fmt.Errorf("could not publish to NATS: %s", err)
+		}
+	}
+	if len(handler.kafkaBrokers) > 0 {
+		key := fmt.Sprintf("%s/%s", record.Namespace, record.Entity)
+		if err := publishKafka(key, payload); err != nil {
+			return fmt.Errorf("could not publish to Kafka: %s", err)
+		}
+	}
+	if handler.agentEventsURL != "" {
+		if err := publishAgentEvent(payload); err != nil {
+			return fmt.Errorf("could not publish to the agent events API: %s", err)
+		}
+	}
+
+	return nil
+}
+
+func publishNATS(payload []byte) error {
+	conn, err := nats.Connect(handler.natsURL, nats.Name(handler.Name), nats.Timeout(requestTimeout()))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	msg := nats.NewMsg(handler.natsSubject)
+	msg.Data = payload
+	// Headers require NATS 2.2 or later, only send them when the consumer
+	// needs them to identify CloudEvents
+	if handler.messageFormat == formatCloudEvents {
+		msg.Header.Set("Content-Type", contentType())
+	}
+	if err := conn.PublishMsg(msg); err != nil {
+		return err
+	}
+	if timeout := requestTimeout(); timeout > 0 {
+		err = conn.FlushTimeout(timeout)
+	} else {
+		err = conn.Flush()
+	}
+	if err != nil {
+		return err
+	}
+
+	log.Printf("published record to NATS subject %q", handler.natsSubject)
+	return nil
+}
+
+// agentEvent is the event posted to the agent events API, which completes it
+// with the agent entity
+type agentEvent struct {
+	Check agentCheck `json:"check"`
+}
+
+type agentCheck struct {
+	Metadata struct {
+		Name string `json:"name"`
+	} `json:"metadata"`
+	Status   uint32   `json:"status"`
+	Output   string   `json:"output"`
+	Handlers []string `json:"handlers,omitempty"`
+}
+
+func publishAgentEvent(payload []byte) error {
+	var event agentEvent
+	event.Check.Metadata.Name = handler.agentEventCheck
+	event.Check.Output = string(payload)
+	event.Check.Handlers = handler.agentEventHandlers
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(executionCtx, http.MethodPost, handler.agentEventsURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	client := &http.Client{Transport: limitedTransport(withConnectionTrace(nil)), Timeout: requestTimeout()}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("unexpected HTTP status %s", http.StatusText(resp.StatusCode))
+	}
+
+	log.Printf("published record to the agent events API as check %q", handler.agentEventCheck)
+	return nil
+}
+
+func publishKafka(key string, payload []byte) error {
+	writer := &kafka.Writer{
+		Addr:         kafka.TCP(handler.kafkaBrokers...),
+		Topic:        handler.kafkaTopic,
+		Balancer:     &kafka.Hash{},
+		RequiredAcks: kafka.RequireOne,
+	}
+	defer writer.Close()
+
+	ctx := executionCtx
+	if timeout := requestTimeout(); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	msg := kafka.Message{
+		Key:     []byte(key),
+		Value:   payload,
+		Headers: []kafka.Header{{Key: "content-type", Value: []byte(contentType())}},
+	}
+	if err := writer.WriteMessages(ctx, msg); err != nil {
+		return err
+	}
+
+	log.Printf("published record to Kafka topic %q", handler.kafkaTopic)
+	return nil
+}
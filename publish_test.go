@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	corev2 "github.com/sensu/core/v2"
+)
+
+func Test_newDeregistrationRecord(t *testing.T) {
+	event := corev2.FixtureEvent("foo", "keepalive")
+	lookup := nodeLookup{name: "foo.example.com", status: nodeNotFound}
+
+	record := newDeregistrationRecord(event, lookup, actionDelete)
+	if record.Entity != "foo" || record.Namespace != "default" {
+		t.Errorf("newDeregistrationRecord() entity = %s/%s", record.Namespace, record.Entity)
+	}
+	if record.PuppetNode != "foo.example.com" || record.PuppetStatus != nodeNotFound {
+		t.Errorf("newDeregistrationRecord() puppet node = %s (%s)", record.PuppetNode, record.PuppetStatus)
+	}
+	if record.Action != actionDelete {
+		t.Errorf("newDeregistrationRecord() action = %s, want %s", record.Action, actionDelete)
+	}
+	if record.Timestamp == 0 {
+		t.Error("newDeregistrationRecord() timestamp is not set")
+	}
+}
+
+func Test_publishRecord(t *testing.T) {
+	setHandler(t, Handler{})
+	event := corev2.FixtureEvent("foo", "keepalive")
+	if err := publishRecord(event, nodeLookup{name: "foo", status: nodeNotFound}, actionDelete); err != nil {
+		t.Errorf("publishRecord() without publishers error = %v", err)
+	}
+}
+
+func Test_encodeRecord(t *testing.T) {
+	setHandler(t, Handler{
+		messageFormat:     formatCloudEvents,
+		cloudEventsSource: "/sensu-puppet-handler",
+		cloudEventsType:   "io.sensu.puppet.deregistration",
+	})
+	event := corev2.FixtureEvent("foo", "keepalive")
+	record := newDeregistrationRecord(event, nodeLookup{name: "foo", status: nodeNotFound}, actionDelete)
+
+	payload, err := encodeRecord(record)
+	if err != nil {
+		t.Fatalf("encodeRecord() error = %v", err)
+	}
+	var ce cloudEvent
+	if err := json.Unmarshal(payload, &ce); err != nil {
+		t.Fatalf("encodeRecord() returned invalid JSON: %v", err)
+	}
+	if ce.SpecVersion != "1.0" || ce.ID == "" {
+		t.Errorf("encodeRecord() specversion = %q, id = %q", ce.SpecVersion, ce.ID)
+	}
+	if ce.Source != handler.cloudEventsSource || ce.Type != handler.cloudEventsType {
+		t.Errorf("encodeRecord() source = %q, type = %q", ce.Source, ce.Type)
+	}
+	if ce.Subject != "default/foo" {
+		t.Errorf("encodeRecord() subject = %q, want %q", ce.Subject, "default/foo")
+	}
+	if ce.Data != record {
+		t.Errorf("encodeRecord() data = %v, want %v", ce.Data, record)
+	}
+}
+
+func Test_publishAgentEvent(t *testing.T) {
+	var got agentEvent
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			t.Errorf("publishAgentEvent() method = %v, want %v", r.Method, http.MethodPost)
+		}
+		_ = json.NewDecoder(r.Body).Decode(&got)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer ts.Close()
+	setHandler(t, Handler{
+		agentEventsURL:     ts.URL,
+		agentEventCheck:    "puppet-deregistration",
+		agentEventHandlers: []string{"slack"},
+	})
+	defer func() { setHandler(t, Handler{}) }()
+
+	event := corev2.FixtureEvent("foo", "keepalive")
+	lookup := nodeLookup{name: "foo.example.com", status: nodeNotFound}
+	if err := publishRecord(event, lookup, actionDelete); err != nil {
+		t.Fatalf("publishRecord() error = %v", err)
+	}
+	if got.Check.Metadata.Name != "puppet-deregistration" || len(got.Check.Handlers) != 1 {
+		t.Errorf("publishAgentEvent() check = %+v", got.Check)
+	}
+	var record deregistrationRecord
+	if err := json.Unmarshal([]byte(got.Check.Output), &record); err != nil || record.Entity != "foo" {
+		t.Errorf("publishAgentEvent() output = %q", got.Check.Output)
+	}
+}
@@ -0,0 +1,190 @@
+package puppet
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// CommandPath is the path of the PuppetDB command API
+const CommandPath = "/pdb/cmd/v1"
+
+// deactivateNodeVersion is the version of the deactivate node command
+const deactivateNodeVersion = 3
+
+// UnreportedNode is a node whose last report is older than the threshold
+type UnreportedNode struct {
+	Certname        string    `json:"certname"`
+	ReportTimestamp time.Time `json:"report_timestamp"`
+}
+
+// UnreportedNodes returns the active nodes whose last report was submitted
+// before the given time. The nodes which never reported are left out, since
+// nothing tells how long they have existed.
+func UnreportedNodes(ctx context.Context, config Config, before time.Time) ([]UnreportedNode, error) {
+	var nodes []UnreportedNode
+	if err := queryNodes(ctx, config, []interface{}{"<", "report_timestamp", before.UTC().Format(time.RFC3339)}, &nodes); err != nil {
+		return nil, err
+	}
+	return nodes, nil
+}
+
+// NodeList is a listing of the reported nodes with the validators of the
+// response, cached by the callers to make the next listing conditional
+type NodeList struct {
+	Nodes        []UnreportedNode `json:"nodes"`
+	ETag         string           `json:"etag,omitempty"`
+	LastModified string           `json:"last_modified,omitempty"`
+
+	// NotModified is set when the server answered that the cached listing is
+	// still current
+	NotModified bool `json:"-"`
+}
+
+// ReportedNodes returns the active nodes which submitted a report. The query
+// does not depend on the time so that its response can be revalidated: with a
+// cached listing, the request carries its ETag and Last-Modified validators
+// and the cached nodes are returned when PuppetDB, or a caching proxy in front
+// of it, answers 304 Not Modified.
+func ReportedNodes(ctx context.Context, config Config, cached *NodeList) (NodeList, error) {
+	req, err := nodesRequest(ctx, config, []interface{}{"not", []interface{}{"null?", "report_timestamp", true}})
+	if err != nil {
+		return NodeList{}, err
+	}
+	if cached != nil {
+		if cached.ETag != "" {
+			req.Header.Set("If-None-Match", cached.ETag)
+		}
+		if cached.LastModified != "" {
+			req.Header.Set("If-Modified-Since", cached.LastModified)
+		}
+	}
+	client := config.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return NodeList{}, err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotModified && cached != nil:
+		list := *cached
+		list.NotModified = true
+		return list, nil
+	case resp.StatusCode != http.StatusOK:
+		return NodeList{}, responseError(resp)
+	}
+	list := NodeList{ETag: resp.Header.Get("ETag"), LastModified: resp.Header.Get("Last-Modified")}
+	if err := json.NewDecoder(resp.Body).Decode(&list.Nodes); err != nil {
+		return NodeList{}, fmt.Errorf("puppet node query returned invalid response: %s", err)
+	}
+	return list, nil
+}
+
+// ActiveNodeCount returns the number of active nodes known to PuppetDB, so
+// that bulk operations can tell a wiped or freshly restored database from the
+// fleet
+func ActiveNodeCount(ctx context.Context, config Config) (int, error) {
+	var counts []struct {
+		Count int `json:"count"`
+	}
+	query := []interface{}{"extract", []interface{}{[]interface{}{"function", "count"}}, []interface{}{"=", "node_state", "active"}}
+	if err := queryNodes(ctx, config, query, &counts); err != nil {
+		return 0, err
+	}
+	if len(counts) != 1 {
+		return 0, fmt.Errorf("puppet node count query returned %d results", len(counts))
+	}
+	return counts[0].Count, nil
+}
+
+// queryNodes runs the query against the configured nodes endpoint and decodes
+// the response into v
+func queryNodes(ctx context.Context, config Config, query []interface{}, v interface{}) error {
+	req, err := nodesRequest(ctx, config, query)
+	if err != nil {
+		return err
+	}
+	client := config.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return responseError(resp)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("puppet node query returned invalid response: %s", err)
+	}
+	return nil
+}
+
+// nodesRequest returns the request of the query against the configured nodes
+// endpoint
+func nodesRequest(ctx context.Context, config Config, query []interface{}) (*http.Request, error) {
+	// The comparison operators are kept unescaped for readable query logs
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(query); err != nil {
+		return nil, err
+	}
+	endpoint := fmt.Sprintf("%s?%s", strings.TrimRight(config.Endpoint, "/"), url.Values{"query": {strings.TrimSpace(b.String())}}.Encode())
+	return http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+}
+
+// DeactivateNode submits the deactivate node command of the certname to the
+// PuppetDB command API on the host of the configured endpoint. PuppetDB
+// processes the commands asynchronously, so the node is deactivated shortly
+// after the command is accepted.
+func DeactivateNode(ctx context.Context, config Config, certname string, now time.Time) error {
+	u, err := url.Parse(config.Endpoint)
+	if err != nil {
+		return err
+	}
+	u.Path, u.RawPath = CommandPath, ""
+	u.RawQuery = url.Values{
+		"command":  {"deactivate_node"},
+		"version":  {fmt.Sprint(deactivateNodeVersion)},
+		"certname": {certname},
+	}.Encode()
+	payload, err := json.Marshal(map[string]string{
+		"certname":           certname,
+		"producer_timestamp": now.UTC().Format(time.RFC3339),
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.String(), bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	client := config.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return responseError(resp)
+	}
+	return nil
+}
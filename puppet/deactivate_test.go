@@ -0,0 +1,113 @@
+package puppet
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestUnreportedNodes(t *testing.T) {
+	var query string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query = r.URL.Query().Get("query")
+		_, _ = w.Write([]byte(`[{"certname":"web01","report_timestamp":"2024-01-01T00:00:00.000Z","deactivated":null}]`))
+	}))
+	defer server.Close()
+
+	before := time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)
+	nodes, err := UnreportedNodes(context.Background(), Config{Endpoint: server.URL + "/pdb/query/v4/nodes"}, before)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `["<","report_timestamp","2024-02-01T00:00:00Z"]`; query != want {
+		t.Errorf("UnreportedNodes() query = %s, want %s", query, want)
+	}
+	if len(nodes) != 1 || nodes[0].Certname != "web01" || !nodes[0].ReportTimestamp.Equal(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("UnreportedNodes() = %+v", nodes)
+	}
+}
+
+func TestReportedNodes(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if want := `["not",["null?","report_timestamp",true]]`; r.URL.Query().Get("query") != want {
+			t.Errorf("ReportedNodes() query = %s, want %s", r.URL.Query().Get("query"), want)
+		}
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Last-Modified", "Mon, 01 Jan 2024 00:00:00 GMT")
+		_, _ = w.Write([]byte(`[{"certname":"web01","report_timestamp":"2024-01-01T00:00:00.000Z"}]`))
+	}))
+	defer server.Close()
+	config := Config{Endpoint: server.URL + "/pdb/query/v4/nodes"}
+
+	list, err := ReportedNodes(context.Background(), config, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if list.NotModified || len(list.Nodes) != 1 || list.ETag != `"v1"` || list.LastModified != "Mon, 01 Jan 2024 00:00:00 GMT" {
+		t.Fatalf("ReportedNodes() = %+v", list)
+	}
+
+	// The cached listing is revalidated instead of downloaded again
+	again, err := ReportedNodes(context.Background(), config, &list)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !again.NotModified || len(again.Nodes) != 1 || again.Nodes[0].Certname != "web01" || again.ETag != `"v1"` {
+		t.Errorf("ReportedNodes() revalidated = %+v", again)
+	}
+	if requests != 2 {
+		t.Errorf("ReportedNodes() made %d requests, want 2", requests)
+	}
+}
+
+func TestActiveNodeCount(t *testing.T) {
+	var query string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query = r.URL.Query().Get("query")
+		_, _ = w.Write([]byte(`[{"count":42}]`))
+	}))
+	defer server.Close()
+
+	count, err := ActiveNodeCount(context.Background(), Config{Endpoint: server.URL + "/pdb/query/v4/nodes"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `["extract",[["function","count"]],["=","node_state","active"]]`; query != want {
+		t.Errorf("ActiveNodeCount() query = %s, want %s", query, want)
+	}
+	if count != 42 {
+		t.Errorf("ActiveNodeCount() = %d, want 42", count)
+	}
+}
+
+func TestDeactivateNode(t *testing.T) {
+	var payload map[string]string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != CommandPath {
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+		}
+		if got := r.URL.Query().Get("command"); got != "deactivate_node" {
+			t.Errorf("command = %q, want deactivate_node", got)
+		}
+		_ = json.NewDecoder(r.Body).Decode(&payload)
+		_, _ = w.Write([]byte(`{"uuid":"a3a81ca9-0a4e-4d4d-8b6f-4a2b0e5e7c1d"}`))
+	}))
+	defer server.Close()
+
+	now := time.Date(2024, 2, 1, 12, 0, 0, 0, time.UTC)
+	if err := DeactivateNode(context.Background(), Config{Endpoint: server.URL + "/pdb/query/v4/nodes"}, "web01", now); err != nil {
+		t.Fatal(err)
+	}
+	if payload["certname"] != "web01" || payload["producer_timestamp"] != "2024-02-01T12:00:00Z" {
+		t.Errorf("DeactivateNode() payload = %v", payload)
+	}
+}
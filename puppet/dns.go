@@ -0,0 +1,74 @@
+package puppet
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+
+	corev2 "github.com/sensu/core/v2"
+)
+
+// lookupAddr and lookupHost resolve names with the resolver, replaced in tests
+var (
+	lookupAddr = func(ctx context.Context, r *net.Resolver, addr string) ([]string, error) {
+		return r.LookupAddr(ctx, addr)
+	}
+	lookupHost = func(ctx context.Context, r *net.Resolver, host string) ([]string, error) {
+		return r.LookupHost(ctx, host)
+	}
+)
+
+// canonicalNodeName returns the fully qualified name the reverse DNS lookup of
+// the entity's address resolves to. The first global unicast address reported
+// by the entity is used, or the first address the name resolves to when the
+// entity reports none.
+func (c Config) canonicalNodeName(event *corev2.Event, name string) (string, error) {
+	resolver := c.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	ctx := context.Background()
+	if c.RequestTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.RequestTimeout)
+		defer cancel()
+	}
+
+	addr := entityAddress(event.Entity)
+	if addr == "" {
+		addrs, err := lookupHost(ctx, resolver, name)
+		if err != nil {
+			return "", fmt.Errorf("could not resolve %q: %s", name, err)
+		}
+		if len(addrs) == 0 {
+			return "", fmt.Errorf("%q resolves to no address", name)
+		}
+		addr = addrs[0]
+	}
+	names, err := lookupAddr(ctx, resolver, addr)
+	if err != nil {
+		return "", fmt.Errorf("could not resolve the name of %s: %s", addr, err)
+	}
+	if len(names) == 0 {
+		return "", fmt.Errorf("%s has no PTR record", addr)
+	}
+	return strings.TrimSuffix(names[0], "."), nil
+}
+
+// entityAddress returns the first global unicast address of the entity's
+// network interfaces, empty if there is none
+func entityAddress(entity *corev2.Entity) string {
+	for _, iface := range entity.System.Network.Interfaces {
+		for _, cidr := range iface.Addresses {
+			ip, _, err := net.ParseCIDR(cidr)
+			if err != nil {
+				ip = net.ParseIP(cidr)
+			}
+			if ip != nil && ip.IsGlobalUnicast() {
+				return ip.String()
+			}
+		}
+	}
+	return ""
+}
@@ -0,0 +1,86 @@
+package puppet
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+
+	corev2 "github.com/sensu/core/v2"
+)
+
+func TestConfig_ResolveNodeName_canonicalizeDNS(t *testing.T) {
+	savedAddr, savedHost := lookupAddr, lookupHost
+	defer func() { lookupAddr, lookupHost = savedAddr, savedHost }()
+	lookupAddr = func(_ context.Context, _ *net.Resolver, addr string) ([]string, error) {
+		switch addr {
+		case "10.0.0.5":
+			return []string{"web01.example.com."}, nil
+		case "10.0.0.6":
+			return []string{"web02.example.com."}, nil
+		}
+		return nil, errors.New("no such host")
+	}
+	lookupHost = func(_ context.Context, _ *net.Resolver, host string) ([]string, error) {
+		if host == "web02" {
+			return []string{"10.0.0.6"}, nil
+		}
+		return nil, errors.New("no such host")
+	}
+
+	tests := []struct {
+		name      string
+		config    Config
+		entity    string
+		addresses []string
+		want      string
+		wantErr   bool
+	}{
+		{
+			name:      "entity address",
+			config:    Config{CanonicalizeDNS: true},
+			entity:    "foo",
+			addresses: []string{"127.0.0.1/8", "10.0.0.5/24"},
+			want:      "web01.example.com",
+		},
+		{
+			name:   "resolved entity name",
+			config: Config{CanonicalizeDNS: true},
+			entity: "web02",
+			want:   "web02.example.com",
+		},
+		{
+			name:    "unresolvable entity name",
+			config:  Config{CanonicalizeDNS: true},
+			entity:  "foo",
+			wantErr: true,
+		},
+		{
+			name:      "rewrites applied to the canonical name",
+			config:    Config{CanonicalizeDNS: true, NodeNameRewrites: []string{`s/\.example\.com$//`}},
+			entity:    "foo",
+			addresses: []string{"10.0.0.5/24"},
+			want:      "web01",
+		},
+		{
+			name:      "explicit node name not canonicalized",
+			config:    Config{CanonicalizeDNS: true, NodeName: "bar.example.com"},
+			entity:    "foo",
+			addresses: []string{"10.0.0.5/24"},
+			want:      "bar.example.com",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			event := corev2.FixtureEvent(tt.entity, "keepalive")
+			event.Entity.System.Network.Interfaces = []corev2.NetworkInterface{{Name: "eth0", Addresses: tt.addresses}}
+			got, err := tt.config.ResolveNodeName(event)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ResolveNodeName() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("ResolveNodeName() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
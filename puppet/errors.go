@@ -0,0 +1,48 @@
+package puppet
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// maxErrorBodySize caps the part of error response bodies reported
+const maxErrorBodySize = 512
+
+// responseError returns an error describing an unsuccessful PuppetDB
+// response, with hints for the common causes of client errors
+func responseError(resp *http.Response) error {
+	var description string
+	switch resp.StatusCode {
+	case http.StatusBadRequest:
+		description = "PuppetDB rejected the node query"
+	case http.StatusUnauthorized, http.StatusForbidden:
+		description = "PuppetDB denied access, make sure the certname of the certificate is listed in its certificate-allowlist"
+	default:
+		description = fmt.Sprintf("unexpected HTTP status %s while querying PuppetDB", http.StatusText(resp.StatusCode))
+	}
+	if message := errorBody(resp); message != "" {
+		return fmt.Errorf("%s: %s", description, message)
+	}
+	return errors.New(description)
+}
+
+// errorBody returns the message of an error response body. PuppetDB answers
+// in plain text or with a JSON object carrying the message in an "error" or
+// "msg" field.
+func errorBody(resp *http.Response) string {
+	b, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBodySize))
+
+	var object map[string]interface{}
+	if json.Unmarshal(b, &object) == nil {
+		for _, field := range []string{"error", "msg", "message"} {
+			if message, ok := object[field].(string); ok && message != "" {
+				return message
+			}
+		}
+	}
+	return strings.TrimSpace(string(b))
+}
@@ -0,0 +1,49 @@
+package puppet
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func Test_responseError(t *testing.T) {
+	tests := []struct {
+		name       string
+		statusCode int
+		body       string
+		want       string
+	}{
+		{
+			name:       "bad query",
+			statusCode: http.StatusBadRequest,
+			body:       "'foo' is not a queryable object for nodes\n",
+			want:       "PuppetDB rejected the node query: 'foo' is not a queryable object for nodes",
+		},
+		{
+			name:       "certificate not allowed",
+			statusCode: http.StatusForbidden,
+			body:       "Permission denied",
+			want:       "PuppetDB denied access, make sure the certname of the certificate is listed in its certificate-allowlist: Permission denied",
+		},
+		{
+			name:       "JSON error body",
+			statusCode: http.StatusBadRequest,
+			body:       `{"error": "Unrecognized operator 'foo'"}`,
+			want:       "PuppetDB rejected the node query: Unrecognized operator 'foo'",
+		},
+		{
+			name:       "empty body",
+			statusCode: http.StatusInternalServerError,
+			want:       "unexpected HTTP status Internal Server Error while querying PuppetDB",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := &http.Response{StatusCode: tt.statusCode, Body: io.NopCloser(strings.NewReader(tt.body))}
+			if got := responseError(resp).Error(); got != tt.want {
+				t.Errorf("responseError() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
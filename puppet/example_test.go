@@ -0,0 +1,25 @@
+package puppet_test
+
+import (
+	"context"
+	"log"
+
+	corev2 "github.com/sensu/core/v2"
+	"github.com/sensu/sensu-puppet-handler/puppet"
+)
+
+func ExampleHandleEvent() {
+	config := puppet.Config{
+		Endpoint:       "https://puppetdb.example.com:8081/pdb/query/v4/nodes",
+		NodeNameSource: puppet.NameSourceHostname,
+	}
+	event := corev2.FixtureEvent("webserver01", "keepalive")
+
+	decision, err := puppet.HandleEvent(context.Background(), config, event)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if decision.Deregister {
+		log.Printf("deregistering entity, puppet node %q is %s", decision.NodeName, decision.Status)
+	}
+}
@@ -0,0 +1,86 @@
+package puppet
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Facts returns the named facts of the node, as returned by PuppetDB. Fact
+// names can use dots to select a value of a structured fact, e.g. os.family.
+// Facts the node does not have are left out.
+func Facts(ctx context.Context, config Config, certname string, names []string) (map[string]interface{}, error) {
+	if config.Endpoint == "" {
+		return nil, errors.New("the PuppetDB API endpoint is required")
+	}
+	facts := make(map[string]interface{})
+	if len(names) == 0 {
+		return facts, nil
+	}
+
+	// Only query the top-level facts holding the requested values
+	query := []interface{}{"or"}
+	for _, name := range names {
+		query = append(query, []interface{}{"=", "name", strings.SplitN(name, ".", 2)[0]})
+	}
+	b, err := json.Marshal(query)
+	if err != nil {
+		return nil, err
+	}
+	endpoint := fmt.Sprintf("%s/%s/facts?%s",
+		strings.TrimRight(config.Endpoint, "/"), url.PathEscape(certname), url.Values{"query": {string(b)}}.Encode())
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	client := config.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, responseError(resp)
+	}
+	var results []struct {
+		Name  string      `json:"name"`
+		Value interface{} `json:"value"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&results); err != nil {
+		return nil, fmt.Errorf("puppet facts query returned invalid response: %s", err)
+	}
+	values := make(map[string]interface{}, len(results))
+	for _, result := range results {
+		values[result.Name] = result.Value
+	}
+
+	for _, name := range names {
+		if value, ok := factValue(values, strings.Split(name, ".")); ok {
+			facts[name] = value
+		}
+	}
+	return facts, nil
+}
+
+// factValue walks the path into the structured facts
+func factValue(facts map[string]interface{}, path []string) (interface{}, bool) {
+	var value interface{} = facts
+	for _, key := range path {
+		m, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if value, ok = m[key]; !ok {
+			return nil, false
+		}
+	}
+	return value, true
+}
@@ -0,0 +1,39 @@
+package puppet
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestFacts(t *testing.T) {
+	var gotPath, gotQuery string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.Path
+		gotQuery = r.URL.Query().Get("query")
+		_ = json.NewEncoder(w).Encode([]map[string]interface{}{
+			{"certname": "foo", "name": "role", "value": "webserver"},
+			{"certname": "foo", "name": "os", "value": map[string]interface{}{"family": "RedHat"}},
+		})
+	}))
+	defer ts.Close()
+	config := Config{Endpoint: ts.URL + "/pdb/query/v4/nodes", Client: ts.Client()}
+
+	got, err := Facts(context.Background(), config, "foo", []string{"role", "os.family", "owner"})
+	if err != nil {
+		t.Fatalf("Facts() error = %v", err)
+	}
+	want := map[string]interface{}{"role": "webserver", "os.family": "RedHat"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Facts() = %v, want %v", got, want)
+	}
+	if gotPath != "/pdb/query/v4/nodes/foo/facts" {
+		t.Errorf("Facts() path = %s", gotPath)
+	}
+	if wantQuery := `["or",["=","name","role"],["=","name","os"],["=","name","owner"]]`; gotQuery != wantQuery {
+		t.Errorf("Facts() query = %s, want %s", gotQuery, wantQuery)
+	}
+}
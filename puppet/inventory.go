@@ -0,0 +1,83 @@
+package puppet
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// inventoryEndpoint returns the URL of the PuppetDB inventory query API, next
+// to the nodes query API of the configured endpoint
+func (c Config) inventoryEndpoint() (string, error) {
+	u, err := url.Parse(strings.TrimRight(c.Endpoint, "/"))
+	if err != nil {
+		return "", err
+	}
+	u.Path, u.RawPath, u.RawQuery = path.Join(path.Dir(u.Path), "inventory"), "", ""
+	return u.String(), nil
+}
+
+// inventoryQuery returns the PuppetDB query matching the inventory entries of
+// the named node by certname or fqdn fact, in the entity's environment
+func (c Config) inventoryQuery(name string) []interface{} {
+	match := []interface{}{"or",
+		[]interface{}{"=", "certname", name},
+		[]interface{}{"=", "facts.fqdn", name},
+	}
+	if c.CaseInsensitive {
+		pattern := fmt.Sprintf("(?i)^%s$", regexp.QuoteMeta(name))
+		match = []interface{}{"or",
+			[]interface{}{"~", "certname", pattern},
+			[]interface{}{"~", "facts.fqdn", pattern},
+		}
+	}
+	if c.environment == "" {
+		return match
+	}
+	return []interface{}{"and", match, []interface{}{"=", "environment", c.environment}}
+}
+
+// queryInventory queries the PuppetDB inventory for the named node, and
+// returns its inventory entry, nil if there is none. Inventory entries outlive
+// the node records on the servers pruning the latter aggressively.
+func (c Config) queryInventory(ctx context.Context, name string) (map[string]interface{}, error) {
+	endpoint, err := c.inventoryEndpoint()
+	if err != nil {
+		return nil, err
+	}
+	query, err := json.Marshal(c.inventoryQuery(name))
+	if err != nil {
+		return nil, err
+	}
+	endpoint = fmt.Sprintf("%s?%s", endpoint, url.Values{"query": {string(query)}}.Encode())
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	client := c.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		log.Printf("error getting puppet inventory: %s", err)
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, responseError(resp)
+	}
+	entry, err := firstNode(resp.Body)
+	if err != nil {
+		log.Printf("puppet inventory query returned invalid response: %s", err)
+		return nil, err
+	}
+	return entry, nil
+}
@@ -0,0 +1,212 @@
+package puppet
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	corev2 "github.com/sensu/core/v2"
+)
+
+// Node name sources, selecting the entity attribute used as Puppet node name
+const (
+	NameSourceEntityName = "entity-name"
+	NameSourceHostname   = "hostname"
+	NameSourceFQDN       = "fqdn"
+	NameSourceAnnotation = "annotation"
+)
+
+// NameSources lists the supported node name sources
+var NameSources = []string{NameSourceEntityName, NameSourceHostname, NameSourceFQDN, NameSourceAnnotation}
+
+// ResolveNodeName returns the Puppet node name of the event's entity. The name
+// is derived from the configured source, unless overridden through the node
+// name annotation or the explicit node name.
+func (c Config) ResolveNodeName(event *corev2.Event) (string, error) {
+	if override := c.overrideNodeName(event); override != "" {
+		return c.normalizeNodeName(override, NameSourceAnnotation), nil
+	}
+	return c.candidateNodeName(event, c.NodeNameSource)
+}
+
+// NodeNameCandidates returns the Puppet node name followed by the names
+// derived from the fallback sources, without duplicates. Fallback sources
+// missing from the entity are skipped.
+func (c Config) NodeNameCandidates(event *corev2.Event) ([]string, error) {
+	name, err := c.ResolveNodeName(event)
+	if err != nil {
+		return nil, err
+	}
+	names := []string{name}
+	for _, source := range c.FallbackNames {
+		name, err := c.candidateNodeName(event, source)
+		if err != nil {
+			continue
+		}
+		if !contains(names, name) {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+// contains returns whether the value is in the list
+func contains(list []string, value string) bool {
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// candidateNodeName returns the node name derived from the given source,
+// canonicalized through DNS when configured
+func (c Config) candidateNodeName(event *corev2.Event, source string) (string, error) {
+	name, err := c.sourceNodeName(event, source)
+	if err != nil {
+		return "", err
+	}
+	if c.CanonicalizeDNS && source != NameSourceAnnotation {
+		if name, err = c.canonicalNodeName(event, name); err != nil {
+			return "", err
+		}
+	}
+	return c.normalizeNodeName(name, source), nil
+}
+
+// normalizeNodeName applies the rewrite rules, unless the name was explicitly
+// set through an annotation, and lowercases the name if matching is case
+// insensitive
+func (c Config) normalizeNodeName(name, source string) string {
+	if source != NameSourceAnnotation {
+		// The rewrite rules are validated along with the configuration
+		name, _ = c.rewriteNodeName(name)
+	}
+	if c.CaseInsensitive {
+		name = strings.ToLower(name)
+	}
+	return name
+}
+
+// sourceNodeName returns the entity attribute selected as node name source
+func (c Config) sourceNodeName(event *corev2.Event, source string) (string, error) {
+	switch source {
+	case NameSourceHostname:
+		if event.Entity.System.Hostname == "" {
+			return "", errors.New("the entity does not report a system hostname")
+		}
+		return event.Entity.System.Hostname, nil
+	case NameSourceFQDN:
+		hostname := event.Entity.System.Hostname
+		if !strings.Contains(strings.TrimSuffix(hostname, "."), ".") {
+			return "", fmt.Errorf("the entity system hostname %q is not fully qualified", hostname)
+		}
+		return strings.TrimSuffix(hostname, "."), nil
+	case NameSourceAnnotation:
+		name := c.overrideNodeName(event)
+		if name == "" {
+			return "", errors.New("the entity has no node name annotation")
+		}
+		return name, nil
+	}
+	return event.Entity.Name, nil
+}
+
+// overrideNodeName returns the node name explicitly set for the entity, either
+// through the configured node name annotation or the explicit node name
+func (c Config) overrideNodeName(event *corev2.Event) string {
+	if c.NodeNameAnnotation != "" {
+		if name := event.Entity.Annotations[c.NodeNameAnnotation]; name != "" {
+			return name
+		}
+	}
+	return c.NodeName
+}
+
+// rewriteRule is a sed style substitution applied to the entity name
+type rewriteRule struct {
+	pattern     *regexp.Regexp
+	replacement string
+	global      bool
+}
+
+// parseRewriteRule parses a rule of the form s/pattern/replacement/flags. Any
+// character can be used as delimiter instead of the slash, and the supported
+// flags are g (replace every match) and i (ignore case)
+func parseRewriteRule(rule string) (rewriteRule, error) {
+	if len(rule) < 2 || rule[0] != 's' {
+		return rewriteRule{}, fmt.Errorf("rule %q must be of the form s/pattern/replacement/", rule)
+	}
+	delim := rule[1:2]
+	parts := splitUnescaped(rule[2:], delim)
+	if len(parts) != 3 {
+		return rewriteRule{}, fmt.Errorf("rule %q must be of the form s/pattern/replacement/", rule)
+	}
+
+	var r rewriteRule
+	expr := parts[0]
+	for _, flag := range parts[2] {
+		switch flag {
+		case 'g':
+			r.global = true
+		case 'i':
+			expr = "(?i)" + expr
+		default:
+			return rewriteRule{}, fmt.Errorf("unknown flag %q in rule %q", flag, rule)
+		}
+	}
+	pattern, err := regexp.Compile(expr)
+	if err != nil {
+		return rewriteRule{}, fmt.Errorf("invalid pattern in rule %q: %s", rule, err)
+	}
+	r.pattern = pattern
+	r.replacement = parts[1]
+	return r, nil
+}
+
+// splitUnescaped splits s around each delimiter not preceded by a backslash,
+// unescaping the delimiters
+func splitUnescaped(s, delim string) []string {
+	var parts []string
+	var part strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\' && strings.HasPrefix(s[i+1:], delim):
+			part.WriteString(delim)
+			i += len(delim)
+		case strings.HasPrefix(s[i:], delim):
+			parts = append(parts, part.String())
+			part.Reset()
+		default:
+			part.WriteByte(s[i])
+		}
+	}
+	return append(parts, part.String())
+}
+
+// apply returns the name with the rule substitution applied
+func (r rewriteRule) apply(name string) string {
+	if r.global {
+		return r.pattern.ReplaceAllString(name, r.replacement)
+	}
+	match := r.pattern.FindStringSubmatchIndex(name)
+	if match == nil {
+		return name
+	}
+	dst := r.pattern.ExpandString(nil, r.replacement, name, match)
+	return name[:match[0]] + string(dst) + name[match[1]:]
+}
+
+// rewriteNodeName applies the node name rewrite rules in order
+func (c Config) rewriteNodeName(name string) (string, error) {
+	for _, rule := range c.NodeNameRewrites {
+		r, err := parseRewriteRule(rule)
+		if err != nil {
+			return name, err
+		}
+		name = r.apply(name)
+	}
+	return name, nil
+}
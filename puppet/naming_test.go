@@ -0,0 +1,180 @@
+package puppet
+
+import (
+	"testing"
+
+	corev2 "github.com/sensu/core/v2"
+)
+
+func Test_rewriteNodeName(t *testing.T) {
+	tests := []struct {
+		name     string
+		rules    []string
+		nodeName string
+		want     string
+		wantErr  bool
+	}{
+		{
+			name:     "no rules",
+			nodeName: "sensu-web01",
+			want:     "sensu-web01",
+		},
+		{
+			name:     "strip prefix",
+			rules:    []string{"s/^sensu-//"},
+			nodeName: "sensu-web01",
+			want:     "web01",
+		},
+		{
+			name:     "capture groups and custom delimiter",
+			rules:    []string{`s|^(\w+)\.dc1\.|${1}.us-east-1.|`},
+			nodeName: "web01.dc1.example.com",
+			want:     "web01.us-east-1.example.com",
+		},
+		{
+			name:     "first match only",
+			rules:    []string{"s/-/./"},
+			nodeName: "web01-dc1-example",
+			want:     "web01.dc1-example",
+		},
+		{
+			name:     "global and ignore case",
+			rules:    []string{"s/X/-/gi"},
+			nodeName: "axbXc",
+			want:     "a-b-c",
+		},
+		{
+			name:     "escaped delimiter",
+			rules:    []string{`s/\//./`},
+			nodeName: "web01/example",
+			want:     "web01.example",
+		},
+		{
+			name:     "rules applied in order",
+			rules:    []string{"s/^sensu-//", "s/$/.example.com/"},
+			nodeName: "sensu-web01",
+			want:     "web01.example.com",
+		},
+		{
+			name:     "invalid syntax",
+			rules:    []string{"s/foo"},
+			nodeName: "foo",
+			wantErr:  true,
+		},
+		{
+			name:     "unknown flag",
+			rules:    []string{"s/foo/bar/x"},
+			nodeName: "foo",
+			wantErr:  true,
+		},
+		{
+			name:     "invalid pattern",
+			rules:    []string{"s/(/bar/"},
+			nodeName: "foo",
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := Config{NodeNameRewrites: tt.rules}
+			got, err := c.rewriteNodeName(tt.nodeName)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("rewriteNodeName() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && got != tt.want {
+				t.Errorf("rewriteNodeName() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConfig_ResolveNodeName(t *testing.T) {
+	tests := []struct {
+		name        string
+		config      Config
+		hostname    string
+		annotations map[string]string
+		want        string
+		wantErr     bool
+	}{
+		{
+			name: "entity name by default",
+			want: "foo",
+		},
+		{
+			name:   "node name override",
+			config: Config{NodeName: "bar.example.com"},
+			want:   "bar.example.com",
+		},
+		{
+			name:     "hostname",
+			config:   Config{NodeNameSource: NameSourceHostname},
+			hostname: "web01",
+			want:     "web01",
+		},
+		{
+			name:    "missing hostname",
+			config:  Config{NodeNameSource: NameSourceHostname},
+			wantErr: true,
+		},
+		{
+			name:     "FQDN",
+			config:   Config{NodeNameSource: NameSourceFQDN},
+			hostname: "web01.example.com.",
+			want:     "web01.example.com",
+		},
+		{
+			name:     "unqualified hostname as FQDN",
+			config:   Config{NodeNameSource: NameSourceFQDN},
+			hostname: "web01",
+			wantErr:  true,
+		},
+		{
+			name:   "annotation",
+			config: Config{NodeNameSource: NameSourceAnnotation, NodeName: "bar.example.com"},
+			want:   "bar.example.com",
+		},
+		{
+			name:        "custom annotation",
+			config:      Config{NodeNameSource: NameSourceAnnotation, NodeNameAnnotation: "example.com/certname", NodeName: "bar.example.com"},
+			annotations: map[string]string{"example.com/certname": "baz.example.com"},
+			want:        "baz.example.com",
+		},
+		{
+			name:        "custom annotation overrides the source",
+			config:      Config{NodeNameAnnotation: "example.com/certname"},
+			annotations: map[string]string{"example.com/certname": "baz.example.com"},
+			want:        "baz.example.com",
+		},
+		{
+			name:   "missing custom annotation falls back to node name",
+			config: Config{NodeNameSource: NameSourceAnnotation, NodeNameAnnotation: "example.com/certname", NodeName: "bar.example.com"},
+			want:   "bar.example.com",
+		},
+		{
+			name:    "missing annotation",
+			config:  Config{NodeNameSource: NameSourceAnnotation},
+			wantErr: true,
+		},
+		{
+			name:     "rewritten and lowercased",
+			config:   Config{NodeNameSource: NameSourceHostname, NodeNameRewrites: []string{"s/$/.example.com/"}, CaseInsensitive: true},
+			hostname: "WEB01",
+			want:     "web01.example.com",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			event := corev2.FixtureEvent("foo", "keepalive")
+			event.Entity.System.Hostname = tt.hostname
+			event.Entity.Annotations = tt.annotations
+			got, err := tt.config.ResolveNodeName(event)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ResolveNodeName() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("ResolveNodeName() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,379 @@
+// Package puppet decides whether a Sensu entity should be deregistered
+// because its Puppet node no longer exists in PuppetDB. It holds the decision
+// logic of the sensu-puppet-handler, so that it can be embedded in other
+// handlers or test frameworks.
+package puppet
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	corev2 "github.com/sensu/core/v2"
+)
+
+// Node statuses reported in decisions
+const (
+	StatusActive   = "active"
+	StatusNotFound = "not-found"
+)
+
+// Config configures the PuppetDB lookup of the entities
+type Config struct {
+	// Endpoint is the URL of the PuppetDB nodes query API, e.g.
+	// https://puppetdb:8081/pdb/query/v4/nodes
+	Endpoint string
+
+	// Client is the HTTP client used to query PuppetDB, typically configured
+	// with the Puppet client certificate. http.DefaultClient is used if nil.
+	Client *http.Client
+
+	// NodeName overrides the node name of every entity
+	NodeName string
+
+	// NodeNameSource is the entity attribute used as node name, one of
+	// NameSources. The entity name is used if empty.
+	NodeNameSource string
+
+	// NodeNameAnnotation is the entity annotation holding the node name,
+	// taking precedence over NodeName when present
+	NodeNameAnnotation string
+
+	// NodeNameRewrites are the s/pattern/replacement/flags rules applied in
+	// order to the node names derived from the entity attributes
+	NodeNameRewrites []string
+
+	// FallbackNames are the node name sources tried in order when the node is
+	// not found under its primary name
+	FallbackNames []string
+
+	// CanonicalizeDNS replaces the node names derived from the entity
+	// attributes with the name the reverse DNS lookup of the entity's address
+	// resolves to, for sites whose certnames follow reverse DNS
+	CanonicalizeDNS bool
+
+	// Resolver resolves the names when canonicalizing them,
+	// net.DefaultResolver if nil
+	Resolver *net.Resolver
+
+	// CaseInsensitive lowercases the node names and matches them against the
+	// PuppetDB certnames regardless of case
+	CaseInsensitive bool
+
+	// IncludeDeactivated and IncludeExpired consider the deactivated and
+	// expired nodes as existing
+	IncludeDeactivated bool
+	IncludeExpired     bool
+
+	// RequestTimeout bounds each PuppetDB query. When the context passed to
+	// HandleEvent has a deadline, timed out queries are retried until it
+	// expires.
+	RequestTimeout time.Duration
+
+	// Environments maps Sensu namespaces to Puppet environments. The
+	// entities of a mapped namespace only match the nodes whose catalog was
+	// compiled in the environment, so that a node of the same name in
+	// another environment does not mask an orphan entity.
+	Environments map[string]string
+
+	// RecheckAfter is how long to wait before looking the node up again when
+	// it is not found, absorbing the window between the provisioning of a
+	// node and its first catalog. The node is looked up once if zero.
+	RecheckAfter time.Duration
+
+	// InventoryFallback looks the nodes not found up in the PuppetDB
+	// inventory by certname or fqdn fact before deciding they do not exist,
+	// for the servers pruning the node records before the inventory facts
+	InventoryFallback bool
+
+	// ServerVersion is the version of the PuppetDB server, as returned by
+	// ServerVersion, used to adapt the queries to the server. A current
+	// server is assumed if empty.
+	ServerVersion string
+
+	// environment is the Puppet environment of the entity being looked up
+	environment string
+}
+
+// Decision is the outcome of the PuppetDB lookup of an entity
+type Decision struct {
+	// Deregister is true when the entity has no corresponding Puppet node
+	Deregister bool
+
+	// NodeName is the name of the Puppet node, as returned by PuppetDB if the
+	// node exists
+	NodeName string
+
+	// Status is the status of the node, StatusActive or StatusNotFound
+	Status string
+
+	// Node is the node as returned by PuppetDB, nil if it does not exist
+	Node map[string]interface{}
+}
+
+// Validate returns an error if the configuration is invalid
+func (c Config) Validate() error {
+	if c.Endpoint == "" {
+		return errors.New("the PuppetDB API endpoint is required")
+	}
+	for _, rule := range c.NodeNameRewrites {
+		if _, err := parseRewriteRule(rule); err != nil {
+			return fmt.Errorf("invalid node name rewrite: %s", err)
+		}
+	}
+	sources := append([]string{c.NodeNameSource}, c.FallbackNames...)
+	for _, source := range sources {
+		if source != "" && !contains(NameSources, source) {
+			return fmt.Errorf("unknown node name source %q", source)
+		}
+	}
+	if err := c.requireVersion(MinVersion, "the v4 query API"); err != nil {
+		return err
+	}
+	if c.InventoryFallback {
+		if err := c.requireVersion(inventoryVersion, "the inventory fallback"); err != nil {
+			return err
+		}
+	}
+	if c.IncludeDeactivated || c.IncludeExpired {
+		if err := c.requireVersion(nodeStateVersion, "including deactivated or expired nodes"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// HandleEvent looks up the Puppet node of the event's entity and decides
+// whether the entity should be deregistered. Candidate names are looked up in
+// turn, and the entity is only deregistered if none of them exist, including
+// after the re-check delay when configured.
+func HandleEvent(ctx context.Context, config Config, event *corev2.Event) (Decision, error) {
+	if event == nil || event.Entity == nil {
+		return Decision{}, errors.New("the event has no entity")
+	}
+	if err := config.Validate(); err != nil {
+		return Decision{}, err
+	}
+	names, err := config.NodeNameCandidates(event)
+	if err != nil {
+		return Decision{}, err
+	}
+	config.environment = config.Environments[event.Entity.Namespace]
+
+	decision, err := config.lookupNames(ctx, names)
+	if err != nil || !decision.Deregister || config.RecheckAfter <= 0 {
+		return decision, err
+	}
+	log.Printf("puppet node %q not found, checking again in %s", decision.NodeName, config.RecheckAfter)
+	timer := time.NewTimer(config.RecheckAfter)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return decision, ctx.Err()
+	case <-timer.C:
+	}
+	return config.lookupNames(ctx, names)
+}
+
+// lookupNames looks up the candidate names in turn, and returns the decision
+// of the primary name if none of them exist
+func (c Config) lookupNames(ctx context.Context, names []string) (Decision, error) {
+	var primary Decision
+	for i, name := range names {
+		decision, err := c.getNode(ctx, name)
+		if err != nil {
+			return decision, err
+		}
+		if !decision.Deregister {
+			return decision, nil
+		}
+		if i == 0 {
+			primary = decision
+		} else {
+			log.Printf("fallback node name %q does not exist either", name)
+		}
+	}
+	return primary, nil
+}
+
+// getNode queries PuppetDB for the named node, retrying the queries exceeding
+// the request timeout as long as the overall deadline allows it
+func (c Config) getNode(ctx context.Context, name string) (Decision, error) {
+	if c.RequestTimeout <= 0 {
+		return c.queryNode(ctx, name)
+	}
+	_, hasDeadline := ctx.Deadline()
+	for {
+		attemptCtx, cancel := context.WithTimeout(ctx, c.RequestTimeout)
+		decision, err := c.queryNode(attemptCtx, name)
+		// The client may enforce the same timeout, failing first
+		var netErr net.Error
+		timedOut := attemptCtx.Err() == context.DeadlineExceeded || (errors.As(err, &netErr) && netErr.Timeout())
+		cancel()
+		if err == nil || !timedOut || !hasDeadline || ctx.Err() != nil {
+			return decision, err
+		}
+		log.Printf("puppet node query timed out after %s, retrying", c.RequestTimeout)
+	}
+}
+
+// queryNode queries PuppetDB once for the named node. PuppetDB leaves the
+// deactivated and expired nodes out of query results unless the query
+// explicitly includes them, while the certname route of the older servers
+// returns them, so their state is checked in the response instead
+func (c Config) queryNode(ctx context.Context, name string) (Decision, error) {
+	decision := Decision{NodeName: name}
+
+	// Query the puppet node, older servers are looked up by certname
+	endpoint := strings.TrimRight(c.Endpoint, "/")
+	byPath := !c.CaseInsensitive && c.environment == "" && !c.supports(queryParamVersion)
+	if byPath {
+		endpoint = fmt.Sprintf("%s/%s", endpoint, url.PathEscape(name))
+	} else {
+		query, err := json.Marshal(c.nodeQuery(name))
+		if err != nil {
+			return decision, err
+		}
+		endpoint = fmt.Sprintf("%s?%s", endpoint, url.Values{"query": {string(query)}}.Encode())
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return decision, err
+	}
+	client := c.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		log.Printf("error getting puppet node: %s", err)
+		return decision, err
+	}
+	defer resp.Body.Close()
+
+	var nodes []map[string]interface{}
+	switch {
+	case byPath && resp.StatusCode == http.StatusNotFound:
+	case resp.StatusCode != http.StatusOK:
+		return decision, responseError(resp)
+	case byPath:
+		var node map[string]interface{}
+		if err := json.NewDecoder(resp.Body).Decode(&node); err != nil {
+			log.Printf("puppet node query returned invalid response: %s", err)
+			return decision, err
+		}
+		if inactive := nodeInactive(node); inactive != "" {
+			log.Printf("puppet node %q is %s", name, inactive)
+			break
+		}
+		nodes = append(nodes, node)
+	default:
+		node, err := firstNode(resp.Body)
+		if err != nil {
+			log.Printf("puppet node query returned invalid response: %s", err)
+			return decision, err
+		}
+		if node != nil {
+			nodes = append(nodes, node)
+		}
+	}
+
+	// Determine if the node exists, falling back to the inventory
+	if len(nodes) == 0 && c.InventoryFallback {
+		entry, err := c.queryInventory(ctx, name)
+		if err != nil {
+			return decision, err
+		}
+		if entry != nil {
+			nodes = append(nodes, entry)
+			log.Printf("puppet node %q found in the inventory", name)
+		}
+	}
+	if len(nodes) == 0 {
+		log.Printf("puppet node %q does not exist", name)
+		decision.Status = StatusNotFound
+		decision.Deregister = true
+		return decision, nil
+	}
+	decision.Node = nodes[0]
+	if certname, ok := nodes[0]["certname"].(string); ok {
+		decision.NodeName = certname
+	}
+	log.Printf("puppet node %q exists", decision.NodeName)
+	decision.Status = StatusActive
+	return decision, nil
+}
+
+// nodeInactive returns whether the node is deactivated or expired, empty if it
+// is active. The certname route is only used with the servers not supporting
+// the inclusion of inactive nodes, so they are never considered.
+func nodeInactive(node map[string]interface{}) string {
+	switch {
+	case node["deactivated"] != nil:
+		return "deactivated"
+	case node["expired"] != nil:
+		return "expired"
+	}
+	return ""
+}
+
+// firstNode decodes the first node of a node query response, nil if there is
+// none. The response is decoded as a stream and the other nodes are not read,
+// so that a query matching many nodes does not buffer them all.
+func firstNode(r io.Reader) (map[string]interface{}, error) {
+	dec := json.NewDecoder(r)
+	token, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	if token == nil {
+		return nil, nil
+	}
+	if delim, ok := token.(json.Delim); !ok || delim != '[' {
+		return nil, errors.New("expected a list of nodes")
+	}
+	if !dec.More() {
+		return nil, nil
+	}
+	var node map[string]interface{}
+	if err := dec.Decode(&node); err != nil {
+		return nil, err
+	}
+	return node, nil
+}
+
+// nodeQuery returns the PuppetDB query matching the named node in the
+// entity's environment, including the deactivated and expired nodes if
+// configured to
+func (c Config) nodeQuery(name string) []interface{} {
+	match := []interface{}{"=", "certname", name}
+	if c.CaseInsensitive {
+		match = []interface{}{"~", "certname", fmt.Sprintf("(?i)^%s$", regexp.QuoteMeta(name))}
+	}
+	query := []interface{}{"and", match}
+	if c.environment != "" {
+		query = append(query, []interface{}{"=", "catalog_environment", c.environment})
+	}
+	if c.IncludeDeactivated || c.IncludeExpired {
+		query = append(query, []interface{}{"=", "node_state", "any"})
+		if !c.IncludeDeactivated {
+			query = append(query, []interface{}{"null?", "deactivated", true})
+		}
+		if !c.IncludeExpired {
+			query = append(query, []interface{}{"null?", "expired", true})
+		}
+	}
+	if len(query) == 2 {
+		return match
+	}
+	return query
+}
@@ -0,0 +1,472 @@
+package puppet
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	corev2 "github.com/sensu/core/v2"
+)
+
+func Test_nodeQuery(t *testing.T) {
+	tests := []struct {
+		name               string
+		includeDeactivated bool
+		includeExpired     bool
+		environment        string
+		want               string
+	}{
+		{
+			name: "active nodes only",
+			want: `["=","certname","foo"]`,
+		},
+		{
+			name:               "deactivated nodes",
+			includeDeactivated: true,
+			want:               `["and",["=","certname","foo"],["=","node_state","any"],["null?","expired",true]]`,
+		},
+		{
+			name:           "expired nodes",
+			includeExpired: true,
+			want:           `["and",["=","certname","foo"],["=","node_state","any"],["null?","deactivated",true]]`,
+		},
+		{
+			name:               "all nodes",
+			includeDeactivated: true,
+			includeExpired:     true,
+			want:               `["and",["=","certname","foo"],["=","node_state","any"]]`,
+		},
+		{
+			name:        "environment",
+			environment: "staging",
+			want:        `["and",["=","certname","foo"],["=","catalog_environment","staging"]]`,
+		},
+		{
+			name:           "environment and expired nodes",
+			includeExpired: true,
+			environment:    "staging",
+			want:           `["and",["=","certname","foo"],["=","catalog_environment","staging"],["=","node_state","any"],["null?","deactivated",true]]`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := Config{IncludeDeactivated: tt.includeDeactivated, IncludeExpired: tt.includeExpired, environment: tt.environment}
+			got, err := json.Marshal(c.nodeQuery("foo"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("nodeQuery() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHandleEvent_caseInsensitive(t *testing.T) {
+	tests := []struct {
+		name     string
+		nodes    []map[string]interface{}
+		want     bool
+		wantName string
+	}{
+		{
+			name:     "node exists with different case",
+			nodes:    []map[string]interface{}{{"certname": "webserver01.example.com"}},
+			want:     true,
+			wantName: "webserver01.example.com",
+		},
+		{
+			name:     "node does not exist",
+			nodes:    []map[string]interface{}{},
+			want:     false,
+			wantName: "webserver01.example.com",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var query string
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				query = r.URL.Query().Get("query")
+				_ = json.NewEncoder(w).Encode(tt.nodes)
+			}))
+			defer ts.Close()
+			config := Config{Endpoint: ts.URL, Client: ts.Client(), CaseInsensitive: true}
+
+			event := corev2.FixtureEvent("WebServer01.example.com", "keepalive")
+			got, err := HandleEvent(context.Background(), config, event)
+			if err != nil {
+				t.Fatalf("HandleEvent() error = %v", err)
+			}
+			if want := `["~","certname","(?i)^webserver01\\.example\\.com$"]`; query != want {
+				t.Errorf("HandleEvent() query = %s, want %s", query, want)
+			}
+			if got.Deregister == tt.want {
+				t.Errorf("HandleEvent() = %v, want %v", !got.Deregister, tt.want)
+			}
+			if got.NodeName != tt.wantName {
+				t.Errorf("HandleEvent() name = %q, want %q", got.NodeName, tt.wantName)
+			}
+		})
+	}
+}
+
+func TestHandleEvent_fallbackNames(t *testing.T) {
+	tests := []struct {
+		name          string
+		fallbackNames []string
+		existing      string
+		want          bool
+		wantName      string
+		wantRequests  []string
+	}{
+		{
+			name:         "no fallback names",
+			existing:     "web01.example.com",
+			want:         false,
+			wantName:     "foo",
+			wantRequests: []string{"foo"},
+		},
+		{
+			name:          "found under a fallback name",
+			fallbackNames: []string{"hostname", "fqdn"},
+			existing:      "web01.example.com",
+			want:          true,
+			wantName:      "web01.example.com",
+			wantRequests:  []string{"foo", "web01.example.com"},
+		},
+		{
+			name:          "absent under every name",
+			fallbackNames: []string{"entity-name", "hostname", "annotation"},
+			existing:      "bar",
+			want:          false,
+			wantName:      "foo",
+			wantRequests:  []string{"foo", "web01.example.com"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var requests []string
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				var query []string
+				_ = json.Unmarshal([]byte(r.URL.Query().Get("query")), &query)
+				requests = append(requests, query[2])
+				nodes := []map[string]interface{}{}
+				if query[2] == tt.existing {
+					nodes = append(nodes, map[string]interface{}{"certname": tt.existing})
+				}
+				_ = json.NewEncoder(w).Encode(nodes)
+			}))
+			defer ts.Close()
+			config := Config{Endpoint: ts.URL, Client: ts.Client(), FallbackNames: tt.fallbackNames}
+
+			event := corev2.FixtureEvent("foo", "keepalive")
+			event.Entity.System.Hostname = "web01.example.com"
+			got, err := HandleEvent(context.Background(), config, event)
+			if err != nil {
+				t.Fatalf("HandleEvent() error = %v", err)
+			}
+			if got.Deregister == tt.want {
+				t.Errorf("HandleEvent() = %v, want %v", !got.Deregister, tt.want)
+			}
+			if got.NodeName != tt.wantName {
+				t.Errorf("HandleEvent() name = %q, want %q", got.NodeName, tt.wantName)
+			}
+			if !reflect.DeepEqual(requests, tt.wantRequests) {
+				t.Errorf("HandleEvent() requests = %v, want %v", requests, tt.wantRequests)
+			}
+		})
+	}
+}
+
+func TestHandleEvent_requestTimeout(t *testing.T) {
+	tests := []struct {
+		name          string
+		deadline      time.Duration
+		clientTimeout time.Duration
+		wantErr       bool
+		wantRequests  int
+	}{
+		{
+			name:         "retried within the deadline",
+			deadline:     5 * time.Second,
+			wantRequests: 2,
+		},
+		{
+			name:          "retried after the client timeout",
+			deadline:      5 * time.Second,
+			clientTimeout: 20 * time.Millisecond,
+			wantRequests:  2,
+		},
+		{
+			name:         "not retried without deadline",
+			wantErr:      true,
+			wantRequests: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var requests int32
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				// Only the first query is slow
+				if atomic.AddInt32(&requests, 1) == 1 {
+					<-r.Context().Done()
+					return
+				}
+				_ = json.NewEncoder(w).Encode([]map[string]interface{}{{"certname": "foo"}})
+			}))
+			defer ts.Close()
+			client := ts.Client()
+			client.Timeout = tt.clientTimeout
+			config := Config{Endpoint: ts.URL, Client: client, RequestTimeout: 50 * time.Millisecond}
+
+			ctx := context.Background()
+			if tt.deadline > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, tt.deadline)
+				defer cancel()
+			}
+			got, err := HandleEvent(ctx, config, corev2.FixtureEvent("foo", "keepalive"))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("HandleEvent() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && got.Deregister {
+				t.Error("HandleEvent() deregistered an existing node")
+			}
+			if n := int(atomic.LoadInt32(&requests)); n != tt.wantRequests {
+				t.Errorf("HandleEvent() requests = %d, want %d", n, tt.wantRequests)
+			}
+		})
+	}
+}
+
+func TestConfig_Validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  Config
+		wantErr bool
+	}{
+		{
+			name:   "valid configuration",
+			config: Config{Endpoint: "https://puppetdb:8081/pdb/query/v4/nodes", NodeNameSource: NameSourceHostname, FallbackNames: []string{NameSourceFQDN}},
+		},
+		{
+			name:    "required endpoint",
+			config:  Config{},
+			wantErr: true,
+		},
+		{
+			name:    "invalid rewrite rule",
+			config:  Config{Endpoint: "https://puppetdb:8081", NodeNameRewrites: []string{"s/foo"}},
+			wantErr: true,
+		},
+		{
+			name:    "unknown fallback name source",
+			config:  Config{Endpoint: "https://puppetdb:8081", FallbackNames: []string{"uuid"}},
+			wantErr: true,
+		},
+		{
+			name:    "inventory fallback on an old server",
+			config:  Config{Endpoint: "https://puppetdb:8081", InventoryFallback: true, ServerVersion: "4.3.2"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.config.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestHandleEvent_recheckAfter(t *testing.T) {
+	tests := []struct {
+		name           string
+		appearsAfter   int32
+		wantDeregister bool
+		wantRequests   int
+	}{
+		{
+			name:         "node appearing before the re-check",
+			appearsAfter: 1,
+			wantRequests: 2,
+		},
+		{
+			name:           "node still absent",
+			appearsAfter:   2,
+			wantDeregister: true,
+			wantRequests:   2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var requests int32
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				nodes := []map[string]interface{}{}
+				if atomic.AddInt32(&requests, 1) > tt.appearsAfter {
+					nodes = append(nodes, map[string]interface{}{"certname": "foo"})
+				}
+				_ = json.NewEncoder(w).Encode(nodes)
+			}))
+			defer ts.Close()
+			config := Config{Endpoint: ts.URL, Client: ts.Client(), RecheckAfter: 10 * time.Millisecond}
+
+			got, err := HandleEvent(context.Background(), config, corev2.FixtureEvent("foo", "keepalive"))
+			if err != nil {
+				t.Fatalf("HandleEvent() error = %v", err)
+			}
+			if got.Deregister != tt.wantDeregister {
+				t.Errorf("HandleEvent() Deregister = %v, want %v", got.Deregister, tt.wantDeregister)
+			}
+			if n := int(atomic.LoadInt32(&requests)); n != tt.wantRequests {
+				t.Errorf("PuppetDB queried %d times, want %d", n, tt.wantRequests)
+			}
+		})
+	}
+}
+
+func TestHandleEvent_environments(t *testing.T) {
+	var query string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query = r.URL.Query().Get("query")
+		_ = json.NewEncoder(w).Encode([]map[string]interface{}{})
+	}))
+	defer ts.Close()
+
+	event := corev2.FixtureEvent("foo", "keepalive")
+	event.Entity.Namespace = "staging"
+	config := Config{Endpoint: ts.URL, Client: ts.Client(), Environments: map[string]string{"staging": "stage"}}
+	if _, err := HandleEvent(context.Background(), config, event); err != nil {
+		t.Fatal(err)
+	}
+	if want := `["and",["=","certname","foo"],["=","catalog_environment","stage"]]`; query != want {
+		t.Errorf("query = %s, want %s", query, want)
+	}
+}
+
+func TestHandleEvent_certnameRoute(t *testing.T) {
+	tests := []struct {
+		name       string
+		node       map[string]interface{}
+		deregister bool
+	}{
+		{
+			name: "active node",
+			node: map[string]interface{}{"certname": "foo", "deactivated": nil, "expired": nil},
+		},
+		{
+			name:       "deactivated node",
+			node:       map[string]interface{}{"certname": "foo", "deactivated": "2024-01-02T03:04:05.000Z", "expired": nil},
+			deregister: true,
+		},
+		{
+			name:       "expired node",
+			node:       map[string]interface{}{"certname": "foo", "deactivated": nil, "expired": "2024-01-02T03:04:05.000Z"},
+			deregister: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != "/pdb/query/v4/nodes/foo" {
+					t.Errorf("HandleEvent() path = %s, want the certname route", r.URL.Path)
+				}
+				_ = json.NewEncoder(w).Encode(tt.node)
+			}))
+			defer ts.Close()
+			config := Config{Endpoint: ts.URL + "/pdb/query/v4/nodes", Client: ts.Client(), ServerVersion: "3.2.4"}
+
+			got, err := HandleEvent(context.Background(), config, corev2.FixtureEvent("foo", "keepalive"))
+			if err != nil {
+				t.Fatalf("HandleEvent() error = %v", err)
+			}
+			if got.Deregister != tt.deregister {
+				t.Errorf("HandleEvent() deregister = %v, want %v", got.Deregister, tt.deregister)
+			}
+		})
+	}
+}
+
+func TestHandleEvent_inventoryFallback(t *testing.T) {
+	tests := []struct {
+		name      string
+		inventory []map[string]interface{}
+		want      bool
+		wantName  string
+	}{
+		{
+			name:      "node found in the inventory",
+			inventory: []map[string]interface{}{{"certname": "web01", "facts": map[string]interface{}{"fqdn": "web01.example.com"}}},
+			want:      true,
+			wantName:  "web01",
+		},
+		{
+			name:      "node not in the inventory",
+			inventory: []map[string]interface{}{},
+			want:      false,
+			wantName:  "web01.example.com",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var query string
+			mux := http.NewServeMux()
+			mux.HandleFunc("/pdb/query/v4/nodes", func(w http.ResponseWriter, r *http.Request) {
+				_ = json.NewEncoder(w).Encode([]map[string]interface{}{})
+			})
+			mux.HandleFunc("/pdb/query/v4/inventory", func(w http.ResponseWriter, r *http.Request) {
+				query = r.URL.Query().Get("query")
+				_ = json.NewEncoder(w).Encode(tt.inventory)
+			})
+			ts := httptest.NewServer(mux)
+			defer ts.Close()
+			config := Config{Endpoint: ts.URL + "/pdb/query/v4/nodes", Client: ts.Client(), InventoryFallback: true}
+
+			event := corev2.FixtureEvent("web01.example.com", "keepalive")
+			got, err := HandleEvent(context.Background(), config, event)
+			if err != nil {
+				t.Fatalf("HandleEvent() error = %v", err)
+			}
+			if want := `["or",["=","certname","web01.example.com"],["=","facts.fqdn","web01.example.com"]]`; query != want {
+				t.Errorf("HandleEvent() query = %s, want %s", query, want)
+			}
+			if got.Deregister == tt.want {
+				t.Errorf("HandleEvent() = %v, want %v", !got.Deregister, tt.want)
+			}
+			if got.NodeName != tt.wantName {
+				t.Errorf("HandleEvent() name = %q, want %q", got.NodeName, tt.wantName)
+			}
+		})
+	}
+}
+
+func Test_firstNode(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		want    string
+		wantErr bool
+	}{
+		{name: "nodes", body: `[{"certname": "web01"}, {"certname": "web02"}, truncated`, want: "web01"},
+		{name: "no nodes", body: `[]`},
+		{name: "null", body: `null`},
+		{name: "object", body: `{"error": "invalid query"}`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			node, err := firstNode(strings.NewReader(tt.body))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("firstNode() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got, _ := node["certname"].(string); got != tt.want {
+				t.Errorf("firstNode() certname = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,121 @@
+package puppet
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// VersionPath is the path of the PuppetDB version API
+const VersionPath = "/pdb/meta/v1/version"
+
+// Minimum PuppetDB versions of the features used by the lookup
+const (
+	// MinVersion is the first PuppetDB version serving the v4 query API
+	MinVersion = "3.0.0"
+
+	// queryParamVersion is the first version looked up with a node query,
+	// older servers are looked up by certname with the nodes/<certname>
+	// route
+	queryParamVersion = "4.0.0"
+
+	// nodeStateVersion is the first version supporting the node_state field
+	// used to include the deactivated and expired nodes
+	nodeStateVersion = "4.2.0"
+
+	// inventoryVersion is the first version serving the inventory query API
+	// used by the inventory fallback
+	inventoryVersion = "4.4.0"
+)
+
+// ServerVersion queries the PuppetDB version API on the host of the
+// configured endpoint and returns the version of the server
+func ServerVersion(ctx context.Context, config Config) (string, error) {
+	u, err := url.Parse(config.Endpoint)
+	if err != nil {
+		return "", err
+	}
+	u.Path, u.RawPath, u.RawQuery = VersionPath, "", ""
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	client := config.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", responseError(resp)
+	}
+	var result struct {
+		Version string `json:"version"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", fmt.Errorf("puppet version query returned invalid response: %s", err)
+	}
+	if _, err := parseVersion(result.Version); err != nil {
+		return "", fmt.Errorf("puppet version query returned invalid version: %s", err)
+	}
+	return result.Version, nil
+}
+
+// supports returns whether the PuppetDB server is at least the given version.
+// An unknown server version is assumed to be current.
+func (c Config) supports(minimum string) bool {
+	if c.ServerVersion == "" {
+		return true
+	}
+	have, err := parseVersion(c.ServerVersion)
+	if err != nil {
+		return true
+	}
+	want, _ := parseVersion(minimum)
+	for i := range want {
+		if have[i] != want[i] {
+			return have[i] > want[i]
+		}
+	}
+	return true
+}
+
+// requireVersion returns an error naming the feature if the PuppetDB server
+// is older than the given version
+func (c Config) requireVersion(minimum, feature string) error {
+	if c.supports(minimum) {
+		return nil
+	}
+	return fmt.Errorf("%s requires PuppetDB %s or later, the server runs PuppetDB %s", feature, minimum, c.ServerVersion)
+}
+
+// parseVersion returns the major, minor and patch numbers of a version,
+// ignoring any pre-release or build suffix
+func parseVersion(version string) ([3]int, error) {
+	var numbers [3]int
+	if version == "" {
+		return numbers, errors.New("empty version")
+	}
+	version = strings.SplitN(strings.SplitN(version, "-", 2)[0], "+", 2)[0]
+	parts := strings.Split(version, ".")
+	if len(parts) > len(numbers) {
+		return numbers, fmt.Errorf("invalid version %q", version)
+	}
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return numbers, fmt.Errorf("invalid version %q", version)
+		}
+		numbers[i] = n
+	}
+	return numbers, nil
+}
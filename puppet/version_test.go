@@ -0,0 +1,113 @@
+package puppet
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	corev2 "github.com/sensu/core/v2"
+)
+
+func TestServerVersion(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != VersionPath {
+			t.Errorf("unexpected path %q", r.URL.Path)
+		}
+		_, _ = w.Write([]byte(`{"version":"7.13.1"}`))
+	}))
+	defer server.Close()
+
+	version, err := ServerVersion(context.Background(), Config{Endpoint: server.URL + "/pdb/query/v4/nodes"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != "7.13.1" {
+		t.Errorf("ServerVersion() = %q, want %q", version, "7.13.1")
+	}
+}
+
+func TestConfig_supports(t *testing.T) {
+	tests := []struct {
+		version string
+		minimum string
+		want    bool
+	}{
+		{"", "4.2.0", true},
+		{"4.2.0", "4.2.0", true},
+		{"4.10.1", "4.2.0", true},
+		{"7.0.0-SNAPSHOT", "4.2.0", true},
+		{"4.1.9", "4.2.0", false},
+		{"3", "4.0.0", false},
+	}
+	for _, tt := range tests {
+		c := Config{ServerVersion: tt.version}
+		if got := c.supports(tt.minimum); got != tt.want {
+			t.Errorf("supports(%q) with PuppetDB %q = %v, want %v", tt.minimum, tt.version, got, tt.want)
+		}
+	}
+}
+
+func TestConfig_Validate_serverVersion(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  Config
+		wantErr string
+	}{
+		{
+			name:    "v4 query API",
+			config:  Config{Endpoint: "https://puppetdb:8081", ServerVersion: "2.3.8"},
+			wantErr: "the v4 query API requires PuppetDB 3.0.0 or later, the server runs PuppetDB 2.3.8",
+		},
+		{
+			name:    "deactivated nodes",
+			config:  Config{Endpoint: "https://puppetdb:8081", ServerVersion: "4.1.0", IncludeDeactivated: true},
+			wantErr: "including deactivated or expired nodes requires PuppetDB 4.2.0 or later",
+		},
+		{
+			name:   "supported",
+			config: Config{Endpoint: "https://puppetdb:8081", ServerVersion: "4.1.0"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.config.Validate()
+			if (err != nil) != (tt.wantErr != "") || err != nil && !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Validate() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestHandleEvent_pathLookup(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.RawQuery != "" {
+			t.Errorf("unexpected query %q", r.URL.RawQuery)
+		}
+		if r.URL.Path != "/pdb/query/v4/nodes/entity1" {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = w.Write([]byte(`{"certname":"entity1"}`))
+	}))
+	defer server.Close()
+
+	for _, tt := range []struct {
+		entity     string
+		deregister bool
+	}{
+		{"entity1", false},
+		{"entity2", true},
+	} {
+		config := Config{Endpoint: server.URL + "/pdb/query/v4/nodes", ServerVersion: "3.2.4"}
+		event := corev2.FixtureEvent(tt.entity, "keepalive")
+		decision, err := HandleEvent(context.Background(), config, event)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if decision.Deregister != tt.deregister {
+			t.Errorf("HandleEvent(%q) Deregister = %v, want %v", tt.entity, decision.Deregister, tt.deregister)
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	corev2 "github.com/sensu/core/v2"
+	"github.com/sensu/sensu-puppet-handler/puppet"
+)
+
+// puppetHTTPClient configures an HTTP client for PuppetDB
+func puppetHTTPClient() (*http.Client, error) {
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: handler.puppetInsecureSkipVerify,
+		Renegotiation:      renegotiationSupport(handler.tlsRenegotiation),
+	}
+
+	// Load the public/private key pair, which is optional with OAuth2 and
+	// SPNEGO
+	if handler.puppetCert != "" || !puppetProxyAuth() {
+		cert, err := tls.LoadX509KeyPair(handler.puppetCert, handler.puppetKey)
+		if err != nil {
+			return nil, fmt.Errorf("could not read the certificate/key: %s", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	// Load the CA certificate. API gateways and reverse proxies publishing
+	// PuppetDB with OAuth2 or SPNEGO can be trusted through the system roots
+	// instead.
+	if handler.puppetCACert != "" || handler.puppetCAURL != "" || !puppetProxyAuth() {
+		caCert, err := puppetCACertificate()
+		if err != nil {
+			return nil, err
+		}
+		caCertPool := x509.NewCertPool()
+		caCertPool.AppendCertsFromPEM(caCert)
+		tlsConfig.RootCAs = caCertPool
+	}
+
+	// Setup the HTTPS client
+	transport := &http.Transport{TLSClientConfig: tlsConfig}
+	if err := setProxy(transport, handler.puppetProxyURL); err != nil {
+		return nil, err
+	}
+	setResolver(transport)
+	base := withConnectionTrace(withHTTPVersion(transport, handler.puppetHTTPVersion))
+	if puppetOAuth() {
+		oauth, err := newOAuthTransport(base)
+		if err != nil {
+			return nil, err
+		}
+		base = oauth
+	}
+	if handler.puppetSPNEGO {
+		spnego, err := newSPNEGOTransport(base, urlHost(handler.endpoint))
+		if err != nil {
+			return nil, err
+		}
+		base = spnego
+	}
+	client := &http.Client{
+		Transport:     limitedTransport(withRequestID(countRequests(base, &summary.puppetDBRequests))),
+		CheckRedirect: checkRedirect,
+		Timeout:       requestTimeout(),
+	}
+
+	return client, nil
+}
+
+// puppetProxyAuth returns whether PuppetDB is published through an API gateway
+// or reverse proxy authenticating the handler, rather than authenticated with
+// a Puppet-issued client certificate
+func puppetProxyAuth() bool {
+	return puppetOAuth() || handler.puppetSPNEGO
+}
+
+// normalizeEndpoint returns the URL of the PuppetDB nodes query API. The
+// scheme defaults to https and the path to the nodes query API, so that
+// "puppetdb:8081" is enough.
+func normalizeEndpoint(endpoint string) (string, error) {
+	if !strings.Contains(endpoint, "://") {
+		endpoint = "https://" + endpoint
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return "", fmt.Errorf("unsupported scheme %q", u.Scheme)
+	}
+	if u.Hostname() == "" {
+		return "", errors.New("missing host")
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = path.Join("/", defaultAPIPath)
+	}
+	return u.String(), nil
+}
+
+const (
+	renegotiateNever  = "never"
+	renegotiateOnce   = "once"
+	renegotiateFreely = "freely"
+)
+
+// renegotiationSupport returns the TLS renegotiation support matching the
+// configured setting. Some older front ends to PuppetDB require client
+// initiated renegotiation, which Go rejects by default.
+func renegotiationSupport(setting string) tls.RenegotiationSupport {
+	switch setting {
+	case renegotiateOnce:
+		return tls.RenegotiateOnceAsClient
+	case renegotiateFreely:
+		return tls.RenegotiateFreelyAsClient
+	}
+	return tls.RenegotiateNever
+}
+
+// nodeLookup is the outcome of querying PuppetDB for a node
+type nodeLookup struct {
+	name   string
+	status string
+	// record is the node as returned by PuppetDB, nil if it does not exist
+	record map[string]interface{}
+}
+
+const (
+	nodeActive   = puppet.StatusActive
+	nodeNotFound = puppet.StatusNotFound
+)
+
+// exists returns whether the node is known to the inventory and not retired
+func (l nodeLookup) exists() bool {
+	return l.status == nodeActive
+}
+
+// puppetConfig returns the configuration of the PuppetDB lookup, querying
+// PuppetDB with the given client. The queries are adapted to the version of
+// the server when a client is given.
+func puppetConfig(client *http.Client) puppet.Config {
+	config := puppet.Config{
+		Endpoint:           handler.endpoint,
+		Client:             client,
+		NodeName:           handler.puppetNodeName,
+		NodeNameSource:     handler.nodeNameSource,
+		NodeNameAnnotation: handler.nodeNameAnnotation,
+		NodeNameRewrites:   handler.nodeNameRewrites,
+		FallbackNames:      handler.fallbackNames,
+		CaseInsensitive:    handler.caseInsensitive,
+		CanonicalizeDNS:    handler.canonicalizeDNS,
+		IncludeDeactivated: handler.includeDeactivated,
+		IncludeExpired:     handler.includeExpired,
+		InventoryFallback:  handler.inventoryFallback,
+		RequestTimeout:     requestTimeout(),
+		Environments:       handler.namespaceEnvironments,
+		RecheckAfter:       time.Duration(handler.recheckAfter) * time.Second,
+		Resolver:           dnsResolver(),
+	}
+	if client != nil {
+		config.ServerVersion = puppetDBVersion(client)
+	}
+	return config
+}
+
+// lookupPuppetNode returns whether a given node exists in Puppet and any error
+// encountered. The Puppet node name defaults to the entity name but can be
+// overriden through the entity label "puppet_node_name"
+func lookupPuppetNode(client *http.Client, event *corev2.Event) (nodeLookup, error) {
+	decision, err := puppet.HandleEvent(executionCtx, puppetConfig(client), event)
+	return nodeLookup{name: decision.NodeName, status: decision.Status, record: decision.Node}, err
+}
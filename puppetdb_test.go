@@ -0,0 +1,111 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	corev2 "github.com/sensu/core/v2"
+)
+
+func Test_lookupPuppetNode(t *testing.T) {
+	saveHandler(t)
+	tests := []struct {
+		name       string
+		statusCode int
+		nodes      []map[string]interface{}
+		want       bool
+		wantErr    bool
+	}{
+		{
+			name:       "node exists",
+			statusCode: http.StatusOK,
+			nodes:      []map[string]interface{}{{"certname": "foo", "deactivated": nil}},
+			want:       true,
+		},
+		{
+			name:       "node does not exist",
+			statusCode: http.StatusOK,
+			nodes:      []map[string]interface{}{},
+			want:       false,
+		},
+		{
+			name:       "unexpected status code",
+			statusCode: http.StatusInternalServerError,
+			want:       false,
+			wantErr:    true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.statusCode)
+				if tt.statusCode == http.StatusOK {
+					_ = json.NewEncoder(w).Encode(tt.nodes)
+				}
+			}))
+			defer ts.Close()
+			handler.endpoint = ts.URL
+
+			event := corev2.FixtureEvent("foo", "check-cpu")
+			got, err := lookupPuppetNode(ts.Client(), event)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("lookupPuppetNode() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if got.exists() != tt.want {
+				t.Errorf("lookupPuppetNode() = %v, want %v", got.exists(), tt.want)
+			}
+		})
+	}
+}
+
+func Test_renegotiationSupport(t *testing.T) {
+	tests := []struct {
+		setting string
+		want    tls.RenegotiationSupport
+	}{
+		{setting: "", want: tls.RenegotiateNever},
+		{setting: renegotiateNever, want: tls.RenegotiateNever},
+		{setting: renegotiateOnce, want: tls.RenegotiateOnceAsClient},
+		{setting: renegotiateFreely, want: tls.RenegotiateFreelyAsClient},
+	}
+	for _, tt := range tests {
+		t.Run(tt.setting, func(t *testing.T) {
+			if got := renegotiationSupport(tt.setting); got != tt.want {
+				t.Errorf("renegotiationSupport() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_normalizeEndpoint(t *testing.T) {
+	tests := []struct {
+		endpoint string
+		want     string
+		wantErr  bool
+	}{
+		{endpoint: "puppetdb", want: "https://puppetdb/pdb/query/v4/nodes"},
+		{endpoint: "puppetdb:8081", want: "https://puppetdb:8081/pdb/query/v4/nodes"},
+		{endpoint: "puppetdb.example.com:8081/", want: "https://puppetdb.example.com:8081/pdb/query/v4/nodes"},
+		{endpoint: "puppetdb:8081/custom/nodes", want: "https://puppetdb:8081/custom/nodes"},
+		{endpoint: "http://127.0.0.1:8080", want: "http://127.0.0.1:8080/pdb/query/v4/nodes"},
+		{endpoint: "https://puppetdb:8081/pdb/query/v4/nodes", want: "https://puppetdb:8081/pdb/query/v4/nodes"},
+		{endpoint: ":8081", wantErr: true},
+		{endpoint: "ftp://puppetdb", wantErr: true},
+		{endpoint: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.endpoint, func(t *testing.T) {
+			got, err := normalizeEndpoint(tt.endpoint)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("normalizeEndpoint() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("normalizeEndpoint() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/sensu/sensu-puppet-handler/puppet"
+)
+
+const (
+	puppetDBVersionStateFile = "puppetdb-version.json"
+
+	// puppetDBVersionTTL is how long the detected PuppetDB version is
+	// cached in the state directory
+	puppetDBVersionTTL = time.Hour
+)
+
+// cachedVersion is a PuppetDB version cached in the state directory
+type cachedVersion struct {
+	Version string `json:"version"`
+	Expires int64  `json:"expires"`
+}
+
+// puppetDBVersions memoizes the versions detected during this execution, by
+// PuppetDB server
+var puppetDBVersions = make(map[string]string)
+
+// puppetDBVersionsMu serializes the detection, so that the workers of the bulk
+// subcommands wait for the first one instead of probing the server each
+var puppetDBVersionsMu sync.Mutex
+
+// puppetDBVersion returns the version of the configured PuppetDB server,
+// detected once and cached in the state directory. An empty version is
+// returned when it could not be detected, the lookup then assumes a current
+// server.
+func puppetDBVersion(client *http.Client) string {
+	u, err := url.Parse(handler.endpoint)
+	if err != nil {
+		return ""
+	}
+	server := u.Scheme + "://" + u.Host
+	puppetDBVersionsMu.Lock()
+	defer puppetDBVersionsMu.Unlock()
+	if version, ok := puppetDBVersions[server]; ok {
+		return version
+	}
+
+	cache := make(map[string]cachedVersion)
+	if err := readState(puppetDBVersionStateFile, &cache); err != nil {
+		log.Printf("could not read the PuppetDB version cache: %s", err)
+	}
+	now := time.Now()
+	if cached, ok := cache[server]; ok && cached.Expires > now.Unix() {
+		puppetDBVersions[server] = cached.Version
+		return cached.Version
+	}
+
+	config := puppetConfig(nil)
+	config.Client = client
+	version, err := puppet.ServerVersion(executionCtx, config)
+	if err != nil {
+		// Only remember the failure for this execution, the next one tries
+		// again
+		log.Printf("could not detect the PuppetDB version, assuming a current server: %s", err)
+		puppetDBVersions[server] = ""
+		return ""
+	}
+	log.Printf("detected PuppetDB version %s", version)
+	puppetDBVersions[server] = version
+	cache[server] = cachedVersion{Version: version, Expires: now.Add(puppetDBVersionTTL).Unix()}
+	for key, cached := range cache {
+		if cached.Expires <= now.Unix() {
+			delete(cache, key)
+		}
+	}
+	if err := writeState(puppetDBVersionStateFile, cache); err != nil {
+		log.Printf("could not write the PuppetDB version cache: %s", err)
+	}
+	return version
+}
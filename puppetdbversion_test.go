@@ -0,0 +1,39 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/sensu/sensu-puppet-handler/puppet"
+)
+
+func Test_puppetDBVersion(t *testing.T) {
+	var queries int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != puppet.VersionPath {
+			t.Errorf("unexpected path %q", r.URL.Path)
+		}
+		atomic.AddInt32(&queries, 1)
+		_, _ = w.Write([]byte(`{"version":"6.20.2"}`))
+	}))
+	defer server.Close()
+
+	saveHandler(t)
+	handler.stateDir = t.TempDir()
+	handler.endpoint = server.URL + "/pdb/query/v4/nodes"
+
+	if got := puppetDBVersion(server.Client()); got != "6.20.2" {
+		t.Errorf("puppetDBVersion() = %q, want %q", got, "6.20.2")
+	}
+
+	// The version is cached in the state directory across executions
+	puppetDBVersions = make(map[string]string)
+	if got := puppetDBVersion(server.Client()); got != "6.20.2" {
+		t.Errorf("cached puppetDBVersion() = %q, want %q", got, "6.20.2")
+	}
+	if n := atomic.LoadInt32(&queries); n != 1 {
+		t.Errorf("PuppetDB version queried %d times, want 1", n)
+	}
+}
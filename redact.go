@@ -0,0 +1,76 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"regexp"
+	"strings"
+
+	"github.com/sensu/sensu-plugin-sdk/sensu"
+)
+
+// minSecretLength is the length under which secret values are not redacted,
+// as replacing every occurrence of a very short string would garble the output
+// without protecting anything
+const minSecretLength = 4
+
+// credentialsPattern matches the password of URLs with embedded credentials
+var credentialsPattern = regexp.MustCompile(`([a-zA-Z][a-zA-Z0-9+.-]*://[^/@\s:]*):[^/@\s]*@`)
+
+// redact masks the values of the secret options and the passwords embedded in
+// URLs found in s
+func redact(s string) string {
+	for _, value := range secretValues() {
+		if len(value) < minSecretLength {
+			continue
+		}
+		s = strings.ReplaceAll(s, value, secretMask)
+	}
+	return credentialsPattern.ReplaceAllString(s, "${1}:"+secretMask+"@")
+}
+
+// secretValues returns the values of the secret options, each value of the
+// secret map options, and the Sensu API keys read from the namespace API keys
+// file
+func secretValues() []string {
+	var values []string
+	for _, opt := range options {
+		if guard, ok := opt.(*annotationGuard); ok {
+			opt = guard.ConfigOption
+		}
+		if o, ok := opt.(*sensu.MapPluginConfigOption[string]); ok && o.Secret {
+			for _, value := range *o.Value {
+				values = append(values, value)
+			}
+			continue
+		}
+		if info, ok := describeOption(opt); ok && info.secret {
+			values = append(values, info.value)
+		}
+	}
+	for _, key := range fileAPIKeys {
+		values = append(values, key)
+	}
+	return values
+}
+
+// redactError returns err with its message redacted
+func redactError(err error) error {
+	if err == nil {
+		return nil
+	}
+	return errors.New(redact(err.Error()))
+}
+
+// redactWriter redacts everything written to the underlying writer, it is used
+// as the output of the standard logger so that no log line can leak secrets
+type redactWriter struct {
+	w io.Writer
+}
+
+func (r redactWriter) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(r.w, redact(string(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// defaultMaxRedirects matches the redirect limit of the Go HTTP client
+const defaultMaxRedirects = 10
+
+// checkRedirect applies the redirect policy to the PuppetDB and Sensu API
+// clients. Redirects beyond the limit fail with the redirect target, which is
+// clearer than the decoding error of a load balancer error page. The Go client
+// drops the authorization headers on redirects to another host, and the token
+// transports only authenticate the requests to their API host (see
+// sendCredentials), so credentials are only forwarded when configured to.
+func checkRedirect(req *http.Request, via []*http.Request) error {
+	if handler.maxRedirects <= 0 {
+		return fmt.Errorf("redirect to %s not followed, redirects are disabled", req.URL.Redacted())
+	}
+	if len(via) > handler.maxRedirects {
+		return fmt.Errorf("redirect to %s not followed, stopped after %d redirects", req.URL.Redacted(), handler.maxRedirects)
+	}
+	if handler.redirectForwardAuth {
+		for _, header := range []string{"Authorization", "Cookie"} {
+			if value := via[0].Header.Get(header); value != "" && req.Header.Get(header) == "" {
+				req.Header.Set(header, value)
+			}
+		}
+	}
+	return nil
+}
+
+// sendCredentials returns whether the transports adding bearer tokens may
+// authenticate the request: requests to the host of the API the tokens were
+// issued for are, requests redirected to other hosts only with
+// --redirect-forward-auth
+func sendCredentials(req *http.Request, apiHost string) bool {
+	return handler.redirectForwardAuth || strings.EqualFold(req.URL.Host, apiHost)
+}
+
+// urlHost returns the host and port of the URL, empty if it is invalid
+func urlHost(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+	return u.Host
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func Test_checkRedirect(t *testing.T) {
+	saveHandler(t)
+	var gotAuth string
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotAuth = r.Header.Get("Authorization")
+	}))
+	defer target.Close()
+	// Redirect to another host name than the origin's
+	targetURL := strings.Replace(target.URL, "127.0.0.1", "localhost", 1)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, targetURL, http.StatusFound)
+	}))
+	defer origin.Close()
+
+	tests := []struct {
+		name         string
+		maxRedirects int
+		forwardAuth  bool
+		wantErr      bool
+		wantAuth     string
+	}{
+		{
+			name:         "redirects disabled",
+			maxRedirects: 0,
+			wantErr:      true,
+		},
+		{
+			name:         "authorization dropped across hosts",
+			maxRedirects: 1,
+		},
+		{
+			name:         "authorization forwarded",
+			maxRedirects: 1,
+			forwardAuth:  true,
+			wantAuth:     "Key xxxxxxxxxx",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler.maxRedirects = tt.maxRedirects
+			handler.redirectForwardAuth = tt.forwardAuth
+			defer func() {
+				handler.maxRedirects = 0
+				handler.redirectForwardAuth = false
+			}()
+			gotAuth = ""
+
+			client := &http.Client{CheckRedirect: checkRedirect}
+			req, err := http.NewRequest(http.MethodGet, origin.URL, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Authorization", "Key xxxxxxxxxx")
+			resp, err := client.Do(req)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("checkRedirect() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			resp.Body.Close()
+			if gotAuth != tt.wantAuth {
+				t.Errorf("checkRedirect() authorization = %q, want %q", gotAuth, tt.wantAuth)
+			}
+		})
+	}
+}
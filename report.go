@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Marks of the --diff-report lines
+const (
+	diffRemoved = "-"
+	diffKept    = " "
+	diffSkipped = "~"
+)
+
+// diffEntry is what the check subcommand would do with an entity
+type diffEntry struct {
+	mark   string
+	name   string
+	reason string
+}
+
+// diffReport collects the entities of the check subcommand by namespace, to
+// list those the handler would remove, keep or skip, with the reason, in a
+// form that can be pasted into a change request before enabling the
+// deregistration. A nil report collects nothing.
+type diffReport struct {
+	mu      sync.Mutex
+	entries map[string][]diffEntry
+}
+
+// newDiffReport returns the report when --diff-report is set, nil otherwise
+func newDiffReport() *diffReport {
+	if handler.diffReport == "" {
+		return nil
+	}
+	return &diffReport{entries: make(map[string][]diffEntry)}
+}
+
+// add records the entity of the namespace, the reason formatted as with
+// fmt.Sprintf
+func (r *diffReport) add(namespace, mark, name, format string, args ...interface{}) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.entries[namespace] = append(r.entries[namespace], diffEntry{mark: mark, name: name, reason: fmt.Sprintf(format, args...)})
+}
+
+// write writes the report of the namespaces to w, the entities of each
+// namespace sorted by name
+func (r *diffReport) write(w io.Writer, namespaces []string) error {
+	for i, namespace := range namespaces {
+		entries := r.entries[namespace]
+		sort.Slice(entries, func(i, j int) bool { return entries[i].name < entries[j].name })
+		counts := make(map[string]int)
+		for _, entry := range entries {
+			counts[entry.mark]++
+		}
+		var b strings.Builder
+		if i > 0 {
+			b.WriteString("\n")
+		}
+		fmt.Fprintf(&b, "# namespace %s: %d removed, %d kept, %d skipped\n", namespace, counts[diffRemoved], counts[diffKept], counts[diffSkipped])
+		for _, entry := range entries {
+			fmt.Fprintf(&b, "%s %s: %s\n", entry.mark, entry.name, entry.reason)
+		}
+		if _, err := io.WriteString(w, b.String()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// save writes the report to the --diff-report file, or to the standard output
+// after the check output when "-"
+func (r *diffReport) save(namespaces []string) error {
+	if r == nil {
+		return nil
+	}
+	if handler.diffReport == "-" {
+		return r.write(os.Stdout, namespaces)
+	}
+	var b strings.Builder
+	if err := r.write(&b, namespaces); err != nil {
+		return err
+	}
+	// The report names the infrastructure, keep it to its owner
+	return os.WriteFile(handler.diffReport, []byte(b.String()), 0600)
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func Test_diffReport_write(t *testing.T) {
+	saveHandler(t)
+	handler.diffReport = "-"
+	report := newDiffReport()
+	report.add("production", diffKept, "web02", "node %q is %s", "web02.example.com", nodeActive)
+	report.add("production", diffSkipped, "db01", "protected by %q", "db*")
+	report.add("production", diffRemoved, "web01", "node %q is %s", "web01.example.com", nodeNotFound)
+
+	var b strings.Builder
+	if err := report.write(&b, []string{"production", "staging"}); err != nil {
+		t.Fatal(err)
+	}
+	want := `# namespace production: 1 removed, 1 kept, 1 skipped
+~ db01: protected by "db*"
+- web01: node "web01.example.com" is not-found
+  web02: node "web02.example.com" is active
+
+# namespace staging: 0 removed, 0 kept, 0 skipped
+`
+	if b.String() != want {
+		t.Errorf("write() =\n%s\nwant\n%s", b.String(), want)
+	}
+}
+
+func Test_newDiffReport(t *testing.T) {
+	saveHandler(t)
+	handler.diffReport = ""
+	report := newDiffReport()
+	if report != nil {
+		t.Fatalf("newDiffReport() = %v, want nil without --diff-report", report)
+	}
+	// A nil report ignores the entities
+	report.add("default", diffKept, "web01", "node %q is %s", "web01", nodeActive)
+	if err := report.save([]string{"default"}); err != nil {
+		t.Errorf("save() error = %v", err)
+	}
+}
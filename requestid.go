@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/google/uuid"
+)
+
+// requestIDHeader carries the correlation ID of the handler execution in the
+// requests sent to PuppetDB and the Sensu API
+const requestIDHeader = "X-Request-ID"
+
+// setupRequestID generates the correlation ID of the handler execution unless
+// one was provided, and prefixes every log line with it
+func setupRequestID() {
+	if handler.requestID == "" {
+		handler.requestID = uuid.New().String()
+	}
+	log.SetFlags(log.LstdFlags | log.Lmsgprefix)
+	log.SetPrefix(fmt.Sprintf("[%s] ", handler.requestID))
+}
+
+// requestIDTransport sets the correlation ID header on the requests sent
+// through it
+type requestIDTransport struct {
+	base http.RoundTripper
+}
+
+// withRequestID wraps the transport to send the correlation ID, if any
+func withRequestID(base http.RoundTripper) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	if handler.requestID == "" {
+		return base
+	}
+	return requestIDTransport{base: base}
+}
+
+func (t requestIDTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.Header.Set(requestIDHeader, handler.requestID)
+	return t.base.RoundTrip(req)
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func Test_withRequestID(t *testing.T) {
+	saveHandler(t)
+	var got string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Get(requestIDHeader)
+	}))
+	defer ts.Close()
+	defer func() { handler.requestID = "" }()
+
+	handler.requestID = "3f9c8a8e-5a4b-4b8e-9a51-2c1b7f1d9e42"
+	client := &http.Client{Transport: withRequestID(nil)}
+	resp, err := client.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if got != handler.requestID {
+		t.Errorf("withRequestID() header = %q, want %q", got, handler.requestID)
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// defaultDNSPort is the port of the DNS servers given without one
+const defaultDNSPort = "53"
+
+// customResolver memoizes the resolver querying the configured DNS servers
+var customResolver *net.Resolver
+
+// customResolverMu guards customResolver against the concurrent workers of the
+// bulk subcommands
+var customResolverMu sync.Mutex
+
+// dnsServerAddr returns the address of a DNS server given as an IP address
+// with an optional port
+func dnsServerAddr(server string) (string, error) {
+	host, port, err := net.SplitHostPort(server)
+	if err != nil {
+		host, port = server, defaultDNSPort
+	}
+	if net.ParseIP(host) == nil {
+		return "", fmt.Errorf("%q is not an IP address", host)
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// dnsResolver returns the resolver of the names of PuppetDB, the Sensu API and
+// the service discovery records. With --dns-servers, the names are resolved
+// by the given servers in turn rather than the host's, so that the Puppet
+// infrastructure can be reached through a dedicated internal resolver.
+func dnsResolver() *net.Resolver {
+	if len(handler.dnsServers) == 0 {
+		return net.DefaultResolver
+	}
+	customResolverMu.Lock()
+	defer customResolverMu.Unlock()
+	if customResolver != nil {
+		return customResolver
+	}
+	var next uint32
+	customResolver = &net.Resolver{
+		PreferGo: true,
+		// Each attempt of the resolver goes to the next server, so that a
+		// server not answering fails over to the others
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			i := atomic.AddUint32(&next, 1) - 1
+			addr, err := dnsServerAddr(handler.dnsServers[int(i)%len(handler.dnsServers)])
+			if err != nil {
+				return nil, err
+			}
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, network, addr)
+		},
+	}
+	return customResolver
+}
+
+// dnsLookupContext bounds the DNS lookups made with the returned context by
+// --dns-timeout, when set
+func dnsLookupContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if handler.dnsTimeout <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, time.Duration(handler.dnsTimeout)*time.Second)
+}
+
+// dialContext dials the addresses, resolving their host names with the DNS
+// resolver within the DNS lookup timeout. The resolved addresses are tried in
+// turn until a connection is established.
+func dialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	resolver := dnsResolver()
+	dialer := &net.Dialer{Resolver: resolver}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || net.ParseIP(host) != nil {
+		return dialer.DialContext(ctx, network, addr)
+	}
+
+	lookupCtx, cancel := dnsLookupContext(ctx)
+	defer cancel()
+	addrs, err := resolver.LookupHost(lookupCtx, host)
+	if err != nil {
+		return nil, err
+	}
+	var conn net.Conn
+	for _, resolved := range addrs {
+		if conn, err = dialer.DialContext(ctx, network, net.JoinHostPort(resolved, port)); err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
+
+// setResolver makes the transport resolve the names with the DNS resolver when
+// the DNS servers or lookup timeout are configured
+func setResolver(transport *http.Transport) {
+	if len(handler.dnsServers) == 0 && handler.dnsTimeout <= 0 {
+		return
+	}
+	transport.DialContext = dialContext
+}
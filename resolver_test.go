@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func Test_dnsServerAddr(t *testing.T) {
+	tests := []struct {
+		name    string
+		server  string
+		want    string
+		wantErr bool
+	}{
+		{name: "default port", server: "10.0.0.53", want: "10.0.0.53:53"},
+		{name: "custom port", server: "10.0.0.53:5353", want: "10.0.0.53:5353"},
+		{name: "IPv6 address", server: "[fd00::53]:53", want: "[fd00::53]:53"},
+		{name: "host name", server: "dns.example.com", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := dnsServerAddr(tt.server)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("dnsServerAddr() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("dnsServerAddr() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_dnsResolver(t *testing.T) {
+	saveHandler(t)
+	savedResolver := customResolver
+	defer func() { customResolver = savedResolver }()
+	customResolver = nil
+
+	if got := dnsResolver(); got != net.DefaultResolver {
+		t.Errorf("dnsResolver() = %v, want the default resolver", got)
+	}
+
+	// The attempts go to the servers in turn
+	handler.dnsServers = []string{"127.0.0.1:5301", "127.0.0.1:5302"}
+	resolver := dnsResolver()
+	for _, want := range []string{"127.0.0.1:5301", "127.0.0.1:5302", "127.0.0.1:5301"} {
+		conn, err := resolver.Dial(context.Background(), "udp", "192.0.2.1:53")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := conn.RemoteAddr().String(); got != want {
+			t.Errorf("Dial() server = %s, want %s", got, want)
+		}
+		conn.Close()
+	}
+}
+
+func Test_dialContext_timeout(t *testing.T) {
+	saveHandler(t)
+	savedResolver := customResolver
+	defer func() { customResolver = savedResolver }()
+	customResolver = nil
+
+	// A DNS server which never answers
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	handler.dnsServers = []string{conn.LocalAddr().String()}
+	handler.dnsTimeout = 1
+
+	start := time.Now()
+	if _, err := dialContext(context.Background(), "tcp", "puppetdb.invalid:8081"); err == nil {
+		t.Fatal("dialContext() expected an error")
+	}
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("dialContext() took %s, want the lookup to time out after 1s", elapsed)
+	}
+}
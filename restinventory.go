@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+const (
+	sourceGenericREST = "generic-rest"
+
+	// Statuses of the nodes reported by the generic REST inventory
+	nodeDeactivated = "deactivated"
+	nodeStale       = "stale"
+)
+
+// restURLData is the data of the generic REST inventory URL template
+type restURLData struct {
+	// Name is the node name, escaped to be used in the URL
+	Name string
+}
+
+// lookupREST queries the generic REST inventory for the node, and reports it
+// as not found when the inventory answers with a not found status or the
+// exists field is false, deactivated when the deactivated field is true, and
+// stale when it was last seen longer than the maximum age ago
+func lookupREST(name string) (nodeLookup, error) {
+	lookup := nodeLookup{name: name}
+
+	endpoint, err := restURL(name)
+	if err != nil {
+		return lookup, err
+	}
+	req, err := http.NewRequestWithContext(executionCtx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return lookup, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if handler.restToken != "" {
+		req.Header.Set("Authorization", "Bearer "+handler.restToken)
+	} else if handler.restUsername != "" {
+		req.SetBasicAuth(handler.restUsername, handler.restPassword)
+	}
+
+	client := &http.Client{Transport: limitedTransport(withConnectionTrace(nil)), Timeout: requestTimeout()}
+	resp, err := client.Do(req)
+	if err != nil {
+		return lookup, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		log.Printf("node %q does not exist in the REST inventory", name)
+		lookup.status = nodeNotFound
+		return lookup, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return lookup, fmt.Errorf("unexpected HTTP status %s while querying the REST inventory", http.StatusText(resp.StatusCode))
+	}
+
+	var record interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&record); err != nil {
+		return lookup, fmt.Errorf("REST inventory returned invalid response: %s", err)
+	}
+	// Search endpoints answer with the list of the matching records
+	if records, ok := record.([]interface{}); ok {
+		if len(records) == 0 {
+			log.Printf("node %q does not exist in the REST inventory", name)
+			lookup.status = nodeNotFound
+			return lookup, nil
+		}
+		record = records[0]
+	}
+
+	lookup.status, err = restStatus(record, time.Now())
+	if err != nil {
+		return lookup, err
+	}
+	if object, ok := record.(map[string]interface{}); ok {
+		lookup.record = object
+	}
+	log.Printf("node %q is %s in the REST inventory", name, lookup.status)
+	return lookup, nil
+}
+
+// restURL renders the generic REST inventory URL template for the node
+func restURL(name string) (string, error) {
+	tmpl, err := template.New("url").Option("missingkey=error").Parse(handler.restURL)
+	if err != nil {
+		return "", fmt.Errorf("invalid REST inventory URL template: %s", err)
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, restURLData{Name: url.PathEscape(name)}); err != nil {
+		return "", fmt.Errorf("could not render the REST inventory URL: %s", err)
+	}
+	return buf.String(), nil
+}
+
+// restStatus returns the status of the node record according to the field
+// mappings
+func restStatus(record interface{}, now time.Time) (string, error) {
+	if handler.restExistsField != "" {
+		value, _ := jsonField(record, handler.restExistsField)
+		if !truthy(value) {
+			return nodeNotFound, nil
+		}
+	}
+	if handler.restDeactivatedField != "" {
+		value, _ := jsonField(record, handler.restDeactivatedField)
+		if truthy(value) {
+			return nodeDeactivated, nil
+		}
+	}
+	if handler.restLastSeenField != "" {
+		value, ok := jsonField(record, handler.restLastSeenField)
+		if !ok || value == nil {
+			return nodeStale, nil
+		}
+		lastSeen, err := parseTimestamp(value)
+		if err != nil {
+			return "", fmt.Errorf("invalid %s field in the REST inventory response: %s", handler.restLastSeenField, err)
+		}
+		if now.Sub(lastSeen) > time.Duration(handler.restMaxAge)*time.Second {
+			return nodeStale, nil
+		}
+	}
+	return nodeActive, nil
+}
+
+// jsonField returns the value at the dot-separated path of a decoded JSON
+// value, where numeric segments index arrays, and false if there is none
+func jsonField(value interface{}, path string) (interface{}, bool) {
+	for _, segment := range strings.Split(path, ".") {
+		switch v := value.(type) {
+		case map[string]interface{}:
+			var ok bool
+			if value, ok = v[segment]; !ok {
+				return nil, false
+			}
+		case []interface{}:
+			i, err := strconv.Atoi(segment)
+			if err != nil || i < 0 || i >= len(v) {
+				return nil, false
+			}
+			value = v[i]
+		default:
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+// truthy returns whether a decoded JSON value is true: true booleans, strings
+// parsing as true, non-zero numbers and any other non-null value
+func truthy(value interface{}) bool {
+	switch v := value.(type) {
+	case nil:
+		return false
+	case bool:
+		return v
+	case string:
+		b, err := strconv.ParseBool(v)
+		return err == nil && b
+	case float64:
+		return v != 0
+	}
+	return true
+}
+
+// parseTimestamp parses a RFC 3339 time or a number of seconds since the Unix
+// epoch
+func parseTimestamp(value interface{}) (time.Time, error) {
+	switch v := value.(type) {
+	case float64:
+		return time.Unix(int64(v), 0), nil
+	case string:
+		if seconds, err := strconv.ParseInt(v, 10, 64); err == nil {
+			return time.Unix(seconds, 0), nil
+		}
+		return time.Parse(time.RFC3339, v)
+	}
+	return time.Time{}, errors.New("not a timestamp")
+}
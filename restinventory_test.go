@@ -0,0 +1,97 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func Test_lookupREST(t *testing.T) {
+	recent := time.Now().Add(-time.Minute).UTC().Format(time.RFC3339)
+	tests := []struct {
+		name       string
+		statusCode int
+		body       string
+		wantStatus string
+		wantErr    bool
+	}{
+		{
+			name:       "node exists",
+			statusCode: http.StatusOK,
+			body:       `{"host": {"active": true, "retired": false, "seen": "` + recent + `"}}`,
+			wantStatus: nodeActive,
+		},
+		{
+			name:       "node not found",
+			statusCode: http.StatusNotFound,
+			wantStatus: nodeNotFound,
+		},
+		{
+			name:       "exists field is false",
+			statusCode: http.StatusOK,
+			body:       `{"host": {"active": "false"}}`,
+			wantStatus: nodeNotFound,
+		},
+		{
+			name:       "empty search result",
+			statusCode: http.StatusOK,
+			body:       `[]`,
+			wantStatus: nodeNotFound,
+		},
+		{
+			name:       "deactivated node",
+			statusCode: http.StatusOK,
+			body:       `[{"host": {"active": true, "retired": 1}}]`,
+			wantStatus: nodeDeactivated,
+		},
+		{
+			name:       "stale node",
+			statusCode: http.StatusOK,
+			body:       `{"host": {"active": true, "seen": 1500000000}}`,
+			wantStatus: nodeStale,
+		},
+		{
+			name:       "invalid last seen time",
+			statusCode: http.StatusOK,
+			body:       `{"host": {"active": true, "seen": "yesterday"}}`,
+			wantErr:    true,
+		},
+		{
+			name:       "unexpected status code",
+			statusCode: http.StatusForbidden,
+			wantErr:    true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.EscapedPath() != "/hosts/web%2001" {
+					t.Errorf("lookupREST() path = %v", r.URL.EscapedPath())
+				}
+				if got := r.Header.Get("Authorization"); got != "Bearer secret" {
+					t.Errorf("lookupREST() authorization = %v", got)
+				}
+				w.WriteHeader(tt.statusCode)
+				_, _ = w.Write([]byte(tt.body))
+			}))
+			defer ts.Close()
+			setHandler(t, Handler{
+				restURL:              ts.URL + "/hosts/{{ .Name }}",
+				restToken:            "secret",
+				restExistsField:      "host.active",
+				restDeactivatedField: "host.retired",
+				restLastSeenField:    "host.seen",
+				restMaxAge:           3600,
+			})
+
+			lookup, err := lookupREST("web 01")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("lookupREST() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && lookup.status != tt.wantStatus {
+				t.Errorf("lookupREST() status = %v, want %v", lookup.status, tt.wantStatus)
+			}
+		})
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+
+	corev2 "github.com/sensu/core/v2"
+)
+
+// labelRequirement is a single statement of a label selector
+type labelRequirement struct {
+	key      string
+	operator string
+	values   []string
+}
+
+const (
+	opEqual    = "=="
+	opNotEqual = "!="
+	opIn       = "in"
+	opNotIn    = "notin"
+	opMatches  = "matches"
+)
+
+// parseLabelSelector parses a label selector following the Sensu syntax:
+// statements of the form "key == value", "key != value", "key in [a, b]",
+// "key notin [a, b]" or "key matches value" combined with "&&". Values can be
+// quoted.
+func parseLabelSelector(selector string) ([]labelRequirement, error) {
+	tokens, err := tokenizeSelector(selector)
+	if err != nil {
+		return nil, err
+	}
+
+	var requirements []labelRequirement
+	for len(tokens) > 0 {
+		if len(tokens) < 3 {
+			return nil, fmt.Errorf("incomplete statement %q", strings.Join(tokens, " "))
+		}
+		r := labelRequirement{key: tokens[0], operator: tokens[1]}
+		tokens = tokens[2:]
+		switch r.operator {
+		case opEqual, opNotEqual, opMatches:
+			r.values = []string{tokens[0]}
+			tokens = tokens[1:]
+		case opIn, opNotIn:
+			if tokens[0] != "[" {
+				return nil, fmt.Errorf("expected [ after %q", r.operator)
+			}
+			tokens = tokens[1:]
+			for {
+				if len(tokens) < 2 {
+					return nil, fmt.Errorf("unterminated list of values for %q", r.key)
+				}
+				r.values = append(r.values, tokens[0])
+				separator := tokens[1]
+				tokens = tokens[2:]
+				if separator == "]" {
+					break
+				}
+				if separator != "," {
+					return nil, fmt.Errorf("expected , or ] in list of values for %q", r.key)
+				}
+			}
+		default:
+			return nil, fmt.Errorf("unknown operator %q", r.operator)
+		}
+		requirements = append(requirements, r)
+
+		if len(tokens) > 0 {
+			if tokens[0] != "&&" {
+				return nil, fmt.Errorf("expected && before %q", tokens[0])
+			}
+			tokens = tokens[1:]
+			if len(tokens) == 0 {
+				return nil, fmt.Errorf("missing statement after &&")
+			}
+		}
+	}
+	return requirements, nil
+}
+
+// tokenizeSelector splits a label selector into keys, values, operators and
+// punctuation
+func tokenizeSelector(selector string) ([]string, error) {
+	var tokens []string
+	runes := []rune(selector)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '[' || r == ']' || r == ',':
+			tokens = append(tokens, string(r))
+			i++
+		case r == '=' || r == '!' || r == '&':
+			if i+1 >= len(runes) || (runes[i+1] != '=' && runes[i+1] != '&') {
+				return nil, fmt.Errorf("invalid operator at position %d", i)
+			}
+			op := string(runes[i : i+2])
+			if op != opEqual && op != opNotEqual && op != "&&" {
+				return nil, fmt.Errorf("invalid operator %q", op)
+			}
+			tokens = append(tokens, op)
+			i += 2
+		case r == '"' || r == '\'':
+			end := i + 1
+			for end < len(runes) && runes[end] != r {
+				end++
+			}
+			if end == len(runes) {
+				return nil, fmt.Errorf("unterminated quoted value at position %d", i)
+			}
+			tokens = append(tokens, string(runes[i+1:end]))
+			i = end + 1
+		default:
+			end := i
+			for end < len(runes) && !unicode.IsSpace(runes[end]) && !strings.ContainsRune("[],=!&\"'", runes[end]) {
+				end++
+			}
+			tokens = append(tokens, string(runes[i:end]))
+			i = end
+		}
+	}
+	return tokens, nil
+}
+
+// matches returns whether the labels satisfy the requirement. A missing label
+// only satisfies the != and notin operators.
+func (r labelRequirement) matches(labels map[string]string) bool {
+	value, ok := labels[r.key]
+	switch r.operator {
+	case opEqual:
+		return ok && value == r.values[0]
+	case opNotEqual:
+		return !ok || value != r.values[0]
+	case opMatches:
+		return ok && strings.Contains(value, r.values[0])
+	case opIn:
+		return ok && contains(r.values, value)
+	case opNotIn:
+		return !ok || !contains(r.values, value)
+	}
+	return false
+}
+
+// entitySelected returns whether the labels of the event's entity match the
+// label selector, if any
+func entitySelected(event *corev2.Event) (bool, error) {
+	if handler.labelSelector == "" {
+		return true, nil
+	}
+	requirements, err := parseLabelSelector(handler.labelSelector)
+	if err != nil {
+		return false, fmt.Errorf("invalid label selector: %s", err)
+	}
+	for _, r := range requirements {
+		if !r.matches(event.Entity.Labels) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
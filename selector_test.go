@@ -0,0 +1,99 @@
+package main
+
+import (
+	"testing"
+
+	corev2 "github.com/sensu/core/v2"
+)
+
+func Test_entitySelected(t *testing.T) {
+	saveHandler(t)
+	tests := []struct {
+		name     string
+		selector string
+		labels   map[string]string
+		want     bool
+		wantErr  bool
+	}{
+		{
+			name: "no selector",
+			want: true,
+		},
+		{
+			name:     "equal",
+			selector: "tier == web",
+			labels:   map[string]string{"tier": "web"},
+			want:     true,
+		},
+		{
+			name:     "not equal",
+			selector: "tier!=critical",
+			labels:   map[string]string{"tier": "critical"},
+			want:     false,
+		},
+		{
+			name:     "not equal with missing label",
+			selector: "tier != critical",
+			want:     true,
+		},
+		{
+			name:     "in",
+			selector: `region in [us-west-1, "us-west-2"]`,
+			labels:   map[string]string{"region": "us-west-2"},
+			want:     true,
+		},
+		{
+			name:     "notin",
+			selector: "region notin [us-west-1, us-west-2]",
+			labels:   map[string]string{"region": "us-west-2"},
+			want:     false,
+		},
+		{
+			name:     "matches",
+			selector: "role matches web",
+			labels:   map[string]string{"role": "frontend-webserver"},
+			want:     true,
+		},
+		{
+			name:     "all statements must match",
+			selector: "tier != critical && region == 'us-west-1'",
+			labels:   map[string]string{"tier": "web", "region": "us-west-2"},
+			want:     false,
+		},
+		{
+			name:     "unknown operator",
+			selector: "tier like web",
+			wantErr:  true,
+		},
+		{
+			name:     "incomplete statement",
+			selector: "tier ==",
+			wantErr:  true,
+		},
+		{
+			name:     "unterminated list",
+			selector: "region in [us-west-1",
+			wantErr:  true,
+		},
+		{
+			name:     "dangling &&",
+			selector: "tier == web &&",
+			wantErr:  true,
+		},
+	}
+	defer func() { handler.labelSelector = "" }()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler.labelSelector = tt.selector
+			event := corev2.FixtureEvent("foo", "keepalive")
+			event.Entity.Labels = tt.labels
+			got, err := entitySelected(event)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("entitySelected() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("entitySelected() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,510 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/google/uuid"
+	corev2 "github.com/sensu/core/v2"
+	"github.com/sensu/sensu-plugin-sdk/httpclient"
+)
+
+// sensuClient configures a client for the Sensu API, authenticated with the
+// API key of the namespace
+func sensuClient(namespace string) (*httpclient.CoreClient, error) {
+	apiKey, err := sensuAPIKeyFor(namespace)
+	if err != nil {
+		return nil, err
+	}
+	config := httpclient.CoreClientConfig{
+		URL:    sensuAPIURLFor(namespace),
+		APIKey: apiKey,
+	}
+	if handler.sensuCACert != "" {
+		pemCert, err := ioutil.ReadFile(handler.sensuCACert)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load sensu-ca-cert: %s", err)
+		}
+
+		block, _ := pem.Decode([]byte(pemCert))
+		if block == nil {
+			return nil, errors.New("failed to decode sensu-ca-cert PEM")
+		}
+
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("invalid sensu-ca-cert: %s", err)
+		}
+		config.CACert = cert
+
+	}
+	if handler.puppetInsecureSkipVerify {
+		config.InsecureSkipVerify = true
+	}
+	client := httpclient.NewCoreClient(config)
+
+	// Present the Puppet-issued client certificate to backends trusting the
+	// Puppet CA
+	if handler.sensuUsePuppetCert {
+		cert, err := tls.LoadX509KeyPair(handler.puppetCert, handler.puppetKey)
+		if err != nil {
+			return nil, fmt.Errorf("could not read the certificate/key: %s", err)
+		}
+		transport := sensuTransport(client)
+		if transport.TLSClientConfig == nil {
+			transport.TLSClientConfig = new(tls.Config)
+		}
+		transport.TLSClientConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	if err := setProxy(sensuTransport(client), handler.sensuProxyURL); err != nil {
+		return nil, err
+	}
+	setResolver(sensuTransport(client))
+
+	client.HTTPClient.Transport = withRequestID(countRequests(withConnectionTrace(withHTTPVersion(sensuTransport(client), handler.sensuHTTPVersion)), &summary.sensuRequests))
+
+	if sensuTokenAuth() {
+		transport, err := newTokenTransport(client.HTTPClient.Transport, config.URL)
+		if err != nil {
+			return nil, err
+		}
+		client.HTTPClient.Transport = transport
+	}
+	if handler.sensuSPNEGO {
+		transport, err := newSPNEGOTransport(client.HTTPClient.Transport, urlHost(config.URL))
+		if err != nil {
+			return nil, err
+		}
+		client.HTTPClient.Transport = transport
+	}
+	client.HTTPClient.Transport = limitedTransport(client.HTTPClient.Transport)
+	client.HTTPClient.Timeout = requestTimeout()
+	client.HTTPClient.CheckRedirect = checkRedirect
+
+	return client, nil
+}
+
+// sensuAPIURLFor returns the Sensu API URL of the backend serving the
+// namespace, so that namespaces living on separate clusters are handled by the
+// same handler configuration
+func sensuAPIURLFor(namespace string) string {
+	if apiURL, ok := handler.namespaceAPIURLs[namespace]; ok {
+		return apiURL
+	}
+	return handler.sensuAPIURL
+}
+
+// sensuTransport returns the transport of the Sensu API client, setting it up
+// if the SDK did not need one
+func sensuTransport(client *httpclient.CoreClient) *http.Transport {
+	transport, ok := client.HTTPClient.Transport.(*http.Transport)
+	if !ok {
+		transport = new(http.Transport)
+		client.HTTPClient.Transport = transport
+	}
+	return transport
+}
+
+// exitSensuAccessDenied is the exit status of the handler when the Sensu API
+// rejects its credentials or permissions, which retrying will not fix
+const exitSensuAccessDenied = 3
+
+// sensuAccessError reports that the Sensu API rejected a request because of
+// the handler's credentials or permissions
+type sensuAccessError struct {
+	statusCode int
+	verb       string
+	namespace  string
+}
+
+func (e sensuAccessError) Error() string {
+	if e.statusCode == http.StatusUnauthorized {
+		return "the Sensu API rejected the credentials, make sure the API key or access token is valid and not expired"
+	}
+	return fmt.Sprintf("the Sensu API denied access, make sure the API key or access token is allowed to %s entities in namespace %q", e.verb, e.namespace)
+}
+
+// accessError returns a sensuAccessError for the authentication and
+// authorization failure statuses, nil otherwise
+func accessError(statusCode int, verb, namespace string) error {
+	if statusCode == http.StatusUnauthorized || statusCode == http.StatusForbidden {
+		return sensuAccessError{statusCode: statusCode, verb: verb, namespace: namespace}
+	}
+	return nil
+}
+
+func deregisterEntity(event *corev2.Event) error {
+	client, err := sensuClient(event.Entity.Namespace)
+	if err != nil {
+		return err
+	}
+	request, err := httpclient.NewResourceRequest("core/v2", "Entity", event.Entity.Namespace, event.Entity.Name)
+	if err != nil {
+		return err
+	}
+
+	// Delete the Sensu entity
+	log.Printf("deleting entity (%s/%s)\n", event.Entity.Namespace, event.Entity.Name)
+	if _, err := client.DeleteResource(executionCtx, request); err != nil {
+		if httperr, ok := err.(httpclient.HTTPError); ok {
+			if err := accessError(httperr.StatusCode, "delete", event.Entity.Namespace); err != nil {
+				return err
+			}
+			if httperr.StatusCode < 500 {
+				log.Printf("entity already deleted (%s/%s)", event.Entity.Namespace, event.Entity.Name)
+				return nil
+			}
+		}
+		return err
+	}
+
+	return nil
+}
+
+// tombstoneEntity marks the entity as deregistered by patching its annotations
+// rather than deleting it, so it can be reviewed before being removed
+func tombstoneEntity(event *corev2.Event, lookup nodeLookup) error {
+	client, err := sensuClient(event.Entity.Namespace)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("tombstoning entity (%s/%s)\n", event.Entity.Namespace, event.Entity.Name)
+	return patchAnnotations(client, event, "tombstoning", map[string]string{
+		annotationPrefix + "deregistered-by":      handler.Name,
+		annotationPrefix + "deregistered-at":      time.Now().UTC().Format(time.RFC3339),
+		annotationPrefix + "puppet-lookup-result": fmt.Sprintf("%s: %s", lookup.name, lookup.status),
+	})
+}
+
+// tombstonedAt returns when the entity was tombstoned, empty if it was not, so
+// that the following failing keepalives leave the tombstone as it was
+func tombstonedAt(entity *corev2.Entity) string {
+	return entity.Annotations[annotationPrefix+"deregistered-at"]
+}
+
+// stampLastVerified records on the kept entity when its Puppet node was last
+// found, for operators and dashboards to tell how fresh the confirmation is
+func stampLastVerified(event *corev2.Event) error {
+	client, err := sensuClient(event.Entity.Namespace)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("stamping entity (%s/%s) as verified\n", event.Entity.Namespace, event.Entity.Name)
+	return patchAnnotations(client, event, "stamping", map[string]string{
+		annotationPrefix + "puppet-last-verified": time.Now().UTC().Format(time.RFC3339),
+	})
+}
+
+// patchAnnotations merges the annotations into those of the event's entity,
+// the verb naming the update in the errors
+func patchAnnotations(client *httpclient.CoreClient, event *corev2.Event, verb string, annotations map[string]string) error {
+	patch := map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": annotations,
+		},
+	}
+	body, err := json.Marshal(patch)
+	if err != nil {
+		return err
+	}
+
+	entity := corev2.NewEntity(corev2.NewObjectMeta(event.Entity.Name, event.Entity.Namespace))
+	req, err := http.NewRequestWithContext(executionCtx, http.MethodPatch, client.Config.URL+entity.URIPath(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("Key %s", client.Config.APIKey))
+	req.Header.Set("Content-Type", "application/merge-patch+json")
+
+	resp, err := client.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := accessError(resp.StatusCode, "update", event.Entity.Namespace); err != nil {
+		return err
+	}
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("unexpected HTTP status %s while %s entity", http.StatusText(resp.StatusCode), verb)
+	}
+
+	return nil
+}
+
+// entitySilenced returns whether an active silencing entry targets the
+// event's entity, either silencing the event itself or all the checks of the
+// entity through its entity subscription
+func entitySilenced(event *corev2.Event) (bool, error) {
+	if event.IsSilenced() {
+		return true, nil
+	}
+	client, err := sensuClient(event.Entity.Namespace)
+	if err != nil {
+		return false, err
+	}
+
+	subscription := corev2.GetEntitySubscription(event.Entity.Name)
+	endpoint := fmt.Sprintf("%s/api/core/v2/namespaces/%s/silenced/subscriptions/%s",
+		client.Config.URL, url.PathEscape(event.Entity.Namespace), url.PathEscape(subscription))
+	req, err := http.NewRequestWithContext(executionCtx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("Key %s", client.Config.APIKey))
+
+	resp, err := client.HTTPClient.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return false, fmt.Errorf("unexpected HTTP status %s while listing silenced entries", http.StatusText(resp.StatusCode))
+	}
+	var entries []corev2.Silenced
+	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		return false, err
+	}
+
+	now := time.Now().Unix()
+	for _, entry := range entries {
+		// Entries silencing another check only are not about the entity
+		if entry.Check != "" && entry.Check != event.Check.Name {
+			continue
+		}
+		if entry.Begin <= now {
+			log.Printf("entity (%s/%s) is silenced by %q", event.Entity.Namespace, event.Entity.Name, entry.Name)
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// silenceEntity creates or replaces the silencing entry of all the checks of
+// the event's entity, through its entity subscription
+func silenceEntity(event *corev2.Event) error {
+	client, err := sensuClient(event.Entity.Namespace)
+	if err != nil {
+		return err
+	}
+
+	subscription := corev2.GetEntitySubscription(event.Entity.Name)
+	silenced := corev2.NewSilenced(corev2.NewObjectMeta("", event.Entity.Namespace))
+	silenced.Subscription = subscription
+	silenced.Name, _ = corev2.SilencedName(subscription, "")
+	silenced.Creator = handler.Name
+	silenced.Reason = "silenced by the decision hook of " + handler.Name
+	silenced.Expire = int64(handler.silenceExpire)
+	if silenced.Expire == 0 {
+		silenced.Expire = -1
+	}
+	body, err := json.Marshal(silenced)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(executionCtx, http.MethodPut, client.Config.URL+silenced.URIPath(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("Key %s", client.Config.APIKey))
+	req.Header.Set("Content-Type", "application/json")
+
+	log.Printf("silencing entity (%s/%s)\n", event.Entity.Namespace, event.Entity.Name)
+	resp, err := client.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := accessError(resp.StatusCode, "silence", event.Entity.Namespace); err != nil {
+		return err
+	}
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("unexpected HTTP status %s while silencing entity", http.StatusText(resp.StatusCode))
+	}
+	return nil
+}
+
+// fetchEntity fetches the named entity of the namespace, nil if it does not
+// exist
+func fetchEntity(namespace, name string) (*corev2.Entity, error) {
+	client, err := sensuClient(namespace)
+	if err != nil {
+		return nil, err
+	}
+	var entity corev2.Entity
+	found, err := getSensuResource(client, namespace, "entities/"+url.PathEscape(name), &entity)
+	if err != nil || !found {
+		return nil, err
+	}
+	return &entity, nil
+}
+
+// entityRecovered fetches the entity and its keepalive event again right
+// before deregistering it, and returns why the deregistration should be
+// skipped if the entity is gone or its agent came back since the event was
+// emitted, empty otherwise. This closes the window between the PuppetDB
+// lookup and the deregistration during which the agent can recover.
+func entityRecovered(event *corev2.Event) (string, error) {
+	client, err := sensuClient(event.Entity.Namespace)
+	if err != nil {
+		return "", err
+	}
+
+	var entity corev2.Entity
+	found, err := getSensuResource(client, event.Entity.Namespace, "entities/"+url.PathEscape(event.Entity.Name), &entity)
+	if err != nil {
+		return "", err
+	}
+	if !found {
+		return "the entity no longer exists", nil
+	}
+	if entity.LastSeen > event.Entity.LastSeen {
+		return "the agent was seen again", nil
+	}
+
+	var keepalive corev2.Event
+	found, err = getSensuResource(client, event.Entity.Namespace, fmt.Sprintf("events/%s/%s", url.PathEscape(event.Entity.Name), corev2.KeepaliveCheckName), &keepalive)
+	if err != nil {
+		return "", err
+	}
+	if found && keepalive.Check != nil && keepalive.Check.Status == 0 && keepalive.Timestamp > event.Timestamp {
+		return "the agent keepalive is passing again", nil
+	}
+	return "", nil
+}
+
+// entitySeenRecently fetches the entity right before deregistering it and
+// returns why the deregistration should be skipped if its agent was last seen
+// more recently than --min-last-seen ago, empty otherwise. The entity last
+// seen time is a liveness signal independent of the keepalive event which
+// triggered the handler. Entities never seen, like proxy entities, are not
+// kept.
+func entitySeenRecently(event *corev2.Event, now time.Time) (string, error) {
+	entity, err := fetchEntity(event.Entity.Namespace, event.Entity.Name)
+	if err != nil {
+		return "", err
+	}
+	if entity == nil {
+		return "the entity no longer exists", nil
+	}
+	if entity.LastSeen == 0 {
+		return "", nil
+	}
+	age := now.Sub(time.Unix(entity.LastSeen, 0))
+	if age < time.Duration(handler.minLastSeen)*time.Second {
+		return fmt.Sprintf("the agent was last seen %s ago", age.Round(time.Second)), nil
+	}
+	return "", nil
+}
+
+// entityPassingCheck fetches the events of the entity and returns why the
+// deregistration should be skipped if one of its checks, other than keepalive
+// and the trigger checks, passed within --passing-check-window, empty
+// otherwise. A check passing shows the host is alive when its keepalives are
+// blocked, by a firewall for instance.
+func entityPassingCheck(event *corev2.Event, now time.Time) (string, error) {
+	client, err := sensuClient(event.Entity.Namespace)
+	if err != nil {
+		return "", err
+	}
+
+	var events []corev2.Event
+	if _, err := getSensuResource(client, event.Entity.Namespace, "events/"+url.PathEscape(event.Entity.Name), &events); err != nil {
+		return "", err
+	}
+	window := time.Duration(handler.passingCheckWindow) * time.Second
+	for _, e := range events {
+		if e.Check == nil || e.Check.Status != 0 || e.Check.Name == corev2.KeepaliveCheckName || isTriggerCheck(e.Check.Name) {
+			continue
+		}
+		executed := e.Check.Executed
+		if executed == 0 {
+			executed = e.Timestamp
+		}
+		if age := now.Sub(time.Unix(executed, 0)); age < window {
+			return fmt.Sprintf("check %q passed %s ago", e.Check.Name, age.Round(time.Second)), nil
+		}
+	}
+	return "", nil
+}
+
+// checkPermissions verifies that the Sensu API credentials are allowed to
+// take the configured action on the entities of the namespace, so that the
+// handler fails with a clear message before querying PuppetDB rather than
+// when deregistering. It deletes or patches an entity which does not exist:
+// the API authorizes the request before looking the entity up, and answers
+// with a not found status when it is allowed.
+func checkPermissions(namespace string) error {
+	client, err := sensuClient(namespace)
+	if err != nil {
+		return err
+	}
+
+	method, verb, body := http.MethodDelete, "delete", []byte(nil)
+	if handler.action == actionTombstone {
+		method, verb, body = http.MethodPatch, "update", []byte("{}")
+	}
+	name := fmt.Sprintf("%s-permission-check-%s", handler.Name, uuid.New())
+	entity := corev2.NewEntity(corev2.NewObjectMeta(name, namespace))
+	req, err := http.NewRequestWithContext(executionCtx, method, client.Config.URL+entity.URIPath(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("Key %s", client.Config.APIKey))
+	if body != nil {
+		req.Header.Set("Content-Type", "application/merge-patch+json")
+	}
+
+	resp, err := client.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := accessError(resp.StatusCode, verb, namespace); err != nil {
+		return err
+	}
+	if resp.StatusCode >= 400 && resp.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("unexpected HTTP status %s while checking the Sensu API permissions", http.StatusText(resp.StatusCode))
+	}
+	return nil
+}
+
+// getSensuResource decodes the core/v2 resource at the path of the namespace
+// into v, and returns false if it does not exist
+func getSensuResource(client *httpclient.CoreClient, namespace, resourcePath string, v interface{}) (bool, error) {
+	endpoint := fmt.Sprintf("%s/api/core/v2/namespaces/%s/%s", client.Config.URL, url.PathEscape(namespace), resourcePath)
+	req, err := http.NewRequestWithContext(executionCtx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("Key %s", client.Config.APIKey))
+
+	resp, err := client.HTTPClient.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return false, nil
+	}
+	if err := accessError(resp.StatusCode, "get", namespace); err != nil {
+		return false, err
+	}
+	if resp.StatusCode >= 400 {
+		return false, fmt.Errorf("unexpected HTTP status %s while fetching %s", http.StatusText(resp.StatusCode), resourcePath)
+	}
+	return true, json.NewDecoder(resp.Body).Decode(v)
+}
@@ -0,0 +1,550 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	corev2 "github.com/sensu/core/v2"
+)
+
+func Test_deregisterEntity(t *testing.T) {
+	saveHandler(t)
+	tests := []struct {
+		name       string
+		statusCode int
+		wantErr    bool
+		wantAccess bool
+	}{
+		{
+			name:       "entity deleted",
+			statusCode: http.StatusNoContent,
+		},
+		{
+			name:       "entity not deleted",
+			statusCode: http.StatusNotFound,
+		},
+		{
+			name:       "unexpected status code",
+			statusCode: http.StatusInternalServerError,
+			wantErr:    true,
+		},
+		{
+			name:       "invalid API key",
+			statusCode: http.StatusUnauthorized,
+			wantErr:    true,
+			wantAccess: true,
+		},
+		{
+			name:       "missing delete permission",
+			statusCode: http.StatusForbidden,
+			wantErr:    true,
+			wantAccess: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.statusCode)
+			}))
+			defer ts.Close()
+			handler.sensuAPIURL = ts.URL
+
+			event := corev2.FixtureEvent("foo", "check-cpu")
+			err := deregisterEntity(event)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("deregisterEntity() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			var accessErr sensuAccessError
+			if errors.As(err, &accessErr) != tt.wantAccess {
+				t.Errorf("deregisterEntity() error = %v, want access error %v", err, tt.wantAccess)
+			}
+		})
+	}
+}
+
+func Test_tombstoneEntity(t *testing.T) {
+	saveHandler(t)
+	tests := []struct {
+		name       string
+		statusCode int
+		wantErr    bool
+	}{
+		{
+			name:       "entity tombstoned",
+			statusCode: http.StatusOK,
+		},
+		{
+			name:       "unexpected status code",
+			statusCode: http.StatusInternalServerError,
+			wantErr:    true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var patch struct {
+				Metadata struct {
+					Annotations map[string]string `json:"annotations"`
+				} `json:"metadata"`
+			}
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Method != http.MethodPatch {
+					t.Errorf("tombstoneEntity() method = %v, want %v", r.Method, http.MethodPatch)
+				}
+				if r.URL.Path != "/api/core/v2/namespaces/default/entities/foo" {
+					t.Errorf("tombstoneEntity() path = %v", r.URL.Path)
+				}
+				_ = json.NewDecoder(r.Body).Decode(&patch)
+				w.WriteHeader(tt.statusCode)
+			}))
+			defer ts.Close()
+			handler.sensuAPIURL = ts.URL
+
+			event := corev2.FixtureEvent("foo", "check-cpu")
+			lookup := nodeLookup{name: "foo", status: nodeNotFound}
+			if err := tombstoneEntity(event, lookup); (err != nil) != tt.wantErr {
+				t.Errorf("tombstoneEntity() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got := patch.Metadata.Annotations[annotationPrefix+"puppet-lookup-result"]; got != "foo: not-found" {
+				t.Errorf("tombstoneEntity() lookup result = %q", got)
+			}
+			if patch.Metadata.Annotations[annotationPrefix+"deregistered-at"] == "" {
+				t.Error("tombstoneEntity() missing deregistered-at annotation")
+			}
+		})
+	}
+}
+
+func Test_stampLastVerified(t *testing.T) {
+	saveHandler(t)
+	var patch struct {
+		Metadata struct {
+			Annotations map[string]string `json:"annotations"`
+		} `json:"metadata"`
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPatch || r.URL.Path != "/api/core/v2/namespaces/default/entities/foo" {
+			t.Errorf("stampLastVerified() request = %s %s", r.Method, r.URL.Path)
+		}
+		_ = json.NewDecoder(r.Body).Decode(&patch)
+	}))
+	defer ts.Close()
+	handler.sensuAPIURL = ts.URL
+
+	if err := stampLastVerified(corev2.FixtureEvent("foo", "keepalive")); err != nil {
+		t.Fatal(err)
+	}
+	verified, err := time.Parse(time.RFC3339, patch.Metadata.Annotations[annotationPrefix+"puppet-last-verified"])
+	if err != nil {
+		t.Fatalf("stampLastVerified() invalid puppet-last-verified annotation: %v", err)
+	}
+	if time.Since(verified) > time.Minute {
+		t.Errorf("stampLastVerified() puppet-last-verified = %s", verified)
+	}
+	if len(patch.Metadata.Annotations) != 1 {
+		t.Errorf("stampLastVerified() annotations = %v, want only puppet-last-verified", patch.Metadata.Annotations)
+	}
+}
+
+func Test_sensuClient(t *testing.T) {
+	certFile, keyFile := writeKeyPair(t)
+	setHandler(t, Handler{
+		puppetCert:         certFile,
+		puppetKey:          keyFile,
+		sensuAPIURL:        "https://localhost:8080",
+		sensuUsePuppetCert: true,
+	})
+
+	client, err := sensuClient("default")
+	if err != nil {
+		t.Fatalf("sensuClient() error = %v", err)
+	}
+	counted, ok := client.HTTPClient.Transport.(countTransport)
+	if !ok {
+		t.Fatal("sensuClient() does not count its requests")
+	}
+	transport, ok := counted.base.(*http.Transport)
+	if !ok || transport.TLSClientConfig == nil {
+		t.Fatal("sensuClient() has no TLS configuration")
+	}
+	if len(transport.TLSClientConfig.Certificates) != 1 {
+		t.Errorf("sensuClient() client certificates = %d, want 1", len(transport.TLSClientConfig.Certificates))
+	}
+
+	handler.puppetKey = "missing.pem"
+	if _, err := sensuClient("default"); err == nil {
+		t.Error("sensuClient() expected an error with a missing private key")
+	}
+}
+
+func Test_entitySilenced(t *testing.T) {
+	tests := []struct {
+		name     string
+		silenced bool
+		entries  []corev2.Silenced
+		want     bool
+	}{
+		{
+			name:     "silenced event",
+			silenced: true,
+			want:     true,
+		},
+		{
+			name: "no silencing entry",
+			want: false,
+		},
+		{
+			name:    "silencing all checks",
+			entries: []corev2.Silenced{{ObjectMeta: corev2.ObjectMeta{Name: "entity:foo:*"}, Subscription: "entity:foo"}},
+			want:    true,
+		},
+		{
+			name:    "silencing another check",
+			entries: []corev2.Silenced{{ObjectMeta: corev2.ObjectMeta{Name: "entity:foo:check-cpu"}, Subscription: "entity:foo", Check: "check-cpu"}},
+			want:    false,
+		},
+		{
+			name:    "scheduled silencing",
+			entries: []corev2.Silenced{{ObjectMeta: corev2.ObjectMeta{Name: "entity:foo:*"}, Subscription: "entity:foo", Begin: time.Now().Add(time.Hour).Unix()}},
+			want:    false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != "/api/core/v2/namespaces/default/silenced/subscriptions/entity:foo" {
+					t.Errorf("entitySilenced() path = %v", r.URL.Path)
+				}
+				entries := tt.entries
+				if entries == nil {
+					entries = []corev2.Silenced{}
+				}
+				_ = json.NewEncoder(w).Encode(entries)
+			}))
+			defer ts.Close()
+			setHandler(t, Handler{sensuAPIURL: ts.URL})
+
+			event := corev2.FixtureEvent("foo", "keepalive")
+			if tt.silenced {
+				event.Check.Silenced = []string{"entity:foo:*"}
+			}
+			got, err := entitySilenced(event)
+			if err != nil {
+				t.Fatalf("entitySilenced() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("entitySilenced() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_entityRecovered(t *testing.T) {
+	event := corev2.FixtureEvent("foo", "keepalive")
+	event.Entity.LastSeen = 1000
+	event.Timestamp = 1000
+
+	tests := []struct {
+		name      string
+		entity    *corev2.Entity
+		keepalive *corev2.Event
+		want      string
+	}{
+		{
+			name:   "deleted entity",
+			entity: nil,
+			want:   "the entity no longer exists",
+		},
+		{
+			name:   "entity seen again",
+			entity: &corev2.Entity{LastSeen: 2000},
+			want:   "the agent was seen again",
+		},
+		{
+			name:      "passing keepalive",
+			entity:    &corev2.Entity{LastSeen: 1000},
+			keepalive: &corev2.Event{Timestamp: 2000, Check: &corev2.Check{Status: 0}},
+			want:      "the agent keepalive is passing again",
+		},
+		{
+			name:      "failing keepalive",
+			entity:    &corev2.Entity{LastSeen: 1000},
+			keepalive: &corev2.Event{Timestamp: 2000, Check: &corev2.Check{Status: 2}},
+			want:      "",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				var v interface{}
+				switch r.URL.Path {
+				case "/api/core/v2/namespaces/default/entities/foo":
+					v = tt.entity
+				case "/api/core/v2/namespaces/default/events/foo/keepalive":
+					v = tt.keepalive
+				default:
+					t.Errorf("entityRecovered() path = %v", r.URL.Path)
+				}
+				if v == nil || reflect.ValueOf(v).IsNil() {
+					http.NotFound(w, r)
+					return
+				}
+				_ = json.NewEncoder(w).Encode(v)
+			}))
+			defer ts.Close()
+			setHandler(t, Handler{sensuAPIURL: ts.URL})
+
+			got, err := entityRecovered(event)
+			if err != nil {
+				t.Fatalf("entityRecovered() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("entityRecovered() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_checkPermissions(t *testing.T) {
+	saveHandler(t)
+	tests := []struct {
+		name       string
+		action     string
+		status     int
+		wantMethod string
+		wantErr    string
+	}{
+		{
+			name:       "allowed to delete",
+			action:     actionDelete,
+			status:     http.StatusNotFound,
+			wantMethod: http.MethodDelete,
+		},
+		{
+			name:       "denied delete",
+			action:     actionDelete,
+			status:     http.StatusForbidden,
+			wantMethod: http.MethodDelete,
+			wantErr:    `allowed to delete entities in namespace "default"`,
+		},
+		{
+			name:       "denied update",
+			action:     actionTombstone,
+			status:     http.StatusForbidden,
+			wantMethod: http.MethodPatch,
+			wantErr:    `allowed to update entities in namespace "default"`,
+		},
+		{
+			name:       "rejected credentials",
+			action:     actionDelete,
+			status:     http.StatusUnauthorized,
+			wantMethod: http.MethodDelete,
+			wantErr:    "rejected the credentials",
+		},
+		{
+			name:       "server error",
+			action:     actionDelete,
+			status:     http.StatusInternalServerError,
+			wantMethod: http.MethodDelete,
+			wantErr:    "unexpected HTTP status",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Method != tt.wantMethod {
+					t.Errorf("checkPermissions() method = %v, want %v", r.Method, tt.wantMethod)
+				}
+				if !strings.HasPrefix(r.URL.Path, "/api/core/v2/namespaces/default/entities/sensu-puppet-handler-permission-check-") {
+					t.Errorf("checkPermissions() path = %v", r.URL.Path)
+				}
+				w.WriteHeader(tt.status)
+			}))
+			defer ts.Close()
+			setHandler(t, Handler{sensuAPIURL: ts.URL, action: tt.action})
+			handler.Name = "sensu-puppet-handler"
+
+			err := checkPermissions("default")
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("checkPermissions() error = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("checkPermissions() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_silenceEntity(t *testing.T) {
+	var got corev2.Silenced
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut || r.URL.EscapedPath() != "/api/core/v2/namespaces/default/silenced/entity:foo:%2A" {
+			t.Errorf("silenceEntity() request = %v %v", r.Method, r.URL.EscapedPath())
+		}
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Error(err)
+		}
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer ts.Close()
+	setHandler(t, Handler{sensuAPIURL: ts.URL, silenceExpire: 3600})
+	handler.Name = "sensu-puppet-handler"
+
+	if err := silenceEntity(corev2.FixtureEvent("foo", "keepalive")); err != nil {
+		t.Fatalf("silenceEntity() error = %v", err)
+	}
+	if got.Subscription != "entity:foo" || got.Check != "" || got.Expire != 3600 || got.Creator != "sensu-puppet-handler" {
+		t.Errorf("silenceEntity() entry = %+v", got)
+	}
+}
+
+func Test_sensuAPIURLFor(t *testing.T) {
+	setHandler(t, Handler{
+		sensuAPIURL:      "http://localhost:8080",
+		sensuAPIKey:      "default-key",
+		namespaceAPIURLs: map[string]string{"staging": "https://staging.example.com:8080"},
+	})
+
+	for namespace, want := range map[string]string{
+		"staging": "https://staging.example.com:8080",
+		"default": "http://localhost:8080",
+	} {
+		client, err := sensuClient(namespace)
+		if err != nil {
+			t.Fatalf("sensuClient(%q) error = %v", namespace, err)
+		}
+		if client.Config.URL != want {
+			t.Errorf("sensuClient(%q) URL = %q, want %q", namespace, client.Config.URL, want)
+		}
+	}
+}
+
+func Test_entitySeenRecently(t *testing.T) {
+	saveHandler(t)
+	event := corev2.FixtureEvent("foo", "keepalive")
+	now := time.Unix(10000, 0)
+
+	tests := []struct {
+		name   string
+		entity *corev2.Entity
+		want   string
+	}{
+		{
+			name:   "deleted entity",
+			entity: nil,
+			want:   "the entity no longer exists",
+		},
+		{
+			name:   "recently seen",
+			entity: &corev2.Entity{LastSeen: 9700},
+			want:   "the agent was last seen 5m0s ago",
+		},
+		{
+			name:   "not seen recently",
+			entity: &corev2.Entity{LastSeen: 1000},
+			want:   "",
+		},
+		{
+			name:   "never seen",
+			entity: &corev2.Entity{},
+			want:   "",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != "/api/core/v2/namespaces/default/entities/foo" {
+					t.Errorf("entitySeenRecently() path = %v", r.URL.Path)
+				}
+				if tt.entity == nil {
+					http.NotFound(w, r)
+					return
+				}
+				_ = json.NewEncoder(w).Encode(tt.entity)
+			}))
+			defer ts.Close()
+			setHandler(t, Handler{sensuAPIURL: ts.URL, minLastSeen: 3600})
+
+			got, err := entitySeenRecently(event, now)
+			if err != nil {
+				t.Fatalf("entitySeenRecently() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("entitySeenRecently() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_entityPassingCheck(t *testing.T) {
+	saveHandler(t)
+	event := corev2.FixtureEvent("foo", "keepalive")
+	now := time.Unix(10000, 0)
+	check := func(name string, status uint32, executed int64) corev2.Event {
+		return corev2.Event{Check: &corev2.Check{ObjectMeta: corev2.ObjectMeta{Name: name}, Status: status, Executed: executed}}
+	}
+
+	tests := []struct {
+		name   string
+		events []corev2.Event
+		want   string
+	}{
+		{
+			name:   "recently passing check",
+			events: []corev2.Event{check("keepalive", 2, 9900), check("check-cpu", 0, 9900)},
+			want:   `check "check-cpu" passed 1m40s ago`,
+		},
+		{
+			name:   "failing check",
+			events: []corev2.Event{check("check-cpu", 2, 9900)},
+			want:   "",
+		},
+		{
+			name:   "check passing long ago",
+			events: []corev2.Event{check("check-cpu", 0, 1000)},
+			want:   "",
+		},
+		{
+			name:   "passing keepalive",
+			events: []corev2.Event{check("keepalive", 0, 9900)},
+			want:   "",
+		},
+		{
+			name:   "no events",
+			events: nil,
+			want:   "",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != "/api/core/v2/namespaces/default/events/foo" {
+					t.Errorf("entityPassingCheck() path = %v", r.URL.Path)
+				}
+				if tt.events == nil {
+					http.NotFound(w, r)
+					return
+				}
+				_ = json.NewEncoder(w).Encode(tt.events)
+			}))
+			defer ts.Close()
+			setHandler(t, Handler{sensuAPIURL: ts.URL, triggerChecks: []string{"keepalive"}, passingCheckWindow: 600})
+
+			got, err := entityPassingCheck(event, now)
+			if err != nil {
+				t.Fatalf("entityPassingCheck() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("entityPassingCheck() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const nodeRetired = "retired"
+
+// serviceNowResponse is the response of the ServiceNow Table API
+type serviceNowResponse struct {
+	Result []map[string]string `json:"result"`
+}
+
+// lookupCMDB queries the ServiceNow CMDB for the configuration item matching
+// the Puppet node name, and reports it as not found or retired when the CI is
+// absent or its install status is one of the configured retired statuses
+func lookupCMDB(name string) (nodeLookup, error) {
+	lookup := nodeLookup{name: name}
+
+	// Encoded queries cannot escape the caret, which would start another
+	// clause matching other CIs
+	if strings.Contains(name, "^") {
+		return lookup, fmt.Errorf("invalid ServiceNow CI name %q: encoded queries cannot contain ^", name)
+	}
+	query := url.Values{}
+	query.Set("sysparm_query", fmt.Sprintf("%s=%s", handler.serviceNowNameField, name))
+	query.Set("sysparm_fields", strings.Join([]string{handler.serviceNowNameField, "install_status"}, ","))
+	query.Set("sysparm_limit", "1")
+	endpoint := fmt.Sprintf("%s/api/now/table/%s?%s", strings.TrimRight(handler.serviceNowURL, "/"), handler.serviceNowTable, query.Encode())
+
+	req, err := http.NewRequestWithContext(executionCtx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return lookup, err
+	}
+	req.SetBasicAuth(handler.serviceNowUsername, handler.serviceNowPassword)
+	req.Header.Set("Accept", "application/json")
+
+	client := &http.Client{Transport: limitedTransport(withConnectionTrace(nil)), Timeout: requestTimeout()}
+	resp, err := client.Do(req)
+	if err != nil {
+		log.Printf("error getting ServiceNow CI: %s", err)
+		return lookup, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return lookup, fmt.Errorf("unexpected HTTP status %s while querying ServiceNow", http.StatusText(resp.StatusCode))
+	}
+
+	var result serviceNowResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		log.Printf("ServiceNow returned invalid response: %s", err)
+		return lookup, err
+	}
+
+	if len(result.Result) == 0 {
+		log.Printf("ServiceNow CI %q does not exist", name)
+		lookup.status = nodeNotFound
+		return lookup, nil
+	}
+	status := result.Result[0]["install_status"]
+	for _, retired := range handler.serviceNowRetiredStatuses {
+		if status == retired {
+			log.Printf("ServiceNow CI %q is retired (install status %s)", name, status)
+			lookup.status = nodeRetired
+			return lookup, nil
+		}
+	}
+
+	log.Printf("ServiceNow CI %q exists (install status %s)", name, status)
+	lookup.status = nodeActive
+	return lookup, nil
+}
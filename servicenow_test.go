@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func Test_lookupCMDB(t *testing.T) {
+	tests := []struct {
+		name       string
+		statusCode int
+		result     []map[string]string
+		wantStatus string
+		wantErr    bool
+	}{
+		{
+			name:       "CI exists",
+			statusCode: http.StatusOK,
+			result:     []map[string]string{{"name": "foo", "install_status": "1"}},
+			wantStatus: nodeActive,
+		},
+		{
+			name:       "CI is retired",
+			statusCode: http.StatusOK,
+			result:     []map[string]string{{"name": "foo", "install_status": "7"}},
+			wantStatus: nodeRetired,
+		},
+		{
+			name:       "CI does not exist",
+			statusCode: http.StatusOK,
+			result:     []map[string]string{},
+			wantStatus: nodeNotFound,
+		},
+		{
+			name:       "unexpected status code",
+			statusCode: http.StatusUnauthorized,
+			wantErr:    true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != "/api/now/table/cmdb_ci_server" {
+					t.Errorf("lookupCMDB() path = %v", r.URL.Path)
+				}
+				if got := r.URL.Query().Get("sysparm_query"); got != "name=foo" {
+					t.Errorf("lookupCMDB() query = %v", got)
+				}
+				if user, pass, _ := r.BasicAuth(); user != "admin" || pass != "secret" {
+					t.Errorf("lookupCMDB() credentials = %s:%s", user, pass)
+				}
+				w.WriteHeader(tt.statusCode)
+				_ = json.NewEncoder(w).Encode(serviceNowResponse{Result: tt.result})
+			}))
+			defer ts.Close()
+			setHandler(t, Handler{
+				serviceNowURL:             ts.URL,
+				serviceNowUsername:        "admin",
+				serviceNowPassword:        "secret",
+				serviceNowTable:           "cmdb_ci_server",
+				serviceNowNameField:       "name",
+				serviceNowRetiredStatuses: []string{"7", "100"},
+			})
+
+			got, err := lookupCMDB("foo")
+			if (err != nil) != tt.wantErr {
+				t.Errorf("lookupCMDB() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if got.status != tt.wantStatus {
+				t.Errorf("lookupCMDB() = %v, want %v", got.status, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func Test_lookupCMDB_encodedQuery(t *testing.T) {
+	var requests int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		_ = json.NewEncoder(w).Encode(serviceNowResponse{Result: []map[string]string{{"name": "bar", "install_status": "1"}}})
+	}))
+	defer ts.Close()
+	setHandler(t, Handler{serviceNowURL: ts.URL, serviceNowTable: "cmdb_ci_server", serviceNowNameField: "name"})
+
+	// The name would otherwise match any active CI
+	if _, err := lookupCMDB("foo^ORinstall_status=1"); err == nil {
+		t.Error("lookupCMDB() expected an error")
+	}
+	if requests != 0 {
+		t.Errorf("lookupCMDB() sent %d requests, want none", requests)
+	}
+}
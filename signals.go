@@ -0,0 +1,36 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// executionCtx is cancelled when the handler is asked to terminate, aborting
+// the in-flight requests
+var executionCtx = context.Background()
+
+// handleSignals cancels the execution context on SIGINT or SIGTERM, so that
+// a handler killed by a pipeline timeout stops its requests and returns an
+// error instead of being interrupted midway. The returned function restores
+// the default behavior.
+func handleSignals() func() {
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		select {
+		case sig := <-signals:
+			log.Printf("received %s, cancelling the handler execution", sig)
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	executionCtx = ctx
+	return func() {
+		signal.Stop(signals)
+		cancel()
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"syscall"
+	"testing"
+	"time"
+
+	corev2 "github.com/sensu/core/v2"
+)
+
+func Test_handleSignals(t *testing.T) {
+	saveHandler(t)
+	stop := handleSignals()
+	defer func() {
+		stop()
+		executionCtx = context.Background()
+	}()
+
+	pending := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(pending)
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+		_ = json.NewEncoder(w).Encode([]interface{}{})
+	}))
+	defer ts.Close()
+	endpoint := handler.endpoint
+	handler.endpoint = ts.URL
+	defer func() { handler.endpoint = endpoint }()
+
+	go func() {
+		<-pending
+		_ = syscall.Kill(syscall.Getpid(), syscall.SIGTERM)
+	}()
+
+	event := corev2.FixtureEvent("foo", "check-cpu")
+	if _, err := lookupPuppetNode(ts.Client(), event); err == nil {
+		t.Fatal("lookupPuppetNode() expected an error after SIGTERM")
+	}
+	if executionCtx.Err() == nil {
+		t.Error("handleSignals() did not cancel the execution context")
+	}
+}
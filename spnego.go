@@ -0,0 +1,139 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/jcmturner/gokrb5/v8/client"
+	"github.com/jcmturner/gokrb5/v8/config"
+	"github.com/jcmturner/gokrb5/v8/credentials"
+	"github.com/jcmturner/gokrb5/v8/keytab"
+	"github.com/jcmturner/gokrb5/v8/spnego"
+)
+
+// defaultKrb5Config is the default path of the Kerberos configuration
+const defaultKrb5Config = "/etc/krb5.conf"
+
+// kerberosClient memoizes the Kerberos client shared by the PuppetDB and Sensu
+// API clients, so that the handler logs in once per execution
+var kerberosClient *client.Client
+
+// kerberosClientMu guards kerberosClient against the concurrent workers of the
+// bulk subcommands
+var kerberosClientMu sync.Mutex
+
+// spnegoTransport authenticates requests with a Kerberos service ticket
+// negotiated through SPNEGO, for the PuppetDB and Sensu endpoints published
+// through enterprise SSO reverse proxies
+type spnegoTransport struct {
+	base http.RoundTripper
+	// host is the host of the endpoint the tickets are sent to
+	host string
+}
+
+// newSPNEGOTransport returns a SPNEGO transport authenticating the requests
+// to the host with the host's keytab or credential cache
+func newSPNEGOTransport(base http.RoundTripper, host string) (*spnegoTransport, error) {
+	if _, err := krb5Client(); err != nil {
+		return nil, err
+	}
+	return &spnegoTransport{base: base, host: host}, nil
+}
+
+func (t *spnegoTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// Keep the ticket from the hosts the requests are redirected to
+	if !sendCredentials(req, t.host) {
+		return t.base.RoundTrip(req)
+	}
+	cl, err := krb5Client()
+	if err != nil {
+		return nil, err
+	}
+	// The service principal is named after the host, which the library
+	// would otherwise canonicalize in the Host header of the request
+	req = req.Clone(req.Context())
+	if err := spnego.SetSPNEGOHeader(cl, req, "HTTP/"+req.URL.Hostname()); err != nil {
+		return nil, fmt.Errorf("could not negotiate SPNEGO with %s: %s", req.URL.Host, err)
+	}
+	return t.base.RoundTrip(req)
+}
+
+// krb5Client returns the Kerberos client, logging in with the keytab of
+// --krb5-principal when set, or with the tickets of the credential cache
+func krb5Client() (*client.Client, error) {
+	kerberosClientMu.Lock()
+	defer kerberosClientMu.Unlock()
+	if kerberosClient != nil {
+		return kerberosClient, nil
+	}
+	cfg, err := config.Load(handler.krb5Config)
+	if err != nil {
+		return nil, fmt.Errorf("could not read the Kerberos configuration: %s", err)
+	}
+
+	var cl *client.Client
+	if handler.krb5Keytab != "" {
+		kt, err := keytab.Load(handler.krb5Keytab)
+		if err != nil {
+			return nil, fmt.Errorf("could not read the Kerberos keytab: %s", err)
+		}
+		user, realm := splitPrincipal(handler.krb5Principal, cfg.LibDefaults.DefaultRealm)
+		cl = client.NewWithKeytab(user, realm, kt, cfg, client.DisablePAFXFAST(true))
+	} else {
+		path, err := credentialCachePath()
+		if err != nil {
+			return nil, err
+		}
+		ccache, err := credentials.LoadCCache(path)
+		if err != nil {
+			return nil, fmt.Errorf("could not read the Kerberos credential cache: %s", err)
+		}
+		if cl, err = client.NewFromCCache(ccache, cfg, client.DisablePAFXFAST(true)); err != nil {
+			return nil, fmt.Errorf("could not use the Kerberos credential cache: %s", err)
+		}
+	}
+	kerberosClient = cl
+	return cl, nil
+}
+
+// splitPrincipal returns the user and realm of the principal, in the default
+// realm unless given
+func splitPrincipal(principal, defaultRealm string) (string, string) {
+	if i := strings.LastIndex(principal, "@"); i >= 0 {
+		return principal[:i], principal[i+1:]
+	}
+	return principal, defaultRealm
+}
+
+// credentialCachePath returns the path of the credential cache, named by
+// KRB5CCNAME as kinit does. Only the file caches can be read.
+func credentialCachePath() (string, error) {
+	name := os.Getenv("KRB5CCNAME")
+	if name == "" {
+		return fmt.Sprintf("/tmp/krb5cc_%d", os.Getuid()), nil
+	}
+	if i := strings.Index(name, ":"); i >= 0 {
+		if kind := name[:i]; kind != "FILE" {
+			return "", fmt.Errorf("unsupported Kerberos credential cache type %q, only FILE caches are supported", kind)
+		}
+		name = name[i+1:]
+	}
+	return name, nil
+}
+
+// validateKerberos validates the options of the SPNEGO authentication
+func validateKerberos() error {
+	if handler.krb5Keytab != "" && handler.krb5Principal == "" {
+		return errors.New("the Kerberos principal of the keytab is required")
+	}
+	if handler.krb5Keytab == "" {
+		if _, err := credentialCachePath(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jcmturner/gokrb5/v8/iana/etypeID"
+	"github.com/jcmturner/gokrb5/v8/keytab"
+)
+
+func Test_splitPrincipal(t *testing.T) {
+	tests := []struct {
+		principal string
+		wantUser  string
+		wantRealm string
+	}{
+		{principal: "sensu", wantUser: "sensu", wantRealm: "EXAMPLE.COM"},
+		{principal: "sensu@CORP.EXAMPLE.COM", wantUser: "sensu", wantRealm: "CORP.EXAMPLE.COM"},
+		{principal: "HTTP/sensu.example.com@CORP.EXAMPLE.COM", wantUser: "HTTP/sensu.example.com", wantRealm: "CORP.EXAMPLE.COM"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.principal, func(t *testing.T) {
+			user, realm := splitPrincipal(tt.principal, "EXAMPLE.COM")
+			if user != tt.wantUser || realm != tt.wantRealm {
+				t.Errorf("splitPrincipal() = %q, %q, want %q, %q", user, realm, tt.wantUser, tt.wantRealm)
+			}
+		})
+	}
+}
+
+func Test_credentialCachePath(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     string
+		want    string
+		wantErr bool
+	}{
+		{name: "path", env: "/var/lib/sensu/krb5cc", want: "/var/lib/sensu/krb5cc"},
+		{name: "file cache", env: "FILE:/var/lib/sensu/krb5cc", want: "/var/lib/sensu/krb5cc"},
+		{name: "keyring cache", env: "KEYRING:persistent:998", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("KRB5CCNAME", tt.env)
+			got, err := credentialCachePath()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("credentialCachePath() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("credentialCachePath() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_spnegoTransport(t *testing.T) {
+	savedClient := kerberosClient
+	defer func() { kerberosClient = savedClient }()
+	kerberosClient = nil
+
+	var requests int
+	var gotAuth string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		gotAuth = r.Header.Get("Authorization")
+	}))
+	defer ts.Close()
+
+	// A keytab and a KDC which cannot be reached
+	dir := t.TempDir()
+	conf := filepath.Join(dir, "krb5.conf")
+	if err := os.WriteFile(conf, []byte("[libdefaults]\n  default_realm = EXAMPLE.COM\n  dns_lookup_kdc = false\n[realms]\n  EXAMPLE.COM = {\n    kdc = 127.0.0.1:1\n  }\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	kt := keytab.New()
+	if err := kt.AddEntry("sensu", "EXAMPLE.COM", "secret", time.Now(), 1, etypeID.AES256_CTS_HMAC_SHA1_96); err != nil {
+		t.Fatal(err)
+	}
+	b, err := kt.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ktFile := filepath.Join(dir, "sensu.keytab")
+	if err := os.WriteFile(ktFile, b, 0600); err != nil {
+		t.Fatal(err)
+	}
+	setHandler(t, Handler{krb5Config: conf, krb5Keytab: ktFile, krb5Principal: "sensu"})
+
+	// The requests to other hosts are not negotiated
+	client := &http.Client{Transport: &spnegoTransport{base: http.DefaultTransport, host: "puppetdb.example.com"}}
+	resp, err := client.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if requests != 1 || gotAuth != "" {
+		t.Errorf("request to another host sent Authorization %q", gotAuth)
+	}
+
+	// A failed negotiation fails the request rather than sending it without
+	// credentials
+	transport, err := newSPNEGOTransport(http.DefaultTransport, urlHost(ts.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client = &http.Client{Transport: transport}
+	if _, err := client.Get(ts.URL); err == nil {
+		t.Error("RoundTrip() expected a negotiation error")
+	}
+	if requests != 1 {
+		t.Errorf("RoundTrip() sent %d requests after the failed negotiation, want none", requests-1)
+	}
+}
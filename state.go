@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+)
+
+// readState decodes the named state file from the state directory into v. A
+// missing state file is not an error and leaves v untouched.
+func readState(name string, v interface{}) error {
+	b, err := os.ReadFile(filepath.Join(handler.stateDir, name))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// writeState encodes v into the named state file of the state directory. The
+// file is replaced atomically so concurrent handler executions never read a
+// partially written state.
+func writeState(name string, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return writeStateFile(name, b)
+}
+
+// writeStateFile atomically replaces the named state file of the state
+// directory with b
+func writeStateFile(name string, b []byte) error {
+	if err := os.MkdirAll(handler.stateDir, 0700); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(handler.stateDir, name+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(handler.stateDir, name))
+}
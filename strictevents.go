@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+
+	corev2 "github.com/sensu/core/v2"
+)
+
+var (
+	// rawEvent is the event JSON the SDK read from stdin, captured by
+	// captureEvent and complete once rawEventDone is closed
+	rawEvent     []byte
+	rawEventErr  error
+	rawEventDone chan struct{}
+
+	eventType       = reflect.TypeOf(corev2.Event{})
+	unmarshalerType = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+)
+
+// captureEvent interposes a pipe between stdin and the SDK, which reads the
+// event from stdin on its own, so that the event JSON is available to the
+// strict validation. It must be called before the SDK handler is created.
+func captureEvent() {
+	stdin := os.Stdin
+	r, w, err := os.Pipe()
+	if err != nil {
+		log.Printf("could not capture the event: %s", err)
+		return
+	}
+	os.Stdin = r
+	done := make(chan struct{})
+	rawEventDone = done
+	go func() {
+		defer close(done)
+		var buf bytes.Buffer
+		_, err := io.Copy(io.MultiWriter(w, &buf), stdin)
+		w.Close()
+		rawEvent, rawEventErr = buf.Bytes(), err
+	}()
+}
+
+// capturedEvent returns the event JSON captured by captureEvent
+func capturedEvent() ([]byte, error) {
+	if rawEventDone == nil {
+		return nil, errors.New("the event was not captured")
+	}
+	<-rawEventDone
+	return rawEvent, rawEventErr
+}
+
+// validateStrictEvent validates the event JSON against the corev2 Event
+// schema. Unlike the SDK, which ignores the fields it does not know so that
+// events of newer agents are accepted, it rejects unknown fields and events
+// missing what the handler relies on, listing every offending field.
+func validateStrictEvent(data []byte) error {
+	var doc interface{}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return fmt.Errorf("invalid event JSON: %s", err)
+	}
+	if _, ok := doc.(map[string]interface{}); !ok {
+		return errors.New("invalid event: the event must be a JSON object")
+	}
+	problems := schemaErrors("", doc, eventType)
+
+	var event corev2.Event
+	if err := json.Unmarshal(data, &event); err != nil {
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &typeErr) && typeErr.Field != "" {
+			problems = append(problems, fmt.Sprintf("%s: cannot be a JSON %s, expected %s", typeErr.Field, typeErr.Value, typeErr.Type))
+		} else {
+			problems = append(problems, err.Error())
+		}
+	} else {
+		if event.Timestamp <= 0 {
+			problems = append(problems, "timestamp: must be set")
+		}
+		if event.Entity == nil {
+			problems = append(problems, "entity: must be set")
+		} else if event.Entity.Namespace == "" {
+			problems = append(problems, "entity.metadata.namespace: must be set")
+		}
+		if event.Check == nil {
+			problems = append(problems, "check: must be set")
+		}
+		if event.Entity != nil && event.Check != nil {
+			if err := event.Validate(); err != nil {
+				problems = append(problems, err.Error())
+			}
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid event: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// schemaErrors returns the fields of the decoded JSON value which have no
+// matching field in the given type, by path. The values are otherwise
+// checked by the regular unmarshaling.
+func schemaErrors(path string, value interface{}, t reflect.Type) []string {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	// Types decoding themselves may not follow their struct layout
+	if t != eventType && reflect.PtrTo(t).Implements(unmarshalerType) {
+		return nil
+	}
+
+	var problems []string
+	switch t.Kind() {
+	case reflect.Struct:
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		fields := jsonFields(t)
+		keys := make([]string, 0, len(object))
+		for key := range object {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			fieldPath := joinPath(path, key)
+			field, ok := fields[key]
+			if !ok {
+				problem := fieldPath + ": unknown field"
+				for name := range fields {
+					if strings.EqualFold(name, key) {
+						problem = fmt.Sprintf("%s: unknown field, did you mean %q?", fieldPath, name)
+						break
+					}
+				}
+				problems = append(problems, problem)
+				continue
+			}
+			problems = append(problems, schemaErrors(fieldPath, object[key], field)...)
+		}
+	case reflect.Slice, reflect.Array:
+		items, ok := value.([]interface{})
+		if !ok {
+			return nil
+		}
+		for i, item := range items {
+			problems = append(problems, schemaErrors(fmt.Sprintf("%s[%d]", path, i), item, t.Elem())...)
+		}
+	case reflect.Map:
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		keys := make([]string, 0, len(object))
+		for key := range object {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			problems = append(problems, schemaErrors(joinPath(path, key), object[key], t.Elem())...)
+		}
+	}
+	return problems
+}
+
+// jsonFields returns the types of the fields of a struct by JSON name,
+// following the encoding/json rules for tags and embedded structs
+func jsonFields(t reflect.Type) map[string]reflect.Type {
+	fields := make(map[string]reflect.Type)
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, _, _ := strings.Cut(tag, ",")
+		if field.Anonymous && name == "" {
+			embedded := field.Type
+			if embedded.Kind() == reflect.Ptr {
+				embedded = embedded.Elem()
+			}
+			if embedded.Kind() == reflect.Struct {
+				for name, typ := range jsonFields(embedded) {
+					if _, ok := fields[name]; !ok {
+						fields[name] = typ
+					}
+				}
+				continue
+			}
+		}
+		if !field.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		fields[name] = field.Type
+	}
+	return fields
+}
+
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	corev2 "github.com/sensu/core/v2"
+)
+
+func Test_validateStrictEvent(t *testing.T) {
+	event := corev2.FixtureEvent("web01", "keepalive")
+	valid, err := json.Marshal(event)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		data    string
+		wantErr []string
+	}{
+		{
+			name: "valid event",
+			data: string(valid),
+		},
+		{
+			name:    "unknown fields",
+			data:    strings.Replace(string(valid), `"timestamp":`, `"extra":1,"check":{"intervall":60,"metadata":{"name":"keepalive","namespace":"default"}},"timestamp":`, 1),
+			wantErr: []string{"check.intervall: unknown field"},
+		},
+		{
+			name:    "field case",
+			data:    `{"timestamp":1,"entity":{"metadata":{"name":"web01","namespace":"default"},"entity_class":"agent","Subscriptions":["linux"]},"check":{"metadata":{"name":"keepalive","namespace":"default"},"interval":60}}`,
+			wantErr: []string{`entity.Subscriptions: unknown field, did you mean "subscriptions"?`},
+		},
+		{
+			name:    "nested unknown field",
+			data:    `{"timestamp":1,"entity":{"metadata":{"name":"web01","namespace":"default","owner":"me"},"entity_class":"agent","system":{"network":{"interfaces":[{"name":"eth0","speed":1}]}}},"check":{"metadata":{"name":"keepalive","namespace":"default"},"interval":60}}`,
+			wantErr: []string{"entity.metadata.owner: unknown field", "entity.system.network.interfaces[0].speed: unknown field"},
+		},
+		{
+			name:    "missing fields",
+			data:    `{"metadata":{}}`,
+			wantErr: []string{"timestamp: must be set", "entity: must be set", "check: must be set"},
+		},
+		{
+			name:    "wrong type",
+			data:    `{"timestamp":"now","entity":{"metadata":{"name":"web01","namespace":"default"}}}`,
+			wantErr: []string{"timestamp: cannot be a JSON string, expected int64"},
+		},
+		{
+			name:    "not an object",
+			data:    `[]`,
+			wantErr: []string{"the event must be a JSON object"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateStrictEvent([]byte(tt.data))
+			if len(tt.wantErr) == 0 {
+				if err != nil {
+					t.Fatalf("validateStrictEvent() error = %v", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatal("validateStrictEvent() expected an error")
+			}
+			for _, want := range tt.wantErr {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("validateStrictEvent() error = %v, want it to contain %q", err, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	corev2 "github.com/sensu/core/v2"
+)
+
+// entitySubscribed returns whether the subscriptions of the event's entity
+// make it eligible for deregistration: it must have one of the required
+// subscriptions, if any, and none of the excluded ones
+func entitySubscribed(event *corev2.Event) bool {
+	subscriptions := event.Entity.Subscriptions
+	for _, excluded := range handler.excludeSubscriptions {
+		if contains(subscriptions, excluded) {
+			return false
+		}
+	}
+	if len(handler.requireSubscriptions) == 0 {
+		return true
+	}
+	for _, required := range handler.requireSubscriptions {
+		if contains(subscriptions, required) {
+			return true
+		}
+	}
+	return false
+}
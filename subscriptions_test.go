@@ -0,0 +1,59 @@
+package main
+
+import (
+	"testing"
+
+	corev2 "github.com/sensu/core/v2"
+)
+
+func Test_entitySubscribed(t *testing.T) {
+	saveHandler(t)
+	tests := []struct {
+		name                string
+		require             []string
+		exclude             []string
+		entitySubscriptions []string
+		want                bool
+	}{
+		{
+			name:                "no restriction",
+			entitySubscriptions: []string{"linux"},
+			want:                true,
+		},
+		{
+			name:                "required subscription",
+			require:             []string{"puppet-managed", "puppet-legacy"},
+			entitySubscriptions: []string{"linux", "puppet-managed"},
+			want:                true,
+		},
+		{
+			name:                "missing required subscription",
+			require:             []string{"puppet-managed"},
+			entitySubscriptions: []string{"linux"},
+			want:                false,
+		},
+		{
+			name:                "excluded subscription",
+			require:             []string{"puppet-managed"},
+			exclude:             []string{"database"},
+			entitySubscriptions: []string{"puppet-managed", "database"},
+			want:                false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler.requireSubscriptions = tt.require
+			handler.excludeSubscriptions = tt.exclude
+			defer func() {
+				handler.requireSubscriptions = nil
+				handler.excludeSubscriptions = nil
+			}()
+
+			event := corev2.FixtureEvent("foo", "keepalive")
+			event.Entity.Subscriptions = tt.entitySubscriptions
+			if got := entitySubscribed(event); got != tt.want {
+				t.Errorf("entitySubscribed() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	corev2 "github.com/sensu/core/v2"
+)
+
+// outcome returns what the execution did with the event's entity
+func (s runSummary) outcome() string {
+	switch {
+	case s.failed > 0:
+		return "error"
+	case s.deleted > 0:
+		return actionDelete
+	case s.tombstoned > 0:
+		return actionTombstone
+	case s.queued > 0:
+		return "queue"
+	case s.skipped > 0:
+		return "skip"
+	case s.kept > 0:
+		return actionKeep
+	}
+	return "ignore"
+}
+
+// line returns the summary of the execution logged once it is done, as a
+// single line of key=value pairs so that each execution leaves one record
+// that is easy to search for
+func (s runSummary) line(event *corev2.Event) string {
+	fields := []string{
+		"summary:",
+		"entity=" + quoteValue(fmt.Sprintf("%s/%s", event.Entity.Namespace, event.Entity.Name)),
+		"check=" + quoteValue(event.Check.Name),
+		"node=" + quoteValue(s.node),
+		"status=" + quoteValue(s.status),
+		"outcome=" + s.outcome(),
+		"duration=" + s.duration.Round(time.Millisecond).String(),
+		"lookup_duration=" + s.lookupDuration.Round(time.Millisecond).String(),
+		fmt.Sprintf("puppetdb_requests=%d", s.puppetDBRequests),
+		fmt.Sprintf("sensu_requests=%d", s.sensuRequests),
+	}
+	return strings.Join(fields, " ")
+}
+
+// quoteValue quotes the value of a summary field if it is empty or holds
+// spaces or quotes
+func quoteValue(value string) string {
+	if value == "" || strings.ContainsAny(value, " \t\"") {
+		return fmt.Sprintf("%q", value)
+	}
+	return value
+}
+
+// countMu guards the request counters, incremented by the workers of the bulk
+// subcommands concurrently
+var countMu sync.Mutex
+
+// countTransport counts the requests sent through it
+type countTransport struct {
+	base  http.RoundTripper
+	count *int
+}
+
+// countRequests wraps the transport to count its requests, retries and
+// redirects included, in the given counter
+func countRequests(base http.RoundTripper, count *int) http.RoundTripper {
+	return countTransport{base: base, count: count}
+}
+
+func (t countTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	countMu.Lock()
+	*t.count++
+	countMu.Unlock()
+	return t.base.RoundTrip(req)
+}
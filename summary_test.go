@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	corev2 "github.com/sensu/core/v2"
+)
+
+func Test_runSummary_line(t *testing.T) {
+	event := corev2.FixtureEvent("foo", "keepalive")
+	tests := []struct {
+		name    string
+		summary runSummary
+		want    string
+	}{
+		{
+			name: "deleted",
+			summary: runSummary{
+				checked: 1, deleted: 1, node: "foo.example.com", status: nodeNotFound,
+				lookupDuration: 12 * time.Millisecond, duration: 48 * time.Millisecond,
+				puppetDBRequests: 2, sensuRequests: 1,
+			},
+			want: "summary: entity=default/foo check=keepalive node=foo.example.com status=not-found outcome=delete duration=48ms lookup_duration=12ms puppetdb_requests=2 sensu_requests=1",
+		},
+		{
+			name:    "ignored",
+			summary: runSummary{},
+			want:    `summary: entity=default/foo check=keepalive node="" status="" outcome=ignore duration=0s lookup_duration=0s puppetdb_requests=0 sensu_requests=0`,
+		},
+		{
+			name:    "failed",
+			summary: runSummary{checked: 1, deleted: 1, failed: 1, node: "foo"},
+			want:    `summary: entity=default/foo check=keepalive node=foo status="" outcome=error duration=0s lookup_duration=0s puppetdb_requests=0 sensu_requests=0`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.summary.line(event); got != tt.want {
+				t.Errorf("line() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_countRequests(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	var count int
+	client := &http.Client{Transport: countRequests(http.DefaultTransport, &count)}
+	for i := 0; i < 3; i++ {
+		resp, err := client.Get(server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	if count != 3 {
+		t.Errorf("count = %d, want 3", count)
+	}
+}
@@ -0,0 +1,21 @@
+package main
+
+import (
+	"bytes"
+	"io"
+)
+
+// teeEvent writes the event JSON read on stdin to w unchanged, followed by a
+// newline if it does not end with one, so that the handler can sit in the
+// middle of a chain of piped handlers without swallowing the event
+func teeEvent(w io.Writer) error {
+	data, err := capturedEvent()
+	if err != nil {
+		return err
+	}
+	if !bytes.HasSuffix(data, []byte("\n")) {
+		data = append(data, '\n')
+	}
+	_, err = w.Write(data)
+	return err
+}
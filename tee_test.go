@@ -0,0 +1,27 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func Test_teeEvent(t *testing.T) {
+	savedEvent, savedErr, savedDone := rawEvent, rawEventErr, rawEventDone
+	defer func() { rawEvent, rawEventErr, rawEventDone = savedEvent, savedErr, savedDone }()
+
+	rawEventDone = nil
+	if err := teeEvent(new(bytes.Buffer)); err == nil {
+		t.Error("teeEvent() expected an error when the event was not captured")
+	}
+
+	done := make(chan struct{})
+	close(done)
+	rawEvent, rawEventErr, rawEventDone = []byte(`{"entity":{"metadata":{"name":"web01"}}}`), nil, done
+	var buf bytes.Buffer
+	if err := teeEvent(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if want := "{\"entity\":{\"metadata\":{\"name\":\"web01\"}}}\n"; buf.String() != want {
+		t.Errorf("teeEvent() wrote %q, want %q", buf.String(), want)
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"bytes"
+	"text/template"
+
+	corev2 "github.com/sensu/core/v2"
+)
+
+// templateData is the data made available to the log and message templates
+type templateData struct {
+	Event        *corev2.Event
+	Node         map[string]interface{}
+	NodeName     string
+	PuppetStatus string
+	Action       string
+}
+
+func newTemplateData(event *corev2.Event, lookup nodeLookup, action string) templateData {
+	return templateData{
+		Event:        event,
+		Node:         lookup.record,
+		NodeName:     lookup.name,
+		PuppetStatus: lookup.status,
+		Action:       action,
+	}
+}
+
+// renderTemplate executes the Go template text with the given data
+func renderTemplate(text string, data templateData) (string, error) {
+	tmpl, err := template.New("template").Option("missingkey=zero").Parse(text)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
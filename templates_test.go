@@ -0,0 +1,52 @@
+package main
+
+import (
+	"testing"
+
+	corev2 "github.com/sensu/core/v2"
+)
+
+func Test_renderTemplate(t *testing.T) {
+	event := corev2.FixtureEvent("foo", "keepalive")
+	lookup := nodeLookup{
+		name:   "foo.example.com",
+		status: nodeNotFound,
+		record: map[string]interface{}{"deactivated": "2023-02-09T12:00:00.000Z"},
+	}
+	data := newTemplateData(event, lookup, actionDelete)
+
+	tests := []struct {
+		name    string
+		text    string
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "event and lookup fields",
+			text: "{{.Action}} {{.Event.Entity.Namespace}}/{{.Event.Entity.Name}}: {{.NodeName}} is {{.PuppetStatus}}",
+			want: "delete default/foo: foo.example.com is not-found",
+		},
+		{
+			name: "node record fields",
+			text: `{{index .Node "deactivated"}}`,
+			want: "2023-02-09T12:00:00.000Z",
+		},
+		{
+			name:    "invalid template",
+			text:    "{{.Action",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := renderTemplate(tt.text, data)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("renderTemplate() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if got != tt.want {
+				t.Errorf("renderTemplate() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
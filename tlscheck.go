@@ -0,0 +1,25 @@
+package main
+
+import (
+	"errors"
+	"log"
+)
+
+// checkTLSSettings detects contradictory TLS settings. Providing a CA
+// certificate while skipping TLS verification silently ignores the CA, which
+// is rejected in strict TLS mode.
+func checkTLSSettings() error {
+	if !handler.puppetInsecureSkipVerify {
+		return nil
+	}
+	caConfigured := handler.puppetCACert != "" || handler.puppetCAURL != "" || handler.sensuCACert != ""
+	if handler.strictTLS && caConfigured {
+		return errors.New("a CA certificate cannot be used with --insecure-skip-tls-verify in strict TLS mode")
+	}
+
+	log.Printf("WARNING: TLS verification of PuppetDB and the Sensu API is disabled, the connections are vulnerable to man-in-the-middle attacks")
+	if caConfigured {
+		log.Printf("WARNING: the configured CA certificate is ignored since --insecure-skip-tls-verify is set")
+	}
+	return nil
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+// sensuTokens is an access/refresh token pair for the Sensu API, as returned
+// by the /auth/token endpoint and stored in token files
+type sensuTokens struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresAt    int64  `json:"expires_at,omitempty"`
+}
+
+// tokenTransport authenticates requests to the Sensu API with a bearer access
+// token, and refreshes the token pair once when a request is rejected with a
+// 401 status
+type tokenTransport struct {
+	base http.RoundTripper
+	// apiURL is the Sensu API URL the tokens are refreshed against
+	apiURL string
+
+	mu     sync.Mutex
+	tokens sensuTokens
+}
+
+// newTokenTransport returns a token transport for the Sensu API URL using the
+// tokens from the flags, or from the token file if set
+func newTokenTransport(base http.RoundTripper, apiURL string) (*tokenTransport, error) {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	t := &tokenTransport{
+		base:   base,
+		apiURL: apiURL,
+		tokens: sensuTokens{
+			AccessToken:  handler.sensuAccessToken,
+			RefreshToken: handler.sensuRefreshToken,
+		},
+	}
+	if handler.sensuTokenFile != "" {
+		b, err := os.ReadFile(handler.sensuTokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read the Sensu token file: %s", err)
+		}
+		if err := json.Unmarshal(b, &t.tokens); err != nil {
+			return nil, fmt.Errorf("invalid Sensu token file: %s", err)
+		}
+	}
+	if t.tokens.AccessToken == "" {
+		return nil, errors.New("no Sensu access token")
+	}
+	return t, nil
+}
+
+func (t *tokenTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.mu.Lock()
+	accessToken, refreshToken := t.tokens.AccessToken, t.tokens.RefreshToken
+	t.mu.Unlock()
+
+	// Keep the token from the hosts the requests are redirected to
+	if !sendCredentials(req, urlHost(t.apiURL)) {
+		return t.base.RoundTrip(req)
+	}
+	resp, err := t.base.RoundTrip(authorize(req, accessToken))
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+	if refreshToken == "" || (req.Body != nil && req.GetBody == nil) {
+		return resp, nil
+	}
+
+	// The access token expired, refresh it and retry the request once
+	resp.Body.Close()
+	if err := t.refresh(req, accessToken); err != nil {
+		return nil, err
+	}
+	retry := req.Clone(req.Context())
+	if req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		retry.Body = body
+	}
+	t.mu.Lock()
+	accessToken = t.tokens.AccessToken
+	t.mu.Unlock()
+	return t.base.RoundTrip(authorize(retry, accessToken))
+}
+
+// refresh exchanges the refresh token for a new token pair and saves it to the
+// token file, if any
+func (t *tokenTransport) refresh(orig *http.Request, accessToken string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.tokens.AccessToken != accessToken {
+		// Already refreshed by a concurrent request
+		return nil
+	}
+
+	body, err := json.Marshal(map[string]string{"refresh_token": t.tokens.RefreshToken})
+	if err != nil {
+		return err
+	}
+	endpoint := strings.TrimRight(t.apiURL, "/") + "/auth/token"
+	req, err := http.NewRequestWithContext(orig.Context(), http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		return fmt.Errorf("could not refresh the Sensu access token: %s", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		_, _ = io.Copy(io.Discard, resp.Body)
+		return fmt.Errorf("unexpected HTTP status %s while refreshing the Sensu access token", http.StatusText(resp.StatusCode))
+	}
+	var tokens sensuTokens
+	if err := json.NewDecoder(resp.Body).Decode(&tokens); err != nil {
+		return fmt.Errorf("invalid Sensu token refresh response: %s", err)
+	}
+	t.tokens = tokens
+	log.Print("refreshed the Sensu access token")
+
+	if handler.sensuTokenFile != "" {
+		b, err := json.Marshal(tokens)
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(handler.sensuTokenFile, b, 0600); err != nil {
+			log.Printf("could not save the refreshed Sensu tokens: %s", err)
+		}
+	}
+	return nil
+}
+
+// authorize returns a copy of the request authenticated with the access token
+func authorize(req *http.Request, accessToken string) *http.Request {
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	return req
+}
+
+// sensuTokenAuth returns whether the Sensu API is authenticated with tokens
+// rather than an API key
+func sensuTokenAuth() bool {
+	return handler.sensuAccessToken != "" || handler.sensuTokenFile != ""
+}
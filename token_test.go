@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	corev2 "github.com/sensu/core/v2"
+)
+
+func Test_tokenTransport(t *testing.T) {
+	var deletes int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/auth/token" {
+			var body map[string]string
+			_ = json.NewDecoder(r.Body).Decode(&body)
+			if body["refresh_token"] != "refresh-1" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			_ = json.NewEncoder(w).Encode(sensuTokens{AccessToken: "access-2", RefreshToken: "refresh-2"})
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer access-2" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		deletes++
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer ts.Close()
+
+	tokenFile := filepath.Join(t.TempDir(), "tokens.json")
+	if err := os.WriteFile(tokenFile, []byte(`{"access_token":"access-1","refresh_token":"refresh-1"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	setHandler(t, Handler{sensuAPIURL: ts.URL, sensuTokenFile: tokenFile})
+
+	event := corev2.FixtureEvent("foo", "keepalive")
+	if err := deregisterEntity(event); err != nil {
+		t.Fatalf("deregisterEntity() error = %v", err)
+	}
+	if deletes != 1 {
+		t.Errorf("deregisterEntity() deletes = %d, want 1", deletes)
+	}
+
+	b, err := os.ReadFile(tokenFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tokens sensuTokens
+	if err := json.Unmarshal(b, &tokens); err != nil {
+		t.Fatal(err)
+	}
+	if tokens.AccessToken != "access-2" || tokens.RefreshToken != "refresh-2" {
+		t.Errorf("token file = %+v, want refreshed tokens", tokens)
+	}
+}
+
+func Test_tokenTransport_redirect(t *testing.T) {
+	var gotAuth string
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotAuth = r.Header.Get("Authorization")
+	}))
+	defer target.Close()
+	targetURL := strings.Replace(target.URL, "127.0.0.1", "localhost", 1)
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer access-1" {
+			t.Errorf("API received Authorization %q", r.Header.Get("Authorization"))
+		}
+		http.Redirect(w, r, targetURL, http.StatusFound)
+	}))
+	defer api.Close()
+
+	tests := []struct {
+		name        string
+		forwardAuth bool
+		wantAuth    string
+	}{
+		{name: "token kept from other hosts"},
+		{name: "token forwarded", forwardAuth: true, wantAuth: "Bearer access-1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setHandler(t, Handler{sensuAccessToken: "access-1", maxRedirects: 1, redirectForwardAuth: tt.forwardAuth})
+			gotAuth = ""
+
+			transport, err := newTokenTransport(nil, api.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			client := &http.Client{Transport: transport, CheckRedirect: checkRedirect}
+			resp, err := client.Get(api.URL + "/api/core/v2/namespaces/default/entities")
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if gotAuth != tt.wantAuth {
+				t.Errorf("redirect target received Authorization %q, want %q", gotAuth, tt.wantAuth)
+			}
+		})
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptrace"
+	"strings"
+	"sync"
+	"time"
+)
+
+// traceTransport logs the timings of the connection phases of the requests
+// sent through it
+type traceTransport struct {
+	base http.RoundTripper
+}
+
+// withConnectionTrace wraps the transport to log the connection timings of
+// each request when --trace-connections is set. It wraps the transport
+// connecting to the server, below the transports sending requests of their
+// own such as the OAuth2 one, whose requests are traced separately. The
+// exchanges are recorded in the HAR file at the same level, with the headers
+// set by the transports above.
+func withConnectionTrace(base http.RoundTripper) http.RoundTripper {
+	base = withHARCapture(base)
+	if !handler.traceConnections {
+		return base
+	}
+	return traceTransport{base: base}
+}
+
+// connectionTimings are the timings of the connection phases of a request,
+// the phases which did not happen being zero
+type connectionTimings struct {
+	mu        sync.Mutex
+	start     time.Time
+	dnsStart  time.Time
+	dns       time.Duration
+	connStart time.Time
+	connect   time.Duration
+	tlsStart  time.Time
+	tls       time.Duration
+	firstByte time.Duration
+	reused    bool
+}
+
+func (t traceTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	timings := &connectionTimings{start: time.Now()}
+	trace := &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) {
+			timings.mu.Lock()
+			defer timings.mu.Unlock()
+			timings.dnsStart = time.Now()
+		},
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			timings.mu.Lock()
+			defer timings.mu.Unlock()
+			timings.dns = time.Since(timings.dnsStart)
+		},
+		// Several connections can be attempted concurrently, the first
+		// one started and the last one done are kept
+		ConnectStart: func(string, string) {
+			timings.mu.Lock()
+			defer timings.mu.Unlock()
+			if timings.connStart.IsZero() {
+				timings.connStart = time.Now()
+			}
+		},
+		ConnectDone: func(string, string, error) {
+			timings.mu.Lock()
+			defer timings.mu.Unlock()
+			timings.connect = time.Since(timings.connStart)
+		},
+		TLSHandshakeStart: func() {
+			timings.mu.Lock()
+			defer timings.mu.Unlock()
+			timings.tlsStart = time.Now()
+		},
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			timings.mu.Lock()
+			defer timings.mu.Unlock()
+			timings.tls = time.Since(timings.tlsStart)
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			timings.mu.Lock()
+			defer timings.mu.Unlock()
+			timings.reused = info.Reused
+		},
+		GotFirstResponseByte: func() {
+			timings.mu.Lock()
+			defer timings.mu.Unlock()
+			timings.firstByte = time.Since(timings.start)
+		},
+	}
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+
+	resp, err := t.base.RoundTrip(req)
+	u := *req.URL
+	u.RawQuery, u.Fragment = "", ""
+	if err != nil {
+		log.Printf("trace %s %s: %s, failed after %s: %s", req.Method, u.Redacted(), timings, time.Since(timings.start).Round(time.Millisecond), err)
+	} else {
+		log.Printf("trace %s %s: %s", req.Method, u.Redacted(), timings)
+	}
+	return resp, err
+}
+
+func (t *connectionTimings) String() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var phases []string
+	if t.reused {
+		phases = append(phases, "reused connection")
+	}
+	for _, phase := range []struct {
+		name     string
+		duration time.Duration
+	}{
+		{"dns", t.dns},
+		{"connect", t.connect},
+		{"tls", t.tls},
+		{"first byte", t.firstByte},
+	} {
+		if phase.duration > 0 {
+			phases = append(phases, fmt.Sprintf("%s %s", phase.name, phase.duration.Round(time.Microsecond)))
+		}
+	}
+	if len(phases) == 0 {
+		return "no connection timings"
+	}
+	return strings.Join(phases, ", ")
+}
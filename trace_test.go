@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func Test_withConnectionTrace(t *testing.T) {
+	savedOutput := log.Writer()
+	defer log.SetOutput(savedOutput)
+	var out bytes.Buffer
+	log.SetOutput(&out)
+
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer ts.Close()
+
+	setHandler(t, Handler{})
+	if _, ok := withConnectionTrace(nil).(traceTransport); ok {
+		t.Fatal("withConnectionTrace() traces without --trace-connections")
+	}
+
+	handler.traceConnections = true
+	client := &http.Client{Transport: withConnectionTrace(ts.Client().Transport)}
+	for i := 0; i < 2; i++ {
+		resp, err := client.Get(ts.URL + "/pdb/query/v4/nodes?query=secret")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("withConnectionTrace() logged %q, want 2 lines", out.String())
+	}
+	for _, want := range []string{"trace GET " + ts.URL + "/pdb/query/v4/nodes: ", "connect ", "tls ", "first byte "} {
+		if !strings.Contains(lines[0], want) {
+			t.Errorf("withConnectionTrace() first line = %q, want it to contain %q", lines[0], want)
+		}
+	}
+	if !strings.Contains(lines[1], "reused connection") || strings.Contains(lines[1], "tls ") {
+		t.Errorf("withConnectionTrace() second line = %q, want a reused connection", lines[1])
+	}
+	if strings.Contains(out.String(), "secret") {
+		t.Errorf("withConnectionTrace() logged the query string: %q", out.String())
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"runtime"
+	"runtime/debug"
+)
+
+// Build metadata, injected at build time with
+// -ldflags "-X main.version=... -X main.commit=... -X main.date=..."
+var (
+	version = "dev"
+	commit  = ""
+	date    = ""
+)
+
+// printVersion prints the build metadata of the handler. Without injected
+// metadata, the commit and date recorded by the Go toolchain are used.
+func printVersion(w io.Writer) {
+	revision, buildTime := commit, date
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range info.Settings {
+			switch {
+			case setting.Key == "vcs.revision" && revision == "":
+				revision = setting.Value
+			case setting.Key == "vcs.time" && buildTime == "":
+				buildTime = setting.Value
+			}
+		}
+	}
+	if revision == "" {
+		revision = "unknown"
+	}
+	if buildTime == "" {
+		buildTime = "unknown"
+	}
+
+	fmt.Fprintf(w, "%s version %s\n", handler.Name, version)
+	fmt.Fprintf(w, "commit:     %s\n", revision)
+	fmt.Fprintf(w, "built:      %s\n", buildTime)
+	fmt.Fprintf(w, "go version: %s %s/%s\n", runtime.Version(), runtime.GOOS, runtime.GOARCH)
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"bytes"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func Test_printVersion(t *testing.T) {
+	saved := commit
+	commit = "abc1234"
+	defer func() { commit = saved }()
+
+	var buf bytes.Buffer
+	printVersion(&buf)
+	for _, want := range []string{"version " + version, "commit:     abc1234", runtime.Version()} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("printVersion() = %q, missing %q", buf.String(), want)
+		}
+	}
+}
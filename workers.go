@@ -0,0 +1,66 @@
+package main
+
+import "sync"
+
+// workerPool runs the jobs of the bulk subcommands on --concurrency
+// goroutines, sharing the HTTP clients of the execution
+type workerPool struct {
+	jobs chan func() error
+	wg   sync.WaitGroup
+
+	mu  sync.Mutex
+	err error
+}
+
+// newWorkerPool starts a pool of n workers, at least one
+func newWorkerPool(n int) *workerPool {
+	if n < 1 {
+		n = 1
+	}
+	p := &workerPool{jobs: make(chan func() error)}
+	p.wg.Add(n)
+	for i := 0; i < n; i++ {
+		go func() {
+			defer p.wg.Done()
+			for job := range p.jobs {
+				// Once a job failed the remaining ones are drained without
+				// running, the run is reported as failed anyway
+				if p.failed() != nil {
+					continue
+				}
+				if err := job(); err != nil {
+					p.mu.Lock()
+					if p.err == nil {
+						p.err = err
+					}
+					p.mu.Unlock()
+				}
+			}
+		}()
+	}
+	return p
+}
+
+// submit hands the job to the next idle worker, or returns the error of a
+// failed job so that the caller stops producing
+func (p *workerPool) submit(job func() error) error {
+	if err := p.failed(); err != nil {
+		return err
+	}
+	p.jobs <- job
+	return nil
+}
+
+// wait waits for the submitted jobs to complete and returns the error of the
+// first failed one. The pool cannot be used afterwards.
+func (p *workerPool) wait() error {
+	close(p.jobs)
+	p.wg.Wait()
+	return p.failed()
+}
+
+func (p *workerPool) failed() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.err
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func Test_workerPool(t *testing.T) {
+	pool := newWorkerPool(3)
+	var running, peak, done int32
+	var mu sync.Mutex
+	for i := 0; i < 12; i++ {
+		err := pool.submit(func() error {
+			n := atomic.AddInt32(&running, 1)
+			mu.Lock()
+			if n > peak {
+				peak = n
+			}
+			mu.Unlock()
+			time.Sleep(5 * time.Millisecond)
+			atomic.AddInt32(&running, -1)
+			atomic.AddInt32(&done, 1)
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("submit() error = %v", err)
+		}
+	}
+	if err := pool.wait(); err != nil {
+		t.Fatalf("wait() error = %v", err)
+	}
+	if done != 12 {
+		t.Errorf("workerPool ran %d jobs, want 12", done)
+	}
+	if peak > 3 {
+		t.Errorf("workerPool ran %d jobs at once, want at most 3", peak)
+	}
+}
+
+func Test_workerPool_error(t *testing.T) {
+	pool := newWorkerPool(0)
+	failure := errors.New("lookup failed")
+	if err := pool.submit(func() error { return failure }); err != nil {
+		t.Fatalf("submit() error = %v", err)
+	}
+	// The job is handed to the only worker, which then fails the pool
+	deadline := time.Now().Add(time.Second)
+	for pool.failed() == nil && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	ran := false
+	if err := pool.submit(func() error { ran = true; return nil }); err != failure {
+		t.Errorf("submit() error = %v, want %v", err, failure)
+	}
+	if err := pool.wait(); err != failure {
+		t.Errorf("wait() error = %v, want %v", err, failure)
+	}
+	if ran {
+		t.Error("workerPool ran a job submitted after a failure")
+	}
+}